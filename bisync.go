@@ -0,0 +1,781 @@
+package filesystem
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// syncStateVersion is the version of the SyncState format.
+const syncStateVersion = 1
+
+// SyncState is what Bisync knew about both sides after the last run: the
+// paths both sides agreed on, with their metadata and content hash.
+type SyncState struct {
+	Version int                        `json:"version"`
+	Entries map[string]*SyncStateEntry `json:"entries"`
+}
+
+// SyncStateEntry is the last known state of a path.
+type SyncStateEntry struct {
+	IsDir bool  `json:"isDir,omitempty"`
+	Size  int64 `json:"size,omitempty"`
+
+	// Hash is the hex SHA-256 of the content of a file.
+	Hash string `json:"hash,omitempty"`
+
+	// ModTime of the path on side a and side b, a file whose size and
+	// modification time did not change is not hashed again.
+	ModTime [2]time.Time `json:"modTime"`
+}
+
+// NewSyncState returns the state of two sides that never synced.
+func NewSyncState() *SyncState {
+	return &SyncState{Version: syncStateVersion, Entries: map[string]*SyncStateEntry{}}
+}
+
+// LoadSyncState reads the state saved at name, a missing file is the state
+// of two sides that never synced.
+func LoadSyncState(vfs FileSystem, name string) (*SyncState, error) {
+	data, err := ReadFile(vfs, name)
+	if errors.Is(err, fs.ErrNotExist) {
+		return NewSyncState(), nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	state := &SyncState{}
+	if err := json.Unmarshal(data, state); err != nil {
+		return nil, fmt.Errorf("sync state %s: %w", name, err)
+	}
+	if state.Version != syncStateVersion {
+		return nil, fmt.Errorf("sync state %s: unsupported version %d", name, state.Version)
+	}
+	if state.Entries == nil {
+		state.Entries = map[string]*SyncStateEntry{}
+	}
+	return state, nil
+}
+
+// Save writes the state to name through a temporary file renamed over name.
+func (s *SyncState) Save(vfs FileSystem, name string) error {
+	data, err := json.Marshal(s)
+	if err != nil {
+		return err
+	}
+
+	tmp := name + ".tmp"
+	if err := WriteFile(vfs, tmp, data); err != nil {
+		return err
+	}
+	return vfs.Rename(tmp, name)
+}
+
+// Resolution is the outcome of a conflict.
+type Resolution int
+
+const (
+	// ResolveKeepBoth keeps both versions, the version of b moves to
+	// ConflictName on both sides. A deletion keeps the surviving version.
+	ResolveKeepBoth Resolution = iota
+	// ResolveKeepA makes b match a.
+	ResolveKeepA
+	// ResolveKeepB makes a match b.
+	ResolveKeepB
+	// ResolveSkip leaves both sides alone, the conflict comes back on the next run.
+	ResolveSkip
+)
+
+func (r Resolution) String() string {
+	switch r {
+	case ResolveKeepBoth:
+		return "keep both"
+	case ResolveKeepA:
+		return "keep a"
+	case ResolveKeepB:
+		return "keep b"
+	case ResolveSkip:
+		return "skip"
+	}
+	return fmt.Sprintf("Resolution(%d)", int(r))
+}
+
+// ConflictVersion is the version of a conflicting path on one side.
+type ConflictVersion struct {
+	IsDir   bool
+	Size    int64
+	ModTime time.Time
+}
+
+// Conflict is a path both sides changed since the last run.
+// A version is nil when its side deleted the path.
+type Conflict struct {
+	Path       string
+	A, B       *ConflictVersion
+	Resolution Resolution
+}
+
+// ConflictResolver decides the outcome of a conflict.
+type ConflictResolver func(c *Conflict) (Resolution, error)
+
+// KeepBoth resolves every conflict with ResolveKeepBoth.
+func KeepBoth(c *Conflict) (Resolution, error) {
+	return ResolveKeepBoth, nil
+}
+
+// NewestWins keeps the most recently modified version, a on a tie. A version
+// always wins over a deletion.
+func NewestWins(c *Conflict) (Resolution, error) {
+	switch {
+	case c.B == nil:
+		return ResolveKeepA, nil
+	case c.A == nil:
+		return ResolveKeepB, nil
+	case c.B.ModTime.After(c.A.ModTime):
+		return ResolveKeepB, nil
+	}
+	return ResolveKeepA, nil
+}
+
+// ConflictName returns the path the version of side takes when both
+// versions of name are kept, "dir/report.conflict-b.txt" for "dir/report.txt".
+func ConflictName(name, side string) string {
+	ext := path.Ext(name)
+	if strings.HasPrefix(path.Base(name), ".") && path.Base(name) == ext {
+		ext = ""
+	}
+	return strings.TrimSuffix(name, ext) + ".conflict-" + side + ext
+}
+
+// BisyncOptions configures Bisync.
+type BisyncOptions struct {
+	// Resolver decides conflicts, KeepBoth when nil.
+	Resolver ConflictResolver
+
+	// Exclude are patterns as in SyncOptions, excluded paths are neither
+	// synced nor deleted. A state file kept inside a side belongs here.
+	Exclude []string
+}
+
+// BisyncItem is an action taken on one side.
+type BisyncItem struct {
+	Action SyncAction
+
+	// Side is the side the action changed, "a" or "b".
+	Side string
+
+	Path string
+
+	// Target is the new path of a rename.
+	Target string
+}
+
+// BisyncReport describes the actions and conflicts of a Bisync.
+type BisyncReport struct {
+	Items     []BisyncItem
+	Conflicts []*Conflict
+}
+
+// Bisync synchronizes a and b in both directions. Changes are detected
+// against state, the changes of one side are applied to the other and paths
+// changed on both sides are passed to the resolver. A path renamed on one
+// side is renamed on the other when the content of its file is unique.
+// Only files are paired: a renamed directory is deleted and made again on the
+// other side, its files renamed into it one by one when their content is
+// unique and copied otherwise.
+// A path that is a file on one side and a directory on the other keeps both,
+// whatever the resolver says. On success, state describes both sides and is
+// ready to be saved for the next run.
+func Bisync(a, b FileSystem, state *SyncState, opts *BisyncOptions) (*BisyncReport, error) {
+	if opts == nil {
+		opts = &BisyncOptions{}
+	}
+	if state.Entries == nil {
+		state.Entries = map[string]*SyncStateEntry{}
+	}
+
+	for _, pattern := range opts.Exclude {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("sync pattern %q: %w", pattern, err)
+		}
+	}
+
+	s := &bisyncer{
+		sides:  [2]*bisyncSide{{vfs: a, index: 0, name: "a"}, {vfs: b, index: 1, name: "b"}},
+		state:  state,
+		opts:   opts,
+		report: &BisyncReport{},
+	}
+
+	if err := s.run(); err != nil {
+		return s.report, err
+	}
+	return s.report, nil
+}
+
+type bisyncer struct {
+	sides [2]*bisyncSide
+
+	state *SyncState
+
+	opts *BisyncOptions
+
+	report *BisyncReport
+
+	// handled holds the paths a rename already synced.
+	handled map[string]bool
+
+	// removed holds the directories a side deleted, removed from the other
+	// side once their contents are synced.
+	removed []bisyncRemoval
+}
+
+type bisyncRemoval struct {
+	name     string
+	from, to *bisyncSide
+}
+
+type bisyncSide struct {
+	vfs FileSystem
+
+	index int
+
+	name string
+
+	entries map[string]*bisyncEntry
+}
+
+type bisyncEntry struct {
+	isDir   bool
+	size    int64
+	modTime time.Time
+	hash    string
+}
+
+type bisyncChange int
+
+const (
+	changeNone bisyncChange = iota
+	changeCreate
+	changeModify
+	changeDelete
+)
+
+func (s *bisyncer) run() error {
+	for _, side := range s.sides {
+		if err := s.scan(side); err != nil {
+			return err
+		}
+	}
+
+	s.handled = map[string]bool{}
+	for _, side := range s.sides {
+		if err := s.renames(side, s.other(side)); err != nil {
+			return err
+		}
+	}
+
+	for _, name := range s.paths() {
+		if s.handled[name] {
+			continue
+		}
+		if err := s.sync(name); err != nil {
+			return err
+		}
+	}
+
+	sort.Slice(s.removed, func(i, j int) bool { return s.removed[i].name > s.removed[j].name })
+	for _, r := range s.removed {
+		if err := r.to.vfs.Remove("/" + r.name); err != nil {
+			// the directory still holds entries the other side kept
+			if err := r.from.vfs.MkdirAll("/"+r.name, 0755); err != nil {
+				return err
+			}
+			continue
+		}
+		s.record(SyncDelete, r.to, r.name, "")
+	}
+
+	return s.update()
+}
+
+func (s *bisyncer) other(side *bisyncSide) *bisyncSide {
+	return s.sides[1-side.index]
+}
+
+// scan reads the tree of the side, the hashes of files whose size and
+// modification time did not change are taken from the previous scan or
+// from the state.
+func (s *bisyncer) scan(side *bisyncSide) error {
+	prev := side.entries
+	side.entries = map[string]*bisyncEntry{}
+
+	return WalkDir(side.vfs, "/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel := strings.TrimPrefix(name, "/")
+		if rel == "" {
+			return nil
+		}
+		if matchAny(s.opts.Exclude, rel) {
+			if d.IsDir() {
+				return fs.SkipDir
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+
+		e := &bisyncEntry{isDir: d.IsDir(), size: info.Size(), modTime: info.ModTime()}
+		if e.isDir {
+			e.size = 0
+		} else if p := prev[rel]; p != nil && !p.isDir && p.size == e.size && p.modTime.Equal(e.modTime) {
+			e.hash = p.hash
+		} else if known := s.state.Entries[rel]; known != nil && !known.IsDir &&
+			known.Size == e.size && known.ModTime[side.index].Equal(e.modTime) {
+			e.hash = known.Hash
+		}
+		side.entries[rel] = e
+		return nil
+	})
+}
+
+// hash returns the content hash of the file of the side.
+func (s *bisyncer) hash(side *bisyncSide, name string) (string, error) {
+	e := side.entries[name]
+	if e.hash != "" {
+		return e.hash, nil
+	}
+
+	f, err := OpenFile(side.vfs, "/"+name)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	e.hash = hex.EncodeToString(h.Sum(nil))
+	return e.hash, nil
+}
+
+// change tells how the path changed on the side since the last run.
+func (s *bisyncer) change(side *bisyncSide, name string) (bisyncChange, error) {
+	known, e := s.state.Entries[name], side.entries[name]
+
+	switch {
+	case known == nil && e == nil:
+		return changeNone, nil
+	case known == nil:
+		return changeCreate, nil
+	case e == nil:
+		return changeDelete, nil
+	case known.IsDir != e.isDir:
+		return changeModify, nil
+	case e.isDir:
+		return changeNone, nil
+	case known.Size != e.size:
+		return changeModify, nil
+	}
+
+	hash, err := s.hash(side, name)
+	if err != nil {
+		return changeNone, err
+	}
+	if hash != known.Hash {
+		return changeModify, nil
+	}
+	return changeNone, nil
+}
+
+// renames pairs the files side deleted with the files it created with the
+// same content, and renames them on the other side when it left them alone.
+func (s *bisyncer) renames(side, other *bisyncSide) error {
+	deleted := map[string][]string{}
+	for name, known := range s.state.Entries {
+		if !known.IsDir && side.entries[name] == nil && !s.handled[name] {
+			deleted[known.Hash] = append(deleted[known.Hash], name)
+		}
+	}
+	if len(deleted) == 0 {
+		return nil
+	}
+
+	created := map[string][]string{}
+	for name, e := range side.entries {
+		if e.isDir || s.state.Entries[name] != nil || s.handled[name] {
+			continue
+		}
+		hash, err := s.hash(side, name)
+		if err != nil {
+			return err
+		}
+		created[hash] = append(created[hash], name)
+	}
+
+	for hash, from := range deleted {
+		to := created[hash]
+		if len(from) != 1 || len(to) != 1 {
+			continue
+		}
+
+		oldpath, newpath := from[0], to[0]
+		if change, err := s.change(other, oldpath); err != nil || change != changeNone {
+			continue
+		}
+		if other.entries[newpath] != nil {
+			continue
+		}
+
+		if err := other.vfs.MkdirAll("/"+path.Dir(newpath), 0755); err != nil {
+			return err
+		}
+		if err := other.vfs.Rename("/"+oldpath, "/"+newpath); err != nil {
+			return err
+		}
+		s.record(SyncRename, other, oldpath, newpath)
+
+		other.entries[newpath] = other.entries[oldpath]
+		delete(other.entries, oldpath)
+		s.handled[oldpath], s.handled[newpath] = true, true
+	}
+	return nil
+}
+
+// paths returns every path of either side or of the state, parents first.
+func (s *bisyncer) paths() []string {
+	set := map[string]bool{}
+	for name := range s.state.Entries {
+		set[name] = true
+	}
+	for _, side := range s.sides {
+		for name := range side.entries {
+			set[name] = true
+		}
+	}
+
+	list := make([]string, 0, len(set))
+	for name := range set {
+		list = append(list, name)
+	}
+	sort.Strings(list)
+	return list
+}
+
+func (s *bisyncer) sync(name string) error {
+	a, b := s.sides[0], s.sides[1]
+
+	ca, err := s.change(a, name)
+	if err != nil {
+		return err
+	}
+	cb, err := s.change(b, name)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case ca == changeNone && cb == changeNone:
+		return nil
+	case cb == changeNone:
+		return s.replace(a, b, name)
+	case ca == changeNone:
+		return s.replace(b, a, name)
+	}
+
+	ea, eb := a.entries[name], b.entries[name]
+	switch {
+	case ea == nil && eb == nil:
+		return nil
+	case ea != nil && eb != nil && ea.isDir && eb.isDir:
+		return nil
+	case ea != nil && eb != nil && !ea.isDir && !eb.isDir:
+		ha, err := s.hash(a, name)
+		if err != nil {
+			return err
+		}
+		hb, err := s.hash(b, name)
+		if err != nil {
+			return err
+		}
+		if ha == hb {
+			return nil
+		}
+	}
+
+	return s.conflict(name)
+}
+
+// replace propagates the change of from, unless from replaced a directory
+// with a file while to changed the contents of that directory.
+func (s *bisyncer) replace(from, to *bisyncSide, name string) error {
+	src, dst := from.entries[name], to.entries[name]
+	if src == nil || src.isDir || dst == nil || !dst.isDir {
+		return s.propagate(from, to, name)
+	}
+
+	changed, err := s.changedBelow(to, name)
+	if err != nil {
+		return err
+	}
+	if changed {
+		return s.conflict(name)
+	}
+	return s.propagate(from, to, name)
+}
+
+// changedBelow tells whether the side changed anything below the directory.
+func (s *bisyncer) changedBelow(side *bisyncSide, dir string) (bool, error) {
+	prefix := dir + "/"
+	for name := range side.entries {
+		if strings.HasPrefix(name, prefix) && s.state.Entries[name] == nil {
+			return true, nil
+		}
+	}
+	for name := range s.state.Entries {
+		if !strings.HasPrefix(name, prefix) {
+			continue
+		}
+		change, err := s.change(side, name)
+		if err != nil || change != changeNone {
+			return true, err
+		}
+	}
+	return false, nil
+}
+
+func (s *bisyncer) conflict(name string) error {
+	a, b := s.sides[0], s.sides[1]
+	ea, eb := a.entries[name], b.entries[name]
+
+	c := &Conflict{Path: name, A: ea.version(), B: eb.version()}
+	s.report.Conflicts = append(s.report.Conflicts, c)
+
+	if ea != nil && eb != nil && ea.isDir != eb.isDir {
+		// a file and a directory: the file moves aside
+		c.Resolution = ResolveKeepBoth
+		file, dir := a, b
+		if !eb.isDir {
+			file, dir = b, a
+		}
+		if err := s.moveAside(file, name); err != nil {
+			return err
+		}
+		return s.propagate(dir, file, name)
+	}
+
+	resolver := s.opts.Resolver
+	if resolver == nil {
+		resolver = KeepBoth
+	}
+
+	resolution, err := resolver(c)
+	if err != nil {
+		return err
+	}
+	c.Resolution = resolution
+
+	switch resolution {
+	case ResolveKeepA:
+		return s.propagate(a, b, name)
+	case ResolveKeepB:
+		return s.propagate(b, a, name)
+	case ResolveSkip:
+		return nil
+	case ResolveKeepBoth:
+		switch {
+		case eb == nil:
+			return s.propagate(a, b, name)
+		case ea == nil:
+			return s.propagate(b, a, name)
+		}
+		if err := s.moveAside(b, name); err != nil {
+			return err
+		}
+		return s.propagate(a, b, name)
+	}
+	return fmt.Errorf("sync %s: unknown resolution %d", name, resolution)
+}
+
+func (e *bisyncEntry) version() *ConflictVersion {
+	if e == nil {
+		return nil
+	}
+	return &ConflictVersion{IsDir: e.isDir, Size: e.size, ModTime: e.modTime}
+}
+
+// moveAside moves the file of the side to a free conflict name and copies it
+// to the other side.
+func (s *bisyncer) moveAside(side *bisyncSide, name string) error {
+	other := s.other(side)
+
+	target := ConflictName(name, side.name)
+	for i := 2; side.entries[target] != nil || other.entries[target] != nil; i++ {
+		target = ConflictName(name, fmt.Sprintf("%s%d", side.name, i))
+	}
+
+	if err := side.vfs.Rename("/"+name, "/"+target); err != nil {
+		return err
+	}
+	s.record(SyncRename, side, name, target)
+	side.entries[target] = side.entries[name]
+	delete(side.entries, name)
+
+	return s.propagate(side, other, target)
+}
+
+// propagate makes the path of to match the one of from.
+func (s *bisyncer) propagate(from, to *bisyncSide, name string) error {
+	src, dst := from.entries[name], to.entries[name]
+
+	switch {
+	case src == nil && dst == nil:
+		return nil
+	case src == nil && dst.isDir:
+		// removed once the contents of the directory are synced
+		s.removed = append(s.removed, bisyncRemoval{name: name, from: from, to: to})
+		return nil
+	case src == nil:
+		if err := to.vfs.Remove("/" + name); err != nil {
+			return err
+		}
+		s.record(SyncDelete, to, name, "")
+		delete(to.entries, name)
+		return nil
+	}
+
+	if dst != nil && dst.isDir != src.isDir {
+		if err := to.vfs.RemoveAll("/" + name); err != nil {
+			return err
+		}
+		s.record(SyncDelete, to, name, "")
+		for child := range to.entries {
+			if child == name || strings.HasPrefix(child, name+"/") {
+				delete(to.entries, child)
+			}
+		}
+		dst = nil
+	}
+
+	if src.isDir {
+		if dst == nil {
+			if err := to.vfs.MkdirAll("/"+name, 0755); err != nil {
+				return err
+			}
+			s.record(SyncMkdir, to, name, "")
+			to.entries[name] = &bisyncEntry{isDir: true}
+		}
+		return nil
+	}
+
+	action := SyncCreate
+	if dst != nil {
+		action = SyncUpdate
+	}
+	if err := s.copy(from, to, name); err != nil {
+		return err
+	}
+	s.record(action, to, name, "")
+	return nil
+}
+
+// copy copies the file, keeping its modification time when the other side
+// can take it, and records the copy in the entries of to.
+func (s *bisyncer) copy(from, to *bisyncSide, name string) error {
+	if err := to.vfs.MkdirAll("/"+path.Dir(name), 0755); err != nil {
+		return err
+	}
+
+	r, err := OpenFile(from.vfs, "/"+name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := to.vfs.Create("/" + name)
+	if err != nil {
+		return err
+	}
+
+	h := sha256.New()
+	_, err = io.Copy(io.MultiWriter(w, h), r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	src := from.entries[name]
+	if err := Chtimes(to.vfs, "/"+name, src.modTime, src.modTime); err != nil && !errors.Is(err, ErrNotSupported) {
+		return err
+	}
+
+	info, err := to.vfs.Stat("/" + name)
+	if err != nil {
+		return err
+	}
+	to.entries[name] = &bisyncEntry{size: info.Size(), modTime: info.ModTime(), hash: hex.EncodeToString(h.Sum(nil))}
+	return nil
+}
+
+func (s *bisyncer) record(action SyncAction, side *bisyncSide, name, target string) {
+	s.report.Items = append(s.report.Items, BisyncItem{Action: action, Side: side.name, Path: name, Target: target})
+}
+
+// update replaces the entries of the state with the paths both sides agree on.
+func (s *bisyncer) update() error {
+	a, b := s.sides[0], s.sides[1]
+
+	// the removal of directories is not reflected in the entries
+	for _, side := range s.sides {
+		if err := s.scan(side); err != nil {
+			return err
+		}
+	}
+
+	entries := map[string]*SyncStateEntry{}
+	for name, ea := range a.entries {
+		eb := b.entries[name]
+		if eb == nil || ea.isDir != eb.isDir {
+			continue
+		}
+
+		entry := &SyncStateEntry{IsDir: ea.isDir, ModTime: [2]time.Time{ea.modTime, eb.modTime}}
+		if !ea.isDir {
+			ha, err := s.hash(a, name)
+			if err != nil {
+				return err
+			}
+			hb, err := s.hash(b, name)
+			if err != nil {
+				return err
+			}
+			if ha != hb {
+				continue
+			}
+			entry.Size, entry.Hash = ea.size, ha
+		}
+		entries[name] = entry
+	}
+
+	s.state.Version = syncStateVersion
+	s.state.Entries = entries
+	return nil
+}
@@ -0,0 +1,210 @@
+package filesystem_test
+
+import (
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"sort"
+	"testing"
+	"time"
+)
+
+func bisyncActions(report *filesystem.BisyncReport) []string {
+	list := make([]string, 0, len(report.Items))
+	for _, item := range report.Items {
+		s := fmt.Sprintf("%s %s %s", item.Side, item.Action, item.Path)
+		if item.Target != "" {
+			s += " " + item.Target
+		}
+		list = append(list, s)
+	}
+	sort.Strings(list)
+	return list
+}
+
+// bisync runs Bisync through a state saved in a memory filesystem.
+func bisync(t *testing.T, a, b filesystem.FileSystem, store filesystem.FileSystem, opts *filesystem.BisyncOptions) *filesystem.BisyncReport {
+	t.Helper()
+
+	state, err := filesystem.LoadSyncState(store, "/state.json")
+	require.NoError(t, err)
+
+	report, err := filesystem.Bisync(a, b, state, opts)
+	require.NoError(t, err)
+	require.NoError(t, state.Save(store, "/state.json"))
+
+	assert.Equal(t, dump(t, a), dump(t, b), "both sides match after the sync")
+	return report
+}
+
+func TestBisync(t *testing.T) {
+	a := open(t, fmt.Sprintf("os://%s/", t.TempDir()))
+	b := open(t, "memory:///")
+	store := open(t, "memory:///")
+
+	populate(t, a, map[string]string{"/a.txt": "a", "/dir/c.txt": "c", "/gone/x.txt": "x"})
+	populate(t, b, map[string]string{"/b.txt": "b", "/dir/c.txt": "c"})
+
+	report := bisync(t, a, b, store, nil)
+	assert.Equal(t, []string{"a create b.txt", "b create a.txt", "b create gone/x.txt", "b mkdir gone"}, bisyncActions(report))
+	assert.Empty(t, report.Conflicts)
+
+	report = bisync(t, a, b, store, nil)
+	assert.Empty(t, report.Items, "nothing changed since the last run")
+
+	populate(t, a, map[string]string{"/a.txt": "changed on a"})
+	require.NoError(t, b.Remove("/b.txt"))
+	require.NoError(t, a.Rename("/dir/c.txt", "/c.txt"))
+	require.NoError(t, b.RemoveAll("/gone"))
+	populate(t, b, map[string]string{"/new/n.txt": "n"})
+
+	report = bisync(t, a, b, store, nil)
+	assert.Equal(t, []string{
+		"a create new/n.txt",
+		"a delete b.txt",
+		"a delete gone",
+		"a delete gone/x.txt",
+		"a mkdir new",
+		"b rename dir/c.txt c.txt",
+		"b update a.txt",
+	}, bisyncActions(report))
+	assert.Equal(t, map[string]string{
+		"/a.txt":     "changed on a",
+		"/c.txt":     "c",
+		"/dir/":      "",
+		"/new/":      "",
+		"/new/n.txt": "n",
+	}, dump(t, a))
+
+	// b left the directory alone, the file of a replaces it
+	require.NoError(t, a.Remove("/dir"))
+	populate(t, a, map[string]string{"/dir": "now a file"})
+
+	report = bisync(t, a, b, store, nil)
+	assert.Equal(t, []string{"b create dir", "b delete dir"}, bisyncActions(report))
+	assert.Empty(t, report.Conflicts)
+}
+
+func TestBisyncRenameDir(t *testing.T) {
+	a, b, store := open(t, "memory:///"), open(t, "memory:///"), open(t, "memory:///")
+	populate(t, a, map[string]string{"/docs/1.txt": "one", "/docs/2.txt": "two", "/docs/dup.txt": "one"})
+	bisync(t, a, b, store, nil)
+
+	// the directory is not paired, only the file of unique content is
+	require.NoError(t, a.Rename("/docs", "/manual"))
+	report := bisync(t, a, b, store, nil)
+	assert.Equal(t, []string{
+		"b create manual/1.txt",
+		"b create manual/dup.txt",
+		"b delete docs",
+		"b delete docs/1.txt",
+		"b delete docs/dup.txt",
+		"b mkdir manual",
+		"b rename docs/2.txt manual/2.txt",
+	}, bisyncActions(report))
+	assert.Empty(t, report.Conflicts)
+}
+
+func TestBisyncConflicts(t *testing.T) {
+	a, b, store := open(t, "memory:///"), open(t, "memory:///"), open(t, "memory:///")
+	populate(t, a, map[string]string{"/k.txt": "k", "/n.txt": "n", "/d.txt": "d", "/f/": ""})
+	bisync(t, a, b, store, nil)
+
+	old, recent := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC), time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+	populate(t, a, map[string]string{"/k.txt": "k on a", "/n.txt": "n on a", "/both.txt": "a"})
+	populate(t, b, map[string]string{"/k.txt": "k on b", "/n.txt": "n on b!", "/d.txt": "d on b", "/both.txt": "b"})
+	require.NoError(t, filesystem.Chtimes(a, "/n.txt", old, old))
+	require.NoError(t, filesystem.Chtimes(b, "/n.txt", recent, recent))
+	require.NoError(t, a.Remove("/d.txt"))
+	require.NoError(t, a.Remove("/f"))
+	populate(t, a, map[string]string{"/f": "file on a"})
+	populate(t, b, map[string]string{"/f/g.txt": "g"})
+
+	var seen []string
+	report := bisync(t, a, b, store, &filesystem.BisyncOptions{
+		Resolver: func(c *filesystem.Conflict) (filesystem.Resolution, error) {
+			seen = append(seen, c.Path)
+			switch c.Path {
+			case "k.txt":
+				return filesystem.KeepBoth(c)
+			case "n.txt":
+				return filesystem.NewestWins(c)
+			case "d.txt":
+				assert.Nil(t, c.A)
+				assert.Equal(t, int64(6), c.B.Size)
+				return filesystem.NewestWins(c)
+			}
+			return filesystem.ResolveKeepA, nil
+		},
+	})
+	assert.Equal(t, []string{"both.txt", "d.txt", "k.txt", "n.txt"}, seen, "a file and a directory never reach the resolver")
+	assert.Len(t, report.Conflicts, 5)
+
+	assert.Equal(t, map[string]string{
+		"/both.txt":         "a",
+		"/d.txt":            "d on b",
+		"/f.conflict-a":     "file on a",
+		"/f/":               "",
+		"/f/g.txt":          "g",
+		"/k.conflict-b.txt": "k on b",
+		"/k.txt":            "k on a",
+		"/n.txt":            "n on b!",
+	}, dump(t, a))
+
+	// resolved conflicts stay resolved
+	report = bisync(t, a, b, store, nil)
+	assert.Empty(t, report.Items)
+	assert.Empty(t, report.Conflicts)
+
+	// skipped conflicts come back
+	populate(t, a, map[string]string{"/k.txt": "1"})
+	populate(t, b, map[string]string{"/k.txt": "2"})
+	state, err := filesystem.LoadSyncState(store, "/state.json")
+	require.NoError(t, err)
+	for i := 0; i < 2; i++ {
+		report, err := filesystem.Bisync(a, b, state, &filesystem.BisyncOptions{
+			Resolver: func(c *filesystem.Conflict) (filesystem.Resolution, error) {
+				return filesystem.ResolveSkip, nil
+			},
+		})
+		require.NoError(t, err)
+		assert.Len(t, report.Conflicts, 1)
+	}
+}
+
+func TestBisyncState(t *testing.T) {
+	a, b := open(t, "memory:///"), open(t, "memory:///")
+	populate(t, a, map[string]string{"/a.txt": "a"})
+
+	// the state lives inside a side, it is excluded from the sync
+	opts := &filesystem.BisyncOptions{Exclude: []string{".sync*"}}
+	state, err := filesystem.LoadSyncState(a, "/.sync.json")
+	require.NoError(t, err)
+	assert.Empty(t, state.Entries)
+
+	_, err = filesystem.Bisync(a, b, state, opts)
+	require.NoError(t, err)
+	require.NoError(t, state.Save(a, "/.sync.json"))
+	assert.False(t, b.Exists("/.sync.json"))
+
+	loaded, err := filesystem.LoadSyncState(a, "/.sync.json")
+	require.NoError(t, err)
+	require.Contains(t, loaded.Entries, "a.txt")
+	assert.Equal(t, int64(1), loaded.Entries["a.txt"].Size)
+	assert.NotEmpty(t, loaded.Entries["a.txt"].Hash)
+
+	report, err := filesystem.Bisync(a, b, loaded, opts)
+	require.NoError(t, err)
+	assert.Empty(t, report.Items)
+
+	require.NoError(t, filesystem.WriteFile(a, "/bad.json", []byte(`{"version": 99}`)))
+	_, err = filesystem.LoadSyncState(a, "/bad.json")
+	assert.Error(t, err)
+}
+
+func TestConflictName(t *testing.T) {
+	assert.Equal(t, "dir/report.conflict-b.txt", filesystem.ConflictName("dir/report.txt", "b"))
+	assert.Equal(t, "Makefile.conflict-a", filesystem.ConflictName("Makefile", "a"))
+	assert.Equal(t, ".env.conflict-b", filesystem.ConflictName(".env", "b"))
+}
@@ -0,0 +1,166 @@
+package filesystem
+
+import (
+	"io"
+	"io/fs"
+	"sort"
+	"sync"
+	"sync/atomic"
+)
+
+// A FileSystem holding resources, such as connections, watchers, caches or
+// temporary directories, implements io.Closer to release them. Close closes
+// the files still open on the filesystem, the ones being written as their own
+// Close would, keeping what was written. Every later operation fails with an
+// error matching fs.ErrClosed, a second Close as well. Sub views live as long
+// as the filesystem they come from, their Close does nothing.
+// A FileSystem wrapping another one closes it in its own Close.
+
+// Close closes vfs when it implements io.Closer.
+func Close(vfs FileSystem) error {
+	if vfs, ok := vfs.(io.Closer); ok {
+		return vfs.Close()
+	}
+
+	return nil
+}
+
+type OpenFilesFS interface {
+	FileSystem
+	// OpenFiles returns the names of the files open on the filesystem
+	OpenFiles() []string
+}
+
+// OpenFiles returns the names of the files open on vfs, sorted, the error is
+// ErrNotSupported when vfs does not track them.
+func OpenFiles(vfs FileSystem) ([]string, error) {
+	if vfs, ok := vfs.(OpenFilesFS); ok {
+		return vfs.OpenFiles(), nil
+	}
+
+	return nil, &fs.PathError{Op: "openfiles", Path: "/", Err: ErrNotSupported}
+}
+
+// Tracker records the files a filesystem has open, so that its Close closes
+// the ones left open and tests find the ones never closed. A driver keeps one
+// per filesystem, shared by its Sub views.
+type Tracker struct {
+	files map[uint64]trackedFile
+
+	seq uint64
+
+	closed int32
+
+	sync.Mutex
+}
+
+type trackedFile struct {
+	name string
+
+	closer io.Closer
+}
+
+// Track records the file f opened under name, f calls release when it is
+// closed. The error is fs.ErrClosed once the tracker is closed.
+func (t *Tracker) Track(name string, f io.Closer) (release func(), err error) {
+	t.Lock()
+	defer t.Unlock()
+
+	if t.Closed() {
+		return nil, fs.ErrClosed
+	}
+	if t.files == nil {
+		t.files = make(map[uint64]trackedFile)
+	}
+
+	t.seq++
+	id := t.seq
+	t.files[id] = trackedFile{name: name, closer: f}
+
+	return func() {
+		t.Lock()
+		defer t.Unlock()
+		delete(t.files, id)
+	}, nil
+}
+
+// OpenFiles returns the names of the files open, sorted.
+func (t *Tracker) OpenFiles() []string {
+	t.Lock()
+	defer t.Unlock()
+
+	names := make([]string, 0, len(t.files))
+	for _, f := range t.files {
+		names = append(names, f.name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Closed reports whether Close was called.
+func (t *Tracker) Closed() bool {
+	return atomic.LoadInt32(&t.closed) == 1
+}
+
+// Close closes the files still open, the error is fs.ErrClosed when the
+// tracker is already closed.
+func (t *Tracker) Close() error {
+	if !atomic.CompareAndSwapInt32(&t.closed, 0, 1) {
+		return fs.ErrClosed
+	}
+
+	t.Lock()
+	open := make([]io.Closer, 0, len(t.files))
+	for _, f := range t.files {
+		open = append(open, f.closer)
+	}
+	t.Unlock()
+
+	for _, f := range open {
+		_ = f.Close()
+	}
+	return nil
+}
+
+// Handle is the state of an open file a Tracker records: whether it is
+// closed, and how to tell the tracker it is. A driver embeds it in its files
+// and holds its lock over their operations.
+type Handle struct {
+	sync.Mutex
+
+	closed bool
+
+	release func()
+}
+
+// Track records in t the file f, which embeds h, opened under name. The
+// error is a *fs.PathError matching fs.ErrClosed once t is closed.
+func (h *Handle) Track(t *Tracker, name string, f io.Closer) error {
+	release, err := t.Track(name, f)
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	h.Lock()
+	h.release = release
+	h.Unlock()
+	return nil
+}
+
+// Closed reports whether the file is closed, the lock is held.
+func (h *Handle) Closed() bool {
+	return h.closed
+}
+
+// MarkClosed marks the file closed and tells the tracker, the lock is held.
+// The error is fs.ErrClosed when the file is already closed.
+func (h *Handle) MarkClosed() error {
+	if h.closed {
+		return fs.ErrClosed
+	}
+	h.closed = true
+	if h.release != nil {
+		h.release()
+	}
+	return nil
+}
@@ -0,0 +1,94 @@
+package filesystem_test
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"testing"
+)
+
+// closer counts its Close calls.
+type closer struct {
+	closed int
+}
+
+func (c *closer) Close() error {
+	c.closed++
+	return nil
+}
+
+func TestTracker(t *testing.T) {
+	var tracker filesystem.Tracker
+	a, b := &closer{}, &closer{}
+
+	releaseA, err := tracker.Track("/a", a)
+	require.NoError(t, err)
+	_, err = tracker.Track("/b", b)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a", "/b"}, tracker.OpenFiles())
+
+	releaseA()
+	assert.Equal(t, []string{"/b"}, tracker.OpenFiles())
+
+	require.NoError(t, tracker.Close())
+	assert.True(t, tracker.Closed())
+	assert.Equal(t, 0, a.closed, "a released file is not closed again")
+	assert.Equal(t, 1, b.closed, "the files left open are closed")
+
+	_, err = tracker.Track("/c", &closer{})
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	assert.ErrorIs(t, tracker.Close(), fs.ErrClosed)
+}
+
+// handleFile is a file closed through its Handle.
+type handleFile struct {
+	filesystem.Handle
+}
+
+func (f *handleFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.MarkClosed()
+}
+
+func TestHandle(t *testing.T) {
+	var tracker filesystem.Tracker
+	a, b := &handleFile{}, &handleFile{}
+
+	require.NoError(t, a.Track(&tracker, "/a", a))
+	require.NoError(t, b.Track(&tracker, "/b", b))
+	assert.Equal(t, []string{"/a", "/b"}, tracker.OpenFiles())
+
+	require.NoError(t, a.Close())
+	assert.True(t, a.Closed())
+	assert.ErrorIs(t, a.Close(), fs.ErrClosed)
+	assert.Equal(t, []string{"/b"}, tracker.OpenFiles())
+
+	require.NoError(t, tracker.Close())
+	assert.True(t, b.Closed(), "the files left open are closed")
+
+	err := (&handleFile{}).Track(&tracker, "/c", &closer{})
+	var pathErr *fs.PathError
+	require.ErrorAs(t, err, &pathErr)
+	assert.Equal(t, "/c", pathErr.Path)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+}
+
+func TestClose(t *testing.T) {
+	vfs := open(t, "memory:///")
+	require.NoError(t, filesystem.WriteFile(vfs, "/a.txt", []byte("a")))
+
+	f, err := vfs.Open("/a.txt")
+	require.NoError(t, err)
+	open, err := filesystem.OpenFiles(vfs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a.txt"}, open)
+	require.NoError(t, f.Close())
+	assert.ErrorIs(t, f.Close(), fs.ErrClosed)
+
+	require.NoError(t, filesystem.Close(vfs))
+	assert.ErrorIs(t, filesystem.Close(vfs), fs.ErrClosed)
+	_, err = vfs.Stat("/a.txt")
+	assert.ErrorIs(t, err, fs.ErrClosed)
+}
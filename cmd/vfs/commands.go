@@ -0,0 +1,655 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+)
+
+type command func(c *cli, args []string) error
+
+var commands = map[string]command{
+	"ls":    (*cli).ls,
+	"tree":  (*cli).tree,
+	"stat":  (*cli).stat,
+	"cat":   (*cli).cat,
+	"put":   (*cli).put,
+	"get":   (*cli).get,
+	"cp":    (*cli).cp,
+	"mv":    (*cli).mv,
+	"rm":    (*cli).rm,
+	"mkdir": (*cli).mkdir,
+	"du":    (*cli).du,
+	"df":    (*cli).df,
+	"find":  (*cli).find,
+}
+
+func (c *cli) ls(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("ls", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		args = []string{"."}
+	}
+
+	var list []*entry
+	for _, arg := range args {
+		t, err := c.resolve(arg, read)
+		if err != nil {
+			return err
+		}
+
+		fi, err := t.vfs.Stat(t.name)
+		if err != nil {
+			return err
+		}
+		if !fi.IsDir() {
+			list = append(list, newEntry(t.path, fi))
+			continue
+		}
+
+		dirs, err := filesystem.ReadDir(t.vfs, t.name)
+		if err != nil {
+			return err
+		}
+		for _, d := range dirs {
+			fi, err := d.Info()
+			if err != nil {
+				return err
+			}
+			list = append(list, newEntry(path.Join(t.path, d.Name()), fi))
+		}
+	}
+
+	if c.json {
+		return c.printJSON(list)
+	}
+	return c.printEntries(list)
+}
+
+func (c *cli) tree(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("tree", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("%w: tree takes one location", errUsage)
+	}
+
+	t, err := c.resolve(args[0], read)
+	if err != nil {
+		return err
+	}
+
+	root, err := c.buildTree(t.vfs, t.name, t.path)
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(root)
+	}
+	fmt.Fprintln(c.stdout, root.Path)
+	c.printTree(root, "")
+	return nil
+}
+
+func (c *cli) buildTree(vfs filesystem.FileSystem, name, display string) (*entry, error) {
+	fi, err := vfs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	e := newEntry(display, fi)
+	if !fi.IsDir() {
+		return e, nil
+	}
+
+	dirs, err := filesystem.ReadDir(vfs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	e.Children = make([]*entry, 0, len(dirs))
+	for _, d := range dirs {
+		child, err := c.buildTree(vfs, path.Join(name, d.Name()), path.Join(display, d.Name()))
+		if err != nil {
+			return nil, err
+		}
+		e.Children = append(e.Children, child)
+	}
+	return e, nil
+}
+
+func (c *cli) stat(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("stat", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w: stat takes at least one location", errUsage)
+	}
+
+	list := make([]*entry, 0, len(args))
+	for _, arg := range args {
+		t, err := c.resolve(arg, read)
+		if err != nil {
+			return err
+		}
+
+		fi, err := t.vfs.Stat(t.name)
+		if err != nil {
+			return err
+		}
+		list = append(list, newEntry(t.path, fi))
+	}
+
+	if c.json {
+		return c.printJSON(list)
+	}
+	for _, e := range list {
+		c.printStat(e)
+	}
+	return nil
+}
+
+func (c *cli) cat(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("cat", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w: cat takes at least one location", errUsage)
+	}
+
+	for _, arg := range args {
+		t, err := c.resolve(arg, read)
+		if err != nil {
+			return err
+		}
+
+		f, err := filesystem.OpenFile(t.vfs, t.name)
+		if err != nil {
+			return err
+		}
+		_, err = io.Copy(c.stdout, f)
+		_ = f.Close()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cli) put(args []string) error {
+	return c.transfer("put", args, func(src, dst string) error {
+		if strings.Contains(src, "://") {
+			return fmt.Errorf("%w: put copies from a local path", errUsage)
+		}
+		return nil
+	})
+}
+
+func (c *cli) get(args []string) error {
+	return c.transfer("get", args, func(src, dst string) error {
+		if strings.Contains(dst, "://") {
+			return fmt.Errorf("%w: get copies to a local path", errUsage)
+		}
+		return nil
+	})
+}
+
+func (c *cli) cp(args []string) error {
+	return c.transfer("cp", args, func(src, dst string) error {
+		return nil
+	})
+}
+
+// transfer copies the first location to the second one, check validates
+// the locations before anything is opened.
+func (c *cli) transfer(name string, args []string, check func(src, dst string) error) error {
+	flags := flag.NewFlagSet(name, flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "copy directories recursively")
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("%w: %s takes a source and a destination", errUsage, name)
+	}
+	if err := check(args[0], args[1]); err != nil {
+		return err
+	}
+
+	src, dst, err := c.endpoints(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	stats := &transferStats{}
+	if err := copyTree(dst, src, *recursive, stats); err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(stats)
+	}
+	return nil
+}
+
+func (c *cli) mv(args []string) error {
+	args, err := parseArgs(flag.NewFlagSet("mv", flag.ContinueOnError), args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 2 {
+		return fmt.Errorf("%w: mv takes a source and a destination", errUsage)
+	}
+
+	src, dst, err := c.endpoints(args[0], args[1])
+	if err != nil {
+		return err
+	}
+
+	if src.contains(dst) {
+		return fmt.Errorf("cannot move %s into itself", src.path)
+	}
+
+	stats := &transferStats{}
+	renamed, err := c.rename(src, dst)
+	if err != nil {
+		return err
+	}
+	if renamed {
+		stats.Renamed = 1
+	} else {
+		if err := copyTree(dst, src, true, stats); err != nil {
+			return err
+		}
+		if err := src.vfs.RemoveAll(src.name); err != nil {
+			return err
+		}
+	}
+
+	if c.json {
+		return c.printJSON(stats)
+	}
+	return nil
+}
+
+// rename moves src to dst in place when a filesystem holds both, the one they
+// share or the root of the local disk. It reports false when they are on
+// different filesystems or devices, and a copy has to move them.
+func (c *cli) rename(src, dst *target) (bool, error) {
+	vfs, oldname, newname := src.vfs, src.name, dst.name
+	if src.dsn != dst.dsn {
+		srcLocal, ok := src.local()
+		dstLocal, dstOk := dst.local()
+		if !ok || !dstOk {
+			return false, nil
+		}
+
+		root, err := c.open("os:///.")
+		if err != nil {
+			return false, err
+		}
+		vfs, oldname, newname = root, srcLocal, dstLocal
+	}
+
+	err := vfs.Rename(oldname, newname)
+	if src.dsn != dst.dsn && errors.Is(err, syscall.EXDEV) {
+		return false, nil
+	}
+	return err == nil, err
+}
+
+// endpoints resolves the source and destination of a copy or move, a
+// destination that is an existing directory receives the source under its
+// own name.
+func (c *cli) endpoints(srcArg, dstArg string) (*target, *target, error) {
+	src, err := c.resolve(srcArg, change)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	dst, err := c.resolve(dstArg, create)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	if dst.vfs.IsDir(dst.name) && src.name != "" {
+		base := path.Base(src.name)
+		dst = &target{vfs: dst.vfs, dsn: dst.dsn, name: path.Join(dst.name, base), path: path.Join(dst.path, base)}
+	}
+
+	return src, dst, nil
+}
+
+func (c *cli) rm(args []string) error {
+	flags := flag.NewFlagSet("rm", flag.ContinueOnError)
+	recursive := flags.Bool("r", false, "remove directories and their contents")
+	force := flags.Bool("f", false, "ignore missing files")
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w: rm takes at least one location", errUsage)
+	}
+
+	removed := make([]string, 0, len(args))
+	for _, arg := range args {
+		t, err := c.resolve(arg, change)
+		if err != nil {
+			return err
+		}
+
+		switch {
+		case *force && !t.vfs.Exists(t.name):
+			continue
+		case *recursive:
+			err = t.vfs.RemoveAll(t.name)
+		default:
+			err = t.vfs.Remove(t.name)
+		}
+		if err != nil {
+			return err
+		}
+		removed = append(removed, t.path)
+	}
+
+	if c.json {
+		return c.printJSON(map[string][]string{"removed": removed})
+	}
+	return nil
+}
+
+func (c *cli) mkdir(args []string) error {
+	flags := flag.NewFlagSet("mkdir", flag.ContinueOnError)
+	parents := flags.Bool("p", false, "create parent directories as needed")
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w: mkdir takes at least one location", errUsage)
+	}
+
+	created := make([]string, 0, len(args))
+	for _, arg := range args {
+		mode := change
+		if *parents {
+			mode = create
+		}
+		t, err := c.resolve(arg, mode)
+		if err != nil {
+			return err
+		}
+
+		if *parents {
+			err = t.vfs.MkdirAll(t.name, 0755)
+		} else {
+			err = t.vfs.Mkdir(t.name, 0755)
+		}
+		if err != nil {
+			return err
+		}
+		created = append(created, t.path)
+	}
+
+	if c.json {
+		return c.printJSON(map[string][]string{"created": created})
+	}
+	return nil
+}
+
+func (c *cli) du(args []string) error {
+	flags := flag.NewFlagSet("du", flag.ContinueOnError)
+	summary := flags.Bool("s", false, "display only a total for each location")
+	human := flags.Bool("h", false, "print sizes in human readable format")
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w: du takes at least one location", errUsage)
+	}
+
+	var list []*duEntry
+	for _, arg := range args {
+		t, err := c.resolve(arg, read)
+		if err != nil {
+			return err
+		}
+
+		if *summary {
+			usage, err := filesystem.DiskUsage(t.vfs, t.name)
+			if err != nil {
+				return err
+			}
+			list = append(list, &duEntry{Path: t.path, Size: usage.Size, Files: usage.Files, Dirs: usage.Dirs})
+			continue
+		}
+
+		if _, err := diskUsage(t.vfs, t.name, t.path, &list); err != nil {
+			return err
+		}
+	}
+
+	if c.json {
+		return c.printJSON(list)
+	}
+	c.printUsage(list, *human)
+	return nil
+}
+
+// diskUsage sums the file sizes below name, the usage of every directory is
+// appended to list after the usage of its sub directories.
+func diskUsage(vfs filesystem.FileSystem, name, display string, list *[]*duEntry) (*duEntry, error) {
+	fi, err := vfs.Stat(name)
+	if err != nil {
+		return nil, err
+	}
+
+	u := &duEntry{Path: display}
+	if !fi.IsDir() {
+		u.Size, u.Files = fi.Size(), 1
+		*list = append(*list, u)
+		return u, nil
+	}
+
+	dirs, err := filesystem.ReadDir(vfs, name)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, d := range dirs {
+		if !d.IsDir() {
+			fi, err := d.Info()
+			if err != nil {
+				return nil, err
+			}
+			u.Size += fi.Size()
+			u.Files++
+			continue
+		}
+
+		child, err := diskUsage(vfs, path.Join(name, d.Name()), path.Join(display, d.Name()), list)
+		if err != nil {
+			return nil, err
+		}
+		u.Size += child.Size
+		u.Files += child.Files
+		u.Dirs += child.Dirs + 1
+	}
+
+	*list = append(*list, u)
+	return u, nil
+}
+
+func (c *cli) df(args []string) error {
+	flags := flag.NewFlagSet("df", flag.ContinueOnError)
+	human := flags.Bool("h", false, "print sizes in human readable format")
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) == 0 {
+		return fmt.Errorf("%w: df takes at least one location", errUsage)
+	}
+
+	list := make([]*dfEntry, 0, len(args))
+	for _, arg := range args {
+		t, err := c.resolve(arg, read)
+		if err != nil {
+			return err
+		}
+
+		usage, err := filesystem.Statfs(t.vfs)
+		if err != nil {
+			return err
+		}
+		list = append(list, &dfEntry{Path: t.path, Usage: usage})
+	}
+
+	if c.json {
+		return c.printJSON(list)
+	}
+	return c.printCapacity(list, *human)
+}
+
+func (c *cli) find(args []string) error {
+	flags := flag.NewFlagSet("find", flag.ContinueOnError)
+	pattern := flags.String("name", "", "match base names against the shell pattern")
+	kind := flags.String("type", "", "f for files, d for directories")
+
+	args, err := parseArgs(flags, args)
+	if err != nil {
+		return err
+	}
+	if len(args) != 1 {
+		return fmt.Errorf("%w: find takes one location", errUsage)
+	}
+	if *kind != "" && *kind != "f" && *kind != "d" {
+		return fmt.Errorf("%w: -type is f or d", errUsage)
+	}
+	if _, err := path.Match(*pattern, ""); err != nil {
+		return fmt.Errorf("%w: -name: %s", errUsage, err)
+	}
+
+	t, err := c.resolve(args[0], read)
+	if err != nil {
+		return err
+	}
+
+	var list []*entry
+	err = filesystem.WalkDir(t.vfs, t.name, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if *kind == "f" && d.IsDir() || *kind == "d" && !d.IsDir() {
+			return nil
+		}
+		if ok, _ := path.Match(*pattern, d.Name()); *pattern != "" && !ok {
+			return nil
+		}
+
+		fi, err := d.Info()
+		if err != nil {
+			return err
+		}
+		list = append(list, newEntry(path.Join(t.path, strings.TrimPrefix(name, t.name)), fi))
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if c.json {
+		return c.printJSON(list)
+	}
+	for _, e := range list {
+		fmt.Fprintln(c.stdout, e.Path)
+	}
+	return nil
+}
+
+type transferStats struct {
+	Files   int   `json:"files"`
+	Dirs    int   `json:"dirs"`
+	Bytes   int64 `json:"bytes"`
+	Renamed int   `json:"renamed,omitempty"`
+}
+
+// copyTree copies src to dst, directories are only copied when recursive is set.
+func copyTree(dst, src *target, recursive bool, stats *transferStats) error {
+	fi, err := src.vfs.Stat(src.name)
+	if err != nil {
+		return err
+	}
+
+	if !fi.IsDir() {
+		if src.location() == dst.location() {
+			return fmt.Errorf("cannot copy %s onto itself", src.path)
+		}
+		return copyFile(dst.vfs, dst.name, src.vfs, src.name, stats)
+	}
+
+	if !recursive {
+		return fmt.Errorf("%s is a directory, use -r", src.path)
+	}
+
+	if src.contains(dst) {
+		return fmt.Errorf("cannot copy %s into itself", src.path)
+	}
+
+	return filesystem.WalkDir(src.vfs, src.name, func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		target := path.Join(dst.name, strings.TrimPrefix(name, src.name))
+		if d.IsDir() {
+			stats.Dirs++
+			return dst.vfs.MkdirAll(target, 0755)
+		}
+		return copyFile(dst.vfs, target, src.vfs, name, stats)
+	})
+}
+
+func copyFile(dvfs filesystem.FileSystem, dname string, svfs filesystem.FileSystem, sname string, stats *transferStats) error {
+	r, err := filesystem.OpenFile(svfs, sname)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := dvfs.Create(dname)
+	if err != nil {
+		return err
+	}
+
+	n, err := io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	stats.Files++
+	stats.Bytes += n
+	return nil
+}
@@ -0,0 +1,301 @@
+// Command vfs operates on any filesystem the registered drivers can open.
+//
+// Usage:
+//
+//	vfs [-json] <command> [flags] <location>...
+//
+// A location is a DSN whose path names the file or directory to operate on,
+// for example os:///srv/data/report.csv. The filesystem is opened at the parent
+// directory of that path, when that does not fit a driver a '#' separates the
+// DSN of the filesystem from the path inside it, as in os:///srv#data/report.csv.
+// A local directory that is only read is the root of the filesystem opened, and
+// opening a location never creates a directory: only mkdir -p and the
+// destinations of put and cp create the missing ones.
+// A location without a scheme is a local path served by the os driver.
+//
+// The commands are:
+//
+//	ls [location...]             list directories
+//	tree <location>              print a directory tree
+//	stat <location...>           describe files and directories
+//	cat <location...>            write file contents to stdout
+//	put [-r] <local> <location>  upload a local file or directory
+//	get [-r] <location> <local>  download a file or directory
+//	cp [-r] <src> <dst>          copy between any two locations
+//	mv <src> <dst>               move between any two locations
+//	rm [-r] [-f] <location...>   remove files and directories
+//	mkdir [-p] <location...>     create directories
+//	du [-s] [-h] <location...>   summarize disk usage
+//	df [-h] <location...>        report filesystem capacity
+//	find <location> [-name pattern] [-type f|d]
+//
+// With -json every command prints a single JSON document instead of text.
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	_ "github.com/lazychanger/go-vfs/driver/bolt"
+	_ "github.com/lazychanger/go-vfs/driver/etcd"
+	_ "github.com/lazychanger/go-vfs/driver/ftp"
+	_ "github.com/lazychanger/go-vfs/driver/memory"
+	_ "github.com/lazychanger/go-vfs/driver/nested"
+	_ "github.com/lazychanger/go-vfs/driver/os"
+	_ "github.com/lazychanger/go-vfs/driver/redis"
+	_ "github.com/lazychanger/go-vfs/driver/s3"
+	_ "github.com/lazychanger/go-vfs/driver/sftp"
+	_ "github.com/lazychanger/go-vfs/driver/sql"
+	_ "github.com/lazychanger/go-vfs/driver/tar"
+	_ "github.com/lazychanger/go-vfs/driver/zip"
+	"io"
+	_ "modernc.org/sqlite"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+const usage = `usage: vfs [-json] <command> [flags] <location>...
+
+commands:
+  ls [location...]             list directories
+  tree <location>              print a directory tree
+  stat <location...>           describe files and directories
+  cat <location...>            write file contents to stdout
+  put [-r] <local> <location>  upload a local file or directory
+  get [-r] <location> <local>  download a file or directory
+  cp [-r] <src> <dst>          copy between any two locations
+  mv <src> <dst>               move between any two locations
+  rm [-r] [-f] <location...>   remove files and directories
+  mkdir [-p] <location...>     create directories
+  du [-s] [-h] <location...>   summarize disk usage
+  df [-h] <location...>        report filesystem capacity
+  find <location> [-name pattern] [-type f|d]
+
+A location is a DSN such as os:///srv/data/file or memory:///file,
+use '#' to split the DSN from the path inside it: os:///srv#data/file.
+`
+
+var errUsage = errors.New("usage")
+
+func main() {
+	os.Exit(run(os.Args[1:], os.Stdout, os.Stderr))
+}
+
+// run executes the command line args and returns the exit code.
+func run(args []string, stdout, stderr io.Writer) int {
+	flags := flag.NewFlagSet("vfs", flag.ContinueOnError)
+	flags.SetOutput(stderr)
+	flags.Usage = func() { fmt.Fprint(stderr, usage) }
+	asJSON := flags.Bool("json", false, "print JSON instead of text")
+
+	if err := flags.Parse(args); err != nil {
+		return 2
+	}
+	if flags.NArg() == 0 {
+		flags.Usage()
+		return 2
+	}
+
+	c := &cli{
+		stdout: stdout,
+		json:   *asJSON,
+		fss:    make(map[string]filesystem.FileSystem),
+	}
+	defer c.close()
+
+	name, args := flags.Arg(0), flags.Args()[1:]
+	cmd, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(stderr, "vfs: unknown command %q\n", name)
+		flags.Usage()
+		return 2
+	}
+
+	if err := cmd(c, args); err != nil {
+		if errors.Is(err, errUsage) {
+			fmt.Fprintf(stderr, "vfs %s: %s\n", name, err)
+			flags.Usage()
+			return 2
+		}
+		fmt.Fprintf(stderr, "vfs %s: %s\n", name, err)
+		return 1
+	}
+	return 0
+}
+
+type cli struct {
+	stdout io.Writer
+
+	json bool
+
+	// fss caches the filesystems by DSN, so that locations on the same
+	// filesystem share one instance.
+	fss map[string]filesystem.FileSystem
+}
+
+// close closes the filesystems the command opened.
+func (c *cli) close() {
+	for _, vfs := range c.fss {
+		_ = filesystem.Close(vfs)
+	}
+}
+
+// target is a resolved location.
+type target struct {
+	vfs filesystem.FileSystem
+
+	// dsn of the filesystem, equal DSNs share a filesystem.
+	dsn string
+
+	// name inside the filesystem, empty for its root.
+	name string
+
+	// path for display.
+	path string
+}
+
+// location returns where t is, equal for the targets naming the same file
+// through different DSNs: its path on the local disk for the os driver, its
+// DSN and name otherwise.
+func (t *target) location() string {
+	if local, ok := t.local(); ok {
+		return "os://" + local
+	}
+	return t.dsn + "#/" + t.name
+}
+
+// local returns the path of t on the local disk, when the os driver serves it
+// from its own root.
+func (t *target) local() (string, bool) {
+	uri, err := url.Parse(t.dsn)
+	if err != nil || uri.Scheme != "os" || uri.RawQuery != "" {
+		return "", false
+	}
+	return path.Join(uri.Path, t.name), true
+}
+
+// contains reports whether other is t or lies under it.
+func (t *target) contains(other *target) bool {
+	dir, loc := t.location(), other.location()
+	return loc == dir || strings.HasPrefix(loc, strings.TrimSuffix(dir, "/")+"/")
+}
+
+// The ways a command uses a location.
+const (
+	// read only reads the location, a directory of the local disk is the
+	// root of the filesystem opened.
+	read = iota
+	// change removes or renames the location in its directory.
+	change
+	// create creates the location along with its missing parents.
+	create
+)
+
+// resolve opens the filesystem of the location arg, at its parent directory.
+// The os driver creates its root when it opens, so a location of the local
+// disk opens at the closest directory that exists, the location itself when
+// it is read, and the rest stays in the name. With create, the filesystem is
+// opened at the closest ancestor the driver accepts, so that missing parents
+// can be created through the filesystem.
+func (c *cli) resolve(arg string, mode int) (*target, error) {
+	if !strings.Contains(arg, "://") {
+		abs, err := filepath.Abs(arg)
+		if err != nil {
+			return nil, err
+		}
+		arg = "os://" + filepath.ToSlash(abs)
+	}
+
+	uri, err := url.Parse(arg)
+	if err != nil {
+		return nil, err
+	}
+
+	if uri.Fragment != "" {
+		name := strings.Trim(path.Clean("/"+uri.Fragment), "/")
+		display := path.Join(uri.Path, name)
+		uri.Fragment = ""
+		vfs, err := c.open(uri.String())
+		if err != nil {
+			return nil, err
+		}
+		return &target{vfs: vfs, dsn: uri.String(), name: name, path: display}, nil
+	}
+
+	display := path.Clean("/" + uri.Path)
+	dir, name := path.Split(display)
+	if uri.Scheme == "os" {
+		dir, name = localDir(display, mode == read)
+	}
+
+	for {
+		dir = path.Clean(dir)
+		uri.Path = dir
+		if uri.Scheme == "os" && dir == "/" {
+			// the os driver takes no root "/", "/." names it as well
+			uri.Path = "/."
+		}
+		vfs, err := c.open(uri.String())
+		if err == nil {
+			return &target{vfs: vfs, dsn: uri.String(), name: name, path: display}, nil
+		}
+		if mode != create || dir == "/" {
+			return nil, err
+		}
+		parent, base := path.Split(dir)
+		dir, name = parent, path.Join(base, strings.TrimPrefix(display, dir))
+	}
+}
+
+// localDir splits the local path p at the closest directory that exists:
+// p itself when self is set and it is a directory, its parent or above
+// otherwise.
+func localDir(p string, self bool) (string, string) {
+	dir := p
+	if !self {
+		dir = path.Dir(p)
+	}
+	for dir != "/" {
+		if info, err := os.Stat(filepath.FromSlash(dir)); err == nil && info.IsDir() {
+			break
+		}
+		dir = path.Dir(dir)
+	}
+	return dir, strings.TrimPrefix(strings.TrimPrefix(p, dir), "/")
+}
+
+func (c *cli) open(dsn string) (filesystem.FileSystem, error) {
+	if vfs, ok := c.fss[dsn]; ok {
+		return vfs, nil
+	}
+
+	vfs, err := filesystem.Open(dsn)
+	if err != nil {
+		return nil, fmt.Errorf("open %s: %w", dsn, err)
+	}
+
+	c.fss[dsn] = vfs
+	return vfs, nil
+}
+
+// parseArgs parses flags placed anywhere among the positional arguments.
+func parseArgs(flags *flag.FlagSet, args []string) ([]string, error) {
+	flags.SetOutput(io.Discard)
+
+	var positional []string
+	for {
+		if err := flags.Parse(args); err != nil {
+			return nil, fmt.Errorf("%w: %s", errUsage, err)
+		}
+		args = flags.Args()
+		if len(args) == 0 {
+			return positional, nil
+		}
+		positional = append(positional, args[0])
+		args = args[1:]
+	}
+}
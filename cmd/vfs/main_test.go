@@ -0,0 +1,267 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"github.com/lazychanger/go-vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// vfs runs the command line and returns stdout, stderr and the exit code.
+func vfs(args ...string) (string, string, int) {
+	var stdout, stderr bytes.Buffer
+	code := run(args, &stdout, &stderr)
+	return stdout.String(), stderr.String(), code
+}
+
+func mustRun(t *testing.T, args ...string) string {
+	t.Helper()
+
+	stdout, stderr, code := vfs(args...)
+	require.Equalf(t, 0, code, "vfs %s: %s", strings.Join(args, " "), stderr)
+	return stdout
+}
+
+func loc(dir string, elems ...string) string {
+	return "os://" + filepath.ToSlash(filepath.Join(append([]string{dir}, elems...)...))
+}
+
+func TestUsage(t *testing.T) {
+	_, stderr, code := vfs()
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, "usage: vfs")
+
+	_, stderr, code = vfs("nope")
+	assert.Equal(t, 2, code)
+	assert.Contains(t, stderr, `unknown command "nope"`)
+
+	_, _, code = vfs("tree")
+	assert.Equal(t, 2, code)
+
+	_, _, code = vfs("find", t.TempDir(), "-type", "x")
+	assert.Equal(t, 2, code)
+
+	_, _, code = vfs("put", "memory:///a", t.TempDir())
+	assert.Equal(t, 2, code)
+
+	_, stderr, code = vfs("cat", loc(t.TempDir(), "missing"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "vfs cat:")
+}
+
+func TestCommands(t *testing.T) {
+	dir := t.TempDir()
+	local := filepath.Join(dir, "local")
+	require.NoError(t, os.MkdirAll(filepath.Join(local, "sub"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(local, "a.txt"), []byte("hello"), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(local, "sub", "b.txt"), []byte("world!"), 0644))
+
+	store := filepath.Join(dir, "store")
+
+	mustRun(t, "mkdir", "-p", loc(store, "x", "y"))
+	assert.DirExists(t, filepath.Join(store, "x", "y"))
+
+	mustRun(t, "put", "-r", local, loc(store, "x"))
+	assert.FileExists(t, filepath.Join(store, "x", "local", "sub", "b.txt"))
+
+	assert.Equal(t, "hello", mustRun(t, "cat", loc(store, "x", "local", "a.txt")))
+	assert.Equal(t, "helloworld!", mustRun(t, "cat", loc(store, "x", "local", "a.txt"), store+"/x/local/sub/b.txt"))
+
+	ls := mustRun(t, "ls", loc(store, "x", "local"))
+	assert.Contains(t, ls, "a.txt")
+	assert.Contains(t, ls, "sub/")
+
+	assert.Equal(t, loc(store, "x", "local")[len("os://"):]+"\n├── a.txt\n└── sub/\n    └── b.txt\n",
+		mustRun(t, "tree", loc(store, "x", "local")))
+
+	assert.Contains(t, mustRun(t, "stat", loc(store, "x", "local", "a.txt")), "Size: 5")
+
+	find := mustRun(t, "find", loc(store, "x"), "-name", "*.txt", "-type", "f")
+	assert.Equal(t, []string{
+		filepath.ToSlash(filepath.Join(store, "x", "local", "a.txt")),
+		filepath.ToSlash(filepath.Join(store, "x", "local", "sub", "b.txt")),
+	}, strings.Fields(find))
+
+	du := strings.Split(strings.TrimSpace(mustRun(t, "du", loc(store, "x", "local"))), "\n")
+	assert.Len(t, du, 2)
+	assert.True(t, strings.HasPrefix(du[0], "6\t"))
+	assert.True(t, strings.HasPrefix(du[1], "11\t"))
+	assert.Equal(t, "11B\t"+filepath.ToSlash(filepath.Join(store, "x", "local"))+"\n",
+		mustRun(t, "du", "-s", "-h", loc(store, "x", "local")))
+
+	mustRun(t, "cp", "-r", loc(store, "x", "local"), loc(store, "copy"))
+	assert.FileExists(t, filepath.Join(store, "copy", "sub", "b.txt"))
+
+	_, stderr, code := vfs("cp", loc(store, "copy"), loc(store, "copy2"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "use -r")
+
+	mustRun(t, "mv", loc(store, "copy"), loc(store, "moved"))
+	assert.NoDirExists(t, filepath.Join(store, "copy"))
+	assert.FileExists(t, filepath.Join(store, "moved", "a.txt"))
+
+	// a '#' moves the filesystem root, rename then becomes copy and delete
+	// between two filesystems.
+	mustRun(t, "mv", loc(store, "moved"), loc(store, "x")+"#again")
+	assert.NoDirExists(t, filepath.Join(store, "moved"))
+	assert.FileExists(t, filepath.Join(store, "x", "again", "sub", "b.txt"))
+
+	out := filepath.Join(dir, "out.txt")
+	mustRun(t, "get", loc(store, "x", "again", "a.txt"), out)
+	data, err := os.ReadFile(out)
+	require.NoError(t, err)
+	assert.Equal(t, "hello", string(data))
+
+	_, _, code = vfs("rm", loc(store, "x"))
+	assert.Equal(t, 1, code)
+	mustRun(t, "rm", "-r", loc(store, "x"))
+	assert.NoDirExists(t, filepath.Join(store, "x"))
+	mustRun(t, "rm", "-f", loc(store, "x"))
+}
+
+func TestJSON(t *testing.T) {
+	store := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(store, "a.txt"), []byte("abc"), 0644))
+
+	var created map[string][]string
+	require.NoError(t, json.Unmarshal([]byte(mustRun(t, "-json", "mkdir", loc(store, "d"))), &created))
+	assert.Equal(t, []string{filepath.ToSlash(filepath.Join(store, "d"))}, created["created"])
+
+	var stats transferStats
+	require.NoError(t, json.Unmarshal([]byte(mustRun(t, "-json", "cp", loc(store, "a.txt"), loc(store, "d"))), &stats))
+	assert.Equal(t, transferStats{Files: 1, Bytes: 3}, stats)
+
+	var list []*entry
+	require.NoError(t, json.Unmarshal([]byte(mustRun(t, "-json", "ls", loc(store, "d"))), &list))
+	require.Len(t, list, 1)
+	assert.Equal(t, "a.txt", list[0].Name)
+	assert.Equal(t, int64(3), list[0].Size)
+	assert.False(t, list[0].IsDir)
+
+	var tree entry
+	require.NoError(t, json.Unmarshal([]byte(mustRun(t, "-json", "tree", loc(store)+"#.")), &tree))
+	assert.True(t, tree.IsDir)
+	assert.Len(t, tree.Children, 2)
+
+	var usage []*duEntry
+	require.NoError(t, json.Unmarshal([]byte(mustRun(t, "-json", "du", "-s", loc(store, "d"))), &usage))
+	assert.Equal(t, []*duEntry{{Path: filepath.ToSlash(filepath.Join(store, "d")), Size: 3, Files: 1}}, usage)
+
+	var removed map[string][]string
+	require.NoError(t, json.Unmarshal([]byte(mustRun(t, "-json", "rm", "-r", loc(store, "d"))), &removed))
+	assert.Len(t, removed["removed"], 1)
+}
+
+func TestMemory(t *testing.T) {
+	var stdout bytes.Buffer
+	c := &cli{stdout: &stdout, fss: make(map[string]filesystem.FileSystem)}
+
+	local := filepath.Join(t.TempDir(), "a.txt")
+	require.NoError(t, os.WriteFile(local, []byte("memory"), 0644))
+
+	// memory filesystems live as long as the process, commands sharing a
+	// cli share the filesystem of a DSN.
+	require.NoError(t, commands["mkdir"](c, []string{"-p", "memory:///#x/y"}))
+	require.NoError(t, commands["put"](c, []string{local, "memory:///#x/y"}))
+	require.NoError(t, commands["mv"](c, []string{"memory:///#x/y/a.txt", "memory:///#b.txt"}))
+	require.NoError(t, commands["cat"](c, []string{"memory:///#b.txt"}))
+	assert.Equal(t, "memory", stdout.String())
+
+	stdout.Reset()
+	require.NoError(t, commands["find"](c, []string{"memory:///#"}))
+	assert.Equal(t, "/\n/b.txt\n/x\n/x/y\n", stdout.String())
+
+	stdout.Reset()
+	c.json = true
+	require.NoError(t, commands["df"](c, []string{"memory:///#"}))
+	var df []map[string]interface{}
+	require.NoError(t, json.Unmarshal(stdout.Bytes(), &df))
+	require.Len(t, df, 1)
+	assert.Equal(t, float64(6), df[0]["used"])
+	assert.Equal(t, float64(4), df[0]["inodesUsed"])
+}
+
+func TestLocations(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "a.txt"), []byte("a"), 0644))
+
+	top := "/" + strings.Split(filepath.ToSlash(dir), "/")[1]
+	assert.Contains(t, mustRun(t, "ls", "/"), strings.TrimPrefix(top, "/"))
+	assert.Contains(t, mustRun(t, "ls", "os:///"), strings.TrimPrefix(top, "/"))
+	assert.Contains(t, mustRun(t, "stat", top), top)
+	assert.Contains(t, mustRun(t, "ls", dir), "a.txt")
+	assert.Contains(t, mustRun(t, "stat", dir), dir)
+
+	// reading or removing a missing location creates nothing
+	_, _, code := vfs("stat", loc(dir, "newdir", "f"))
+	assert.Equal(t, 1, code)
+	_, _, code = vfs("ls", loc(dir, "newdir", "sub"))
+	assert.Equal(t, 1, code)
+	mustRun(t, "rm", "-f", loc(dir, "zz", "f"))
+	_, _, code = vfs("rm", loc(dir, "zz", "f"))
+	assert.Equal(t, 1, code)
+	assert.NoDirExists(t, filepath.Join(dir, "newdir"))
+	assert.NoDirExists(t, filepath.Join(dir, "zz"))
+
+	// a directory read at itself still copies and removes under its name
+	mustRun(t, "mkdir", "-p", loc(dir, "src", "deep"))
+	mustRun(t, "mkdir", loc(dir, "dst"))
+	mustRun(t, "cp", "-r", loc(dir, "src"), loc(dir, "dst"))
+	assert.DirExists(t, filepath.Join(dir, "dst", "src", "deep"))
+	mustRun(t, "rm", "-r", loc(dir, "src"))
+	assert.NoDirExists(t, filepath.Join(dir, "src"))
+	assert.DirExists(t, dir)
+
+	_, _, code = vfs("mkdir", loc(dir, "x", "y"))
+	assert.Equal(t, 1, code)
+	assert.NoDirExists(t, filepath.Join(dir, "x"))
+}
+
+func TestIntoItself(t *testing.T) {
+	dir := t.TempDir()
+	a := filepath.Join(dir, "a")
+	require.NoError(t, os.MkdirAll(filepath.Join(a, "b"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(a, "f"), []byte("f"), 0644))
+
+	// the locations open on different DSNs, the local paths tell they nest
+	_, stderr, code := vfs("cp", "-r", a, filepath.Join(a, "b", "c"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "into itself")
+	assert.NoDirExists(t, filepath.Join(a, "b", "c"))
+
+	_, stderr, code = vfs("mv", a, filepath.Join(a, "sub", "moved"))
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "into itself")
+	assert.NoDirExists(t, filepath.Join(a, "sub"))
+	assert.FileExists(t, filepath.Join(a, "f"))
+
+	_, stderr, code = vfs("cp", filepath.Join(a, "f"), "os://"+filepath.ToSlash(dir)+"#a/f")
+	assert.Equal(t, 1, code)
+	assert.Contains(t, stderr, "onto itself")
+	data, err := os.ReadFile(filepath.Join(a, "f"))
+	require.NoError(t, err)
+	assert.Equal(t, "f", string(data))
+}
+
+func TestMoveLocal(t *testing.T) {
+	dir := t.TempDir()
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "d1"), 0755))
+	require.NoError(t, os.MkdirAll(filepath.Join(dir, "d2"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "d1", "f"), []byte("f"), 0644))
+	before, err := os.Stat(filepath.Join(dir, "d1", "f"))
+	require.NoError(t, err)
+
+	// the directories open as two filesystems, the file is renamed still
+	out := mustRun(t, "-json", "mv", filepath.Join(dir, "d1", "f"), filepath.Join(dir, "d2")+"/")
+	assert.Contains(t, out, `"renamed": 1`)
+
+	after, err := os.Stat(filepath.Join(dir, "d2", "f"))
+	require.NoError(t, err)
+	assert.True(t, os.SameFile(before, after), "the file keeps its inode")
+	assert.NoFileExists(t, filepath.Join(dir, "d1", "f"))
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"io/fs"
+	"text/tabwriter"
+	"time"
+)
+
+// entry describes a file or directory in the output of ls, tree, stat and find.
+type entry struct {
+	Name     string    `json:"name"`
+	Path     string    `json:"path"`
+	Size     int64     `json:"size"`
+	Mode     string    `json:"mode"`
+	ModTime  time.Time `json:"modTime"`
+	IsDir    bool      `json:"isDir"`
+	Children []*entry  `json:"children,omitempty"`
+}
+
+func newEntry(display string, fi fs.FileInfo) *entry {
+	return &entry{
+		Name:    fi.Name(),
+		Path:    display,
+		Size:    fi.Size(),
+		Mode:    fi.Mode().String(),
+		ModTime: fi.ModTime(),
+		IsDir:   fi.IsDir(),
+	}
+}
+
+// duEntry is a line of du output.
+type duEntry struct {
+	Path  string `json:"path"`
+	Size  int64  `json:"size"`
+	Files int64  `json:"files"`
+	Dirs  int64  `json:"dirs"`
+}
+
+// dfEntry is a line of df output.
+type dfEntry struct {
+	Path string `json:"path"`
+	*filesystem.Usage
+}
+
+func (c *cli) printJSON(v interface{}) error {
+	enc := json.NewEncoder(c.stdout)
+	enc.SetIndent("", "  ")
+	return enc.Encode(v)
+}
+
+func (c *cli) printEntries(list []*entry) error {
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 1, ' ', tabwriter.AlignRight)
+	for _, e := range list {
+		name := e.Name
+		if e.IsDir {
+			name += "/"
+		}
+		fmt.Fprintf(w, "%s\t%d\t %s\t %s\t\n", e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04"), name)
+	}
+	return w.Flush()
+}
+
+func (c *cli) printTree(e *entry, prefix string) {
+	for i, child := range e.Children {
+		branch, indent := "├── ", "│   "
+		if i == len(e.Children)-1 {
+			branch, indent = "└── ", "    "
+		}
+
+		name := child.Name
+		if child.IsDir {
+			name += "/"
+		}
+		fmt.Fprintf(c.stdout, "%s%s%s\n", prefix, branch, name)
+		c.printTree(child, prefix+indent)
+	}
+}
+
+func (c *cli) printStat(e *entry) {
+	kind := "file"
+	if e.IsDir {
+		kind = "directory"
+	}
+	fmt.Fprintf(c.stdout, "  Path: %s\n  Type: %s\n  Size: %d\n  Mode: %s\nModify: %s\n",
+		e.Path, kind, e.Size, e.Mode, e.ModTime.Format(time.RFC3339))
+}
+
+func (c *cli) printUsage(list []*duEntry, human bool) {
+	for _, u := range list {
+		size := fmt.Sprint(u.Size)
+		if human {
+			size = humanSize(u.Size)
+		}
+		fmt.Fprintf(c.stdout, "%s\t%s\n", size, u.Path)
+	}
+}
+
+func (c *cli) printCapacity(list []*dfEntry, human bool) error {
+	size := func(n uint64) string {
+		if human {
+			return humanSize(int64(n))
+		}
+		return fmt.Sprint(n)
+	}
+
+	w := tabwriter.NewWriter(c.stdout, 0, 4, 1, ' ', 0)
+	fmt.Fprintln(w, "Size\tUsed\tAvail\tInodes\tIUsed\tPath")
+	for _, e := range list {
+		fmt.Fprintf(w, "%s\t%s\t%s\t%d\t%d\t%s\n",
+			size(e.Total), size(e.Used), size(e.Free), e.Inodes, e.InodesUsed, e.Path)
+	}
+	return w.Flush()
+}
+
+// humanSize formats n bytes with a binary unit suffix.
+func humanSize(n int64) string {
+	const unit = 1024
+	if n < unit {
+		return fmt.Sprintf("%dB", n)
+	}
+
+	div, exp := int64(unit), 0
+	for m := n / unit; m >= unit; m /= unit {
+		div *= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f%c", float64(n)/float64(div), "KMGTPE"[exp])
+}
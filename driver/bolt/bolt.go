@@ -0,0 +1,793 @@
+// Package bolt implements filesystem.FileSystem in a bbolt database, a
+// single file that persists the filesystem.
+//
+// A filesystem is a bucket of buckets: the inodes, with the type, mode, size
+// and modification time of the files and directories, the entries naming
+// the inodes in their parent directory, sorted by name, and the chunks of
+// the content of the files. The root is the inode 1.
+//
+// Every change is a transaction. Rename moves an entry, whatever the size of
+// the tree below it. A File streams its content a chunk at a time to an
+// inode of its own, which replaces the file once it is closed. ReadDir, and
+// a directory opened, list the entries in a single read transaction, a
+// consistent snapshot.
+//
+// bbolt locks its file for a single process: the filesystems opened on a
+// file in the process share the database, another process waits for it.
+// The pages freed by the changes are reused, Compact gives them back to the
+// system.
+package bolt
+
+import (
+	"bytes"
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/internal/chunked"
+	"go.etcd.io/bbolt"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultBucket    = "vfs"
+	defaultChunkSize = 256 << 10
+	defaultTimeout   = time.Second
+
+	// rootID is the inode of the root directory.
+	rootID = 1
+
+	// compactTxSize bounds the size of the transactions of a compaction.
+	compactTxSize = 64 << 20
+)
+
+type boltFs struct {
+	config *Config
+
+	// root is the absolute path the filesystem is rooted at.
+	root string
+
+	// conn is the bucket the Sub views share, only the owner releases its
+	// database, closed with the last filesystem open on the file.
+	conn  *boltConn
+	owner bool
+}
+
+// boltConn is the bucket of the filesystem and the files open on it.
+type boltConn struct {
+	filesystem.Tracker
+
+	db     *database
+	bucket []byte
+}
+
+// databases are the databases open in the process, by path.
+var (
+	databasesMu sync.Mutex
+	databases   = map[string]*database{}
+)
+
+// database is a database file shared by the filesystems opened on it.
+type database struct {
+	// mu is held for reading by the transactions, and for writing by
+	// Compact, which replaces db.
+	mu sync.RWMutex
+	db *bbolt.DB
+
+	path    string
+	timeout time.Duration
+	refs    int
+}
+
+// openDatabase opens the database at path, or shares the one open.
+func openDatabase(file string, timeout time.Duration) (*database, error) {
+	p, err := filepath.Abs(file)
+	if err != nil {
+		return nil, err
+	}
+
+	databasesMu.Lock()
+	defer databasesMu.Unlock()
+
+	if d, ok := databases[p]; ok {
+		d.refs++
+		return d, nil
+	}
+	db, err := bbolt.Open(p, 0600, &bbolt.Options{Timeout: timeout})
+	if err != nil {
+		return nil, err
+	}
+
+	d := &database{db: db, path: p, timeout: timeout, refs: 1}
+	databases[p] = d
+	return d, nil
+}
+
+// release closes the database once the last filesystem on it is closed.
+func (d *database) release() error {
+	databasesMu.Lock()
+	defer databasesMu.Unlock()
+
+	if d.refs--; d.refs > 0 {
+		return nil
+	}
+	delete(databases, d.path)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if d.db == nil {
+		return nil
+	}
+	return d.db.Close()
+}
+
+// compact copies the database to a new file that replaces it.
+func (d *database) compact() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.db == nil {
+		return fs.ErrClosed
+	}
+
+	tmp := d.path + ".compact"
+	_ = os.Remove(tmp)
+	dst, err := bbolt.Open(tmp, 0600, &bbolt.Options{Timeout: d.timeout})
+	if err != nil {
+		return err
+	}
+	err = bbolt.Compact(dst, d.db, compactTxSize)
+	if cerr := dst.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	if err := d.db.Close(); err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+	err = os.Rename(tmp, d.path)
+	if err != nil {
+		_ = os.Remove(tmp)
+	}
+
+	// the database is opened again even when the copy failed to replace it
+	db, oerr := bbolt.Open(d.path, 0600, &bbolt.Options{Timeout: d.timeout})
+	d.db = db
+	if err == nil {
+		err = oerr
+	}
+	return err
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if config.File == "" {
+		return nil, fs.ErrInvalid
+	}
+	if config.Bucket == "" {
+		config.Bucket = defaultBucket
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = defaultChunkSize
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	db, err := openDatabase(config.File, config.Timeout)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &boltConn{db: db, bucket: []byte(config.Bucket)}
+	if err := conn.init(); err != nil {
+		_ = db.release()
+		return nil, err
+	}
+
+	return &boltFs{
+		config: config,
+		root:   "/",
+		conn:   conn,
+		owner:  true,
+	}, nil
+}
+
+// init creates the buckets and the root when missing, and removes the
+// inodes of the files left open by a process that stopped.
+func (conn *boltConn) init() error {
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+
+	return conn.db.db.Update(func(tx *bbolt.Tx) error {
+		top, err := tx.CreateBucketIfNotExists(conn.bucket)
+		if err != nil {
+			return err
+		}
+		for _, name := range [][]byte{inodesBucket, entriesBucket, chunksBucket, pendingBucket} {
+			if _, err := top.CreateBucketIfNotExists(name); err != nil {
+				return err
+			}
+		}
+
+		s := conn.store(tx)
+		if _, err := s.node(rootID); errors.Is(err, fs.ErrNotExist) {
+			if err := s.inodes.SetSequence(rootID); err != nil {
+				return err
+			}
+			root := &node{id: rootID, dir: true, mode: 0755, mtime: time.Now().UnixNano()}
+			if err := s.save(root); err != nil {
+				return err
+			}
+		}
+
+		// the pending inodes of this process are the ones of open files
+		if conn.shared() {
+			return nil
+		}
+		var ids [][]byte
+		_ = s.pending.ForEach(func(k, v []byte) error {
+			ids = append(ids, k)
+			return nil
+		})
+		for _, k := range ids {
+			if err := s.free(decodeID(k)); err != nil {
+				return err
+			}
+			if err := s.pending.Delete(k); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// shared reports whether another filesystem of the process has the
+// database open.
+func (conn *boltConn) shared() bool {
+	databasesMu.Lock()
+	defer databasesMu.Unlock()
+	return conn.db.refs > 1
+}
+
+func (vfs *boltFs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	var n *node
+	err := vfs.conn.view(func(s store) (err error) {
+		n, err = s.lookup(p)
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	if n.dir {
+		d := &boltDir{vfs: vfs, name: name, info: n.info(path.Base(p))}
+		if err := d.Track(&vfs.conn.Tracker, vfs.abs(name), d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	f := &boltFile{vfs: vfs, node: n, info: n.info(path.Base(p))}
+	f.Reader = chunked.Reader{Chunks: f, Size: n.size, ChunkSize: n.chunk, Path: p}
+	if err := f.Track(&vfs.conn.Tracker, vfs.abs(name), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create names an empty inode after the file, the content written to the
+// file replaces it once the file is closed.
+func (vfs *boltFs) Create(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.update(func(s store) error {
+		n, err := s.alloc(false, 0644, time.Now(), vfs.config.ChunkSize)
+		if err != nil {
+			return err
+		}
+		return s.put(p, n)
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	w := newBoltWriter(vfs, name)
+	if err := w.Track(&vfs.conn.Tracker, vfs.abs(name), w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (vfs *boltFs) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.update(func(s store) error {
+		_, err := s.lookup(p)
+		switch {
+		case err == nil:
+			return fs.ErrExist
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		}
+
+		parent, err := s.dir(path.Dir(p))
+		if err != nil {
+			return err
+		}
+		n, err := s.alloc(true, perm, time.Now(), 0)
+		if err != nil {
+			return err
+		}
+		return s.link(parent.id, path.Base(p), n.id)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *boltFs) MkdirAll(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.update(func(s store) error {
+		n, err := s.node(rootID)
+		if err != nil {
+			return err
+		}
+		for _, elem := range split(p) {
+			if !n.dir {
+				return syscall.ENOTDIR
+			}
+
+			child, err := s.child(n.id, elem)
+			if errors.Is(err, fs.ErrNotExist) {
+				if child, err = s.alloc(true, perm, time.Now(), 0); err != nil {
+					return err
+				}
+				err = s.link(n.id, elem, child.id)
+			}
+			if err != nil {
+				return err
+			}
+			n = child
+		}
+		if !n.dir {
+			return syscall.ENOTDIR
+		}
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *boltFs) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	if p == vfs.root {
+		return &fs.PathError{Op: "remove", Path: p, Err: syscall.EBUSY}
+	}
+	err := vfs.conn.update(func(s store) error {
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		if n.dir && !s.empty(n.id) {
+			return syscall.ENOTEMPTY
+		}
+		if err := s.unlink(n); err != nil {
+			return err
+		}
+		return s.free(n.id)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
+
+// RemoveAll removes the tree in one transaction, the root of the filesystem
+// keeps existing.
+func (vfs *boltFs) RemoveAll(name string) error {
+	if err := vfs.closed("unlinkat", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.update(func(s store) error {
+		n, err := s.lookup(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		if p != vfs.root {
+			if err := s.unlink(n); err != nil {
+				return err
+			}
+			return s.removeAll(n)
+		}
+
+		children, err := s.list(n.id)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := s.unlink(child); err != nil {
+				return err
+			}
+			if err := s.removeAll(child); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "unlinkat", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Rename moves the entry of the file, a directory moves with the tree below
+// it.
+func (vfs *boltFs) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
+
+	po, pn := vfs.abs(oldpath), vfs.abs(newpath)
+	var err error = syscall.EBUSY
+	if po != vfs.root && pn != vfs.root {
+		err = vfs.conn.update(func(s store) error {
+			return s.rename(po, pn)
+		})
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: po, New: pn, Err: err}
+	}
+	return nil
+}
+
+func (vfs *boltFs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	n, err := vfs.lookup(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: p, Err: err}
+	}
+	return n.info(path.Base(p)), nil
+}
+
+// lookup resolves the absolute path p in a read transaction of its own.
+func (vfs *boltFs) lookup(p string) (n *node, err error) {
+	err = vfs.conn.view(func(s store) error {
+		n, err = s.lookup(p)
+		return err
+	})
+	return n, err
+}
+
+// ReadDir lists the directory in a single read transaction.
+func (vfs *boltFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	list, err := vfs.readDir(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: p, Err: err}
+	}
+	return list, nil
+}
+
+func (vfs *boltFs) readDir(p string) ([]fs.DirEntry, error) {
+	var list []fs.DirEntry
+	err := vfs.conn.view(func(s store) error {
+		n, err := s.dir(p)
+		if err != nil {
+			return err
+		}
+		children, err := s.list(n.id)
+		if err != nil {
+			return err
+		}
+
+		list = make([]fs.DirEntry, 0, len(children))
+		for _, child := range children {
+			list = append(list, fs.FileInfoToDirEntry(child.info(child.name)))
+		}
+		return nil
+	})
+	return list, err
+}
+
+// ReadFile reads the chunks of the file in a single read transaction.
+func (vfs *boltFs) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	var data []byte
+	err := vfs.conn.view(func(s store) error {
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		if n.dir {
+			return syscall.EISDIR
+		}
+
+		data = make([]byte, n.size)
+		prefix := itob(n.id)
+		c := s.chunks.Cursor()
+		for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+			if off := decodeID(k[8:]) * uint64(n.chunk); off < uint64(n.size) {
+				copy(data[off:], v)
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: err}
+	}
+	return data, nil
+}
+
+// WriteFile stores the last chunk of data and names its inode in one
+// transaction, the file is never seen empty.
+func (vfs *boltFs) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
+
+	w := newBoltWriter(vfs, name)
+	_, err := w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Chtimes saves the mtime of the inode, its record has no access time.
+func (vfs *boltFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := vfs.closed("chtimes", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.update(func(s store) error {
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		n.mtime = mtime.UnixNano()
+		return s.save(n)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *boltFs) Chmod(name string, mode fs.FileMode) error {
+	if err := vfs.closed("chmod", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.update(func(s store) error {
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		n.mode = mode.Perm()
+		return s.save(n)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Truncate removes the chunks past the size and cuts the last one, a file
+// grows by its size alone as the chunks missing read as zeros.
+func (vfs *boltFs) Truncate(name string, size int64) error {
+	if err := vfs.closed("truncate", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.update(func(s store) error {
+		if size < 0 {
+			return syscall.EINVAL
+		}
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		if n.dir {
+			return syscall.EISDIR
+		}
+
+		if size < n.size {
+			if err := s.truncate(n.id, (size+n.chunk-1)/n.chunk); err != nil {
+				return err
+			}
+			if rest := size % n.chunk; rest != 0 {
+				k := chunkKey(n.id, size/n.chunk)
+				if v := s.chunks.Get(k); int64(len(v)) > rest {
+					if err := s.chunks.Put(k, append([]byte(nil), v[:rest]...)); err != nil {
+						return err
+					}
+				}
+			}
+		}
+		n.size, n.mtime = size, time.Now().UnixNano()
+		return s.save(n)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "truncate", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Compact copies the database to a new file that replaces it, giving the
+// pages the changes freed back to the system. The operations of every
+// filesystem on the file wait for it.
+func (vfs *boltFs) Compact() error {
+	if err := vfs.closed("compact", "/"); err != nil {
+		return err
+	}
+
+	if err := vfs.conn.db.compact(); err != nil {
+		return &fs.PathError{Op: "compact", Path: vfs.conn.db.path, Err: err}
+	}
+	return nil
+}
+
+func (vfs *boltFs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	p := vfs.abs(dir)
+	n, err := vfs.lookup(p)
+	if err == nil && !n.dir {
+		err = syscall.ENOTDIR
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: p, Err: err}
+	}
+
+	return &boltFs{
+		config: vfs.config,
+		root:   p,
+		conn:   vfs.conn,
+	}, nil
+}
+
+func (vfs *boltFs) Exists(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	_, err := vfs.lookup(vfs.abs(name))
+	return err == nil
+}
+
+func (vfs *boltFs) IsFile(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	n, err := vfs.lookup(vfs.abs(name))
+	return err == nil && !n.dir
+}
+
+func (vfs *boltFs) IsDir(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	n, err := vfs.lookup(vfs.abs(name))
+	return err == nil && n.dir
+}
+
+// Close releases the database once the files are closed, the database
+// closes with the last filesystem on it.
+func (vfs *boltFs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.conn.Tracker.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.root, Err: err}
+	}
+	return vfs.conn.db.release()
+}
+
+func (vfs *boltFs) OpenFiles() []string {
+	return vfs.conn.OpenFiles()
+}
+
+// closed fails op on name once the bucket is released, the database may
+// still be open for another filesystem.
+func (vfs *boltFs) closed(op, name string) error {
+	if vfs.conn.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.abs(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// abs returns the absolute path of the name.
+func (vfs *boltFs) abs(name string) string {
+	return path.Join(vfs.root, path.Clean("/"+name))
+}
+
+// view runs fn in a read transaction.
+func (conn *boltConn) view(fn func(s store) error) error {
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+
+	if conn.db.db == nil {
+		return fs.ErrClosed
+	}
+	return conn.db.db.View(func(tx *bbolt.Tx) error {
+		return fn(conn.store(tx))
+	})
+}
+
+// update runs fn in a read-write transaction.
+func (conn *boltConn) update(fn func(s store) error) error {
+	conn.db.mu.RLock()
+	defer conn.db.mu.RUnlock()
+
+	if conn.db.db == nil {
+		return fs.ErrClosed
+	}
+	return conn.db.db.Update(func(tx *bbolt.Tx) error {
+		return fn(conn.store(tx))
+	})
+}
+
+func (conn *boltConn) store(tx *bbolt.Tx) store {
+	top := tx.Bucket(conn.bucket)
+	return store{
+		inodes:  top.Bucket(inodesBucket),
+		entries: top.Bucket(entriesBucket),
+		chunks:  top.Bucket(chunksBucket),
+		pending: top.Bucket(pendingBucket),
+	}
+}
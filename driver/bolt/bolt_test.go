@@ -0,0 +1,330 @@
+package bolt
+
+import (
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.etcd.io/bbolt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// openBolt opens the filesystem of the bucket of the database file, in
+// chunks of chunkSize bytes, the default when zero.
+func openBolt(t *testing.T, file, bucket string, chunkSize int64) *boltFs {
+	t.Helper()
+	vfs, err := New(&Config{File: file, Bucket: bucket, ChunkSize: chunkSize})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = vfs.(*boltFs).Close() })
+	return vfs.(*boltFs)
+}
+
+// newBolt opens the filesystem of the bucket vfs of a new database file.
+func newBolt(t *testing.T, chunkSize int64) *boltFs {
+	return openBolt(t, filepath.Join(t.TempDir(), "vfs.db"), "vfs", chunkSize)
+}
+
+// keys returns the keys of a bucket of the filesystem, in their order.
+func keys(t *testing.T, vfs *boltFs, bucket []byte) [][]byte {
+	t.Helper()
+	var list [][]byte
+	require.NoError(t, vfs.conn.db.db.View(func(tx *bbolt.Tx) error {
+		return tx.Bucket(vfs.conn.bucket).Bucket(bucket).ForEach(func(k, _ []byte) error {
+			list = append(list, append([]byte{}, k...))
+			return nil
+		})
+	}))
+	return list
+}
+
+func TestBoltConformance(t *testing.T) {
+	vfstest.TestDriver(t, "bolt://"+filepath.ToSlash(filepath.Join(t.TempDir(), "vfs.db"))+"?bucket=vfs")
+}
+
+func TestBoltLayout(t *testing.T) {
+	vfs := newBolt(t, 4)
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0700))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c", []byte("0123456789")))
+	assert.Len(t, keys(t, vfs, inodesBucket), 4, "the root, two directories and a file")
+	assert.Len(t, keys(t, vfs, entriesBucket), 3)
+	assert.Len(t, keys(t, vfs, chunksBucket), 3, "the content in chunks")
+	assert.Empty(t, keys(t, vfs, pendingBucket))
+
+	info, err := vfs.Stat("/a")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeDir|0700, info.Mode(), "the mode of MkdirAll")
+
+	f, err := vfs.Open("/a/b/c")
+	require.NoError(t, err)
+	defer f.Close()
+	buf := make([]byte, 5)
+	n, err := f.(io.ReaderAt).ReadAt(buf, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "34567", string(buf[:n]), "a read across chunks")
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	// a rewrite replaces the inode and its chunks
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c", []byte("x")))
+	assert.Len(t, keys(t, vfs, inodesBucket), 4)
+	assert.Len(t, keys(t, vfs, chunksBucket), 1)
+	_, err = f.(io.ReaderAt).ReadAt(buf, 0)
+	assert.ErrorIs(t, err, fs.ErrNotExist, "the file opened on the inode replaced")
+}
+
+func TestBoltSparse(t *testing.T) {
+	vfs := newBolt(t, 4)
+
+	require.NoError(t, filesystem.WriteFile(vfs, "/f", []byte("abcdefghij")))
+	require.NoError(t, filesystem.Truncate(vfs, "/f", 5))
+	assert.Len(t, keys(t, vfs, chunksBucket), 2)
+
+	// growing adds no chunk, the cut chunk reads as zeros past its data
+	require.NoError(t, filesystem.Truncate(vfs, "/f", 1024))
+	assert.Len(t, keys(t, vfs, chunksBucket), 2)
+	data, err := filesystem.ReadFile(vfs, "/f")
+	require.NoError(t, err)
+	assert.Len(t, data, 1024)
+	assert.Equal(t, "abcde\x00\x00\x00", string(data[:8]))
+
+	f, err := vfs.Open("/f")
+	require.NoError(t, err)
+	defer f.Close()
+	streamed, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, streamed)
+}
+
+func TestBoltTree(t *testing.T) {
+	vfs := newBolt(t, 0)
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/a/b/%02d", i), []byte{byte(i)}))
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, filesystem.Chtimes(vfs, "/a/b/00", mtime, mtime))
+
+	// a directory opened lists the snapshot of its first ReadDir
+	d, err := vfs.Open("/a/b")
+	require.NoError(t, err)
+	defer d.Close()
+	first, err := d.(filesystem.ReadDirFile).ReadDir(10)
+	require.NoError(t, err)
+	assert.Equal(t, "00", first[0].Name())
+	require.NoError(t, vfs.Remove("/a/b/99"))
+	rest, err := d.(filesystem.ReadDirFile).ReadDir(-1)
+	require.NoError(t, err)
+	assert.Len(t, rest, 90)
+	assert.Equal(t, "99", rest[89].Name())
+
+	require.NoError(t, vfs.Rename("/a", "/c"))
+	assert.False(t, vfs.Exists("/a"))
+	list, err := filesystem.ReadDir(vfs, "/c/b")
+	require.NoError(t, err)
+	assert.Len(t, list, 99)
+	info, err := vfs.Stat("/c/b/00")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime), "the inodes move with their entries")
+
+	err = vfs.Rename("/c", "/c/b/d")
+	assert.ErrorIs(t, err, syscall.EINVAL, "a directory into itself")
+
+	require.NoError(t, vfs.RemoveAll("/c"))
+	assert.Len(t, keys(t, vfs, inodesBucket), 1, "the root alone")
+	assert.Empty(t, keys(t, vfs, entriesBucket))
+	assert.Empty(t, keys(t, vfs, chunksBucket))
+}
+
+func TestBoltBuckets(t *testing.T) {
+	vfs := newBolt(t, 4)
+
+	require.NoError(t, vfs.MkdirAll("/a", 0700))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/f", []byte("0123456789")))
+	dir, err := vfs.lookup("/a")
+	require.NoError(t, err)
+	f, err := vfs.lookup("/a/f")
+	require.NoError(t, err)
+
+	// the entries sort by directory, the chunks by inode then index
+	assert.Equal(t, [][]byte{itob(rootID), itob(dir.id), itob(f.id)}, keys(t, vfs, inodesBucket))
+	assert.Equal(t, [][]byte{entryKey(rootID, "a"), entryKey(dir.id, "f")}, keys(t, vfs, entriesBucket))
+	assert.Equal(t, [][]byte{chunkKey(f.id, 0), chunkKey(f.id, 1), chunkKey(f.id, 2)}, keys(t, vfs, chunksBucket))
+	assert.Empty(t, keys(t, vfs, pendingBucket))
+
+	// a truncate deletes the chunks past the size, a rewrite the inode
+	// replaced with its chunks
+	require.NoError(t, filesystem.Truncate(vfs, "/a/f", 5))
+	assert.Equal(t, [][]byte{chunkKey(f.id, 0), chunkKey(f.id, 1)}, keys(t, vfs, chunksBucket))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/f", []byte("x")))
+	g, err := vfs.lookup("/a/f")
+	require.NoError(t, err)
+	assert.NotEqual(t, f.id, g.id)
+	assert.Equal(t, [][]byte{itob(rootID), itob(dir.id), itob(g.id)}, keys(t, vfs, inodesBucket))
+	assert.Equal(t, [][]byte{chunkKey(g.id, 0)}, keys(t, vfs, chunksBucket))
+
+	// another bucket is another filesystem in the file
+	other := openBolt(t, vfs.config.File, "other", 0)
+	assert.False(t, other.Exists("/a"))
+	require.NoError(t, filesystem.WriteFile(other, "/a", []byte("a")))
+	assert.True(t, vfs.IsDir("/a"))
+	var top []string
+	require.NoError(t, vfs.conn.db.db.View(func(tx *bbolt.Tx) error {
+		return tx.ForEach(func(name []byte, _ *bbolt.Bucket) error {
+			top = append(top, string(name))
+			return nil
+		})
+	}))
+	assert.Equal(t, []string{"other", "vfs"}, top)
+}
+
+func TestBoltTransactions(t *testing.T) {
+	vfs := newBolt(t, 4)
+
+	// a writer stores a chunk per transaction, the content is named after
+	// the file in the last one
+	w, err := vfs.Create("/f")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("0123456"))
+	require.NoError(t, err)
+	assert.Len(t, keys(t, vfs, chunksBucket), 1)
+	data, err := filesystem.ReadFile(vfs, "/f")
+	require.NoError(t, err)
+	assert.Empty(t, data, "the file created empty until the writer is closed")
+	require.NoError(t, w.Close())
+	data, err = filesystem.ReadFile(vfs, "/f")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456", string(data))
+
+	// a file reads a chunk per transaction, the inode it was opened on
+	f, err := vfs.Open("/f")
+	require.NoError(t, err)
+	defer f.Close()
+	buf := make([]byte, 2)
+	_, err = f.Read(buf)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteFile(vfs, "/f", []byte("replaced")))
+	_, err = f.(io.ReaderAt).ReadAt(buf, 4)
+	assert.ErrorIs(t, err, fs.ErrNotExist, "the chunks of the inode replaced")
+
+	// a directory lists the snapshot of the transaction of its first ReadDir
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	for i := 0; i < 20; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/a/b/%02d", i), []byte{byte(i)}))
+	}
+	d, err := vfs.Open("/a/b")
+	require.NoError(t, err)
+	defer d.Close()
+	first, err := d.(filesystem.ReadDirFile).ReadDir(10)
+	require.NoError(t, err)
+	assert.Equal(t, "00", first[0].Name())
+	require.NoError(t, vfs.Remove("/a/b/19"))
+	rest, err := d.(filesystem.ReadDirFile).ReadDir(-1)
+	require.NoError(t, err)
+	assert.Len(t, rest, 10)
+
+	// a change that fails rolls its transaction back
+	inodes, entries := keys(t, vfs, inodesBucket), keys(t, vfs, entriesBucket)
+	err = vfs.Rename("/a", "/a/b/c")
+	assert.ErrorIs(t, err, syscall.EINVAL, "a directory into itself")
+	assert.Equal(t, inodes, keys(t, vfs, inodesBucket))
+	assert.Equal(t, entries, keys(t, vfs, entriesBucket))
+
+	// a tree is removed in one transaction, inodes and chunks included
+	require.NoError(t, vfs.RemoveAll("/a"))
+	require.NoError(t, vfs.Remove("/f"))
+	assert.Equal(t, [][]byte{itob(rootID)}, keys(t, vfs, inodesBucket))
+	assert.Empty(t, keys(t, vfs, entriesBucket))
+	assert.Empty(t, keys(t, vfs, chunksBucket))
+}
+
+func TestBoltPending(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "vfs.db")
+	v, err := New(&Config{File: file, Bucket: "vfs", ChunkSize: 4})
+	require.NoError(t, err)
+	vfs := v.(*boltFs)
+
+	// a writer keeps its inode pending until it is closed
+	w, err := vfs.Create("/f")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	assert.Len(t, keys(t, vfs, pendingBucket), 1)
+	assert.Len(t, keys(t, vfs, inodesBucket), 3, "the root, the empty file and the one written")
+
+	// a process stopped with the writer open
+	require.NoError(t, vfs.conn.db.release())
+
+	vfs = openBolt(t, file, "vfs", 4)
+	assert.Empty(t, keys(t, vfs, pendingBucket))
+	assert.Len(t, keys(t, vfs, inodesBucket), 2)
+	assert.Empty(t, keys(t, vfs, chunksBucket))
+	data, err := filesystem.ReadFile(vfs, "/f")
+	require.NoError(t, err)
+	assert.Empty(t, data, "the file created empty")
+
+	// while a filesystem has the file open, the pending inodes are its own
+	w, err = vfs.Create("/g")
+	require.NoError(t, err)
+	_, err = w.Write([]byte("0123456789"))
+	require.NoError(t, err)
+	openBolt(t, file, "vfs", 4)
+	assert.Len(t, keys(t, vfs, pendingBucket), 1)
+	require.NoError(t, w.Close())
+	assert.Empty(t, keys(t, vfs, pendingBucket))
+}
+
+func TestBoltCompact(t *testing.T) {
+	vfs := newBolt(t, 0)
+	other := openBolt(t, vfs.config.File, "vfs", 0)
+
+	for i := 0; i < 16; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/%d", i), make([]byte, 256<<10)))
+	}
+	for i := 1; i < 16; i++ {
+		require.NoError(t, vfs.Remove(fmt.Sprintf("/%d", i)))
+	}
+
+	file := vfs.config.File
+	before, err := os.Stat(file)
+	require.NoError(t, err)
+	require.NoError(t, vfs.Compact())
+	after, err := os.Stat(file)
+	require.NoError(t, err)
+	assert.Less(t, after.Size(), before.Size())
+	_, err = os.Stat(file + ".compact")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	// the filesystems on the file go on, the inode ids kept by the copy
+	data, err := filesystem.ReadFile(other, "/0")
+	require.NoError(t, err)
+	assert.Len(t, data, 256<<10)
+	require.NoError(t, filesystem.WriteFile(other, "/1", []byte("1")))
+	assert.Len(t, keys(t, vfs, inodesBucket), 3)
+	assert.True(t, vfs.IsFile("/1"))
+
+	require.NoError(t, vfs.Close())
+	assert.ErrorIs(t, vfs.Compact(), fs.ErrClosed)
+}
+
+func TestBoltOpen(t *testing.T) {
+	_, err := filesystem.Open("bolt://")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+	_, err = filesystem.Open("bolt://" + filepath.ToSlash(t.TempDir()))
+	assert.Error(t, err, "a directory")
+
+	vfs, err := filesystem.Open("bolt://" + filepath.ToSlash(filepath.Join(t.TempDir(), "vfs.db")) + "?bucket=vfs&timeout=5s")
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+	assert.Equal(t, 5*time.Second, vfs.(*boltFs).config.Timeout)
+	assert.Equal(t, "bucket=vfs&chunksize=262144&timeout=5s", vfs.(*boltFs).config.Encode().Encode())
+}
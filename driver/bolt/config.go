@@ -0,0 +1,67 @@
+package bolt
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	filesystem.Config
+
+	// File is the path of the database file, created when missing.
+	File string
+
+	// Bucket is the top-level bucket the filesystem keeps its buckets in,
+	// "vfs" by default, so that several filesystems share a file.
+	Bucket string
+
+	// ChunkSize is the size of the values the content of the files is
+	// stored in, 256 KiB by default.
+	ChunkSize int64
+
+	// Timeout bounds the wait for the lock of a file another process has
+	// open, 1s by default.
+	Timeout time.Duration
+}
+
+func (conf *Config) Driver() string {
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	return ""
+}
+
+func (conf *Config) Path() string {
+	return conf.File
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	return nil
+}
+
+// Encode bucket, chunksize and timeout
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if conf.Bucket != "" {
+		values.Set("bucket", conf.Bucket)
+	}
+	if conf.ChunkSize != 0 {
+		values.Set("chunksize", strconv.FormatInt(conf.ChunkSize, 10))
+	}
+	if conf.Timeout != 0 {
+		values.Set("timeout", conf.Timeout.String())
+	}
+	return values
+}
+
+// Decode bucket, chunksize and timeout, a missing one is zero
+func (conf *Config) Decode(query url.Values) error {
+	conf.Bucket = query.Get("bucket")
+	conf.ChunkSize, _ = strconv.ParseInt(query.Get("chunksize"), 10, 64)
+	conf.Timeout, _ = time.ParseDuration(query.Get("timeout"))
+
+	return nil
+}
@@ -0,0 +1,24 @@
+package bolt
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+)
+
+const Driver = "bolt"
+
+func init() {
+	filesystem.RegisterDriver(Driver, &boltDriver{})
+}
+
+type boltDriver struct {
+}
+
+// Open opens bolt:///var/lib/vfs.db?bucket=app, the path is the database
+// file.
+func (d *boltDriver) Open(uri *url.URL) (filesystem.FileSystem, error) {
+	conf := &Config{File: uri.Path}
+	_ = conf.Decode(uri.Query())
+
+	return New(conf)
+}
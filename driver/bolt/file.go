@@ -0,0 +1,250 @@
+package bolt
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/internal/chunked"
+	"io"
+	"io/fs"
+	"path"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | fi.mode
+	}
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// boltFile reads the inode it was opened on a chunk at a time, a read
+// transaction per chunk. Once the file is replaced, the chunks not read yet
+// fail with fs.ErrNotExist.
+type boltFile struct {
+	chunked.Reader
+
+	vfs  *boltFs
+	node *node
+	info *fileInfo
+}
+
+// Chunk gets the chunk at index i, a missing key is a hole unless the inode
+// is gone.
+func (f *boltFile) Chunk(i int64) ([]byte, error) {
+	var chunk []byte
+	err := f.vfs.conn.view(func(s store) error {
+		if _, err := s.node(f.node.id); err != nil {
+			return err
+		}
+		// the value lives as long as the transaction
+		chunk = append([]byte{}, s.chunks.Get(chunkKey(f.node.id, i))...)
+		return nil
+	})
+	return chunk, err
+}
+
+func (f *boltFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// boltWriter streams the content written to it to an inode without a name,
+// a chunk per transaction, and names it after the file once it is closed.
+// The inode is pending until then, removed when the database is opened
+// again after a process stopped with the file open.
+type boltWriter struct {
+	chunked.Writer
+
+	vfs  *boltFs
+	name string
+
+	// id is the inode written, zero until the first chunk.
+	id uint64
+}
+
+func newBoltWriter(vfs *boltFs, name string) *boltWriter {
+	w := &boltWriter{vfs: vfs, name: name}
+	w.Writer = chunked.Writer{Sink: w, ChunkSize: int(vfs.config.ChunkSize), Path: vfs.abs(name)}
+	return w
+}
+
+// alloc inserts the inode written, once, in s.
+func (w *boltWriter) alloc(s store) error {
+	if w.id != 0 {
+		return nil
+	}
+	n, err := s.alloc(false, 0644, time.Now(), w.vfs.config.ChunkSize)
+	if err != nil {
+		return err
+	}
+	if err := s.pending.Put(itob(n.id), []byte{}); err != nil {
+		return err
+	}
+	w.id = n.id
+	return nil
+}
+
+// Flush puts the chunk at index i in a transaction of its own.
+func (w *boltWriter) Flush(i int64, chunk []byte) error {
+	id := w.id
+	err := w.vfs.conn.update(func(s store) error {
+		if err := w.alloc(s); err != nil {
+			return err
+		}
+		return s.chunks.Put(chunkKey(w.id, i), chunk)
+	})
+	if err != nil {
+		// the inode of a failed transaction does not exist
+		w.id = id
+	}
+	return err
+}
+
+// Commit puts the last chunk and names the inode after the file in one
+// transaction, the inode is no longer pending.
+func (w *boltWriter) Commit(i int64, last []byte, size int64) error {
+	id := w.id
+	err := w.vfs.conn.update(func(s store) error {
+		if err := w.alloc(s); err != nil {
+			return err
+		}
+		if len(last) > 0 {
+			if err := s.chunks.Put(chunkKey(w.id, i), last); err != nil {
+				return err
+			}
+		}
+
+		n, err := s.node(w.id)
+		if err != nil {
+			return err
+		}
+		n.size, n.mtime = size, time.Now().UnixNano()
+		if err := s.save(n); err != nil {
+			return err
+		}
+		if err := s.put(w.vfs.abs(w.name), n); err != nil {
+			return err
+		}
+		return s.pending.Delete(itob(w.id))
+	})
+	if err != nil {
+		w.id = id
+	}
+	return err
+}
+
+// Abort frees the pending inode written and its chunks.
+func (w *boltWriter) Abort() {
+	if w.id == 0 {
+		return
+	}
+	_ = w.vfs.conn.update(func(s store) error {
+		if err := s.free(w.id); err != nil {
+			return err
+		}
+		return s.pending.Delete(itob(w.id))
+	})
+}
+
+func (w *boltWriter) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: path.Base(w.vfs.abs(w.name)), size: w.Size(), mode: 0644, modTime: time.Now()}, nil
+}
+
+// boltDir lists a directory on its first ReadDir, in a read transaction.
+type boltDir struct {
+	filesystem.Handle
+
+	vfs  *boltFs
+	name string
+	info *fileInfo
+
+	list []fs.DirEntry
+	read bool
+	off  int
+}
+
+func (d *boltDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: fs.ErrClosed}
+	}
+	if !d.read {
+		list, err := d.vfs.readDir(d.vfs.abs(d.name))
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: err}
+		}
+		d.list, d.read = list, true
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *boltDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *boltDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *boltDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *boltDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.abs(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*boltDir)(nil)
+	_ io.ReaderAt            = (*boltFile)(nil)
+	_ io.Seeker              = (*boltFile)(nil)
+	_ chunked.Sink           = (*boltWriter)(nil)
+)
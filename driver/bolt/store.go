@@ -0,0 +1,333 @@
+package bolt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"go.etcd.io/bbolt"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// The buckets of a filesystem, in its top-level bucket.
+var (
+	inodesBucket  = []byte("inodes")
+	entriesBucket = []byte("entries")
+	chunksBucket  = []byte("chunks")
+	pendingBucket = []byte("pending")
+)
+
+// store is the buckets of a filesystem in a transaction: the inodes by id,
+// the entries by the id of their directory and their name, the chunks by
+// the id of their inode and their index, and the inodes being written.
+type store struct {
+	inodes  *bbolt.Bucket
+	entries *bbolt.Bucket
+	chunks  *bbolt.Bucket
+	pending *bbolt.Bucket
+}
+
+// itob encodes the integer of a key, big endian so that keys sort by it.
+func itob(v uint64) []byte {
+	b := make([]byte, 8)
+	binary.BigEndian.PutUint64(b, v)
+	return b
+}
+
+// decodeID decodes the integer of a key.
+func decodeID(b []byte) uint64 {
+	return binary.BigEndian.Uint64(b)
+}
+
+func entryKey(parent uint64, name string) []byte {
+	return append(itob(parent), name...)
+}
+
+func chunkKey(id uint64, idx int64) []byte {
+	return append(itob(id), itob(uint64(idx))...)
+}
+
+// node is an inode, and the entry it was found by.
+type node struct {
+	id    uint64
+	dir   bool
+	mode  fs.FileMode
+	size  int64
+	mtime int64
+
+	// chunk is the size of the chunks of the content, zero for a
+	// directory.
+	chunk int64
+
+	parent uint64
+	name   string
+}
+
+// nodeSize is the size of an encoded inode.
+const nodeSize = 1 + 4 + 8 + 8 + 8
+
+func (n *node) encode() []byte {
+	b := make([]byte, nodeSize)
+	if n.dir {
+		b[0] = 1
+	}
+	binary.BigEndian.PutUint32(b[1:], uint32(n.mode.Perm()))
+	binary.BigEndian.PutUint64(b[5:], uint64(n.size))
+	binary.BigEndian.PutUint64(b[13:], uint64(n.mtime))
+	binary.BigEndian.PutUint64(b[21:], uint64(n.chunk))
+	return b
+}
+
+func decode(id uint64, b []byte) (*node, error) {
+	if len(b) != nodeSize {
+		return nil, errors.New("corrupt inode")
+	}
+	return &node{
+		id:    id,
+		dir:   b[0] == 1,
+		mode:  fs.FileMode(binary.BigEndian.Uint32(b[1:])),
+		size:  int64(binary.BigEndian.Uint64(b[5:])),
+		mtime: int64(binary.BigEndian.Uint64(b[13:])),
+		chunk: int64(binary.BigEndian.Uint64(b[21:])),
+	}, nil
+}
+
+func (n *node) info(name string) *fileInfo {
+	return &fileInfo{
+		name:    name,
+		size:    n.size,
+		mode:    n.mode,
+		modTime: time.Unix(0, n.mtime),
+		dir:     n.dir,
+	}
+}
+
+// node returns the inode id.
+func (s store) node(id uint64) (*node, error) {
+	b := s.inodes.Get(itob(id))
+	if b == nil {
+		return nil, fs.ErrNotExist
+	}
+	return decode(id, b)
+}
+
+// save writes the inode.
+func (s store) save(n *node) error {
+	return s.inodes.Put(itob(n.id), n.encode())
+}
+
+// child returns the inode named name in the directory parent.
+func (s store) child(parent uint64, name string) (*node, error) {
+	v := s.entries.Get(entryKey(parent, name))
+	if v == nil {
+		return nil, fs.ErrNotExist
+	}
+	n, err := s.node(binary.BigEndian.Uint64(v))
+	if err != nil {
+		return nil, err
+	}
+	n.parent, n.name = parent, name
+	return n, nil
+}
+
+// lookup resolves the absolute path p an entry at a time.
+func (s store) lookup(p string) (*node, error) {
+	n, err := s.node(rootID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range split(p) {
+		if !n.dir {
+			return nil, syscall.ENOTDIR
+		}
+		if n, err = s.child(n.id, name); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// dir resolves the absolute path p of a directory.
+func (s store) dir(p string) (*node, error) {
+	n, err := s.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, syscall.ENOTDIR
+	}
+	return n, nil
+}
+
+// list returns the names and inodes of the entries of the directory id,
+// sorted by name.
+func (s store) list(id uint64) ([]*node, error) {
+	var list []*node
+	prefix := itob(id)
+	c := s.entries.Cursor()
+	for k, v := c.Seek(prefix); k != nil && bytes.HasPrefix(k, prefix); k, v = c.Next() {
+		n, err := s.node(binary.BigEndian.Uint64(v))
+		if err != nil {
+			return nil, err
+		}
+		n.parent, n.name = id, string(k[len(prefix):])
+		list = append(list, n)
+	}
+	return list, nil
+}
+
+// empty reports whether the directory id has no entries.
+func (s store) empty(id uint64) bool {
+	prefix := itob(id)
+	k, _ := s.entries.Cursor().Seek(prefix)
+	return k == nil || !bytes.HasPrefix(k, prefix)
+}
+
+// alloc inserts an inode without a name, the chunks of a file are chunk
+// bytes long.
+func (s store) alloc(dir bool, perm fs.FileMode, mtime time.Time, chunk int64) (*node, error) {
+	id, err := s.inodes.NextSequence()
+	if err != nil {
+		return nil, err
+	}
+	n := &node{id: id, dir: dir, mode: perm.Perm(), mtime: mtime.UnixNano(), chunk: chunk}
+	return n, s.save(n)
+}
+
+// link names the inode id in the directory parent.
+func (s store) link(parent uint64, name string, id uint64) error {
+	return s.entries.Put(entryKey(parent, name), itob(id))
+}
+
+// unlink removes the entry of the inode.
+func (s store) unlink(n *node) error {
+	return s.entries.Delete(entryKey(n.parent, n.name))
+}
+
+// free removes the inode id and its chunks, its entry is removed already.
+func (s store) free(id uint64) error {
+	if err := s.truncate(id, 0); err != nil {
+		return err
+	}
+	return s.inodes.Delete(itob(id))
+}
+
+// truncate removes the chunks of the inode id from the index idx.
+func (s store) truncate(id uint64, idx int64) error {
+	var keys [][]byte
+	prefix := itob(id)
+	c := s.chunks.Cursor()
+	for k, _ := c.Seek(chunkKey(id, idx)); k != nil && bytes.HasPrefix(k, prefix); k, _ = c.Next() {
+		keys = append(keys, k)
+	}
+	for _, k := range keys {
+		if err := s.chunks.Delete(k); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeAll removes the inode and the tree below it.
+func (s store) removeAll(n *node) error {
+	if n.dir {
+		children, err := s.list(n.id)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			if err := s.removeAll(child); err != nil {
+				return err
+			}
+			if err := s.unlink(child); err != nil {
+				return err
+			}
+		}
+	}
+	return s.free(n.id)
+}
+
+// put names the file inode id p, replacing the file named p and keeping its
+// mode.
+func (s store) put(p string, n *node) error {
+	if p == "/" {
+		return syscall.EISDIR
+	}
+	parent, err := s.dir(path.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	old, err := s.child(parent.id, path.Base(p))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return s.link(parent.id, path.Base(p), n.id)
+	case err != nil:
+		return err
+	case old.dir:
+		return syscall.EISDIR
+	}
+
+	n.mode = old.mode
+	if err := s.save(n); err != nil {
+		return err
+	}
+	if err := s.link(parent.id, path.Base(p), n.id); err != nil {
+		return err
+	}
+	return s.free(old.id)
+}
+
+// rename moves the entry of the absolute path po to pn, replacing a file or
+// an empty directory.
+func (s store) rename(po, pn string) error {
+	src, err := s.lookup(po)
+	if err != nil {
+		return err
+	}
+	if po == pn {
+		return nil
+	}
+	if src.dir && strings.HasPrefix(pn+"/", po+"/") {
+		return syscall.EINVAL
+	}
+	parent, err := s.dir(path.Dir(pn))
+	if err != nil {
+		return err
+	}
+
+	dst, err := s.child(parent.id, path.Base(pn))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		dst = nil
+	case err != nil:
+		return err
+	case dst.dir && !src.dir:
+		return syscall.EISDIR
+	case !dst.dir && src.dir:
+		return syscall.ENOTDIR
+	case dst.dir && !s.empty(dst.id):
+		return syscall.ENOTEMPTY
+	}
+
+	if dst != nil {
+		if err := s.free(dst.id); err != nil {
+			return err
+		}
+	}
+	if err := s.unlink(src); err != nil {
+		return err
+	}
+	return s.link(parent.id, path.Base(pn), src.id)
+}
+
+// split returns the names of the absolute path p.
+func split(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
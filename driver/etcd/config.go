@@ -0,0 +1,120 @@
+package etcd
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Config struct {
+	filesystem.Config
+
+	// Endpoints are the hosts of the cluster members, and their ports, 2379
+	// when they have none.
+	Endpoints []string
+
+	// Prefix is the key prefix the filesystem is rooted at, the whole key
+	// space when empty.
+	Prefix string
+
+	User     string
+	Password string
+
+	// TLS talks to the cluster over TLS, verified against the system roots
+	// or CAFile.
+	TLS bool
+
+	// CAFile is the path of the certificates the cluster is verified
+	// against.
+	CAFile string
+
+	// CertFile and KeyFile are the paths of a client certificate and its
+	// key.
+	CertFile string
+	KeyFile  string
+
+	// Insecure accepts any certificate.
+	Insecure bool
+
+	// Timeout bounds the time to connect and the time of every request, 5s
+	// by default.
+	Timeout time.Duration
+
+	// MaxSize is the size of the largest request the cluster accepts, its
+	// --max-request-bytes, 1.5 MiB by default. A file whose content and keys
+	// do not fit in a request is rejected.
+	MaxSize int64
+}
+
+func (conf *Config) Driver() string {
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	if len(conf.Endpoints) == 0 {
+		return ""
+	}
+	return conf.Endpoints[0]
+}
+
+func (conf *Config) Path() string {
+	return conf.Prefix
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if conf.User == "" {
+		return nil
+	}
+	return url.UserPassword(conf.User, conf.Password)
+}
+
+// Encode the options, the endpoints past the first one in endpoints
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if len(conf.Endpoints) > 1 {
+		values.Set("endpoints", strings.Join(conf.Endpoints[1:], ","))
+	}
+	if conf.TLS {
+		values.Set("tls", "true")
+	}
+	if conf.CAFile != "" {
+		values.Set("ca", conf.CAFile)
+	}
+	if conf.CertFile != "" {
+		values.Set("cert", conf.CertFile)
+	}
+	if conf.KeyFile != "" {
+		values.Set("key", conf.KeyFile)
+	}
+	if conf.Insecure {
+		values.Set("insecure", "true")
+	}
+	if conf.Timeout != 0 {
+		values.Set("timeout", conf.Timeout.String())
+	}
+	if conf.MaxSize != 0 {
+		values.Set("maxsize", strconv.FormatInt(conf.MaxSize, 10))
+	}
+	return values
+}
+
+// Decode the url.Values to options, the endpoints of the query come after
+// the ones already set.
+func (conf *Config) Decode(query url.Values) error {
+	for _, endpoint := range strings.Split(query.Get("endpoints"), ",") {
+		if endpoint != "" {
+			conf.Endpoints = append(conf.Endpoints, endpoint)
+		}
+	}
+	conf.TLS, _ = strconv.ParseBool(query.Get("tls"))
+	conf.CAFile = query.Get("ca")
+	conf.CertFile = query.Get("cert")
+	conf.KeyFile = query.Get("key")
+	conf.Insecure, _ = strconv.ParseBool(query.Get("insecure"))
+	conf.Timeout, _ = time.ParseDuration(query.Get("timeout"))
+	conf.MaxSize, _ = strconv.ParseInt(query.Get("maxsize"), 10, 64)
+
+	return nil
+}
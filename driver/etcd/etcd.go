@@ -0,0 +1,989 @@
+// Package etcd implements filesystem.FileSystem on the keys of an etcd
+// cluster below a prefix, for small trees such as configuration.
+//
+// A file is a key holding its content, so any etcd client reads it. A
+// directory is the prefix of the keys below it; Mkdir writes a marker, an
+// empty key named after the directory with a trailing slash, so that the
+// directory exists while it is empty. The modification times are kept in
+// keys of their own, beside the prefix rather than below it.
+//
+// Every change is a transaction guarded by the revisions of the keys it
+// read, retried when another client changed them in between. Rename moves a
+// file or a whole directory in one transaction, so a directory renamed must
+// fit in one: the cluster takes --max-txn-ops operations (128), two for
+// every key moved.
+package etcd
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	"go.etcd.io/etcd/api/v3/v3rpc/rpctypes"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.uber.org/zap"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultPort    = "2379"
+	defaultTimeout = 5 * time.Second
+
+	// defaultMaxSize is the default --max-request-bytes of etcd.
+	defaultMaxSize = 1536 << 10
+
+	// clientMaxSize is the size of the largest request the client sends by
+	// default.
+	clientMaxSize = 2 << 20
+
+	// requestOverhead is the room a transaction writing a file takes in a
+	// request besides the keys and the content.
+	requestOverhead = 512
+
+	// retries is the number of times a change is tried again when the keys
+	// it read changed before it committed.
+	retries = 16
+)
+
+// epoch is the modification time of the keys written by other clients, which
+// have none.
+var epoch = time.Unix(0, 0).UTC()
+
+type etcdFs struct {
+	config *Config
+
+	// root is the prefix of the keys of the filesystem, ending with a slash.
+	root string
+
+	// conn is the cluster client the Sub views share, only the owner closes
+	// it and cancels their requests.
+	conn  *etcdConn
+	owner bool
+}
+
+// etcdConn is the client of the cluster and the files open on it.
+type etcdConn struct {
+	filesystem.Tracker
+
+	client  *clientv3.Client
+	timeout time.Duration
+
+	// base is the root of the filesystem New returned without its trailing
+	// slash, the modification times are kept below base+"\x00".
+	base string
+
+	// ctx is canceled once the filesystem is closed, ending its requests
+	// and watches.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if len(config.Endpoints) == 0 {
+		return nil, fs.ErrInvalid
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+	if config.MaxSize == 0 {
+		config.MaxSize = defaultMaxSize
+	}
+
+	tlsConfig, err := config.tlsConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	endpoints := make([]string, len(config.Endpoints))
+	for i, endpoint := range config.Endpoints {
+		if _, _, err := net.SplitHostPort(endpoint); err != nil {
+			endpoint = net.JoinHostPort(strings.Trim(endpoint, "[]"), defaultPort)
+		}
+		endpoints[i] = endpoint
+	}
+
+	// the cluster, rather than the client, rejects a request too large
+	sendSize := clientMaxSize
+	if int(config.MaxSize)+requestOverhead > sendSize {
+		sendSize = int(config.MaxSize) + requestOverhead
+	}
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:          endpoints,
+		DialTimeout:        config.Timeout,
+		Username:           config.User,
+		Password:           config.Password,
+		TLS:                tlsConfig,
+		MaxCallSendMsgSize: sendSize,
+		Logger:             zap.NewNop(),
+	})
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	root := path.Clean("/" + config.Prefix)
+	conn := &etcdConn{client: client, timeout: config.Timeout, base: strings.TrimSuffix(root, "/")}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+
+	return &etcdFs{
+		config: config,
+		root:   conn.base + "/",
+		conn:   conn,
+		owner:  true,
+	}, nil
+}
+
+// tlsConfig returns the TLS configuration, nil without TLS.
+func (conf *Config) tlsConfig() (*tls.Config, error) {
+	if !conf.TLS && conf.CAFile == "" && conf.CertFile == "" {
+		return nil, nil
+	}
+
+	config := &tls.Config{InsecureSkipVerify: conf.Insecure}
+	if conf.CAFile != "" {
+		pem, err := os.ReadFile(conf.CAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.RootCAs = x509.NewCertPool()
+		if !config.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, errors.New("no certificate in " + conf.CAFile)
+		}
+	}
+	if conf.CertFile != "" {
+		cert, err := tls.LoadX509KeyPair(conf.CertFile, conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+// node is what the keys of a name tell about it, read at one revision.
+type node struct {
+	// file is the key of the file, nil when the name is no file.
+	file *mvccpb.KeyValue
+
+	// below are the keys below the name in order, the marker of a
+	// directory first.
+	below []*mvccpb.KeyValue
+
+	// times are the modification times of the keys that have one.
+	times map[string]time.Time
+
+	root bool
+	rev  int64
+}
+
+func (n *node) exists() bool {
+	return n.root || n.file != nil || len(n.below) > 0
+}
+
+func (n *node) dir() bool {
+	return n.file == nil && (n.root || len(n.below) > 0)
+}
+
+// lookup reads the keys of the name: the file, and the marker and one key
+// below it, or every key below it with their content when all is set.
+func (vfs *etcdFs) lookup(name string, all bool) (*node, error) {
+	p := rel(name)
+	key, prefix := vfs.key(p), vfs.prefix(p)
+
+	below := []clientv3.OpOption{clientv3.WithPrefix()}
+	times := []clientv3.OpOption{clientv3.WithPrefix()}
+	if !all {
+		below = append(below, clientv3.WithKeysOnly(), clientv3.WithLimit(2))
+		times = nil
+	}
+	ops := []clientv3.Op{
+		clientv3.OpGet(prefix, below...),
+		clientv3.OpGet(vfs.conn.meta(prefix), times...),
+	}
+	if p != "" {
+		ops = append(ops, clientv3.OpGet(key), clientv3.OpGet(vfs.conn.meta(key)))
+	}
+
+	ctx, cancel := vfs.conn.context()
+	defer cancel()
+	resp, err := vfs.conn.client.Txn(ctx).Then(ops...).Commit()
+	if err != nil {
+		return nil, errno(err)
+	}
+
+	n := &node{root: p == "", times: make(map[string]time.Time), rev: resp.Header.Revision}
+	for i, r := range resp.Responses {
+		kvs := r.GetResponseRange().Kvs
+		switch {
+		case i == 0:
+			n.below = kvs
+		case i == 2 && len(kvs) > 0:
+			n.file = kvs[0]
+		case i%2 == 1:
+			for _, kv := range kvs {
+				n.times[vfs.conn.unmeta(string(kv.Key))] = parseTime(kv.Value)
+			}
+		}
+	}
+	return n, nil
+}
+
+// empty reports whether the directory holds nothing but its marker.
+func (n *node) empty(prefix string) bool {
+	for _, kv := range n.below {
+		if string(kv.Key) != prefix {
+			return false
+		}
+	}
+	return true
+}
+
+// info describes the name from its keys.
+func (vfs *etcdFs) info(name string, n *node) *fileInfo {
+	p := rel(name)
+	if p == "" {
+		return &fileInfo{name: path.Base(vfs.path("/")), dir: true, modTime: n.time(vfs.root)}
+	}
+	if n.file != nil {
+		return &fileInfo{name: path.Base(p), size: int64(len(n.file.Value)), modTime: n.time(vfs.key(p))}
+	}
+	return &fileInfo{name: path.Base(p), dir: true, modTime: n.time(vfs.prefix(p))}
+}
+
+// time returns the modification time of the key.
+func (n *node) time(key string) time.Time {
+	if t, ok := n.times[key]; ok {
+		return t
+	}
+	return epoch
+}
+
+func (vfs *etcdFs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	n, err := vfs.lookup(name, false)
+	if err == nil && !n.exists() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+
+	if n.dir() {
+		d := &etcdDir{vfs: vfs, name: name, info: vfs.info(name, n)}
+		if err := d.Track(&vfs.conn.Tracker, vfs.path(name), d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	f := &etcdFile{vfs: vfs, name: name, info: vfs.info(name, n), data: n.file.Value}
+	if err := f.Track(&vfs.conn.Tracker, vfs.path(name), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create writes an empty file, the content written to the file replaces it
+// once the file is closed.
+func (vfs *etcdFs) Create(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	key, err := vfs.writable(name)
+	if err == nil {
+		err = vfs.put(key, nil)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+
+	w := &etcdWriter{vfs: vfs, name: name, key: key}
+	if err := w.Track(&vfs.conn.Tracker, vfs.path(name), w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (vfs *etcdFs) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	err := retry(func() (bool, error) {
+		return vfs.mkdir(name)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+func (vfs *etcdFs) mkdir(name string) (bool, error) {
+	p := rel(name)
+	if p == "" {
+		return false, fs.ErrExist
+	}
+	if err := vfs.parent(p); err != nil {
+		return false, err
+	}
+
+	n, err := vfs.lookup(p, false)
+	if err != nil {
+		return false, err
+	}
+	if n.exists() {
+		return false, fs.ErrExist
+	}
+
+	key, prefix := vfs.key(p), vfs.prefix(p)
+	return vfs.commit(
+		[]clientv3.Cmp{absent(key), absentBelow(prefix)},
+		vfs.conn.write(prefix, nil, time.Now())...,
+	)
+}
+
+// MkdirAll writes the markers of the missing directories of the path in one
+// transaction.
+func (vfs *etcdFs) MkdirAll(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	err := retry(func() (bool, error) {
+		return vfs.mkdirAll(name)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+func (vfs *etcdFs) mkdirAll(name string) (bool, error) {
+	p := rel(name)
+	if p == "" {
+		return true, nil
+	}
+
+	var cmps []clientv3.Cmp
+	var ops []clientv3.Op
+	now := time.Now()
+	elems := strings.Split(p, "/")
+	for i := range elems {
+		dir := strings.Join(elems[:i+1], "/")
+
+		n, err := vfs.lookup(dir, false)
+		switch {
+		case err != nil:
+			return false, err
+		case n.file != nil:
+			return false, syscall.ENOTDIR
+		case n.exists():
+			continue
+		}
+
+		// the rest of the path is missing as well
+		for j := i; j < len(elems); j++ {
+			dir := strings.Join(elems[:j+1], "/")
+			cmps = append(cmps, absent(vfs.key(dir)))
+			ops = append(ops, vfs.conn.write(vfs.prefix(dir), nil, now)...)
+		}
+		cmps = append(cmps, absentBelow(vfs.prefix(dir)))
+		break
+	}
+	if len(ops) == 0 {
+		return true, nil
+	}
+	return vfs.commit(cmps, ops...)
+}
+
+func (vfs *etcdFs) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
+
+	err := retry(func() (bool, error) {
+		return vfs.remove(name)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+func (vfs *etcdFs) remove(name string) (bool, error) {
+	p := rel(name)
+	if p == "" {
+		return false, syscall.EBUSY
+	}
+
+	n, err := vfs.lookup(p, false)
+	switch {
+	case err != nil:
+		return false, err
+	case !n.exists():
+		return false, fs.ErrNotExist
+	case n.file != nil:
+		key := vfs.key(p)
+		return vfs.commit(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", n.file.ModRevision)},
+			clientv3.OpDelete(key), clientv3.OpDelete(vfs.conn.meta(key)),
+		)
+	}
+
+	prefix := vfs.prefix(p)
+	if !n.empty(prefix) {
+		return false, syscall.ENOTEMPTY
+	}
+	return vfs.commit(
+		[]clientv3.Cmp{clientv3.Compare(clientv3.Version(prefix+"\x00"), "=", 0).WithRange(clientv3.GetPrefixRangeEnd(prefix))},
+		clientv3.OpDelete(prefix), clientv3.OpDelete(vfs.conn.meta(prefix)),
+	)
+}
+
+// RemoveAll deletes the key of the name and every key below it in one
+// transaction.
+func (vfs *etcdFs) RemoveAll(name string) error {
+	if err := vfs.closed("unlinkat", name); err != nil {
+		return err
+	}
+
+	p := rel(name)
+	prefix := vfs.prefix(p)
+	ops := []clientv3.Op{
+		clientv3.OpDelete(prefix, clientv3.WithPrefix()),
+		clientv3.OpDelete(vfs.conn.meta(prefix), clientv3.WithPrefix()),
+	}
+	if p != "" {
+		ops = append(ops, clientv3.OpDelete(vfs.key(p)), clientv3.OpDelete(vfs.conn.meta(vfs.key(p))))
+	}
+
+	if _, err := vfs.commit(nil, ops...); err != nil {
+		return &fs.PathError{Op: "unlinkat", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+// Rename moves the file, or every key below the directory, in one
+// transaction.
+func (vfs *etcdFs) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
+
+	err := retry(func() (bool, error) {
+		return vfs.rename(oldpath, newpath)
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: vfs.path(oldpath), New: vfs.path(newpath), Err: err}
+	}
+	return nil
+}
+
+func (vfs *etcdFs) rename(oldpath, newpath string) (bool, error) {
+	po, pn := rel(oldpath), rel(newpath)
+	if po == "" || pn == "" {
+		return false, syscall.EBUSY
+	}
+
+	src, err := vfs.lookup(po, true)
+	if err != nil {
+		return false, err
+	}
+	if !src.exists() {
+		return false, fs.ErrNotExist
+	}
+	if po == pn {
+		return true, nil
+	}
+	if err := vfs.parent(pn); err != nil {
+		return false, err
+	}
+
+	dst, err := vfs.lookup(pn, false)
+	if err != nil {
+		return false, err
+	}
+	oldKey, newKey := vfs.key(po), vfs.key(pn)
+	oldPrefix, newPrefix := vfs.prefix(po), vfs.prefix(pn)
+	switch {
+	case dst.file != nil && src.dir():
+		return false, syscall.ENOTDIR
+	case dst.dir() && src.file != nil:
+		return false, syscall.EISDIR
+	case dst.dir() && !dst.empty(newPrefix):
+		return false, syscall.ENOTEMPTY
+	case src.dir() && strings.HasPrefix(pn+"/", po+"/"):
+		return false, syscall.EINVAL
+	}
+
+	cmps := []clientv3.Cmp{
+		clientv3.Compare(clientv3.ModRevision(newKey), "<", dst.rev+1),
+		clientv3.Compare(clientv3.ModRevision(newPrefix).WithPrefix(), "<", dst.rev+1),
+	}
+
+	// a transaction must not delete a key it puts
+	var ops []clientv3.Op
+	put := make(map[string]bool)
+	move := func(from, to string, value []byte) {
+		ops = append(ops, clientv3.OpPut(to, string(value)))
+		put[to] = true
+		if t, ok := src.times[from]; ok {
+			ops = append(ops, clientv3.OpPut(vfs.conn.meta(to), formatTime(t)))
+			put[vfs.conn.meta(to)] = true
+		}
+	}
+
+	if src.file != nil {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(oldKey), "=", src.file.ModRevision))
+		ops = append(ops, clientv3.OpDelete(oldKey), clientv3.OpDelete(vfs.conn.meta(oldKey)))
+		move(oldKey, newKey, src.file.Value)
+	} else {
+		cmps = append(cmps, clientv3.Compare(clientv3.ModRevision(oldPrefix).WithPrefix(), "<", src.rev+1))
+		ops = append(ops,
+			clientv3.OpDelete(oldPrefix, clientv3.WithPrefix()),
+			clientv3.OpDelete(vfs.conn.meta(oldPrefix), clientv3.WithPrefix()),
+		)
+		for _, kv := range src.below {
+			move(string(kv.Key), newPrefix+strings.TrimPrefix(string(kv.Key), oldPrefix), kv.Value)
+		}
+	}
+
+	// what the destination held and is not replaced
+	if dst.file != nil || dst.dir() {
+		for _, key := range []string{newKey, vfs.conn.meta(newKey), newPrefix, vfs.conn.meta(newPrefix)} {
+			if !put[key] {
+				ops = append(ops, clientv3.OpDelete(key))
+			}
+		}
+	}
+
+	return vfs.commit(cmps, ops...)
+}
+
+func (vfs *etcdFs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+
+	n, err := vfs.lookup(name, false)
+	if err == nil && !n.exists() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: vfs.path(name), Err: err}
+	}
+	return vfs.info(name, n), nil
+}
+
+// parent checks that the parent directory of the name exists.
+func (vfs *etcdFs) parent(name string) error {
+	dir := path.Dir(rel(name))
+	if dir == "." {
+		return nil
+	}
+
+	n, err := vfs.lookup(dir, false)
+	switch {
+	case err != nil:
+		return err
+	case !n.exists():
+		return fs.ErrNotExist
+	case n.file != nil:
+		return syscall.ENOTDIR
+	}
+	return nil
+}
+
+// writable returns the key of the file to write, whose parent must exist
+// and which must not be a directory.
+func (vfs *etcdFs) writable(name string) (string, error) {
+	p := rel(name)
+	if p == "" {
+		return "", syscall.EISDIR
+	}
+	if err := vfs.parent(p); err != nil {
+		return "", err
+	}
+
+	n, err := vfs.lookup(p, false)
+	if err != nil {
+		return "", err
+	}
+	if n.dir() {
+		return "", syscall.EISDIR
+	}
+	return vfs.key(p), nil
+}
+
+// put writes the content of the file at key, unless a directory took its
+// name since it was checked.
+func (vfs *etcdFs) put(key string, data []byte) error {
+	if err := vfs.fits(key, len(data)); err != nil {
+		return err
+	}
+
+	ok, err := vfs.commit([]clientv3.Cmp{absentBelow(key + "/")}, vfs.conn.write(key, data, time.Now())...)
+	if err == nil && !ok {
+		err = syscall.EISDIR
+	}
+	return err
+}
+
+// fits checks that a request writing size bytes to key is not larger than
+// the cluster accepts.
+func (vfs *etcdFs) fits(key string, size int) error {
+	if int64(size+2*len(key)+requestOverhead) > vfs.config.MaxSize {
+		return syscall.EFBIG
+	}
+	return nil
+}
+
+// ReadDir lists the directory from every key below it.
+func (vfs *etcdFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+
+	list, err := vfs.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: vfs.path(name), Err: err}
+	}
+	return list, nil
+}
+
+func (vfs *etcdFs) readDir(name string) ([]fs.DirEntry, error) {
+	n, err := vfs.lookup(name, true)
+	switch {
+	case err != nil:
+		return nil, err
+	case !n.exists():
+		return nil, fs.ErrNotExist
+	case n.file != nil:
+		return nil, syscall.ENOTDIR
+	}
+
+	prefix := vfs.prefix(rel(name))
+	entries := make(map[string]*fileInfo)
+	for _, kv := range n.below {
+		rest := strings.TrimPrefix(string(kv.Key), prefix)
+		if rest == "" {
+			continue
+		}
+
+		child, _, below := strings.Cut(rest, "/")
+		if info, ok := entries[child]; ok && !info.dir {
+			continue
+		}
+		if below {
+			entries[child] = &fileInfo{name: child, dir: true, modTime: n.time(prefix + child + "/")}
+		} else {
+			entries[child] = &fileInfo{name: child, size: int64(len(kv.Value)), modTime: n.time(string(kv.Key))}
+		}
+	}
+
+	list := make([]fs.DirEntry, 0, len(entries))
+	for _, info := range entries {
+		list = append(list, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (vfs *etcdFs) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	n, err := vfs.lookup(name, false)
+	switch {
+	case err != nil:
+	case n.dir():
+		err = syscall.EISDIR
+	case n.file == nil:
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+	return n.file.Value, nil
+}
+
+// WriteFile puts the key in one request.
+func (vfs *etcdFs) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
+
+	key, err := vfs.writable(name)
+	if err == nil {
+		err = vfs.put(key, data)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+// Chtimes writes the modification time, a directory without a marker gets
+// one. The access time is not kept.
+func (vfs *etcdFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := vfs.closed("chtimes", name); err != nil {
+		return err
+	}
+
+	err := retry(func() (bool, error) {
+		return vfs.chtimes(name, mtime)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+func (vfs *etcdFs) chtimes(name string, mtime time.Time) (bool, error) {
+	p := rel(name)
+	n, err := vfs.lookup(p, false)
+	switch {
+	case err != nil:
+		return false, err
+	case !n.exists():
+		return false, fs.ErrNotExist
+	case n.file != nil:
+		key := vfs.key(p)
+		return vfs.commit(
+			[]clientv3.Cmp{clientv3.Compare(clientv3.ModRevision(key), "=", n.file.ModRevision)},
+			clientv3.OpPut(vfs.conn.meta(key), formatTime(mtime)),
+		)
+	}
+
+	prefix := vfs.prefix(p)
+	if p == "" || (len(n.below) > 0 && string(n.below[0].Key) == prefix) {
+		return vfs.commit(nil, clientv3.OpPut(vfs.conn.meta(prefix), formatTime(mtime)))
+	}
+	return vfs.commit([]clientv3.Cmp{absent(vfs.key(p))}, vfs.conn.write(prefix, nil, mtime)...)
+}
+
+func (vfs *etcdFs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	n, err := vfs.lookup(dir, false)
+	switch {
+	case err != nil:
+	case !n.exists():
+		err = fs.ErrNotExist
+	case n.file != nil:
+		err = syscall.ENOTDIR
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: vfs.path(dir), Err: err}
+	}
+
+	return &etcdFs{
+		config: vfs.config,
+		root:   vfs.prefix(rel(dir)),
+		conn:   vfs.conn,
+	}, nil
+}
+
+func (vfs *etcdFs) Exists(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	n, err := vfs.lookup(name, false)
+	return err == nil && n.exists()
+}
+
+func (vfs *etcdFs) IsFile(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	n, err := vfs.lookup(name, false)
+	return err == nil && n.file != nil
+}
+
+func (vfs *etcdFs) IsDir(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	n, err := vfs.lookup(name, false)
+	return err == nil && n.dir()
+}
+
+// Close cancels the watches and closes the client after the files.
+func (vfs *etcdFs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.conn.Tracker.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.path("/"), Err: err}
+	}
+
+	vfs.conn.cancel()
+	return vfs.conn.client.Close()
+}
+
+func (vfs *etcdFs) OpenFiles() []string {
+	return vfs.conn.OpenFiles()
+}
+
+// closed fails op on name once the client is closed, its canceled context
+// would fail the request with a less telling error.
+func (vfs *etcdFs) closed(op, name string) error {
+	if vfs.conn.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.path(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// commit runs the operations in a transaction if the comparisons hold, and
+// reports whether they did.
+func (vfs *etcdFs) commit(cmps []clientv3.Cmp, ops ...clientv3.Op) (bool, error) {
+	ctx, cancel := vfs.conn.context()
+	defer cancel()
+
+	resp, err := vfs.conn.client.Txn(ctx).If(cmps...).Then(ops...).Commit()
+	if err != nil {
+		return false, errno(err)
+	}
+	return resp.Succeeded, nil
+}
+
+// retry runs fn until the transaction it commits finds the keys as fn read
+// them, the error is syscall.EAGAIN when it never does.
+func retry(fn func() (bool, error)) error {
+	for i := 0; i < retries; i++ {
+		ok, err := fn()
+		if err != nil || ok {
+			return err
+		}
+	}
+	return syscall.EAGAIN
+}
+
+// context returns the context of a request, bounded by the timeout and
+// canceled once the filesystem is closed.
+func (conn *etcdConn) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(conn.ctx, conn.timeout)
+}
+
+// write returns the operations putting value at key and its modification
+// time.
+func (conn *etcdConn) write(key string, value []byte, mtime time.Time) []clientv3.Op {
+	return []clientv3.Op{
+		clientv3.OpPut(key, string(value)),
+		clientv3.OpPut(conn.meta(key), formatTime(mtime)),
+	}
+}
+
+// meta returns the key of the modification time of key.
+func (conn *etcdConn) meta(key string) string {
+	return conn.base + "\x00" + strings.TrimPrefix(key, conn.base)
+}
+
+// unmeta returns the key whose modification time is at meta.
+func (conn *etcdConn) unmeta(meta string) string {
+	return conn.base + strings.TrimPrefix(meta, conn.base+"\x00")
+}
+
+// absent compares that key does not exist.
+func absent(key string) clientv3.Cmp {
+	return clientv3.Compare(clientv3.Version(key), "=", 0)
+}
+
+// absentBelow compares that no key starts with prefix.
+func absentBelow(prefix string) clientv3.Cmp {
+	return clientv3.Compare(clientv3.Version(prefix), "=", 0).WithPrefix()
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+func parseTime(b []byte) time.Time {
+	ns, err := strconv.ParseInt(string(b), 10, 64)
+	if err != nil {
+		return epoch
+	}
+	return time.Unix(0, ns)
+}
+
+// clusterError is an error of the cluster, it matches the error of a file
+// operation it amounts to.
+type clusterError struct {
+	err   error
+	errno error
+}
+
+func (e *clusterError) Error() string {
+	return e.err.Error()
+}
+
+func (e *clusterError) Unwrap() error {
+	return e.err
+}
+
+func (e *clusterError) Is(target error) bool {
+	return e.errno == target
+}
+
+// errno returns the error of the client matching fs.ErrPermission when the
+// cluster denies access, syscall.EFBIG when a request is too large for the
+// cluster or for its gRPC server.
+func errno(err error) error {
+	switch err {
+	case rpctypes.ErrPermissionDenied, rpctypes.ErrAuthFailed, rpctypes.ErrInvalidAuthToken, rpctypes.ErrUserEmpty:
+		return &clusterError{err: err, errno: fs.ErrPermission}
+	case rpctypes.ErrRequestTooLarge, rpctypes.ErrTooManyOps:
+		return &clusterError{err: err, errno: syscall.EFBIG}
+	}
+	if status.Code(err) == codes.ResourceExhausted {
+		return &clusterError{err: err, errno: syscall.EFBIG}
+	}
+	return err
+}
+
+// key returns the key of the file of the name relative to the root.
+func (vfs *etcdFs) key(p string) string {
+	return vfs.root + p
+}
+
+// prefix returns the prefix of the keys below the name relative to the
+// root, the marker of the directory.
+func (vfs *etcdFs) prefix(p string) string {
+	if p == "" {
+		return vfs.root
+	}
+	return vfs.root + p + "/"
+}
+
+// path returns the name as a key of the cluster, for errors.
+func (vfs *etcdFs) path(name string) string {
+	return path.Join(vfs.root, rel(name))
+}
+
+// rel returns the cleaned name without its leading slash, empty for the
+// root.
+func rel(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,228 @@
+package etcd
+
+import (
+	"context"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"io/fs"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// mount opens the filesystem of conf, closed with the test.
+func mount(t *testing.T, conf *Config) filesystem.FileSystem {
+	t.Helper()
+	vfs, err := New(conf)
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = filesystem.Close(vfs) })
+	return vfs
+}
+
+// keys returns the keys below prefix, the modification times left out.
+func keys(t *testing.T, client *clientv3.Client, prefix string) []string {
+	t.Helper()
+	resp, err := client.Get(context.Background(), prefix, clientv3.WithPrefix(), clientv3.WithKeysOnly())
+	require.NoError(t, err)
+
+	list := make([]string, 0, len(resp.Kvs))
+	for _, kv := range resp.Kvs {
+		list = append(list, string(kv.Key))
+	}
+	return list
+}
+
+func TestEtcdConformance(t *testing.T) {
+	conf := newMember(t).config("root")
+	vfstest.TestDriver(t, fmt.Sprintf("etcd://%s/%s?%s", conf.Host(), conf.Prefix, conf.Encode().Encode()))
+}
+
+func TestEtcdLayout(t *testing.T) {
+	s := newMember(t)
+	client := s.client(t)
+	vfs := mount(t, s.config("config"))
+
+	require.NoError(t, vfs.MkdirAll("/app/empty", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/app/db.yaml", []byte("host: db")))
+	assert.Equal(t, []string{"/config/app/", "/config/app/db.yaml", "/config/app/empty/"}, keys(t, client, "/config/"),
+		"files are keys, directories are markers")
+
+	resp, err := client.Get(context.Background(), "/config/app/db.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "host: db", string(resp.Kvs[0].Value), "the content is the value")
+
+	// a key of another client makes its directories
+	_, err = client.Put(context.Background(), "/config/other/a/b.yaml", "b")
+	require.NoError(t, err)
+	assert.True(t, vfs.IsDir("/other/a"))
+	info, err := vfs.Stat("/other/a/b.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1), info.Size())
+	assert.False(t, info.ModTime().IsZero())
+
+	list, err := filesystem.ReadDir(vfs, "/")
+	require.NoError(t, err)
+	var names []string
+	for _, entry := range list {
+		names = append(names, entry.Name())
+	}
+	assert.Equal(t, []string{"app", "other"}, names)
+
+	require.NoError(t, vfs.Remove("/other/a/b.yaml"))
+	assert.False(t, vfs.Exists("/other"), "an implicit directory goes with its last key")
+
+	// a sub view is a longer prefix
+	sub, err := vfs.Sub("/app")
+	require.NoError(t, err)
+	data, err := filesystem.ReadFile(sub, "/db.yaml")
+	require.NoError(t, err)
+	assert.Equal(t, "host: db", string(data))
+
+	require.NoError(t, vfs.RemoveAll("/"))
+	resp, err = client.Get(context.Background(), "", clientv3.WithFromKey(), clientv3.WithCountOnly())
+	require.NoError(t, err)
+	assert.Zero(t, resp.Count, "the times go with their keys")
+}
+
+func TestEtcdRename(t *testing.T) {
+	s := newMember(t)
+	client := s.client(t)
+	vfs := mount(t, s.config(""))
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/a/b/%d", i), []byte{byte(i)}))
+	}
+	require.NoError(t, vfs.Mkdir("/c", 0755))
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, filesystem.Chtimes(vfs, "/a/b/0", mtime, mtime))
+
+	before, err := client.Get(context.Background(), "/")
+	require.NoError(t, err)
+	require.NoError(t, vfs.Rename("/a", "/c"))
+	after, err := client.Get(context.Background(), "/")
+	require.NoError(t, err)
+	assert.Equal(t, before.Header.Revision+1, after.Header.Revision, "a directory moves in one transaction")
+
+	assert.False(t, vfs.Exists("/a"))
+	list, err := filesystem.ReadDir(vfs, "/c/b")
+	require.NoError(t, err)
+	assert.Len(t, list, 10)
+	info, err := vfs.Stat("/c/b/0")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime), "the times move with the files")
+
+	// more keys than a transaction takes
+	require.NoError(t, vfs.Mkdir("/big", 0755))
+	for i := 0; i < 70; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/big/%d", i), nil))
+	}
+	err = vfs.Rename("/big", "/moved")
+	assert.ErrorIs(t, err, syscall.EFBIG)
+	assert.True(t, vfs.IsDir("/big"))
+	assert.False(t, vfs.Exists("/moved"))
+}
+
+func TestEtcdMaxSize(t *testing.T) {
+	s := newMember(t)
+	vfs := mount(t, s.config(""))
+
+	big := make([]byte, 2<<20)
+	err := filesystem.WriteFile(vfs, "/big", big)
+	assert.ErrorIs(t, err, syscall.EFBIG)
+
+	f, err := vfs.Create("/big")
+	require.NoError(t, err)
+	_, err = f.Write(big[:1<<20])
+	assert.NoError(t, err)
+	_, err = f.Write(big[:1<<20])
+	assert.ErrorIs(t, err, syscall.EFBIG, "a write past what a request holds fails")
+	require.NoError(t, f.Close())
+
+	info, err := vfs.Stat("/big")
+	require.NoError(t, err)
+	assert.Equal(t, int64(1<<20), info.Size())
+
+	// the cluster has the last word
+	conf := s.config("")
+	conf.MaxSize = 8 << 20
+	vfs = mount(t, conf)
+	err = filesystem.WriteFile(vfs, "/big", big)
+	assert.ErrorIs(t, err, syscall.EFBIG)
+}
+
+func TestEtcdWatch(t *testing.T) {
+	s := newMember(t)
+	client := s.client(t)
+	vfs := mount(t, s.config("config"))
+	require.NoError(t, filesystem.WriteFile(vfs, "/app.yaml", []byte("a")))
+
+	_, err := filesystem.Watch(context.Background(), vfs, "/noexist")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	events, err := filesystem.Watch(context.Background(), vfs, "/app.yaml")
+	require.NoError(t, err)
+
+	// the changes of other clients, not of the other files
+	_, err = client.Put(context.Background(), "/config/app.yaml.bak", "b")
+	require.NoError(t, err)
+	_, err = client.Put(context.Background(), "/config/app.yaml", "b")
+	require.NoError(t, err)
+	_, err = client.Delete(context.Background(), "/config/app.yaml")
+	require.NoError(t, err)
+
+	for _, want := range []filesystem.Event{
+		{Name: "/app.yaml", Op: filesystem.EventWrite},
+		{Name: "/app.yaml", Op: filesystem.EventRemove},
+	} {
+		select {
+		case e := <-events:
+			assert.Equal(t, want, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want.Op)
+		}
+	}
+
+	// Close ends the watches
+	require.NoError(t, filesystem.Close(vfs))
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not closed with the filesystem")
+	}
+}
+
+func TestEtcdAuth(t *testing.T) {
+	s := newMember(t)
+	client := s.client(t)
+
+	ctx := context.Background()
+	_, err := client.UserAdd(ctx, "root", "secret")
+	require.NoError(t, err)
+	_, err = client.UserGrantRole(ctx, "root", "root")
+	require.NoError(t, err)
+	_, err = client.AuthEnable(ctx)
+	require.NoError(t, err)
+
+	conf := s.config("")
+	conf.User, conf.Password = "root", "secret"
+	vfs, err := New(conf)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteFile(vfs, "/a", []byte("a")))
+	require.NoError(t, filesystem.Close(vfs))
+
+	conf.Password = "wrong"
+	_, err = New(conf)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+
+	_, err = client.Get(ctx, "/a")
+	assert.ErrorIs(t, errno(err), fs.ErrPermission, "the client without credentials is denied")
+
+	_, err = filesystem.Open("etcd:///")
+	assert.Error(t, err)
+}
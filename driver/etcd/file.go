@@ -0,0 +1,259 @@
+package etcd
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"path"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// etcdFile reads the content of the key as it was when the file was opened.
+type etcdFile struct {
+	filesystem.Handle
+
+	vfs  *etcdFs
+	name string
+	info *fileInfo
+
+	data []byte
+	off  int64
+}
+
+func (f *etcdFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+	if f.off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[f.off:])
+	f.off += int64(n)
+	return n, nil
+}
+
+func (f *etcdFile) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: syscall.EINVAL}
+	}
+	if off >= int64(len(f.data)) {
+		return 0, io.EOF
+	}
+
+	n := copy(p, f.data[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (f *etcdFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(len(f.data))
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.path(f.name), Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *etcdFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.path(f.name), Err: syscall.EBADF}
+}
+
+func (f *etcdFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *etcdFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.path(f.name), Err: err}
+	}
+	f.data = nil
+	return nil
+}
+
+// etcdWriter puts the content written to it once it is closed, a Write
+// taking the content past what a request holds fails with syscall.EFBIG.
+type etcdWriter struct {
+	filesystem.Handle
+
+	vfs  *etcdFs
+	name string
+	key  string
+
+	buf []byte
+}
+
+func (w *etcdWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Closed() {
+		return 0, &fs.PathError{Op: "write", Path: w.vfs.path(w.name), Err: fs.ErrClosed}
+	}
+	if err := w.vfs.fits(w.key, len(w.buf)+len(p)); err != nil {
+		return 0, &fs.PathError{Op: "write", Path: w.vfs.path(w.name), Err: err}
+	}
+
+	w.buf = append(w.buf, p...)
+	return len(p), nil
+}
+
+func (w *etcdWriter) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.vfs.path(w.name), Err: syscall.EBADF}
+}
+
+func (w *etcdWriter) Stat() (fs.FileInfo, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	return &fileInfo{name: path.Base("/" + rel(w.name)), size: int64(len(w.buf)), modTime: time.Now()}, nil
+}
+
+func (w *etcdWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.path(w.name), Err: err}
+	}
+
+	err := w.vfs.put(w.key, w.buf)
+	w.buf = nil
+	if err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.path(w.name), Err: err}
+	}
+	return nil
+}
+
+// etcdDir lists a directory on its first ReadDir.
+type etcdDir struct {
+	filesystem.Handle
+
+	vfs  *etcdFs
+	name string
+	info *fileInfo
+
+	list []fs.DirEntry
+	read bool
+	off  int
+}
+
+func (d *etcdDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.path(d.name), Err: fs.ErrClosed}
+	}
+	if !d.read {
+		list, err := d.vfs.readDir(d.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.vfs.path(d.name), Err: err}
+		}
+		d.list, d.read = list, true
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *etcdDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *etcdDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *etcdDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *etcdDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.path(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*etcdDir)(nil)
+	_ io.ReaderAt            = (*etcdFile)(nil)
+	_ io.Seeker              = (*etcdFile)(nil)
+)
@@ -0,0 +1,66 @@
+package etcd
+
+import (
+	"github.com/stretchr/testify/require"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/server/v3/embed"
+	"go.uber.org/zap"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// member is a cluster of one etcd member, running in the process on a
+// temporary directory.
+type member struct {
+	etcd *embed.Etcd
+
+	// addr is the host and port clients connect to.
+	addr string
+}
+
+func newMember(t *testing.T) *member {
+	t.Helper()
+
+	local, err := url.Parse("http://127.0.0.1:0")
+	require.NoError(t, err)
+
+	config := embed.NewConfig()
+	config.Dir = t.TempDir()
+	config.ListenClientUrls = []url.URL{*local}
+	config.ListenPeerUrls = []url.URL{*local}
+	config.LogLevel = "error"
+	config.ZapLoggerBuilder = embed.NewZapLoggerBuilder(zap.NewNop())
+
+	e, err := embed.StartEtcd(config)
+	require.NoError(t, err)
+	t.Cleanup(e.Close)
+
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(10 * time.Second):
+		t.Fatal("etcd not ready")
+	}
+
+	return &member{etcd: e, addr: e.Clients[0].Addr().String()}
+}
+
+// config returns the config of the filesystem rooted at prefix on the
+// member.
+func (s *member) config(prefix string) *Config {
+	return &Config{Endpoints: []string{s.addr}, Prefix: prefix, Timeout: 5 * time.Second}
+}
+
+// client returns a client of the server, to look at the keys.
+func (s *member) client(t *testing.T) *clientv3.Client {
+	t.Helper()
+
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   []string{s.addr},
+		DialTimeout: 5 * time.Second,
+		Logger:      zap.NewNop(),
+	})
+	require.NoError(t, err)
+	t.Cleanup(func() { _ = client.Close() })
+	return client
+}
@@ -0,0 +1,80 @@
+package etcd
+
+import (
+	"context"
+	"github.com/lazychanger/go-vfs"
+	"go.etcd.io/etcd/api/v3/mvccpb"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"io/fs"
+	"strings"
+)
+
+// Watch watches the keys of the name and below it from the revision it was
+// found at. A key put for the first time reports a creation, a marker the
+// creation of a directory, and a key put again a write. The events stop when
+// ctx is done, the filesystem is closed or the cluster compacted the
+// revisions not delivered yet.
+func (vfs *etcdFs) Watch(ctx context.Context, name string) (<-chan filesystem.Event, error) {
+	if err := vfs.closed("watch", name); err != nil {
+		return nil, err
+	}
+
+	n, err := vfs.lookup(name, false)
+	if err == nil && !n.exists() {
+		err = fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "watch", Path: vfs.path(name), Err: err}
+	}
+
+	p := rel(name)
+	key := vfs.key(p)
+	match := func(k string) bool {
+		return p == "" || k == key || strings.HasPrefix(k, key+"/")
+	}
+
+	ctx, cancel := context.WithCancel(clientv3.WithRequireLeader(ctx))
+	go func() {
+		select {
+		case <-vfs.conn.ctx.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+	}()
+	watch := vfs.conn.client.Watch(ctx, key, clientv3.WithPrefix(), clientv3.WithRev(n.rev+1))
+
+	events := make(chan filesystem.Event)
+	go func() {
+		defer close(events)
+		defer cancel()
+
+		for resp := range watch {
+			if resp.Err() != nil {
+				return
+			}
+			for _, ev := range resp.Events {
+				k := string(ev.Kv.Key)
+				if !match(k) {
+					continue
+				}
+
+				e := filesystem.Event{Name: "/" + strings.TrimSuffix(strings.TrimPrefix(k, vfs.root), "/")}
+				switch {
+				case ev.Type == mvccpb.DELETE:
+					e.Op = filesystem.EventRemove
+				case ev.IsCreate():
+					e.Op = filesystem.EventCreate
+				default:
+					e.Op = filesystem.EventWrite
+				}
+
+				select {
+				case events <- e:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}
+	}()
+	return events, nil
+}
@@ -0,0 +1,130 @@
+package ftp
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPort      = "21"
+	defaultTimeout   = 30 * time.Second
+	defaultConns     = 4
+	defaultChunkSize = 8 << 20
+)
+
+type Config struct {
+	filesystem.Config
+
+	// Addr is the host of the server, and its port, 21 when it has none.
+	Addr string
+
+	// Root is the directory the filesystem is rooted at, the working
+	// directory of the user when empty.
+	Root string
+
+	User     string
+	Password string
+
+	// Active makes the server connect to the client for the transfers,
+	// rather than the client to the server in passive mode.
+	Active bool
+
+	// TLS secures the connections with AUTH TLS, the data connections as
+	// well.
+	TLS bool
+
+	// Insecure accepts any certificate of the server.
+	Insecure bool
+
+	// Conns is the number of idle connections kept for later operations,
+	// 4 by default.
+	Conns int
+
+	// ChunkSize is the size of the chunks files are uploaded in, 8 MiB by
+	// default. An interrupted upload resumes from the last chunk the server
+	// has in part.
+	ChunkSize int64
+
+	// Timeout bounds the time to connect and to wait for replies, 30s by
+	// default.
+	Timeout time.Duration
+}
+
+func (conf *Config) Driver() string {
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	return conf.Addr
+}
+
+func (conf *Config) Path() string {
+	return conf.Root
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if conf.User == "" {
+		return nil
+	}
+	if conf.Password == "" {
+		return url.User(conf.User)
+	}
+	return url.UserPassword(conf.User, conf.Password)
+}
+
+// Encode the options, active mode as passive=false
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if conf.Active {
+		values.Set("passive", "false")
+	}
+	if conf.TLS {
+		values.Set("tls", "true")
+	}
+	if conf.Insecure {
+		values.Set("insecure", "true")
+	}
+	if conf.Conns != 0 {
+		values.Set("conns", strconv.Itoa(conf.Conns))
+	}
+	if conf.ChunkSize != 0 {
+		values.Set("chunksize", strconv.FormatInt(conf.ChunkSize, 10))
+	}
+	if conf.Timeout != 0 {
+		values.Set("timeout", conf.Timeout.String())
+	}
+	return values
+}
+
+// Decode the options, passive unless passive=false
+func (conf *Config) Decode(query url.Values) error {
+	if passive, err := strconv.ParseBool(query.Get("passive")); err == nil {
+		conf.Active = !passive
+	}
+	conf.TLS, _ = strconv.ParseBool(query.Get("tls"))
+	conf.Insecure, _ = strconv.ParseBool(query.Get("insecure"))
+	conf.Conns, _ = strconv.Atoi(query.Get("conns"))
+	conf.ChunkSize, _ = strconv.ParseInt(query.Get("chunksize"), 10, 64)
+	conf.Timeout, _ = time.ParseDuration(query.Get("timeout"))
+
+	return nil
+}
+
+// addr returns the address to dial.
+func (conf *Config) addr() string {
+	if _, _, err := net.SplitHostPort(conf.Addr); err == nil {
+		return conf.Addr
+	}
+	return net.JoinHostPort(strings.Trim(conf.Addr, "[]"), defaultPort)
+}
+
+func (conf *Config) timeout() time.Duration {
+	if conf.Timeout == 0 {
+		return defaultTimeout
+	}
+	return conf.Timeout
+}
@@ -0,0 +1,339 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io/fs"
+	"net"
+	"net/textproto"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// conn is a control connection, logged in and ready for commands.
+type conn struct {
+	config *Config
+
+	raw  net.Conn
+	text *textproto.Conn
+
+	// tls protects the data connections too, nil without TLS.
+	tls *tls.Config
+
+	// features maps the features the server announces to their parameters.
+	features map[string]string
+
+	// noEPSV is set once the server rejected EPSV, PASV is used instead.
+	noEPSV bool
+
+	// broken marks a connection out of step with the server, it is closed
+	// rather than reused.
+	broken bool
+}
+
+// dial connects to the server, secures the connection when tlsConfig is not
+// nil and logs in.
+func dial(config *Config, tlsConfig *tls.Config) (*conn, error) {
+	raw, err := net.DialTimeout("tcp", config.addr(), config.timeout())
+	if err != nil {
+		return nil, err
+	}
+
+	c := &conn{config: config, raw: raw, text: textproto.NewConn(raw)}
+	if err := c.init(tlsConfig); err != nil {
+		_ = raw.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+func (c *conn) init(tlsConfig *tls.Config) error {
+	c.deadline()
+	if _, _, err := c.text.ReadResponse(220); err != nil {
+		return err
+	}
+
+	if tlsConfig != nil {
+		if _, _, err := c.cmd(234, "AUTH TLS"); err != nil {
+			return err
+		}
+		secure := tls.Client(c.raw, tlsConfig)
+		if err := secure.Handshake(); err != nil {
+			return err
+		}
+		c.raw, c.text, c.tls = secure, textproto.NewConn(secure), tlsConfig
+	}
+
+	user, password := c.config.User, c.config.Password
+	if user == "" {
+		user, password = "anonymous", "anonymous@"
+	}
+	code, _, err := c.cmd(0, "USER %s", user)
+	if err == nil && code == 331 {
+		code, _, err = c.cmd(0, "PASS %s", password)
+	}
+	if err != nil {
+		return err
+	}
+	if code != 230 && code != 202 {
+		return &fs.PathError{Op: "login", Path: c.config.addr(), Err: fs.ErrPermission}
+	}
+
+	if c.tls != nil {
+		if _, _, err := c.cmd(200, "PBSZ 0"); err != nil {
+			return err
+		}
+		if _, _, err := c.cmd(200, "PROT P"); err != nil {
+			return err
+		}
+	}
+
+	c.features = map[string]string{}
+	if _, msg, err := c.cmd(211, "FEAT"); err == nil {
+		for _, line := range strings.Split(msg, "\n") {
+			if !strings.HasPrefix(line, " ") {
+				continue
+			}
+			name, params, _ := strings.Cut(strings.TrimSpace(line), " ")
+			c.features[strings.ToUpper(name)] = params
+		}
+	} else if !isReply(err) {
+		return err
+	}
+
+	_, _, err = c.cmd(200, "TYPE I")
+	return err
+}
+
+// has reports whether the server announces the feature.
+func (c *conn) has(feature string) bool {
+	_, ok := c.features[feature]
+	return ok
+}
+
+// cmd sends a command and reads its reply, expect is the code of the reply
+// expected, or its first digit, any reply is accepted when it is 0.
+func (c *conn) cmd(expect int, format string, args ...interface{}) (int, string, error) {
+	line := fmt.Sprintf(format, args...)
+	if strings.ContainsAny(line, "\r\n") {
+		return 0, "", syscall.EINVAL
+	}
+
+	c.deadline()
+	defer c.raw.SetDeadline(time.Time{})
+
+	if err := c.text.PrintfLine("%s", line); err != nil {
+		c.broken = true
+		return 0, "", err
+	}
+	return c.reply(expect)
+}
+
+// reply reads the next reply of the server.
+func (c *conn) reply(expect int) (int, string, error) {
+	code, msg, err := c.text.ReadResponse(expect)
+	if err != nil && (!isReply(err) || code == 421) {
+		c.broken = true
+	}
+	return code, msg, err
+}
+
+// transfer sends the command of a transfer starting at off, and returns its
+// data connection once the server accepted it.
+func (c *conn) transfer(off int64, format string, args ...interface{}) (net.Conn, error) {
+	var (
+		data     net.Conn
+		listener net.Listener
+		err      error
+	)
+	if c.config.Active {
+		listener, err = c.active()
+	} else {
+		data, err = c.passive()
+	}
+	if err != nil {
+		return nil, err
+	}
+	fail := func(err error) (net.Conn, error) {
+		if data != nil {
+			_ = data.Close()
+		}
+		if listener != nil {
+			_ = listener.Close()
+		}
+		return nil, err
+	}
+
+	if off > 0 {
+		if _, _, err := c.cmd(350, "REST %d", off); err != nil {
+			return fail(err)
+		}
+	}
+	if _, _, err := c.cmd(1, format, args...); err != nil {
+		return fail(err)
+	}
+
+	if listener != nil {
+		_ = listener.(*net.TCPListener).SetDeadline(time.Now().Add(c.config.timeout()))
+		data, err = listener.Accept()
+		_ = listener.Close()
+		if err != nil {
+			c.broken = true
+			return nil, err
+		}
+	}
+
+	if c.tls != nil {
+		secure := tls.Client(data, c.tls)
+		_ = secure.SetDeadline(time.Now().Add(c.config.timeout()))
+		if err := secure.Handshake(); err != nil {
+			c.broken = true
+			return fail(err)
+		}
+		_ = secure.SetDeadline(time.Time{})
+		data = secure
+	}
+	return data, nil
+}
+
+// done reads the reply ending a transfer, once its data connection is
+// closed.
+func (c *conn) done() error {
+	c.deadline()
+	defer c.raw.SetDeadline(time.Time{})
+
+	_, _, err := c.reply(2)
+	return err
+}
+
+// passive opens a data connection to the port the server listens on, at the
+// address of the control connection: the address a server behind NAT
+// replies to PASV is often wrong.
+func (c *conn) passive() (net.Conn, error) {
+	host, _, err := net.SplitHostPort(c.raw.RemoteAddr().String())
+	if err != nil {
+		return nil, err
+	}
+
+	port := -1
+	if !c.noEPSV {
+		_, msg, err := c.cmd(229, "EPSV")
+		switch {
+		case err == nil:
+			// 229 Entering Extended Passive Mode (|||port|)
+			start, end := strings.Index(msg, "("), strings.LastIndex(msg, ")")
+			if start < 0 || end < start+2 {
+				return nil, fmt.Errorf("ftp: malformed EPSV reply %q", msg)
+			}
+			fields := strings.Split(msg[start+1:end], msg[start+1:start+2])
+			if len(fields) != 5 {
+				return nil, fmt.Errorf("ftp: malformed EPSV reply %q", msg)
+			}
+			if port, err = strconv.Atoi(fields[3]); err != nil {
+				return nil, fmt.Errorf("ftp: malformed EPSV reply %q", msg)
+			}
+		case isReply(err):
+			c.noEPSV = true
+		default:
+			return nil, err
+		}
+	}
+
+	if port < 0 {
+		_, msg, err := c.cmd(227, "PASV")
+		if err != nil {
+			return nil, err
+		}
+		// 227 Entering Passive Mode (h1,h2,h3,h4,p1,p2)
+		start := strings.IndexAny(msg, "0123456789")
+		end := strings.LastIndexAny(msg, "0123456789")
+		if start < 0 {
+			return nil, fmt.Errorf("ftp: malformed PASV reply %q", msg)
+		}
+		fields := strings.Split(msg[start:end+1], ",")
+		if len(fields) != 6 {
+			return nil, fmt.Errorf("ftp: malformed PASV reply %q", msg)
+		}
+		hi, err1 := strconv.Atoi(fields[4])
+		lo, err2 := strconv.Atoi(fields[5])
+		if err1 != nil || err2 != nil {
+			return nil, fmt.Errorf("ftp: malformed PASV reply %q", msg)
+		}
+		port = hi<<8 | lo
+	}
+
+	return net.DialTimeout("tcp", net.JoinHostPort(host, strconv.Itoa(port)), c.config.timeout())
+}
+
+// active listens on the address of the control connection for the server
+// to open the data connection.
+func (c *conn) active() (net.Listener, error) {
+	host, _, err := net.SplitHostPort(c.raw.LocalAddr().String())
+	if err != nil {
+		return nil, err
+	}
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, "0"))
+	if err != nil {
+		return nil, err
+	}
+
+	port := listener.Addr().(*net.TCPAddr).Port
+	if ip := net.ParseIP(host).To4(); ip != nil {
+		_, _, err = c.cmd(200, "PORT %d,%d,%d,%d,%d,%d", ip[0], ip[1], ip[2], ip[3], port>>8, port&0xff)
+	} else {
+		_, _, err = c.cmd(200, "EPRT |2|%s|%d|", host, port)
+	}
+	if err != nil {
+		_ = listener.Close()
+		return nil, err
+	}
+	return listener, nil
+}
+
+// deadline bounds the time of the next exchange on the control connection.
+func (c *conn) deadline() {
+	_ = c.raw.SetDeadline(time.Now().Add(c.config.timeout()))
+}
+
+// quit logs out and closes the connection.
+func (c *conn) quit() error {
+	if !c.broken {
+		_, _, _ = c.cmd(0, "QUIT")
+	}
+	return c.raw.Close()
+}
+
+// isReply reports whether err is a reply of the server, rather than the
+// failure of the connection.
+func isReply(err error) bool {
+	var reply *textproto.Error
+	return errors.As(err, &reply)
+}
+
+// replyCode returns the code of the reply err is, 0 when it is none.
+func replyCode(err error) int {
+	var reply *textproto.Error
+	if errors.As(err, &reply) {
+		return reply.Code
+	}
+	return 0
+}
+
+// transient reports whether an operation failing with err may succeed
+// again: the connection failed or the server replied with a 4xx code.
+func transient(err error) bool {
+	code := replyCode(err)
+	return code == 0 || code/100 == 4
+}
+
+// notExist turns the reply of the server to a command on a missing file into
+// fs.ErrNotExist.
+func notExist(err error) error {
+	if code := replyCode(err); code == 550 || code == 450 {
+		return fs.ErrNotExist
+	}
+	return err
+}
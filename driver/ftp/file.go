@@ -0,0 +1,324 @@
+package ftp
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"net"
+	"path"
+	"syscall"
+	"time"
+)
+
+// ftpFile reads a file: Read streams it from a transfer starting at the
+// offset, which Seek moves. The transfer holds a connection until it ends.
+type ftpFile struct {
+	filesystem.Handle
+
+	vfs  *ftpFs
+	name string
+	info *fileInfo
+
+	off int64
+
+	// c and data transfer the file from pos on, nil until the next Read.
+	c    *conn
+	data net.Conn
+	pos  int64
+}
+
+func (f *ftpFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+	if f.data != nil && f.pos != f.off {
+		f.abort()
+	}
+	// a transfer reaching the end still has to read its last reply
+	if f.data == nil && f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if f.data == nil {
+		name := f.vfs.path(f.name)
+		c, err := f.vfs.life.pool.take(func(c *conn) (err error) {
+			f.data, err = c.transfer(f.off, "RETR %s", name)
+			if err != nil {
+				return f.vfs.failed(c, name, err)
+			}
+			return nil
+		})
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+		f.c, f.pos = c, f.off
+	}
+
+	n, err := f.data.Read(p)
+	f.off += int64(n)
+	f.pos += int64(n)
+	switch {
+	case err == io.EOF:
+		_ = f.data.Close()
+		err = f.c.done()
+		f.vfs.life.pool.put(f.c)
+		f.c, f.data = nil, nil
+		if err == nil && n == 0 {
+			err = io.EOF
+		}
+		if err != nil && err != io.EOF {
+			err = &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: err}
+		}
+	case err != nil:
+		// the next Read resumes from the offset
+		f.abort()
+		err = &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: err}
+	}
+	return n, err
+}
+
+// abort drops the transfer in progress, the connection with it: the server
+// may send one reply or two to a transfer cut short.
+func (f *ftpFile) abort() {
+	_ = f.data.Close()
+	f.c.broken = true
+	f.vfs.life.pool.put(f.c)
+	f.c, f.data = nil, nil
+}
+
+func (f *ftpFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.path(f.name), Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *ftpFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.path(f.name), Err: syscall.EBADF}
+}
+
+func (f *ftpFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *ftpFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.path(f.name), Err: err}
+	}
+	if f.data != nil {
+		f.abort()
+	}
+	return nil
+}
+
+// ftpWriter uploads the content written to it in chunks, each chunk in a
+// transfer of its own. A transfer interrupted resumes from the size the
+// server has.
+type ftpWriter struct {
+	filesystem.Handle
+
+	vfs  *ftpFs
+	name string
+
+	// buf holds what is written and not uploaded yet, off is the size
+	// uploaded.
+	buf  []byte
+	off  int64
+	size int64
+
+	// started is set once the file is stored, empty.
+	started bool
+
+	// err is the first error of an upload, the file fails once it has one.
+	err error
+}
+
+func (w *ftpWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Closed() {
+		return 0, &fs.PathError{Op: "write", Path: w.vfs.path(w.name), Err: fs.ErrClosed}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf = append(w.buf, p...)
+	w.size += int64(len(p))
+
+	chunk := int(w.vfs.config.ChunkSize)
+	if chunk <= 0 {
+		chunk = defaultChunkSize
+	}
+	for len(w.buf) >= chunk {
+		if err := w.flush(w.buf[:chunk]); err != nil {
+			w.err = &fs.PathError{Op: "write", Path: w.vfs.path(w.name), Err: err}
+			return len(p), w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[chunk:]...)
+	}
+	return len(p), nil
+}
+
+// flush uploads a chunk at the end of the file. When the transfer fails,
+// the chunk is uploaded again from the size the server has.
+func (w *ftpWriter) flush(data []byte) error {
+	name := w.vfs.path(w.name)
+
+	for retry := 0; ; retry++ {
+		err := w.vfs.store(name, w.off, data)
+		if err == nil {
+			w.off += int64(len(data))
+			return nil
+		}
+		if retry == resumeRetries || !transient(err) {
+			return err
+		}
+
+		size, serr := w.vfs.size(name)
+		if serr != nil || size < w.off || size > w.off+int64(len(data)) {
+			return err
+		}
+		data = data[size-w.off:]
+		w.off = size
+		if len(data) == 0 {
+			return nil
+		}
+	}
+}
+
+// upload uploads what is left, the whole file when nothing is stored yet.
+func (w *ftpWriter) upload() error {
+	if len(w.buf) == 0 && w.started {
+		return nil
+	}
+	err := w.flush(w.buf)
+	w.buf = nil
+	return err
+}
+
+func (w *ftpWriter) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.vfs.path(w.name), Err: syscall.EBADF}
+}
+
+func (w *ftpWriter) Stat() (fs.FileInfo, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	return &fileInfo{name: path.Base(w.vfs.path(w.name)), size: w.size, mode: 0644, modTime: time.Now()}, nil
+}
+
+func (w *ftpWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.path(w.name), Err: err}
+	}
+
+	err := w.err
+	if err == nil {
+		err = w.upload()
+	}
+	w.buf = nil
+
+	if err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.path(w.name), Err: err}
+	}
+	return nil
+}
+
+// ftpDir lists a directory on its first ReadDir.
+type ftpDir struct {
+	filesystem.Handle
+
+	vfs  *ftpFs
+	name string
+	info *fileInfo
+
+	list []fs.DirEntry
+	read bool
+	off  int
+}
+
+func (d *ftpDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.path(d.name), Err: fs.ErrClosed}
+	}
+	if !d.read {
+		list, err := d.vfs.readDir(d.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.vfs.path(d.name), Err: err}
+		}
+		d.list, d.read = list, true
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *ftpDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *ftpDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *ftpDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *ftpDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.path(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*ftpDir)(nil)
+	_ io.Seeker              = (*ftpFile)(nil)
+)
@@ -0,0 +1,648 @@
+// Package ftp implements filesystem.FileSystem on a directory of an FTP
+// server, in passive or active mode, with or without explicit TLS.
+//
+// Operations run on a pool of control connections, a file holds one while
+// it transfers. Entries are listed with MLSD and MLST when the server has
+// them, with LIST otherwise, in the format of ls or of DOS servers. Files are
+// uploaded in chunks, an interrupted upload resumes with REST from where the
+// server stopped. The server decides of the mode of the files and
+// directories it creates, Chmod changes it with SITE CHMOD.
+package ftp
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// resumeRetries is the number of times an interrupted upload is resumed.
+const resumeRetries = 3
+
+type ftpFs struct {
+	config *Config
+
+	// root is the absolute path on the server the filesystem is rooted at.
+	root string
+
+	// life is the connection pool the Sub views share, only the owner
+	// closes it.
+	life  *ftpLife
+	owner bool
+}
+
+// ftpLife is the pool of connections to the server and the files open on
+// them.
+type ftpLife struct {
+	filesystem.Tracker
+
+	pool *pool
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if config.Addr == "" {
+		return nil, fs.ErrInvalid
+	}
+
+	p := &pool{config: config}
+	if config.TLS {
+		host, _, _ := net.SplitHostPort(config.addr())
+		p.tls = &tls.Config{
+			ServerName:         host,
+			InsecureSkipVerify: config.Insecure,
+			// servers require the data connections to resume the session
+			// of the control connection
+			ClientSessionCache: tls.NewLRUClientSessionCache(0),
+		}
+	}
+
+	vfs := &ftpFs{
+		config: config,
+		life:   &ftpLife{pool: p},
+		owner:  true,
+	}
+	err := p.do(func(c *conn) error {
+		root := config.Root
+		if root == "" {
+			// 257 "/home/user" is the current directory
+			_, msg, err := c.cmd(257, "PWD")
+			if err != nil {
+				return err
+			}
+			start, end := strings.Index(msg, `"`), strings.LastIndex(msg, `"`)
+			if start < 0 || end <= start {
+				return fmt.Errorf("ftp: malformed PWD reply %q", msg)
+			}
+			root = strings.ReplaceAll(msg[start+1:end], `""`, `"`)
+		}
+
+		vfs.root = path.Clean("/" + root)
+		return vfs.mkdirAll(c, vfs.root)
+	})
+	if err != nil {
+		p.close()
+		return nil, err
+	}
+	return vfs, nil
+}
+
+func (vfs *ftpFs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	var info *fileInfo
+	err := vfs.life.pool.do(func(c *conn) (err error) {
+		info, err = vfs.stat(c, vfs.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+
+	if info.IsDir() {
+		dir := &ftpDir{vfs: vfs, name: name, info: info}
+		if err := dir.Track(&vfs.life.Tracker, vfs.path(name), dir); err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+
+	file := &ftpFile{vfs: vfs, name: name, info: info}
+	if err := file.Track(&vfs.life.Tracker, vfs.path(name), file); err != nil {
+		return nil, err
+	}
+	return file, nil
+}
+
+// OpenFile opens the named file for reading, like the os driver.
+func (vfs *ftpFs) OpenFile(name string) (filesystem.File, error) {
+	return vfs.Open(name)
+}
+
+// Create stores an empty file right away, the content written is uploaded
+// in chunks.
+func (vfs *ftpFs) Create(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	w := &ftpWriter{vfs: vfs, name: name}
+	if err := w.flush(nil); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+	w.started = true
+
+	if err := w.Track(&vfs.life.Tracker, vfs.path(name), w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (vfs *ftpFs) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+	return vfs.wrap("mkdir", name, vfs.life.pool.do(func(c *conn) error {
+		return vfs.mkdir(c, vfs.path(name))
+	}))
+}
+
+// mkdir creates the directory p, telling the errors the server replies 550
+// to apart.
+func (vfs *ftpFs) mkdir(c *conn, p string) error {
+	_, _, err := c.cmd(2, "MKD %s", p)
+	if err == nil || !isReply(err) {
+		return err
+	}
+
+	if _, e := vfs.stat(c, p); e == nil {
+		return fs.ErrExist
+	}
+	if _, e := vfs.stat(c, path.Dir(p)); errors.Is(e, fs.ErrNotExist) {
+		return fs.ErrNotExist
+	}
+	return err
+}
+
+func (vfs *ftpFs) MkdirAll(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+	return vfs.wrap("mkdir", name, vfs.life.pool.do(func(c *conn) error {
+		return vfs.mkdirAll(c, vfs.path(name))
+	}))
+}
+
+func (vfs *ftpFs) mkdirAll(c *conn, p string) error {
+	info, err := vfs.stat(c, p)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+
+	if parent := path.Dir(p); parent != p {
+		if err := vfs.mkdirAll(c, parent); err != nil {
+			return err
+		}
+	}
+	if err := vfs.mkdir(c, p); err != nil && !errors.Is(err, fs.ErrExist) {
+		return err
+	}
+	return nil
+}
+
+func (vfs *ftpFs) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
+	return vfs.wrap("remove", name, vfs.life.pool.do(func(c *conn) error {
+		p := vfs.path(name)
+		info, err := vfs.stat(c, p)
+		if err != nil {
+			return err
+		}
+		return vfs.remove(c, p, info)
+	}))
+}
+
+func (vfs *ftpFs) remove(c *conn, p string, info *fileInfo) error {
+	if info.IsDir() {
+		_, _, err := c.cmd(2, "RMD %s", p)
+		return err
+	}
+	_, _, err := c.cmd(2, "DELE %s", p)
+	return err
+}
+
+// RemoveAll removes the tree below path, symbolic links are removed and not
+// followed.
+func (vfs *ftpFs) RemoveAll(name string) error {
+	if err := vfs.closed("unlinkat", name); err != nil {
+		return err
+	}
+	return vfs.wrap("unlinkat", name, vfs.life.pool.do(func(c *conn) error {
+		return vfs.removeAll(c, vfs.path(name))
+	}))
+}
+
+func (vfs *ftpFs) removeAll(c *conn, p string) error {
+	info, err := vfs.stat(c, p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		list, err := vfs.list(c, p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, child := range list {
+			if err := vfs.removeAll(c, path.Join(p, child.name)); err != nil {
+				return err
+			}
+		}
+	}
+
+	err = vfs.remove(c, p, info)
+	if err != nil {
+		if _, e := vfs.stat(c, p); errors.Is(e, fs.ErrNotExist) {
+			return nil
+		}
+	}
+	return err
+}
+
+// Rename renames with RNFR and RNTO. A server refusing to replace an
+// existing file has it removed first.
+func (vfs *ftpFs) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
+
+	oldname, newname := vfs.path(oldpath), vfs.path(newpath)
+	err := vfs.life.pool.do(func(c *conn) error {
+		err := vfs.rename(c, oldname, newname)
+		if err == nil || !isReply(err) {
+			return err
+		}
+
+		src, e := vfs.stat(c, oldname)
+		if e != nil {
+			return e
+		}
+		if dst, e := vfs.stat(c, newname); e == nil && !dst.IsDir() && !src.IsDir() {
+			if _, _, err = c.cmd(2, "DELE %s", newname); err == nil {
+				err = vfs.rename(c, oldname, newname)
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (vfs *ftpFs) rename(c *conn, oldname, newname string) error {
+	if _, _, err := c.cmd(350, "RNFR %s", oldname); err != nil {
+		return err
+	}
+	_, _, err := c.cmd(2, "RNTO %s", newname)
+	return err
+}
+
+func (vfs *ftpFs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+
+	var info *fileInfo
+	err := vfs.life.pool.do(func(c *conn) (err error) {
+		info, err = vfs.stat(c, vfs.path(name))
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: vfs.path(name), Err: err}
+	}
+	return info, nil
+}
+
+// stat describes p with MLST, or finds it in the listing of its parent
+// when the server does not have it.
+func (vfs *ftpFs) stat(c *conn, p string) (*fileInfo, error) {
+	if c.has("MLST") {
+		_, msg, err := c.cmd(250, "MLST %s", p)
+		if err != nil {
+			return nil, notExist(err)
+		}
+		for _, line := range strings.Split(msg, "\n") {
+			if !strings.HasPrefix(line, " ") {
+				continue
+			}
+			info, err := parseFacts(line[1:])
+			if err != nil {
+				return nil, err
+			}
+			info.name = path.Base(p)
+			return info, nil
+		}
+		return nil, fmt.Errorf("ftp: malformed MLST reply %q", msg)
+	}
+
+	if p == "/" {
+		return &fileInfo{name: "/", mode: fs.ModeDir | 0755}, nil
+	}
+	list, err := vfs.list(c, path.Dir(p))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range list {
+		if info.name != path.Base(p) {
+			continue
+		}
+		// the times LIST shows are to the minute at best
+		if c.has("MDTM") {
+			if _, msg, err := c.cmd(213, "MDTM %s", p); err == nil {
+				if modTime, err := parseModify(msg); err == nil {
+					info.modTime = modTime
+				}
+			} else if !isReply(err) {
+				return nil, err
+			}
+		}
+		return info, nil
+	}
+	return nil, fs.ErrNotExist
+}
+
+func (vfs *ftpFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+	list, err := vfs.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: vfs.path(name), Err: err}
+	}
+	return list, nil
+}
+
+// readDir lists the directory sorted by name.
+func (vfs *ftpFs) readDir(name string) ([]fs.DirEntry, error) {
+	p := vfs.path(name)
+
+	var infos []*fileInfo
+	err := vfs.life.pool.do(func(c *conn) error {
+		info, err := vfs.stat(c, p)
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() {
+			return syscall.ENOTDIR
+		}
+		infos, err = vfs.list(c, p)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		list = append(list, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// list lists the directory p with MLSD, or LIST when the server does not
+// have it.
+func (vfs *ftpFs) list(c *conn, p string) ([]*fileInfo, error) {
+	mlsd := c.has("MLST")
+	command := "LIST -a %s"
+	if mlsd {
+		command = "MLSD %s"
+	}
+
+	data, err := c.transfer(0, command, p)
+	if err != nil {
+		return nil, notExist(err)
+	}
+	var lines []string
+	scanner := bufio.NewScanner(data)
+	for scanner.Scan() {
+		if line := strings.TrimRight(scanner.Text(), "\r"); line != "" {
+			lines = append(lines, line)
+		}
+	}
+	err = scanner.Err()
+	_ = data.Close()
+	if done := c.done(); err == nil {
+		err = done
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	now := time.Now()
+	list := make([]*fileInfo, 0, len(lines))
+	for _, line := range lines {
+		var info *fileInfo
+		if mlsd {
+			info, err = parseFacts(line)
+		} else {
+			info, err = parseList(line, now)
+		}
+		if err != nil {
+			return nil, err
+		}
+		if info.name != "" {
+			list = append(list, info)
+		}
+	}
+	return list, nil
+}
+
+func (vfs *ftpFs) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	var content []byte
+	err := vfs.life.pool.do(func(c *conn) error {
+		p := vfs.path(name)
+		data, err := c.transfer(0, "RETR %s", p)
+		if err != nil {
+			return vfs.failed(c, p, err)
+		}
+		content, err = io.ReadAll(data)
+		_ = data.Close()
+		if done := c.done(); err == nil {
+			err = done
+		}
+		return err
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: vfs.path(name), Err: err}
+	}
+	return content, nil
+}
+
+func (vfs *ftpFs) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
+
+	w := &ftpWriter{vfs: vfs, name: name, buf: data}
+	if err := w.upload(); err != nil {
+		return &fs.PathError{Op: "write", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+// store uploads data to p from off on, with REST when the server has it,
+// else by appending to p, which then holds off bytes.
+func (vfs *ftpFs) store(p string, off int64, data []byte) error {
+	return vfs.life.pool.do(func(c *conn) error {
+		command, rest := "STOR %s", off
+		if off > 0 && !c.has("REST") {
+			command, rest = "APPE %s", 0
+		}
+
+		conn, err := c.transfer(rest, command, p)
+		if err != nil {
+			return vfs.failed(c, p, err)
+		}
+		_, err = conn.Write(data)
+		if cerr := conn.Close(); err == nil {
+			err = cerr
+		}
+		if done := c.done(); err == nil {
+			err = done
+		}
+		return err
+	})
+}
+
+// size returns the size of p on the server.
+func (vfs *ftpFs) size(p string) (int64, error) {
+	var size int64
+	err := vfs.life.pool.do(func(c *conn) error {
+		_, msg, err := c.cmd(213, "SIZE %s", p)
+		if err != nil {
+			return err
+		}
+		size, err = strconv.ParseInt(strings.TrimSpace(msg), 10, 64)
+		return err
+	})
+	return size, err
+}
+
+func (vfs *ftpFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := vfs.closed("chtimes", name); err != nil {
+		return err
+	}
+	return vfs.wrap("chtimes", name, vfs.life.pool.do(func(c *conn) error {
+		if !c.has("MFMT") {
+			return filesystem.ErrNotSupported
+		}
+		_, _, err := c.cmd(213, "MFMT %s %s", mtime.UTC().Format("20060102150405"), vfs.path(name))
+		return notExist(err)
+	}))
+}
+
+func (vfs *ftpFs) Chmod(name string, mode fs.FileMode) error {
+	if err := vfs.closed("chmod", name); err != nil {
+		return err
+	}
+	return vfs.wrap("chmod", name, vfs.life.pool.do(func(c *conn) error {
+		_, _, err := c.cmd(2, "SITE CHMOD %04o %s", mode.Perm(), vfs.path(name))
+		return notExist(err)
+	}))
+}
+
+func (vfs *ftpFs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	if !vfs.IsDir(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrNotExist}
+	}
+
+	return &ftpFs{
+		config: vfs.config,
+		root:   vfs.path(dir),
+		life:   vfs.life,
+	}, nil
+}
+
+func (vfs *ftpFs) Exists(name string) bool {
+	_, err := vfs.Stat(name)
+	return err == nil
+}
+
+func (vfs *ftpFs) IsFile(name string) bool {
+	info, err := vfs.Stat(name)
+	return err == nil && !info.IsDir()
+}
+
+func (vfs *ftpFs) IsDir(name string) bool {
+	info, err := vfs.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+// Close closes the files still open on the filesystem and the connections.
+func (vfs *ftpFs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.life.Tracker.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.root, Err: err}
+	}
+	vfs.life.pool.close()
+	return nil
+}
+
+func (vfs *ftpFs) OpenFiles() []string {
+	return vfs.life.OpenFiles()
+}
+
+// closed fails op on name once the pool is closed, which would dial the
+// server again otherwise.
+func (vfs *ftpFs) closed(op, name string) error {
+	if vfs.life.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.path(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// failed explains the failure of a transfer of p, the server replies 550
+// whether p is missing or a directory.
+func (vfs *ftpFs) failed(c *conn, p string, err error) error {
+	if !isReply(err) {
+		return err
+	}
+	info, e := vfs.stat(c, p)
+	switch {
+	case errors.Is(e, fs.ErrNotExist):
+		return fs.ErrNotExist
+	case e == nil && info.IsDir():
+		return syscall.EISDIR
+	}
+	return err
+}
+
+// wrap returns err as the *fs.PathError of op on name.
+func (vfs *ftpFs) wrap(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return &fs.PathError{Op: op, Path: vfs.path(name), Err: err}
+}
+
+func (vfs *ftpFs) path(p string) string {
+	return path.Join(vfs.root, p)
+}
@@ -0,0 +1,153 @@
+package ftp
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestFTPConformance(t *testing.T) {
+	vfstest.TestDriver(t, dsn(newFTPServer(t).config("root")))
+}
+
+func TestFTPActive(t *testing.T) {
+	conf := newFTPServer(t).config("root")
+	conf.Active = true
+	vfstest.TestDriver(t, dsn(conf))
+}
+
+func TestFTPTLS(t *testing.T) {
+	s := newFTPServer(t, withTLS(t))
+	conf := s.config("root")
+	conf.TLS, conf.Insecure = true, true
+	vfstest.TestDriver(t, dsn(conf))
+
+	// the certificate is self-signed
+	conf.Insecure = false
+	_, err := New(conf)
+	assert.Error(t, err)
+}
+
+func TestFTPList(t *testing.T) {
+	s := newFTPServer(t, func(s *ftpServer) {
+		s.noMLST = true
+	})
+	vfstest.TestDriver(t, dsn(s.config("root")))
+
+	assert.Zero(t, s.count("MLSD"))
+	assert.NotZero(t, s.count("LIST"))
+}
+
+func TestFTPAuth(t *testing.T) {
+	s := newFTPServer(t)
+
+	conf := s.config("")
+	conf.Password = "wrong"
+	_, err := New(conf)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+}
+
+func TestFTPResume(t *testing.T) {
+	s := newFTPServer(t)
+
+	conf := s.config("")
+	conf.ChunkSize = 4
+	vfs, err := New(conf)
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+
+	f, err := vfs.Create("/a.txt")
+	require.NoError(t, err)
+
+	// the upload of the first chunk stops half way
+	s.mu.Lock()
+	s.dropAfter = 2
+	s.mu.Unlock()
+
+	_, err = io.WriteString(f, "0123456789")
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+	assert.Equal(t, 1, s.count("SIZE"), "the upload resumes from the size the server has")
+	assert.Equal(t, 3, s.count("REST"))
+
+	// the same goes for WriteFile
+	s.mu.Lock()
+	s.dropAfter = 3
+	s.mu.Unlock()
+
+	require.NoError(t, filesystem.WriteFile(vfs, "/b.txt", []byte("abcdefgh")))
+	data, err = os.ReadFile(filepath.Join(s.dir, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "abcdefgh", string(data))
+}
+
+func TestFTPPool(t *testing.T) {
+	s := newFTPServer(t)
+
+	conf := s.config("")
+	conf.Conns = 1
+	vfs, err := New(conf)
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+
+	for i := 0; i < 5; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, "/a.txt", []byte("a")))
+		_, err := filesystem.ReadFile(vfs, "/a.txt")
+		require.NoError(t, err)
+	}
+	assert.Equal(t, 1, s.count("PASS"), "the connection is reused")
+
+	// a file read holds its connection, another one is opened meanwhile
+	f, err := vfs.Open("/a.txt")
+	require.NoError(t, err)
+	_, err = f.Read(make([]byte, 1))
+	require.NoError(t, err)
+	assert.True(t, vfs.IsFile("/a.txt"))
+	require.NoError(t, f.Close())
+	assert.Equal(t, 2, s.count("PASS"))
+}
+
+func TestFTPSub(t *testing.T) {
+	s := newFTPServer(t)
+
+	vfs, err := New(s.config("root"))
+	require.NoError(t, err)
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c.txt", []byte("c")))
+	assert.FileExists(t, filepath.Join(s.dir, "root", "a", "b", "c.txt"))
+
+	sub, err := vfs.Sub("/a")
+	require.NoError(t, err)
+	subsub, err := sub.Sub("/b")
+	require.NoError(t, err)
+
+	f, err := subsub.Open("/c.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(data))
+	assert.Equal(t, []string{"/root/a/b/c.txt"}, sub.(filesystem.OpenFilesFS).OpenFiles())
+
+	_, err = vfs.Sub("/a/b/c.txt")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.NoError(t, filesystem.Close(sub), "a view does not close the connections")
+	assert.True(t, subsub.IsFile("/c.txt"))
+
+	require.NoError(t, filesystem.Close(vfs))
+	_, err = f.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, fs.ErrClosed, "the files still open are closed")
+	_, err = subsub.Stat("/c.txt")
+	assert.ErrorIs(t, err, fs.ErrClosed, "Sub views close with their filesystem")
+	assert.ErrorIs(t, filesystem.Close(vfs), fs.ErrClosed)
+}
@@ -0,0 +1,219 @@
+package ftp
+
+import (
+	"fmt"
+	"io/fs"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// parseFacts parses an entry of MLSD or MLST,
+// "type=file;size=3;modify=20060102150405; name". The name is empty for the
+// current and the parent directory, which are not entries.
+func parseFacts(line string) (*fileInfo, error) {
+	facts, name, ok := strings.Cut(line, " ")
+	if !ok {
+		return nil, fmt.Errorf("ftp: malformed entry %q", line)
+	}
+
+	fi := &fileInfo{name: name, mode: 0644}
+	perm := false
+	for _, fact := range strings.Split(facts, ";") {
+		key, value, ok := strings.Cut(fact, "=")
+		if !ok {
+			continue
+		}
+		switch strings.ToLower(key) {
+		case "type":
+			switch strings.ToLower(value) {
+			case "dir":
+				fi.mode = fs.ModeDir | fi.mode.Perm()
+			case "cdir", "pdir":
+				fi.mode = fs.ModeDir | fi.mode.Perm()
+				fi.name = ""
+			case "os.unix=symlink", "os.unix=slink":
+				fi.mode = fs.ModeSymlink | fi.mode.Perm()
+			}
+		case "size":
+			size, err := strconv.ParseInt(value, 10, 64)
+			if err != nil {
+				return nil, fmt.Errorf("ftp: malformed entry %q", line)
+			}
+			fi.size = size
+		case "modify":
+			modTime, err := parseModify(value)
+			if err != nil {
+				return nil, fmt.Errorf("ftp: malformed entry %q", line)
+			}
+			fi.modTime = modTime
+		case "unix.mode":
+			mode, err := strconv.ParseUint(value, 8, 32)
+			if err != nil {
+				return nil, fmt.Errorf("ftp: malformed entry %q", line)
+			}
+			fi.mode = fi.mode.Type() | fs.FileMode(mode).Perm()
+			perm = true
+		}
+	}
+	if fi.mode.IsDir() && !perm {
+		fi.mode = fs.ModeDir | 0755
+	}
+	return fi, nil
+}
+
+// parseModify parses the time of a modify fact or of a reply to MDTM,
+// UTC with optional fractions of a second.
+func parseModify(value string) (time.Time, error) {
+	layout := "20060102150405"
+	if len(value) > len(layout) && value[len(layout)] == '.' {
+		layout += "." + strings.Repeat("0", len(value)-len(layout)-1)
+	}
+	return time.ParseInLocation(layout, value, time.UTC)
+}
+
+// parseList parses a line of LIST, in the format of ls -l or of the DOS
+// servers. The name is empty for lines that are not entries.
+func parseList(line string, now time.Time) (*fileInfo, error) {
+	if strings.HasPrefix(line, "total ") {
+		return &fileInfo{}, nil
+	}
+	if line != "" && line[0] >= '0' && line[0] <= '9' {
+		return parseDOS(line)
+	}
+	return parseUnix(line, now)
+}
+
+// parseUnix parses "drwxr-xr-x 2 user group 4096 Jan  2 15:04 name", the
+// year replaces the time for entries older than about six months.
+func parseUnix(line string, now time.Time) (*fileInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 8 || len(fields[0]) < 10 {
+		return nil, fmt.Errorf("ftp: malformed entry %q", line)
+	}
+
+	// the group column is missing on some servers
+	date := 5
+	if _, err := time.Parse("Jan", fields[date]); err != nil {
+		date--
+		if _, err := time.Parse("Jan", fields[date]); err != nil {
+			return nil, fmt.Errorf("ftp: malformed entry %q", line)
+		}
+	}
+	if len(fields) < date+4 {
+		return nil, fmt.Errorf("ftp: malformed entry %q", line)
+	}
+
+	fi := &fileInfo{}
+	switch fields[0][0] {
+	case 'd':
+		fi.mode = fs.ModeDir
+	case 'l':
+		fi.mode = fs.ModeSymlink
+	case '-':
+	default:
+		fi.mode = fs.ModeIrregular
+	}
+	for i, c := range fields[0][1:10] {
+		if c != '-' {
+			fi.mode |= 1 << uint(8-i)
+		}
+	}
+
+	size, err := strconv.ParseInt(fields[date-1], 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("ftp: malformed entry %q", line)
+	}
+	fi.size = size
+
+	stamp := fields[date] + " " + fields[date+1] + " " + fields[date+2]
+	if strings.Contains(fields[date+2], ":") {
+		modTime, err := time.ParseInLocation("Jan 2 15:04", stamp, time.UTC)
+		if err != nil {
+			return nil, fmt.Errorf("ftp: malformed entry %q", line)
+		}
+		modTime = modTime.AddDate(now.Year(), 0, 0)
+		if modTime.After(now.Add(24 * time.Hour)) {
+			modTime = modTime.AddDate(-1, 0, 0)
+		}
+		fi.modTime = modTime
+	} else if fi.modTime, err = time.ParseInLocation("Jan 2 2006", stamp, time.UTC); err != nil {
+		return nil, fmt.Errorf("ftp: malformed entry %q", line)
+	}
+
+	// the name is the rest of the line after the date, spaces included
+	rest := line
+	for i := 0; i < date+3; i++ {
+		rest = strings.TrimLeft(rest, " ")
+		rest = rest[strings.IndexByte(rest, ' ')+1:]
+	}
+	fi.name = strings.TrimLeft(rest, " ")
+	if fi.mode&fs.ModeSymlink != 0 {
+		fi.name, _, _ = strings.Cut(fi.name, " -> ")
+	}
+	if fi.name == "." || fi.name == ".." {
+		fi.name = ""
+	}
+	return fi, nil
+}
+
+// parseDOS parses "01-02-06  03:04PM       <DIR>          name".
+func parseDOS(line string) (*fileInfo, error) {
+	fields := strings.Fields(line)
+	if len(fields) < 4 {
+		return nil, fmt.Errorf("ftp: malformed entry %q", line)
+	}
+
+	modTime, err := time.ParseInLocation("01-02-06 03:04PM", fields[0]+" "+fields[1], time.UTC)
+	if err != nil {
+		if modTime, err = time.ParseInLocation("01-02-2006 03:04PM", fields[0]+" "+fields[1], time.UTC); err != nil {
+			return nil, fmt.Errorf("ftp: malformed entry %q", line)
+		}
+	}
+
+	fi := &fileInfo{modTime: modTime, mode: 0644}
+	if fields[2] == "<DIR>" {
+		fi.mode = fs.ModeDir | 0755
+	} else if fi.size, err = strconv.ParseInt(fields[2], 10, 64); err != nil {
+		return nil, fmt.Errorf("ftp: malformed entry %q", line)
+	}
+
+	rest := line
+	for i := 0; i < 3; i++ {
+		rest = strings.TrimLeft(rest, " ")
+		rest = rest[strings.IndexByte(rest, ' ')+1:]
+	}
+	fi.name = strings.TrimLeft(rest, " ")
+	return fi, nil
+}
@@ -0,0 +1,87 @@
+package ftp
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+func TestParseList(t *testing.T) {
+	now := time.Date(2024, 3, 1, 12, 0, 0, 0, time.UTC)
+
+	for _, tc := range []struct {
+		line string
+		want fileInfo
+	}{
+		{
+			line: "-rw-r--r--   1 owner group       1234 Feb 28 09:30 a file.txt",
+			want: fileInfo{name: "a file.txt", size: 1234, mode: 0644, modTime: time.Date(2024, 2, 28, 9, 30, 0, 0, time.UTC)},
+		},
+		{
+			// a date later than now is last year's
+			line: "drwxr-x---   2 owner group       4096 Dec 24 18:00 dir",
+			want: fileInfo{name: "dir", size: 4096, mode: fs.ModeDir | 0750, modTime: time.Date(2023, 12, 24, 18, 0, 0, 0, time.UTC)},
+		},
+		{
+			line: "-rw-r--r--   1 owner      42 Jan  2  2006 nogroup",
+			want: fileInfo{name: "nogroup", size: 42, mode: 0644, modTime: time.Date(2006, 1, 2, 0, 0, 0, 0, time.UTC)},
+		},
+		{
+			line: "lrwxrwxrwx   1 owner group          6 Feb 28 09:30 link -> target",
+			want: fileInfo{name: "link", size: 6, mode: fs.ModeSymlink | 0777, modTime: time.Date(2024, 2, 28, 9, 30, 0, 0, time.UTC)},
+		},
+		{
+			line: "01-02-06  03:04PM       <DIR>          dos dir",
+			want: fileInfo{name: "dos dir", mode: fs.ModeDir | 0755, modTime: time.Date(2006, 1, 2, 15, 4, 0, 0, time.UTC)},
+		},
+		{
+			line: "01-02-2006  03:04AM               123 dos.txt",
+			want: fileInfo{name: "dos.txt", size: 123, mode: 0644, modTime: time.Date(2006, 1, 2, 3, 4, 0, 0, time.UTC)},
+		},
+		{
+			line: "total 12",
+			want: fileInfo{},
+		},
+		{
+			line: "drwxr-xr-x   2 owner group       4096 Feb 28 09:30 ..",
+			want: fileInfo{size: 4096, mode: fs.ModeDir | 0755, modTime: time.Date(2024, 2, 28, 9, 30, 0, 0, time.UTC)},
+		},
+	} {
+		fi, err := parseList(tc.line, now)
+		if assert.NoError(t, err, tc.line) {
+			assert.Equal(t, tc.want, *fi, tc.line)
+		}
+	}
+
+	for _, line := range []string{"", "garbage", "-rw-r--r-- 1 owner group x Feb 28 09:30 a", "01-02-06 nope 1 a"} {
+		_, err := parseList(line, now)
+		assert.Error(t, err, line)
+	}
+}
+
+func TestParseFacts(t *testing.T) {
+	fi, err := parseFacts("type=file;size=3;modify=20060102150405.123;unix.mode=0600; a b.txt")
+	require.NoError(t, err)
+	assert.Equal(t, fileInfo{
+		name:    "a b.txt",
+		size:    3,
+		mode:    0600,
+		modTime: time.Date(2006, 1, 2, 15, 4, 5, 123e6, time.UTC),
+	}, *fi)
+
+	fi, err = parseFacts("Type=dir;Modify=20060102150405; dir")
+	require.NoError(t, err)
+	assert.Equal(t, "dir", fi.name)
+	assert.Equal(t, fs.ModeDir|0755, fi.mode)
+
+	fi, err = parseFacts("type=cdir;modify=20060102150405; /path/to/dir")
+	require.NoError(t, err)
+	assert.Empty(t, fi.name)
+
+	for _, line := range []string{"nospace", "size=x; a", "modify=yesterday; a", "unix.mode=999; a"} {
+		_, err := parseFacts(line)
+		assert.Error(t, err, line)
+	}
+}
@@ -0,0 +1,104 @@
+package ftp
+
+import (
+	"crypto/tls"
+	"sync"
+)
+
+// pool keeps idle control connections, so that operations run concurrently
+// on connections of their own and reuse them rather than log in again.
+type pool struct {
+	config *Config
+	tls    *tls.Config
+
+	mu     sync.Mutex
+	idle   []*conn
+	closed bool
+}
+
+// get returns an idle connection, or a new one when none is, reused tells
+// which.
+func (p *pool) get() (c *conn, reused bool, err error) {
+	p.mu.Lock()
+	if n := len(p.idle); n > 0 {
+		c = p.idle[n-1]
+		p.idle = p.idle[:n-1]
+		p.mu.Unlock()
+		return c, true, nil
+	}
+	p.mu.Unlock()
+
+	c, err = dial(p.config, p.tls)
+	return c, false, err
+}
+
+// put gives a connection back, it is closed when broken or when enough are
+// idle.
+func (p *pool) put(c *conn) {
+	if c.broken {
+		_ = c.raw.Close()
+		return
+	}
+
+	p.mu.Lock()
+	if p.closed || len(p.idle) >= p.size() {
+		p.mu.Unlock()
+		_ = c.quit()
+		return
+	}
+	p.idle = append(p.idle, c)
+	p.mu.Unlock()
+}
+
+// take runs fn on a connection and keeps it for the caller when fn succeeds.
+// A connection that was idle may have been dropped by the server meanwhile,
+// fn runs again on a new one when it broke.
+func (p *pool) take(fn func(c *conn) error) (*conn, error) {
+	c, reused, err := p.get()
+	if err != nil {
+		return nil, err
+	}
+
+	err = fn(c)
+	if err != nil && reused && c.broken {
+		p.put(c)
+		if c, err = dial(p.config, p.tls); err != nil {
+			return nil, err
+		}
+		err = fn(c)
+	}
+	if err != nil {
+		p.put(c)
+		return nil, err
+	}
+	return c, nil
+}
+
+// do runs fn on a connection and gives it back.
+func (p *pool) do(fn func(c *conn) error) error {
+	c, err := p.take(fn)
+	if err == nil {
+		p.put(c)
+	}
+	return err
+}
+
+func (p *pool) size() int {
+	if p.config.Conns > 0 {
+		return p.config.Conns
+	}
+	return defaultConns
+}
+
+// close logs out of the idle connections, the ones in use are closed when
+// they are given back.
+func (p *pool) close() {
+	p.mu.Lock()
+	idle := p.idle
+	p.idle, p.closed = nil, true
+	p.mu.Unlock()
+
+	for _, c := range idle {
+		_ = c.quit()
+	}
+}
@@ -0,0 +1,606 @@
+package ftp
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"math/big"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	testUser     = "vfs"
+	testPassword = "secret"
+)
+
+// ftpServer is an FTP server on a temporary directory, the root of the
+// paths of its clients. It accepts testUser with testPassword.
+type ftpServer struct {
+	listener net.Listener
+	dir      string
+
+	// tls enables AUTH TLS.
+	tls *tls.Config
+
+	// noMLST leaves out MLST and MLSD, so that clients use LIST.
+	noMLST bool
+
+	mu sync.Mutex
+
+	// commands counts the commands received.
+	commands map[string]int
+
+	// dropAfter cuts the data connection of the next upload after that many
+	// bytes, when positive.
+	dropAfter int64
+
+	open []net.Conn
+	wg   sync.WaitGroup
+}
+
+func newFTPServer(t *testing.T, options ...func(s *ftpServer)) *ftpServer {
+	t.Helper()
+
+	s := &ftpServer{dir: t.TempDir(), commands: map[string]int{}}
+	for _, option := range options {
+		option(s)
+	}
+
+	var err error
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(func() {
+		_ = s.listener.Close()
+		s.mu.Lock()
+		for _, conn := range s.open {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	})
+	return s
+}
+
+// withTLS makes the server accept AUTH TLS with a self-signed certificate.
+func withTLS(t *testing.T) func(s *ftpServer) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "127.0.0.1"},
+		IPAddresses:  []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	cert, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	require.NoError(t, err)
+
+	return func(s *ftpServer) {
+		s.tls = &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{cert}, PrivateKey: key}}}
+	}
+}
+
+// config returns the config of the filesystem rooted at root, logged in as
+// testUser.
+func (s *ftpServer) config(root string) *Config {
+	return &Config{
+		Addr:     s.listener.Addr().String(),
+		Root:     root,
+		User:     testUser,
+		Password: testPassword,
+		Timeout:  5 * time.Second,
+	}
+}
+
+// dsn returns the DSN of the filesystem of conf, for the conformance suite.
+func dsn(conf *Config) string {
+	return (&url.URL{Scheme: Driver, User: conf.UserInfo(), Host: conf.Addr, Path: "/" + conf.Root, RawQuery: conf.Encode().Encode()}).String()
+}
+
+func (s *ftpServer) count(command string) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.commands[command]
+}
+
+func (s *ftpServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		s.mu.Lock()
+		s.open = append(s.open, conn)
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			defer conn.Close()
+
+			sess := &session{s: s, ctrl: conn, r: bufio.NewReader(conn)}
+			sess.run()
+			if sess.pasv != nil {
+				_ = sess.pasv.Close()
+			}
+		}()
+	}
+}
+
+// session is the state of a control connection.
+type session struct {
+	s *ftpServer
+
+	ctrl net.Conn
+	r    *bufio.Reader
+
+	user   string
+	logged bool
+
+	// prot protects the data connections.
+	prot bool
+
+	// pasv listens for the next data connection in passive mode, port is
+	// the address to connect to in active mode.
+	pasv net.Listener
+	port string
+
+	rest int64
+	rnfr string
+}
+
+func (sess *session) reply(code int, format string, args ...interface{}) {
+	_, _ = fmt.Fprintf(sess.ctrl, "%d %s\r\n", code, fmt.Sprintf(format, args...))
+}
+
+func (sess *session) run() {
+	sess.reply(220, "ready")
+
+	for {
+		line, err := sess.r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		command, arg, _ := strings.Cut(strings.TrimRight(line, "\r\n"), " ")
+		command = strings.ToUpper(command)
+
+		sess.s.mu.Lock()
+		sess.s.commands[command]++
+		sess.s.mu.Unlock()
+
+		if !sess.logged {
+			switch command {
+			case "USER", "PASS", "AUTH", "FEAT", "QUIT":
+			default:
+				sess.reply(530, "not logged in")
+				continue
+			}
+		}
+		if !sess.handle(command, arg) {
+			return
+		}
+	}
+}
+
+// handle runs a command, it returns false once the session is over.
+func (sess *session) handle(command, arg string) bool {
+	rest := sess.rest
+	sess.rest = 0
+
+	switch command {
+	case "USER":
+		sess.user = arg
+		sess.reply(331, "password required")
+	case "PASS":
+		if sess.user != testUser || arg != testPassword {
+			sess.reply(530, "login incorrect")
+			break
+		}
+		sess.logged = true
+		sess.reply(230, "logged in")
+	case "AUTH":
+		if sess.s.tls == nil || strings.ToUpper(arg) != "TLS" {
+			sess.reply(502, "no TLS")
+			break
+		}
+		sess.reply(234, "TLS")
+		secure := tls.Server(sess.ctrl, sess.s.tls)
+		if err := secure.Handshake(); err != nil {
+			return false
+		}
+		sess.ctrl, sess.r = secure, bufio.NewReader(secure)
+	case "PBSZ":
+		sess.reply(200, "PBSZ=0")
+	case "PROT":
+		sess.prot = strings.ToUpper(arg) == "P"
+		sess.reply(200, "protection set")
+	case "FEAT":
+		features := []string{"EPSV", "MDTM", "MFMT", "REST STREAM", "SIZE", "UTF8"}
+		if !sess.s.noMLST {
+			features = append(features, "MLST type*;size*;modify*;unix.mode*;")
+		}
+		_, _ = fmt.Fprintf(sess.ctrl, "211-Features:\r\n %s\r\n211 End\r\n", strings.Join(features, "\r\n "))
+	case "TYPE", "OPTS", "NOOP":
+		sess.reply(200, "ok")
+	case "SYST":
+		sess.reply(215, "UNIX Type: L8")
+	case "PWD":
+		sess.reply(257, `"/" is the current directory`)
+	case "QUIT":
+		sess.reply(221, "bye")
+		return false
+	case "EPSV", "PASV":
+		listener, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			sess.reply(425, "%s", err)
+			break
+		}
+		if sess.pasv != nil {
+			_ = sess.pasv.Close()
+		}
+		sess.pasv, sess.port = listener, ""
+		port := listener.Addr().(*net.TCPAddr).Port
+		if command == "EPSV" {
+			sess.reply(229, "Entering Extended Passive Mode (|||%d|)", port)
+		} else {
+			sess.reply(227, "Entering Passive Mode (127,0,0,1,%d,%d)", port>>8, port&0xff)
+		}
+	case "PORT":
+		fields := strings.Split(arg, ",")
+		if len(fields) != 6 {
+			sess.reply(501, "bad PORT")
+			break
+		}
+		hi, _ := strconv.Atoi(fields[4])
+		lo, _ := strconv.Atoi(fields[5])
+		sess.port = net.JoinHostPort(strings.Join(fields[:4], "."), strconv.Itoa(hi<<8|lo))
+		sess.reply(200, "PORT ok")
+	case "EPRT":
+		fields := strings.Split(arg, arg[:1])
+		if len(fields) != 5 {
+			sess.reply(501, "bad EPRT")
+			break
+		}
+		sess.port = net.JoinHostPort(fields[2], fields[3])
+		sess.reply(200, "EPRT ok")
+	case "REST":
+		n, err := strconv.ParseInt(arg, 10, 64)
+		if err != nil {
+			sess.reply(501, "bad REST")
+			break
+		}
+		sess.rest = n
+		sess.reply(350, "restarting at %d", n)
+	case "RETR":
+		sess.retr(sess.path(arg), rest)
+	case "STOR", "APPE":
+		sess.stor(sess.path(arg), command == "APPE", rest)
+	case "LIST", "MLSD":
+		sess.list(sess.path(strings.TrimPrefix(arg, "-a ")), command == "MLSD")
+	case "MLST":
+		p := sess.path(arg)
+		info, err := os.Stat(p)
+		if err != nil {
+			sess.fail(err)
+			break
+		}
+		_, _ = fmt.Fprintf(sess.ctrl, "250-Listing\r\n %s %s\r\n250 End\r\n", facts(info), path.Clean("/"+arg))
+	case "SIZE":
+		info, err := os.Stat(sess.path(arg))
+		if err != nil {
+			sess.fail(err)
+			break
+		}
+		sess.reply(213, "%d", info.Size())
+	case "MDTM":
+		info, err := os.Stat(sess.path(arg))
+		if err != nil {
+			sess.fail(err)
+			break
+		}
+		sess.reply(213, "%s", info.ModTime().UTC().Format("20060102150405"))
+	case "MFMT":
+		stamp, name, _ := strings.Cut(arg, " ")
+		mtime, err := time.ParseInLocation("20060102150405", stamp, time.UTC)
+		if err != nil {
+			sess.reply(501, "bad time")
+			break
+		}
+		if err := os.Chtimes(sess.path(name), mtime, mtime); err != nil {
+			sess.fail(err)
+			break
+		}
+		sess.reply(213, "Modify=%s; %s", stamp, name)
+	case "DELE":
+		p := sess.path(arg)
+		if info, err := os.Lstat(p); err == nil && info.IsDir() {
+			sess.reply(550, "is a directory")
+			break
+		}
+		sess.result(250, os.Remove(p))
+	case "RMD":
+		p := sess.path(arg)
+		if info, err := os.Lstat(p); err == nil && !info.IsDir() {
+			sess.reply(550, "not a directory")
+			break
+		}
+		sess.result(250, os.Remove(p))
+	case "MKD":
+		if err := os.Mkdir(sess.path(arg), 0755); err != nil {
+			sess.fail(err)
+			break
+		}
+		sess.reply(257, `"%s" created`, arg)
+	case "RNFR":
+		p := sess.path(arg)
+		if _, err := os.Lstat(p); err != nil {
+			sess.fail(err)
+			break
+		}
+		sess.rnfr = p
+		sess.reply(350, "ready for RNTO")
+	case "RNTO":
+		if sess.rnfr == "" {
+			sess.reply(503, "RNFR first")
+			break
+		}
+		err := os.Rename(sess.rnfr, sess.path(arg))
+		sess.rnfr = ""
+		sess.result(250, err)
+	case "SITE":
+		params := strings.SplitN(arg, " ", 3)
+		if len(params) != 3 || strings.ToUpper(params[0]) != "CHMOD" {
+			sess.reply(504, "unknown SITE command")
+			break
+		}
+		mode, err := strconv.ParseUint(params[1], 8, 32)
+		if err != nil {
+			sess.reply(501, "bad mode")
+			break
+		}
+		sess.result(200, os.Chmod(sess.path(params[2]), fs.FileMode(mode)))
+	default:
+		sess.reply(502, "%s not implemented", command)
+	}
+	return true
+}
+
+// path returns the path on the host of a path of the client.
+func (sess *session) path(name string) string {
+	return filepath.Join(sess.s.dir, path.Clean("/"+name))
+}
+
+func (sess *session) fail(err error) {
+	sess.reply(550, "%s", err)
+}
+
+func (sess *session) result(code int, err error) {
+	if err != nil {
+		sess.fail(err)
+		return
+	}
+	sess.reply(code, "ok")
+}
+
+// data opens the data connection of a transfer, once accepted with 150.
+func (sess *session) data() (net.Conn, error) {
+	sess.reply(150, "opening data connection")
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	switch {
+	case sess.pasv != nil:
+		_ = sess.pasv.(*net.TCPListener).SetDeadline(time.Now().Add(5 * time.Second))
+		conn, err = sess.pasv.Accept()
+		_ = sess.pasv.Close()
+		sess.pasv = nil
+	case sess.port != "":
+		conn, err = net.DialTimeout("tcp", sess.port, 5*time.Second)
+		sess.port = ""
+	default:
+		err = errors.New("no data connection")
+	}
+	if err != nil {
+		sess.reply(425, "%s", err)
+		return nil, err
+	}
+
+	if sess.prot {
+		secure := tls.Server(conn, sess.s.tls)
+		if err := secure.Handshake(); err != nil {
+			_ = conn.Close()
+			sess.reply(425, "%s", err)
+			return nil, err
+		}
+		conn = secure
+	}
+	return conn, nil
+}
+
+func (sess *session) retr(p string, rest int64) {
+	f, err := os.Open(p)
+	if err != nil {
+		sess.fail(err)
+		return
+	}
+	defer f.Close()
+	if info, err := f.Stat(); err != nil || info.IsDir() {
+		sess.reply(550, "not a file")
+		return
+	}
+	if _, err := f.Seek(rest, io.SeekStart); err != nil {
+		sess.fail(err)
+		return
+	}
+
+	conn, err := sess.data()
+	if err != nil {
+		return
+	}
+	_, err = io.Copy(conn, f)
+	_ = conn.Close()
+	if err != nil {
+		sess.reply(426, "transfer aborted: %s", err)
+		return
+	}
+	sess.reply(226, "transfer complete")
+}
+
+func (sess *session) stor(p string, appendTo bool, rest int64) {
+	flag := os.O_WRONLY | os.O_CREATE
+	switch {
+	case appendTo:
+		flag |= os.O_APPEND
+	case rest == 0:
+		flag |= os.O_TRUNC
+	}
+	f, err := os.OpenFile(p, flag, 0644)
+	if err != nil {
+		sess.fail(err)
+		return
+	}
+	defer f.Close()
+	if rest > 0 {
+		if err := f.Truncate(rest); err != nil {
+			sess.fail(err)
+			return
+		}
+		if _, err := f.Seek(rest, io.SeekStart); err != nil {
+			sess.fail(err)
+			return
+		}
+	}
+
+	conn, err := sess.data()
+	if err != nil {
+		return
+	}
+
+	sess.s.mu.Lock()
+	drop := sess.s.dropAfter
+	sess.s.dropAfter = 0
+	sess.s.mu.Unlock()
+
+	if drop > 0 {
+		_, _ = io.CopyN(f, conn, drop)
+		_ = conn.Close()
+		sess.reply(426, "connection closed, transfer aborted")
+		return
+	}
+
+	_, err = io.Copy(f, conn)
+	_ = conn.Close()
+	if err != nil {
+		sess.reply(426, "transfer aborted: %s", err)
+		return
+	}
+	sess.reply(226, "transfer complete")
+}
+
+func (sess *session) list(p string, mlsd bool) {
+	info, err := os.Stat(p)
+	if err != nil {
+		sess.fail(err)
+		return
+	}
+	if mlsd && !info.IsDir() {
+		sess.reply(501, "not a directory")
+		return
+	}
+
+	var infos []fs.FileInfo
+	if info.IsDir() {
+		entries, err := os.ReadDir(p)
+		if err != nil {
+			sess.fail(err)
+			return
+		}
+		for _, entry := range entries {
+			if info, err := entry.Info(); err == nil {
+				infos = append(infos, info)
+			}
+		}
+	} else {
+		infos = append(infos, info)
+	}
+	sort.Slice(infos, func(i, j int) bool { return infos[i].Name() < infos[j].Name() })
+
+	conn, err := sess.data()
+	if err != nil {
+		return
+	}
+	w := bufio.NewWriter(conn)
+	if mlsd {
+		_, _ = fmt.Fprintf(w, "type=cdir;modify=%s; .\r\n", info.ModTime().UTC().Format("20060102150405"))
+	} else {
+		_, _ = fmt.Fprintf(w, "total %d\r\n", len(infos))
+	}
+	for _, info := range infos {
+		if mlsd {
+			_, _ = fmt.Fprintf(w, "%s %s\r\n", facts(info), info.Name())
+		} else {
+			_, _ = fmt.Fprintf(w, "%s\r\n", lsLine(info))
+		}
+	}
+	_ = w.Flush()
+	_ = conn.Close()
+	sess.reply(226, "transfer complete")
+}
+
+// facts returns the facts of MLST and MLSD about info.
+func facts(info fs.FileInfo) string {
+	kind := "file"
+	if info.IsDir() {
+		kind = "dir"
+	}
+	return fmt.Sprintf("type=%s;size=%d;modify=%s;unix.mode=%04o;",
+		kind, info.Size(), info.ModTime().UTC().Format("20060102150405"), info.Mode().Perm())
+}
+
+// lsLine returns the line of ls -l about info.
+func lsLine(info fs.FileInfo) string {
+	mode := []byte("-rwxrwxrwx")
+	switch {
+	case info.IsDir():
+		mode[0] = 'd'
+	case info.Mode()&fs.ModeSymlink != 0:
+		mode[0] = 'l'
+	}
+	for i := 0; i < 9; i++ {
+		if info.Mode().Perm()&(1<<uint(8-i)) == 0 {
+			mode[i+1] = '-'
+		}
+	}
+
+	stamp := info.ModTime().UTC().Format("Jan _2 15:04")
+	if time.Since(info.ModTime()) > 180*24*time.Hour {
+		stamp = info.ModTime().UTC().Format("Jan _2  2006")
+	}
+	return fmt.Sprintf("%s 1 owner group %8d %s %s", mode, info.Size(), stamp, info.Name())
+}
@@ -0,0 +1,167 @@
+package memory
+
+import (
+	"sync/atomic"
+)
+
+// chunkSize is the most bytes of a file a chunk holds.
+const chunkSize = 64 << 10
+
+// memChunk is a piece of a file, shared by every version and clone of the
+// file that did not change it.
+//
+// buf never changes size. The bytes below claimed belong to the versions
+// sharing the chunk, the bytes above it are zero and free: a version whose
+// content ends at claimed grows into them without copying the chunk, any
+// other change copies it first.
+type memChunk struct {
+	// edit that created the chunk, it writes anywhere until it is published.
+	edit uint64
+
+	buf []byte
+
+	claimed int64
+}
+
+func newMemChunk(edit uint64, size int, content []byte) *memChunk {
+	c := &memChunk{edit: edit, buf: make([]byte, size)}
+	copy(c.buf, content)
+	return c
+}
+
+// claim grows the bytes owned by a version from old to new, it fails when
+// another version owns bytes past old.
+func (c *memChunk) claim(old, new int) bool {
+	if old == new {
+		return true
+	}
+	return atomic.CompareAndSwapInt64(&c.claimed, int64(old), int64(new))
+}
+
+// memData is the content of a file by chunk index. A missing chunk is a hole
+// that reads as zeros, as do the bytes of a chunk past the end of its buf.
+// There is no chunk past the end of the file.
+type memData struct {
+	chunks hamt[*memChunk]
+
+	size int64
+}
+
+// visible returns how many bytes of chunk i are in the file.
+func (d memData) visible(i int64) int {
+	v := d.size - i*chunkSize
+	switch {
+	case v < 0:
+		return 0
+	case v > chunkSize:
+		return chunkSize
+	}
+	return int(v)
+}
+
+// owned returns how many bytes of the buf of c the version of chunk i owns.
+func (d memData) owned(i int64, c *memChunk) int {
+	return minInt(d.visible(i), len(c.buf))
+}
+
+func (d memData) chunk(i int64) *memChunk {
+	c, _ := d.chunks.get(uint64(i))
+	return c
+}
+
+// readAt copies the content at off into p and returns the number of bytes
+// copied, less than len(p) at the end of the file only.
+func (d memData) readAt(p []byte, off int64) int {
+	n := 0
+	for n < len(p) && off < d.size {
+		i, o := off/chunkSize, int(off%chunkSize)
+		q := p[n : n+minInt(len(p)-n, d.visible(i)-o)]
+
+		k := 0
+		if c := d.chunk(i); c != nil && o < len(c.buf) {
+			k = copy(q, c.buf[o:d.owned(i, c)])
+		}
+		for j := k; j < len(q); j++ {
+			q[j] = 0
+		}
+
+		n += len(q)
+		off += int64(len(q))
+	}
+	return n
+}
+
+// truncate returns the data resized to size, within the edit.
+func (d memData) truncate(edit uint64, size int64) memData {
+	if size < d.size {
+		// chunks past the end go, the version ending in a chunk keeps it as
+		// it is: it simply owns fewer of its bytes
+		for i := (size + chunkSize - 1) / chunkSize; i*chunkSize < d.size; i++ {
+			d.chunks = d.chunks.deleteIn(edit, uint64(i))
+		}
+		d.size = size
+		return d
+	}
+
+	tail := d.size / chunkSize
+	grown := memData{chunks: d.chunks, size: size}
+
+	// the last chunk must own the bytes it gains, they are zero
+	if c := d.chunk(tail); c != nil && !c.claim(d.owned(tail, c), grown.owned(tail, c)) {
+		copied := newMemChunk(edit, len(c.buf), c.buf[:d.owned(tail, c)])
+		copied.claimed = int64(grown.owned(tail, copied))
+		grown.chunks = grown.chunks.setIn(edit, uint64(tail), copied)
+	}
+	return grown
+}
+
+// writeAt returns the data with p written at off, within the edit.
+func (d memData) writeAt(edit uint64, p []byte, off int64) memData {
+	written := d
+	if end := off + int64(len(p)); end > d.size {
+		written = d.truncate(edit, end)
+	}
+
+	for len(p) > 0 {
+		i, o := off/chunkSize, int(off%chunkSize)
+		n := minInt(len(p), chunkSize-o)
+
+		c := written.chunk(i)
+		switch {
+		case c == nil:
+			c = newMemChunk(edit, o+n, nil)
+		case o+n > len(c.buf):
+			// double the buf, appending to a chunk copies it a few times only
+			size := minInt(chunkSize, maxInt(o+n, 2*len(c.buf)))
+			c = newMemChunk(edit, size, c.buf[:written.owned(i, c)])
+		case o < d.owned(i, c) && c.edit != edit:
+			// other versions see these bytes
+			c = newMemChunk(edit, len(c.buf), c.buf[:written.owned(i, c)])
+		}
+		if owned := int64(written.owned(i, c)); c.edit == edit && owned > c.claimed {
+			// bytes the edit left past the end stay claimed, they may not be zero
+			c.claimed = owned
+		}
+
+		copy(c.buf[o:], p[:n])
+		written.chunks = written.chunks.setIn(edit, uint64(i), c)
+
+		p = p[n:]
+		off += int64(n)
+	}
+	return written
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func maxInt(a, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
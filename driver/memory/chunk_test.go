@@ -0,0 +1,88 @@
+package memory
+
+import (
+	"bytes"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+// chunkVersion is a version of a file and the content it should have.
+type chunkVersion struct {
+	data memData
+	want []byte
+}
+
+func (v chunkVersion) writeAt(edit uint64, p []byte, off int64) chunkVersion {
+	want := append([]byte(nil), v.want...)
+	if end := int(off) + len(p); end > len(want) {
+		want = append(want, make([]byte, end-len(want))...)
+	}
+	copy(want[off:], p)
+	return chunkVersion{data: v.data.writeAt(edit, p, off), want: want}
+}
+
+func (v chunkVersion) truncate(edit uint64, size int64) chunkVersion {
+	want := append([]byte(nil), v.want...)
+	if int(size) > len(want) {
+		want = append(want, make([]byte, int(size)-len(want))...)
+	}
+	return chunkVersion{data: v.data.truncate(edit, size), want: want[:size]}
+}
+
+func TestMemData(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+	versions := []chunkVersion{{}}
+
+	for i := 0; i < 3000; i++ {
+		// any version may change, like a file and its clones or an unlinked
+		// file and its handles
+		v := versions[rnd.Intn(len(versions))]
+		edit := newHamtEdit()
+
+		// an edit may change what it created several times
+		for ops := 1 + rnd.Intn(3); ops > 0; ops-- {
+			size := int64(len(v.want))
+			switch rnd.Intn(4) {
+			case 0:
+				v = v.truncate(edit, rnd.Int63n(4*chunkSize))
+			case 1:
+				p := bytes.Repeat([]byte{byte('a' + i%26)}, rnd.Intn(2*chunkSize))
+				v = v.writeAt(edit, p, rnd.Int63n(5*chunkSize))
+			default:
+				p := bytes.Repeat([]byte{byte('A' + i%26)}, 1+rnd.Intn(chunkSize/4))
+				v = v.writeAt(edit, p, size)
+			}
+		}
+		versions = append(versions, v)
+
+		if i%1000 == 999 {
+			for j, v := range versions {
+				require.Equal(t, int64(len(v.want)), v.data.size, "version %d", j)
+				got := make([]byte, len(v.want))
+				require.Equal(t, len(got), v.data.readAt(got, 0))
+				require.True(t, bytes.Equal(v.want, got), "version %d", j)
+			}
+		}
+	}
+}
+
+func TestMemDataSparse(t *testing.T) {
+	var d memData
+	d = d.truncate(newHamtEdit(), 5<<30)
+	d = d.writeAt(newHamtEdit(), []byte("end"), 5<<30-3)
+	d = d.writeAt(newHamtEdit(), []byte("mid"), 2<<30)
+
+	assert.Equal(t, int64(5<<30), d.size)
+	assert.Equal(t, 2, d.chunks.Len(), "holes take no chunks")
+
+	p := make([]byte, 8)
+	assert.Equal(t, 3, d.readAt(p, 5<<30-3))
+	assert.Equal(t, "end", string(p[:3]))
+	assert.Equal(t, 8, d.readAt(p, 2<<30-2))
+	assert.Equal(t, "\x00\x00mid\x00\x00\x00", string(p))
+
+	d = d.truncate(newHamtEdit(), 1<<30)
+	assert.Equal(t, 0, d.chunks.Len(), "truncating releases the chunks past the end")
+}
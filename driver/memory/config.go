@@ -4,29 +4,87 @@ import (
 	"github.com/lazychanger/go-vfs"
 	"net/url"
 	"strconv"
+	"time"
 )
 
 type Config struct {
 	filesystem.Config
 
 	MaxSize int64
+
+	// Name of the shared tree, the host of the DSN.
+	Name string
+
+	// Isolated opens a tree of its own even when Name is set.
+	Isolated bool
+
+	// Load is the path of a snapshot on the host the tree starts from.
+	Load string
+
+	// WAL is the directory on the host of the write-ahead log that makes the
+	// tree persistent, none when empty.
+	WAL string
+
+	// Sync is the policy of syncing the log to disk: SyncAlways,
+	// SyncInterval, the default, or SyncNever.
+	Sync string
+
+	// SyncInterval is the period of SyncInterval, a second by default.
+	SyncInterval time.Duration
+
+	// CompactSize is the size of the log past which it is compacted into a
+	// checkpoint, 64 MiB by default.
+	CompactSize int64
 }
 
 func (conf *Config) Driver() string {
 	return Driver
 }
 
+func (conf *Config) Host() string {
+	return conf.Name
+}
+
+func (conf *Config) Path() string {
+	return "/"
+}
+
 // Encode the options to url.Values
 func (conf *Config) Encode() url.Values {
-	return url.Values{
+	values := url.Values{
 		"maxsize": []string{strconv.FormatInt(conf.MaxSize, 10)},
 	}
+	if conf.Isolated {
+		values.Set("isolated", "true")
+	}
+	if conf.Load != "" {
+		values.Set("load", conf.Load)
+	}
+	if conf.WAL != "" {
+		values.Set("wal", conf.WAL)
+	}
+	if conf.Sync != "" {
+		values.Set("fsync", conf.Sync)
+	}
+	if conf.SyncInterval != 0 {
+		values.Set("fsyncinterval", conf.SyncInterval.String())
+	}
+	if conf.CompactSize != 0 {
+		values.Set("compact", strconv.FormatInt(conf.CompactSize, 10))
+	}
+	return values
 }
 
 // Decode the url.Values to options
 func (conf *Config) Decode(query url.Values) error {
 
 	conf.MaxSize, _ = strconv.ParseInt(query.Get("maxsize"), 10, 64)
+	conf.Isolated, _ = strconv.ParseBool(query.Get("isolated"))
+	conf.Load = query.Get("load")
+	conf.WAL = query.Get("wal")
+	conf.Sync = query.Get("fsync")
+	conf.SyncInterval, _ = time.ParseDuration(query.Get("fsyncinterval"))
+	conf.CompactSize, _ = strconv.ParseInt(query.Get("compact"), 10, 64)
 
 	return nil
 }
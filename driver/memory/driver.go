@@ -3,6 +3,7 @@ package memory
 import (
 	"github.com/lazychanger/go-vfs"
 	"net/url"
+	"sync"
 )
 
 const Driver = "memory"
@@ -14,10 +15,104 @@ func init() {
 type fsDriver struct {
 }
 
+// Open returns a new tree for memory:///, and the tree shared by every Open
+// of the same name for memory://name/ until all of them are closed. The
+// options of the first Open of a name apply, isolated=true opts out of the
+// sharing. load=path fills a new tree with the snapshot at path on the host.
+// wal=dir keeps the tree in a write-ahead log in dir on the host, a tree
+// restored from its log is not loaded again.
 func (m *fsDriver) Open(uri *url.URL) (filesystem.FileSystem, error) {
 	conf := &Config{}
 	_ = conf.Decode(uri.Query())
+	conf.Name = uri.Host
 
-	return New(conf, "/"), nil
+	if conf.Name == "" || conf.Isolated {
+		vfs := New(conf, "/").(*memFs)
+		if err := vfs.init(conf); err != nil {
+			return nil, err
+		}
+		return vfs, nil
+	}
 
+	return named.open(conf)
+}
+
+// named holds the trees shared by name.
+var named = &memInstances{trees: make(map[string]*memInstance)}
+
+type memInstances struct {
+	trees map[string]*memInstance
+
+	sync.Mutex
+}
+
+// memInstance is a named tree and the number of open filesystems on it.
+type memInstance struct {
+	tree *memTree
+
+	refs int
+}
+
+func (s *memInstances) open(conf *Config) (filesystem.FileSystem, error) {
+	s.Lock()
+	defer s.Unlock()
+
+	instance, ok := s.trees[conf.Name]
+	if !ok {
+		instance = &memInstance{tree: newMemTree(conf)}
+	}
+
+	vfs := &memFs{
+		tree: instance.tree,
+		id:   rootID,
+		root: "/",
+		life: &memLife{release: func() error { return s.release(conf.Name, instance) }},
+		top:  true,
+	}
+
+	if !ok {
+		if err := vfs.init(conf); err != nil {
+			return nil, err
+		}
+		s.trees[conf.Name] = instance
+	}
+	instance.refs++
+
+	return vfs, nil
+}
+
+// release drops a reference to the instance, the last one forgets and
+// closes the tree.
+func (s *memInstances) release(name string, instance *memInstance) error {
+	s.Lock()
+	defer s.Unlock()
+
+	instance.refs--
+	if instance.refs > 0 {
+		return nil
+	}
+	if s.trees[name] == instance {
+		delete(s.trees, name)
+	}
+	return instance.tree.close()
+}
+
+// init fills the new tree of vfs as conf says: from its write-ahead log, or
+// else from the snapshot to load.
+func (m *memFs) init(conf *Config) error {
+	restored := false
+	if conf.WAL != "" {
+		var err error
+		if restored, err = openWAL(m, conf); err != nil {
+			return err
+		}
+	}
+
+	if conf.Load != "" && !restored {
+		if err := m.load(conf.Load); err != nil {
+			_ = m.tree.close()
+			return err
+		}
+	}
+	return nil
 }
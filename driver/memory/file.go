@@ -1,86 +1,382 @@
 package memory
 
 import (
-	"bytes"
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"io"
 	"io/fs"
 	"sync"
+	"syscall"
 	"time"
 )
 
-func newMemFile(name string, buf []byte, isDir bool) *memFile {
-	return &memFile{
-		buf: bytes.NewBuffer(buf),
-		fi: &memFileInfo{
-			name:  name,
-			isDir: isDir,
-			ctime: time.Now(),
-		},
+// memHandle is an open memory file.
+// implements io.Writer, io.Reader, io.Closer, io.ReaderAt, io.WriterAt,
+// io.Seeker
+// Writes are appended to the file, reads start at the beginning of the file
+// and advance an offset of their own that Seek moves.
+type memHandle struct {
+	tree *memTree
+
+	id uint64
+
+	// name is the base name of the file when it was opened, file the name
+	// it was opened by in vfs.
+	name string
+	vfs  *memFs
+	file string
+
+	// last is the version of the file the handle saw last. Once the file is
+	// unlinked the handle keeps working on a private copy of it.
+	last     *memInode
+	detached bool
+
+	off int64
+
+	// release untracks the handle once it is closed.
+	release func()
+	closed  bool
+
+	sync.Mutex
+}
+
+func newMemHandle(vfs *memFs, ino *memInode, name, file string) *memHandle {
+	return &memHandle{tree: vfs.tree, id: ino.id, name: name, vfs: vfs, file: file, last: ino}
+}
+
+// memTracked is a handle the filesystem tracks until it is closed.
+type memTracked interface {
+	filesystem.File
+	tracked(release func())
+}
+
+// errUnlinked aborts the update of a file that is no longer in the tree.
+var errUnlinked = errors.New("unlinked")
+
+func (m *memHandle) Write(p []byte) (n int, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return 0, m.error("write", fs.ErrClosed)
 	}
+
+	err = m.change(memChange{p: p, append: true})
+	if err != nil {
+		return 0, m.error("write", err)
+	}
+	return len(p), nil
 }
 
-// memFile is a memory file implementation.
-// implements io.Writer, io.Reader, io.Closer, fs.FileInfo
-type memFile struct {
-	buf *bytes.Buffer
+// WriteAt writes p at off, past the end of the file it leaves a hole that
+// reads as zeros.
+func (m *memHandle) WriteAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, m.error("writeat", errors.New("negative offset"))
+	}
+
+	m.Lock()
+	defer m.Unlock()
 
-	fi *memFileInfo
+	if m.closed {
+		return 0, m.error("writeat", fs.ErrClosed)
+	}
 
-	sync.Mutex
+	err = m.change(memChange{p: p, off: off})
+	if err != nil {
+		return 0, m.error("writeat", err)
+	}
+	return len(p), nil
+}
+
+// Truncate changes the size of the file, see os.File.Truncate.
+func (m *memHandle) Truncate(size int64) error {
+	if size < 0 {
+		return m.error("truncate", syscall.EINVAL)
+	}
+
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return m.error("truncate", fs.ErrClosed)
+	}
+
+	err := m.change(memChange{off: size, truncate: true})
+	if err != nil {
+		return m.error("truncate", err)
+	}
+	return nil
 }
 
-func (m *memFile) Write(p []byte) (n int, err error) {
+// change changes the content of the file.
+func (m *memHandle) change(c memChange) error {
+	if !m.detached {
+		err := m.tree.update(func(tx *memTx) error {
+			ino := tx.get(m.id)
+			if ino == nil {
+				return errUnlinked
+			}
+
+			ino, err := tx.change(ino, c, time.Now())
+			if err != nil {
+				return err
+			}
+			m.last = ino
+			return nil
+		})
+		if err != errUnlinked {
+			return err
+		}
+		m.detach()
+	}
+
+	m.last.data = c.apply(m.last.data, m.last.edit)
+	m.last.modTime = time.Now()
+	return nil
+}
+
+// current returns the latest version of the file.
+func (m *memHandle) current() *memInode {
+	if !m.detached {
+		if ino := m.tree.load().get(m.id); ino != nil {
+			m.last = ino
+		} else {
+			m.detach()
+		}
+	}
+	return m.last
+}
+
+// detach makes the last version seen the private copy of the handle, it
+// shares the content with the unlinked file until either changes.
+func (m *memHandle) detach() {
+	c := m.last.clone()
+	c.edit = newHamtEdit()
+	m.last = c
+	m.detached = true
+}
+
+func (m *memHandle) Stat() (fs.FileInfo, error) {
 	m.Lock()
 	defer m.Unlock()
-	n, err = m.buf.Write(p)
-	m.fi.ctime = time.Now()
-	m.fi.size += int64(n)
-	return
+
+	if m.closed {
+		return nil, m.error("stat", fs.ErrClosed)
+	}
+
+	return newMemFileInfo(m.name, m.current()), nil
 }
 
-func (m *memFile) Stat() (fs.FileInfo, error) {
-	return m.fi, nil
+func (m *memHandle) Read(bytes []byte) (n int, err error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return 0, m.error("read", fs.ErrClosed)
+	}
+
+	ino := m.current()
+	if m.off >= ino.size() {
+		return 0, io.EOF
+	}
+	n = ino.data.readAt(bytes, m.off)
+	m.off += int64(n)
+
+	return n, nil
 }
 
-func (m *memFile) Read(bytes []byte) (n int, err error) {
+func (m *memHandle) ReadAt(bytes []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, m.error("readat", errors.New("negative offset"))
+	}
+
 	m.Lock()
 	defer m.Unlock()
-	n, err = m.buf.Read(bytes)
-	m.fi.size -= int64(n)
-	m.fi.ctime = time.Now()
 
-	return n, err
+	if m.closed {
+		return 0, m.error("readat", fs.ErrClosed)
+	}
+
+	n = m.current().data.readAt(bytes, off)
+	if n < len(bytes) {
+		return n, io.EOF
+	}
+	return n, nil
 }
 
-func (m *memFile) Close() error {
+// Seek sets the offset of the next Read, see io.Seeker. Writes still go to
+// the end of the file.
+func (m *memHandle) Seek(offset int64, whence int) (int64, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return 0, m.error("seek", fs.ErrClosed)
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += m.off
+	case io.SeekEnd:
+		offset += m.current().size()
+	case io.SeekStart:
+	default:
+		return 0, m.error("seek", syscall.EINVAL)
+	}
+	if offset < 0 {
+		return 0, m.error("seek", syscall.EINVAL)
+	}
+
+	m.off = offset
+	return offset, nil
+}
+
+func (m *memHandle) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return m.error("close", fs.ErrClosed)
+	}
+	m.closed = true
+	m.release()
 	return nil
 }
 
-//func (m *memFile) Copy() *memFile {
-//	m.Lock()
-//	defer m.Unlock()
-//
-//	data := make([]byte, m.fi.size)
-//
-//	copy(data, m.buf.Bytes())
-//
-//	return &memFile{
-//		buf: bytes.NewBuffer(data),
-//		fi: &memFileInfo{
-//			name:  m.fi.name,
-//			size:  m.fi.size,
-//			ctime: m.fi.ctime,
-//		},
-//	}
-//}
-
-// memDirEntry see fs.FileInfo
+func (m *memHandle) tracked(release func()) {
+	m.release = release
+}
+
+func (m *memHandle) error(op string, err error) error {
+	return &fs.PathError{Op: op, Path: m.vfs.path(m.file), Err: err}
+}
+
+// memDirHandle is an open memory directory.
+// implements filesystem.ReadDirFile
+// The entries are read once, sorted by name, on the first ReadDir: later
+// changes to the directory do not show up in the handle, so that paging
+// through it never skips or repeats an entry.
+type memDirHandle struct {
+	tree *memTree
+
+	// dir is the directory when it was opened.
+	dir *memInode
+
+	name string
+	vfs  *memFs
+	file string
+
+	entries []fs.DirEntry
+
+	// off is the index of the next entry.
+	off int
+
+	// release untracks the handle once it is closed.
+	release func()
+	closed  bool
+
+	sync.Mutex
+}
+
+func newMemDirHandle(vfs *memFs, dir *memInode, name, file string) *memDirHandle {
+	return &memDirHandle{tree: vfs.tree, dir: dir, name: name, vfs: vfs, file: file}
+}
+
+func (m *memDirHandle) ReadDir(n int) ([]fs.DirEntry, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return nil, m.error("readdirent", fs.ErrClosed)
+	}
+
+	if m.entries == nil {
+		t := m.tree.load()
+		if dir := t.get(m.dir.id); dir != nil {
+			m.dir = dir
+		}
+		m.entries = entries(t, m.dir)
+	}
+
+	rest := m.entries[m.off:]
+	if n <= 0 {
+		m.off = len(m.entries)
+		return rest, nil
+	}
+
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	m.off += n
+	return rest[:n:n], nil
+}
+
+func (m *memDirHandle) Stat() (fs.FileInfo, error) {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return nil, m.error("stat", fs.ErrClosed)
+	}
+
+	if dir := m.tree.load().get(m.dir.id); dir != nil {
+		return newMemFileInfo(m.name, dir), nil
+	}
+	return newMemFileInfo(m.name, m.dir), nil
+}
+
+func (m *memDirHandle) Read(p []byte) (int, error) {
+	return 0, m.error("read", syscall.EISDIR)
+}
+
+func (m *memDirHandle) Write(p []byte) (int, error) {
+	return 0, m.error("write", syscall.EBADF)
+}
+
+func (m *memDirHandle) Close() error {
+	m.Lock()
+	defer m.Unlock()
+
+	if m.closed {
+		return m.error("close", fs.ErrClosed)
+	}
+	m.closed = true
+	m.entries = nil
+	m.release()
+	return nil
+}
+
+func (m *memDirHandle) tracked(release func()) {
+	m.release = release
+}
+
+func (m *memDirHandle) error(op string, err error) error {
+	return &fs.PathError{Op: op, Path: m.vfs.path(m.file), Err: err}
+}
+
+// memFileInfo see fs.FileInfo
 type memFileInfo struct {
 	name  string
 	size  int64
-	isDir bool
+	mode  fs.FileMode
 	ctime time.Time
 }
 
+func newMemFileInfo(name string, ino *memInode) *memFileInfo {
+	fi := &memFileInfo{name: name, size: ino.size(), mode: ino.mode, ctime: ino.modTime}
+	switch {
+	case ino.isDir:
+		fi.mode |= fs.ModeDir
+	case ino.isSymlink():
+		fi.size = int64(len(ino.link))
+	}
+	return fi
+}
+
 func (m *memFileInfo) Name() string {
 	return m.name
 }
@@ -90,7 +386,7 @@ func (m *memFileInfo) Size() int64 {
 }
 
 func (m *memFileInfo) Mode() fs.FileMode {
-	return fs.FileMode(0)
+	return m.mode
 }
 
 func (m *memFileInfo) ModTime() time.Time {
@@ -98,7 +394,7 @@ func (m *memFileInfo) ModTime() time.Time {
 }
 
 func (m *memFileInfo) IsDir() bool {
-	return m.isDir
+	return m.mode.IsDir()
 }
 
 func (m *memFileInfo) Sys() any {
@@ -107,7 +403,7 @@ func (m *memFileInfo) Sys() any {
 
 // memDirEntry see fs.DirEntry
 type memDirEntry struct {
-	fi fs.FileInfo
+	fi memFileInfo
 }
 
 func (m *memDirEntry) Name() string {
@@ -119,9 +415,10 @@ func (m *memDirEntry) IsDir() bool {
 }
 
 func (m *memDirEntry) Type() fs.FileMode {
-	return m.fi.Mode()
+	return m.fi.Mode().Type()
 }
 
 func (m *memDirEntry) Info() (fs.FileInfo, error) {
-	return m.fi, nil
+	fi := m.fi
+	return &fi, nil
 }
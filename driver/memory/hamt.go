@@ -0,0 +1,246 @@
+package memory
+
+import (
+	"math/bits"
+	"sync/atomic"
+)
+
+const (
+	hamtBits  = 5
+	hamtWidth = 1 << hamtBits
+	hamtMask  = hamtWidth - 1
+)
+
+// hamt is a persistent hash array mapped trie keyed by uint64. Updates
+// return a new hamt sharing all untouched nodes with the old one, so a hamt
+// value never changes and is safe to read without locks.
+type hamt[V any] struct {
+	root *hamtNode[V]
+
+	len int
+}
+
+// hamtNode holds a slot for every bit set in bitmap, in bit order.
+type hamtNode[V any] struct {
+	// edit is the batch of updates that created the node, see newHamtEdit.
+	edit uint64
+
+	bitmap uint32
+
+	slots []hamtSlot[V]
+}
+
+// hamtSlot is either a sub node or a single key.
+type hamtSlot[V any] struct {
+	sub *hamtNode[V]
+
+	key uint64
+	val V
+}
+
+var hamtEdits uint64
+
+// newHamtEdit starts a batch of updates. Nodes created by the batch are
+// changed in place by its later updates, so that a batch copies each node at
+// most once. A batch must end before the hamts it built are shared, edit 0
+// copies every node it changes.
+func newHamtEdit() uint64 {
+	return atomic.AddUint64(&hamtEdits, 1)
+}
+
+func (h hamt[V]) Len() int {
+	return h.len
+}
+
+func (h hamt[V]) get(key uint64) (V, bool) {
+	node := h.root
+	for shift := uint(0); node != nil; shift += hamtBits {
+		bit := uint32(1) << ((key >> shift) & hamtMask)
+		if node.bitmap&bit == 0 {
+			break
+		}
+
+		slot := &node.slots[bits.OnesCount32(node.bitmap&(bit-1))]
+		if slot.sub != nil {
+			node = slot.sub
+			continue
+		}
+		if slot.key == key {
+			return slot.val, true
+		}
+		break
+	}
+
+	var zero V
+	return zero, false
+}
+
+func (h hamt[V]) set(key uint64, val V) hamt[V] {
+	return h.setIn(0, key, val)
+}
+
+func (h hamt[V]) delete(key uint64) hamt[V] {
+	return h.deleteIn(0, key)
+}
+
+// setIn is set changing the nodes created by edit in place.
+func (h hamt[V]) setIn(edit uint64, key uint64, val V) hamt[V] {
+	root, added := h.root.set(edit, 0, key, val)
+	if added {
+		return hamt[V]{root: root, len: h.len + 1}
+	}
+	return hamt[V]{root: root, len: h.len}
+}
+
+// deleteIn is delete changing the nodes created by edit in place.
+func (h hamt[V]) deleteIn(edit uint64, key uint64) hamt[V] {
+	root, removed := h.root.delete(edit, 0, key)
+	if !removed {
+		return h
+	}
+	if len(root.slots) == 0 {
+		root = nil
+	}
+	return hamt[V]{root: root, len: h.len - 1}
+}
+
+// each calls fn for every key until fn returns false, in no particular order.
+func (h hamt[V]) each(fn func(key uint64, val V) bool) {
+	if h.root != nil {
+		h.root.each(fn)
+	}
+}
+
+func (n *hamtNode[V]) set(edit uint64, shift uint, key uint64, val V) (*hamtNode[V], bool) {
+	bit := uint32(1) << ((key >> shift) & hamtMask)
+
+	if n == nil {
+		return &hamtNode[V]{edit: edit, bitmap: bit, slots: []hamtSlot[V]{{key: key, val: val}}}, true
+	}
+
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+
+	if n.bitmap&bit == 0 {
+		return n.insert(edit, i, bit, hamtSlot[V]{key: key, val: val}), true
+	}
+
+	slot := n.slots[i]
+	added := false
+	switch {
+	case slot.sub != nil:
+		slot.sub, added = slot.sub.set(edit, shift+hamtBits, key, val)
+	case slot.key == key:
+		slot.val = val
+	default:
+		// two keys share the prefix, push both a level down
+		sub, _ := (*hamtNode[V])(nil).set(edit, shift+hamtBits, slot.key, slot.val)
+		sub, _ = sub.set(edit, shift+hamtBits, key, val)
+		slot = hamtSlot[V]{sub: sub}
+		added = true
+	}
+
+	return n.replace(edit, i, slot), added
+}
+
+func (n *hamtNode[V]) delete(edit uint64, shift uint, key uint64) (*hamtNode[V], bool) {
+	if n == nil {
+		return nil, false
+	}
+
+	bit := uint32(1) << ((key >> shift) & hamtMask)
+	if n.bitmap&bit == 0 {
+		return n, false
+	}
+
+	i := bits.OnesCount32(n.bitmap & (bit - 1))
+	slot := n.slots[i]
+
+	if slot.sub == nil {
+		if slot.key != key {
+			return n, false
+		}
+		return n.remove(edit, i, bit), true
+	}
+
+	sub, removed := slot.sub.delete(edit, shift+hamtBits, key)
+	if !removed {
+		return n, false
+	}
+
+	switch {
+	case len(sub.slots) == 0:
+		return n.remove(edit, i, bit), true
+	case len(sub.slots) == 1 && sub.slots[0].sub == nil:
+		// a single key needs no node of its own
+		return n.replace(edit, i, sub.slots[0]), true
+	}
+	return n.replace(edit, i, hamtSlot[V]{sub: sub}), true
+}
+
+// mutable reports whether n belongs to edit and can be changed in place.
+func (n *hamtNode[V]) mutable(edit uint64) bool {
+	return edit != 0 && n.edit == edit
+}
+
+// replace returns n with slot i replaced.
+func (n *hamtNode[V]) replace(edit uint64, i int, slot hamtSlot[V]) *hamtNode[V] {
+	if n.mutable(edit) {
+		n.slots[i] = slot
+		return n
+	}
+
+	slots := make([]hamtSlot[V], len(n.slots))
+	copy(slots, n.slots)
+	slots[i] = slot
+	return &hamtNode[V]{edit: edit, bitmap: n.bitmap, slots: slots}
+}
+
+// insert returns n with slot added at i.
+func (n *hamtNode[V]) insert(edit uint64, i int, bit uint32, slot hamtSlot[V]) *hamtNode[V] {
+	if n.mutable(edit) {
+		var zero hamtSlot[V]
+		n.slots = append(n.slots, zero)
+		copy(n.slots[i+1:], n.slots[i:])
+		n.slots[i] = slot
+		n.bitmap |= bit
+		return n
+	}
+
+	slots := make([]hamtSlot[V], len(n.slots)+1)
+	copy(slots, n.slots[:i])
+	slots[i] = slot
+	copy(slots[i+1:], n.slots[i:])
+	return &hamtNode[V]{edit: edit, bitmap: n.bitmap | bit, slots: slots}
+}
+
+// remove returns n without slot i.
+func (n *hamtNode[V]) remove(edit uint64, i int, bit uint32) *hamtNode[V] {
+	if n.mutable(edit) {
+		copy(n.slots[i:], n.slots[i+1:])
+		n.slots[len(n.slots)-1] = hamtSlot[V]{}
+		n.slots = n.slots[:len(n.slots)-1]
+		n.bitmap &^= bit
+		return n
+	}
+
+	slots := make([]hamtSlot[V], len(n.slots)-1)
+	copy(slots, n.slots[:i])
+	copy(slots[i:], n.slots[i+1:])
+	return &hamtNode[V]{edit: edit, bitmap: n.bitmap &^ bit, slots: slots}
+}
+
+func (n *hamtNode[V]) each(fn func(key uint64, val V) bool) bool {
+	for i := range n.slots {
+		slot := &n.slots[i]
+		if slot.sub != nil {
+			if !slot.sub.each(fn) {
+				return false
+			}
+			continue
+		}
+		if !fn(slot.key, slot.val) {
+			return false
+		}
+	}
+	return true
+}
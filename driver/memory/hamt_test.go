@@ -0,0 +1,99 @@
+package memory
+
+import (
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"math/rand"
+	"testing"
+)
+
+// hamtMap returns the content of h as a map.
+func hamtMap(h hamt[int]) map[uint64]int {
+	m := make(map[uint64]int, h.Len())
+	h.each(func(key uint64, val int) bool {
+		m[key] = val
+		return true
+	})
+	return m
+}
+
+func TestHamt(t *testing.T) {
+	rnd := rand.New(rand.NewSource(1))
+
+	// few distinct low bits make the keys collide on the first levels
+	keys := make([]uint64, 512)
+	for i := range keys {
+		keys[i] = uint64(rnd.Intn(64)) | uint64(rnd.Intn(1<<20))<<30
+	}
+
+	var h hamt[int]
+	want := map[uint64]int{}
+	versions := []hamt[int]{h}
+	contents := []map[uint64]int{{}}
+
+	for i := 0; i < 5000; i++ {
+		key := keys[rnd.Intn(len(keys))]
+		if rnd.Intn(3) == 0 {
+			h = h.delete(key)
+			delete(want, key)
+		} else {
+			h = h.set(key, i)
+			want[key] = i
+		}
+
+		require.Equal(t, len(want), h.Len())
+		val, ok := h.get(key)
+		assert.Equal(t, want[key], val)
+		_, found := want[key]
+		assert.Equal(t, found, ok)
+
+		if i%500 == 0 {
+			snapshot := make(map[uint64]int, len(want))
+			for k, v := range want {
+				snapshot[k] = v
+			}
+			versions = append(versions, h)
+			contents = append(contents, snapshot)
+		}
+	}
+	assert.Equal(t, want, hamtMap(h))
+
+	// older versions never change
+	for i, v := range versions {
+		assert.Equal(t, contents[i], hamtMap(v), "version %d", i)
+	}
+
+	for key := range want {
+		h = h.delete(key)
+	}
+	assert.Equal(t, 0, h.Len())
+	assert.Nil(t, h.root, "deleting every key frees every node")
+}
+
+func TestHamtEdit(t *testing.T) {
+	var base hamt[int]
+	for i := uint64(0); i < 100; i++ {
+		base = base.set(i*7, int(i))
+	}
+	before := hamtMap(base)
+
+	edit := newHamtEdit()
+	h := base
+	for i := uint64(0); i < 100; i++ {
+		h = h.setIn(edit, i*7, -int(i))
+		h = h.setIn(edit, i*7+1, 1)
+		h = h.deleteIn(edit, i*7+1)
+	}
+	h = h.deleteIn(edit, 0)
+
+	assert.Equal(t, before, hamtMap(base), "an edit never changes nodes it did not create")
+	assert.Equal(t, 99, h.Len())
+	val, ok := h.get(7)
+	assert.True(t, ok)
+	assert.Equal(t, -1, val)
+
+	// a later edit copies the nodes of the finished one
+	frozen := hamtMap(h)
+	h.setIn(newHamtEdit(), 7, 7)
+	assert.Equal(t, frozen, hamtMap(h))
+}
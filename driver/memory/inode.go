@@ -0,0 +1,564 @@
+package memory
+
+import (
+	"io/fs"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"time"
+)
+
+// rootID is the inode of the root directory of a tree.
+const rootID = 1
+
+// memInode is a file or a directory. Inodes are never modified once they are
+// in a table: an update puts a modified copy under the same id.
+type memInode struct {
+	id uint64
+
+	// edit of the transaction that created this version, see memTx.mutable.
+	edit uint64
+
+	isDir bool
+
+	// mode holds the permission bits, and fs.ModeSymlink for a symbolic
+	// link to the path in link.
+	mode fs.FileMode
+	link string
+
+	modTime time.Time
+
+	// data is the content of a file.
+	data memData
+
+	// entries of a directory, by the hash of their name.
+	entries hamt[[]memDirent]
+}
+
+// memDirent links a name of a directory to an inode.
+type memDirent struct {
+	name string
+	id   uint64
+}
+
+func (ino *memInode) clone() *memInode {
+	c := *ino
+	return &c
+}
+
+func (ino *memInode) size() int64 {
+	return ino.data.size
+}
+
+func (ino *memInode) isSymlink() bool {
+	return ino.mode&fs.ModeSymlink != 0
+}
+
+// nameHash is the 64-bit FNV-1a hash of name.
+func nameHash(name string) uint64 {
+	h := uint64(14695981039346656037)
+	for i := 0; i < len(name); i++ {
+		h ^= uint64(name[i])
+		h *= 1099511628211
+	}
+	return h
+}
+
+// lookup returns the inode id of the named entry of the directory.
+func (ino *memInode) lookup(name string) (uint64, bool) {
+	list, _ := ino.entries.get(nameHash(name))
+	for _, d := range list {
+		if d.name == name {
+			return d.id, true
+		}
+	}
+	return 0, false
+}
+
+// dirents calls fn for every entry of the directory.
+func (ino *memInode) dirents(fn func(d memDirent)) {
+	ino.entries.each(func(_ uint64, list []memDirent) bool {
+		for _, d := range list {
+			fn(d)
+		}
+		return true
+	})
+}
+
+func (ino *memInode) empty() bool {
+	return ino.entries.Len() == 0
+}
+
+// memTable is a version of the inode table of a tree.
+type memTable struct {
+	inodes hamt[*memInode]
+}
+
+func (t *memTable) get(id uint64) *memInode {
+	ino, _ := t.inodes.get(id)
+	return ino
+}
+
+// walk resolves the cleaned, slash separated path below the directory dir,
+// empty elements are skipped and symbolic links followed.
+func (t *memTable) walk(dir uint64, name string) (*memInode, error) {
+	return t.resolve(dir, name, true, nil)
+}
+
+// maxLinks is the most symbolic links a walk follows, like the kernel.
+const maxLinks = 40
+
+// resolve walks name below the directory dir like walk, but does not follow
+// the link its last element names unless follow.
+//
+// The target of a link is walked in its place: a relative one from the
+// directory of the link, .. going back up the directories walked through,
+// an absolute one from dir. A walk never goes above dir.
+//
+// missing, when not nil, is called for the elements missing from their
+// directory and returns the inode to walk into instead, linked tells whether
+// the element comes from the target of a link.
+func (t *memTable) resolve(dir uint64, name string, follow bool, missing func(parent *memInode, elem string, linked bool) (*memInode, error)) (*memInode, error) {
+	ino := t.get(dir)
+	if ino == nil {
+		return nil, fs.ErrNotExist
+	}
+
+	var buf [32]*memInode
+	stack := append(buf[:0], ino)
+
+	// own is the length of the end of name that is not from a link target
+	links, own := 0, len(name)
+
+	for name != "" {
+		linked := len(name) > own
+
+		var elem string
+		elem, name = cut(name)
+		if !linked {
+			own = len(name)
+		}
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				// the directory may have changed since, within a transaction
+				stack = stack[:len(stack)-1]
+				if dir := t.get(stack[len(stack)-1].id); dir != nil {
+					stack[len(stack)-1] = dir
+				}
+			}
+			continue
+		}
+
+		parent := stack[len(stack)-1]
+		if !parent.isDir {
+			return nil, syscall.ENOTDIR
+		}
+
+		id, ok := parent.lookup(elem)
+		if !ok && missing != nil {
+			child, err := missing(parent, elem, linked)
+			if err != nil {
+				return nil, err
+			}
+			stack = append(stack, child)
+			continue
+		}
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+
+		ino := t.get(id)
+		if ino == nil {
+			return nil, fs.ErrNotExist
+		}
+		if !ino.isSymlink() || !follow && name == "" {
+			stack = append(stack, ino)
+			continue
+		}
+
+		links++
+		switch {
+		case links > maxLinks:
+			return nil, syscall.ELOOP
+		case ino.link == "":
+			return nil, fs.ErrNotExist
+		case strings.HasPrefix(ino.link, "/"):
+			stack = stack[:1]
+		}
+
+		if name == "" {
+			name = ino.link
+		} else {
+			name = ino.link + "/" + name
+		}
+	}
+
+	return stack[len(stack)-1], nil
+}
+
+// parent resolves the directory holding the last element of name, and that
+// element, empty for the directory dir itself.
+func (t *memTable) parent(dir uint64, name string) (*memInode, string, error) {
+	parent, base := dirname(name)
+
+	ino, err := t.walk(dir, parent)
+	if err != nil {
+		return nil, "", err
+	}
+	if !ino.isDir {
+		return nil, "", syscall.ENOTDIR
+	}
+	return ino, base, nil
+}
+
+func cut(name string) (string, string) {
+	if i := strings.IndexByte(name, '/'); i >= 0 {
+		return name[:i], name[i+1:]
+	}
+	return name, ""
+}
+
+// memTree is the storage of a memory filesystem, shared by its Sub views.
+// Readers load the current table and never block, writers are serialized
+// and publish a new table when they are done.
+type memTree struct {
+	config *Config
+
+	account *memAccount
+
+	table atomic.Value
+
+	// mu serializes the writers, next is the next free inode id.
+	mu   sync.Mutex
+	next uint64
+
+	// wal logs the changes of the tree when it is persistent.
+	wal *memWAL
+}
+
+func newMemTree(config *Config) *memTree {
+	tree := &memTree{
+		config:  config,
+		account: newMemAccount(config.MaxSize),
+		next:    rootID + 1,
+	}
+
+	root := &memInode{id: rootID, isDir: true, mode: 0755, modTime: time.Now()}
+	tree.table.Store(&memTable{inodes: hamt[*memInode]{}.set(rootID, root)})
+	return tree
+}
+
+func (tree *memTree) load() *memTable {
+	return tree.table.Load().(*memTable)
+}
+
+// update runs fn on a copy of the current table and publishes the copy
+// unless fn fails. The accounting only changes within updates. With a
+// write-ahead log the changes are logged before they are published.
+func (tree *memTree) update(fn func(tx *memTx) error) error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	tx := &memTx{tree: tree, memTable: *tree.load(), edit: newHamtEdit()}
+	if tree.wal != nil {
+		tx.log = &walBuf{}
+	}
+
+	mark := tree.account.mark()
+	err := fn(tx)
+	if err == nil && tx.log != nil && len(*tx.log) > 0 {
+		err = tree.wal.append(*tx.log, &tx.memTable)
+	}
+	if err != nil {
+		// the accounting of the transaction goes with it
+		tree.account.reset(mark)
+		return err
+	}
+
+	tree.table.Store(&tx.memTable)
+	return nil
+}
+
+// clone returns a tree that starts from the current table of tree. The two
+// share their inodes, nodes and chunks, which neither changes in place: a
+// transaction copies what it changes, chunks are grown by the version that
+// claims their spare bytes first.
+func (tree *memTree) clone() *memTree {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	mark := tree.account.mark()
+	clone := &memTree{
+		config:  tree.config,
+		account: &memAccount{max: tree.account.max, bytes: mark.bytes, inodes: mark.inodes},
+		next:    tree.next,
+	}
+	clone.table.Store(tree.load())
+	return clone
+}
+
+// close closes the write-ahead log of the tree.
+func (tree *memTree) close() error {
+	tree.mu.Lock()
+	defer tree.mu.Unlock()
+
+	if tree.wal == nil {
+		return nil
+	}
+	err := tree.wal.close()
+	tree.wal = nil
+	return err
+}
+
+// memTx is a table being updated. The inodes and nodes created by the
+// transaction are changed in place until it is published.
+//
+// Every change of the tree goes through the methods below, which log it
+// when the tree has a write-ahead log: replaying the log applies the same
+// changes to the same inodes.
+type memTx struct {
+	tree *memTree
+
+	memTable
+
+	edit uint64
+
+	// log holds the records of the changes, nil without a write-ahead log.
+	log *walBuf
+}
+
+func (tx *memTx) put(ino *memInode) {
+	tx.inodes = tx.inodes.setIn(tx.edit, ino.id, ino)
+}
+
+// mutable returns a version of ino the transaction may change, the caller
+// puts it back in the table.
+func (tx *memTx) mutable(ino *memInode) *memInode {
+	if ino.edit == tx.edit {
+		return ino
+	}
+
+	c := ino.clone()
+	c.edit = tx.edit
+	return c
+}
+
+// link links name in the directory to id, replacing the entry of that name
+// if there is one.
+func (tx *memTx) link(dir *memInode, name string, id uint64) {
+	key := nameHash(name)
+	list, _ := dir.entries.get(key)
+
+	updated := make([]memDirent, 0, len(list)+1)
+	for _, d := range list {
+		if d.name != name {
+			updated = append(updated, d)
+		}
+	}
+	updated = append(updated, memDirent{name: name, id: id})
+
+	dir = tx.mutable(dir)
+	dir.entries = dir.entries.setIn(tx.edit, key, updated)
+	tx.put(dir)
+
+	if tx.log != nil {
+		tx.log.link(dir.id, name, id)
+	}
+}
+
+// unlink removes the entry name from the directory.
+func (tx *memTx) unlink(dir *memInode, name string) {
+	key := nameHash(name)
+	list, _ := dir.entries.get(key)
+
+	updated := make([]memDirent, 0, len(list))
+	for _, d := range list {
+		if d.name != name {
+			updated = append(updated, d)
+		}
+	}
+
+	dir = tx.mutable(dir)
+	if len(updated) == 0 {
+		dir.entries = dir.entries.deleteIn(tx.edit, key)
+	} else {
+		dir.entries = dir.entries.setIn(tx.edit, key, updated)
+	}
+	tx.put(dir)
+
+	if tx.log != nil {
+		tx.log.unlink(dir.id, name)
+	}
+}
+
+// create adds a new inode to the table, a directory when mode has
+// fs.ModeDir.
+func (tx *memTx) create(mode fs.FileMode) *memInode {
+	return tx.add(&memInode{isDir: mode.IsDir(), mode: mode &^ fs.ModeDir, modTime: time.Now()})
+}
+
+// symlink adds a new symbolic link to target to the table.
+func (tx *memTx) symlink(target string) *memInode {
+	return tx.add(&memInode{mode: fs.ModeSymlink | fs.ModePerm, link: target, modTime: time.Now()})
+}
+
+// add adds the new inode to the table under the next free id, or under its
+// own when it has one.
+func (tx *memTx) add(ino *memInode) *memInode {
+	if ino.id == 0 {
+		ino.id = tx.tree.next
+	}
+	if ino.id >= tx.tree.next {
+		tx.tree.next = ino.id + 1
+	}
+
+	ino.edit = tx.edit
+	tx.tree.account.link()
+	tx.put(ino)
+
+	if tx.log != nil {
+		tx.log.create(ino)
+	}
+	return ino
+}
+
+// release removes the inode and everything below it from the table.
+func (tx *memTx) release(id uint64) {
+	if tx.log != nil {
+		tx.log.release(id)
+	}
+	tx.drop(id)
+}
+
+func (tx *memTx) drop(id uint64) {
+	ino := tx.get(id)
+	if ino == nil {
+		return
+	}
+
+	if ino.isDir {
+		ino.dirents(func(d memDirent) {
+			tx.drop(d.id)
+		})
+	}
+
+	tx.tree.account.release(ino.size())
+	tx.tree.account.unlink()
+	tx.inodes = tx.inodes.deleteIn(tx.edit, id)
+}
+
+// memChange is a change of the content of a file: p written at off, at the
+// end of the file when append, or a truncation to the size off.
+type memChange struct {
+	p   []byte
+	off int64
+
+	append   bool
+	truncate bool
+}
+
+func (c memChange) apply(d memData, edit uint64) memData {
+	switch {
+	case c.truncate:
+		return d.truncate(edit, c.off)
+	case c.append:
+		return d.writeAt(edit, c.p, d.size)
+	}
+	return d.writeAt(edit, c.p, c.off)
+}
+
+// change changes the content of the file and sets its modification time,
+// accounting the bytes it adds or removes.
+func (tx *memTx) change(ino *memInode, c memChange, mtime time.Time) (*memInode, error) {
+	if c.append {
+		c.off, c.append = ino.size(), false
+	}
+
+	data := c.apply(ino.data, tx.edit)
+	if grown := data.size - ino.size(); grown > 0 {
+		if err := tx.tree.account.reserve(grown); err != nil {
+			return nil, err
+		}
+	} else {
+		tx.tree.account.release(-grown)
+	}
+
+	ino = tx.mutable(ino)
+	ino.data = data
+	ino.modTime = mtime
+	tx.put(ino)
+
+	if tx.log != nil {
+		tx.log.change(ino.id, c, mtime)
+	}
+	return ino, nil
+}
+
+// share makes the content of the file the one of src. The two share their
+// chunks, neither may be changed again within the transaction.
+func (tx *memTx) share(ino, src *memInode) (*memInode, error) {
+	if err := tx.tree.account.reserve(src.size() - ino.size()); err != nil {
+		return nil, err
+	}
+
+	ino = tx.mutable(ino)
+	ino.data = src.data
+	tx.put(ino)
+
+	if tx.log != nil {
+		tx.log.share(ino.id, src.id)
+	}
+	return ino, nil
+}
+
+// chmod sets the permission bits of the inode.
+func (tx *memTx) chmod(ino *memInode, mode fs.FileMode) *memInode {
+	ino = tx.mutable(ino)
+	ino.mode = ino.mode&^fs.ModePerm | mode&fs.ModePerm
+	tx.put(ino)
+
+	if tx.log != nil {
+		tx.log.chmod(ino.id, mode)
+	}
+	return ino
+}
+
+// touch sets the modification time of the inode.
+func (tx *memTx) touch(ino *memInode, mtime time.Time) *memInode {
+	ino = tx.mutable(ino)
+	ino.modTime = mtime
+	tx.put(ino)
+
+	if tx.log != nil {
+		tx.log.touch(ino.id, mtime)
+	}
+	return ino
+}
+
+// mkdirAll resolves name below dir, creating the missing directories with
+// the permission bits perm. A directory is not created in place of a link
+// to nowhere, nor below one.
+func (tx *memTx) mkdirAll(dir uint64, name string, perm fs.FileMode) (*memInode, error) {
+	ino, err := tx.resolve(dir, name, true, func(parent *memInode, elem string, linked bool) (*memInode, error) {
+		if linked {
+			return nil, fs.ErrExist
+		}
+
+		child := tx.create(fs.ModeDir | perm&fs.ModePerm)
+		tx.link(parent, elem, child.id)
+		return child, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !ino.isDir {
+		return nil, syscall.ENOTDIR
+	}
+	return ino, nil
+}
@@ -3,55 +3,40 @@ package memory
 import (
 	"errors"
 	"github.com/lazychanger/go-vfs"
-	"io"
 	"io/fs"
+	"os"
 	"path"
+	"sort"
 	"strings"
-	"sync"
+	"syscall"
 	"time"
 )
 
+// memFs is a view of a memory tree rooted at one of its directories, Sub
+// views share the tree of the filesystem they come from.
+// Errors carry the same syscall errors the os package reports, so that
+// errors.Is gives the same answers for both drivers.
 type memFs struct {
-	root string
-
-	config *Config
-
-	size uint64
+	tree *memTree
 
-	top *memFs
+	// id of the directory the view is rooted at.
+	id uint64
 
-	files map[string]*memFile
-	dirs  map[string]*memFs
-
-	fi *memFileInfo
+	// root is the path of that directory, for errors.
+	root string
 
-	sync.RWMutex
+	// life is the same for the views of a tree, the top one New or Open
+	// returned closes it and drops its reference to a named tree.
+	life *memLife
+	top  bool
 }
 
-func (m *memFs) ReadDir(name string) ([]fs.DirEntry, error) {
-	dirs := make([]fs.DirEntry, 0)
-
-	node, exist := m.node(name, false)
-	if !exist || len(node.dirs) == 0 {
-		return dirs, io.EOF
-	}
-
-	node.RLock()
-	defer node.RUnlock()
-
-	for _, file := range node.files {
-		dirs = append(dirs, &memDirEntry{
-			fi: file.fi,
-		})
-	}
-
-	for _, dir := range node.dirs {
-		dirs = append(dirs, &memDirEntry{
-			fi: dir.fi,
-		})
-	}
+// memLife tracks the files open on a filesystem until it is closed.
+type memLife struct {
+	filesystem.Tracker
 
-	return dirs, nil
+	// release drops the reference to a named tree, nil for others.
+	release func() error
 }
 
 func New(config *Config, root string) filesystem.FileSystem {
@@ -59,200 +44,277 @@ func New(config *Config, root string) filesystem.FileSystem {
 		config = &Config{}
 	}
 
-	_, name := dirname(root)
-
 	return &memFs{
-		root:   strings.TrimRight(root, "/") + "/",
-		config: config,
-		files:  make(map[string]*memFile),
-		dirs:   make(map[string]*memFs),
-		fi: &memFileInfo{
-			name:  name,
-			size:  0,
-			isDir: true,
-			ctime: time.Now(),
-		},
+		tree: newMemTree(config),
+		id:   rootID,
+		root: strings.TrimRight(root, "/") + "/",
+		life: &memLife{},
+		top:  true,
 	}
 }
 
-func (m *memFs) Open(name string) (filesystem.File, error) {
-	dir, fname := dirname(name)
+func (m *memFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	t := m.tree.load()
 
-	node, exist := m.node(dir, false)
-	if !exist {
-		return nil, &fs.PathError{Op: "open", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
+	ino, _, err := m.lookup(t, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: pathjoin(m.root, name), Err: err}
+	}
+	if !ino.isDir {
+		return nil, &fs.PathError{Op: "readdir", Path: pathjoin(m.root, name), Err: syscall.ENOTDIR}
 	}
 
-	return node.open(fname)
+	return entries(t, ino), nil
 }
 
-func (m *memFs) open(name string) (filesystem.File, error) {
-	m.RLock()
-	defer m.RUnlock()
-	if f, ok := m.files[name]; ok {
-		return f, nil
-	}
-	return nil, &fs.PathError{Op: "open", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
-}
+// entries returns the entries of the directory sorted by name.
+func entries(t *memTable, dir *memInode) []fs.DirEntry {
+	list := make([]fs.DirEntry, 0, dir.entries.Len())
 
-func (m *memFs) Create(name string) (filesystem.File, error) {
-	dir, fname := dirname(name)
+	dir.dirents(func(d memDirent) {
+		if ino := t.get(d.id); ino != nil {
+			list = append(list, &memDirEntry{fi: *newMemFileInfo(d.name, ino)})
+		}
+	})
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+
+	return list
+}
 
-	node, exist := m.node(dir, false)
-	if !exist {
-		return nil, &fs.PathError{Op: "open", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
+func (m *memFs) Open(name string) (filesystem.File, error) {
+	ino, base, err := m.lookup(m.tree.load(), name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: pathjoin(m.root, name), Err: err}
 	}
 
-	if f := node.getFile(fname); f != nil {
-		return f, nil
+	if ino.isDir {
+		return m.track("open", name, newMemDirHandle(m, ino, base, name))
 	}
 
-	return node.create(fname, nil)
+	return m.track("open", name, newMemHandle(m, ino, base, name))
 }
 
-func (m *memFs) create(name string, f *memFile) (filesystem.File, error) {
-	m.Lock()
-	defer m.Unlock()
-
-	if f != nil {
-		f.fi.name = name
-		f.fi.ctime = time.Now()
-		m.files[name] = f
-	} else {
-		m.files[name] = newMemFile(name, nil, false)
+// track records the handle opened under name until it is closed.
+func (m *memFs) track(op, name string, h memTracked) (filesystem.File, error) {
+	release, err := m.life.Track(m.path(name), h)
+	if err != nil {
+		return nil, &fs.PathError{Op: op, Path: pathjoin(m.root, name), Err: err}
 	}
 
-	return m.files[name], nil
+	h.tracked(release)
+	return h, nil
 }
 
-func (m *memFs) Mkdir(name string, perm fs.FileMode) error {
-	dir, dname := dirname(name)
-
-	node, exist := m.node(dir, false)
-	if !exist {
-		return &fs.PathError{Op: "mkdir", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
+// Create opens the named file, truncating it if it already exists.
+func (m *memFs) Create(name string) (filesystem.File, error) {
+	var file *memInode
+	var base string
+
+	err := m.update(func(tx *memTx) error {
+		// a link is followed to the file it names, created when missing
+		target := name
+		for links := 0; ; links++ {
+			parent, elem, err := tx.parent(m.id, target)
+			if err != nil {
+				return err
+			}
+			if elem == "" {
+				return syscall.EISDIR
+			}
+			if links == 0 {
+				base = elem
+			}
+
+			id, ok := parent.lookup(elem)
+			if !ok {
+				file = tx.create(0666)
+				tx.link(parent, elem, file.id)
+				return nil
+			}
+
+			ino := tx.get(id)
+			switch {
+			case ino.isSymlink() && links == maxLinks:
+				return syscall.ELOOP
+			case ino.isSymlink():
+				target = linkTarget(target, ino.link)
+				continue
+			case ino.isDir:
+				return syscall.EISDIR
+			}
+
+			file, err = tx.change(ino, memChange{truncate: true}, time.Now())
+			return err
+		}
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: pathjoin(m.root, name), Err: err}
 	}
 
-	return node.mkdir(dname)
+	return m.track("open", name, newMemHandle(m, file, base, name))
 }
 
-func (m *memFs) mkdir(name string) (err error) {
-	m.Lock()
-	defer m.Unlock()
-
-	if _, ok := m.dirs[name]; ok {
-		return &fs.PathError{Op: "mkdir", Path: pathjoin(m.root, name), Err: fs.ErrExist}
-	}
+func (m *memFs) Mkdir(name string, perm fs.FileMode) error {
+	err := m.update(func(tx *memTx) error {
+		parent, base, err := tx.parent(m.id, name)
+		if err != nil {
+			return err
+		}
 
-	m.dirs[name] = New(m.config, m.root+name+"/").(*memFs)
+		if _, ok := parent.lookup(base); ok || base == "" {
+			return fs.ErrExist
+		}
 
+		dir := tx.create(fs.ModeDir | perm&fs.ModePerm)
+		tx.link(parent, base, dir.id)
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: pathjoin(m.root, name), Err: err}
+	}
 	return nil
 }
 
-func (m *memFs) MkdirAll(path string, perm fs.FileMode) error {
-	m.node(path, true)
+func (m *memFs) MkdirAll(name string, perm fs.FileMode) error {
+	err := m.update(func(tx *memTx) error {
+		_, err := tx.mkdirAll(m.id, path.Clean("/"+name), perm)
+		return err
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: pathjoin(m.root, name), Err: err}
+	}
 	return nil
 }
 
 func (m *memFs) Remove(name string) error {
-	dir, fname := dirname(name)
-
-	node, exist := m.node(dir, false)
+	err := m.update(func(tx *memTx) error {
+		parent, base, err := tx.parent(m.id, name)
+		if err != nil {
+			return err
+		}
+		if base == "" {
+			return syscall.EBUSY
+		}
 
-	if !exist {
-		return &fs.PathError{Op: "removeFile", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
-	}
+		id, ok := parent.lookup(base)
+		if !ok {
+			return fs.ErrNotExist
+		}
 
-	if strings.HasSuffix(name, "/") {
-		if _, err := node.removeDir(fname); err != nil {
-			return err
+		ino := tx.get(id)
+		switch {
+		case !ino.isDir && strings.HasSuffix(name, "/"):
+			return syscall.ENOTDIR
+		case ino.isDir && !ino.empty():
+			return syscall.ENOTEMPTY
 		}
-		return nil
-	}
 
-	if _, err := node.removeFile(fname); err == nil {
+		tx.release(id)
+		tx.unlink(parent, base)
 		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: pathjoin(m.root, name), Err: err}
 	}
-
-	if _, err := node.removeDir(fname); err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func (m *memFs) removeFile(name string) (*memFile, error) {
-	m.Lock()
-	defer m.Unlock()
+func (m *memFs) RemoveAll(name string) error {
+	err := m.update(func(tx *memTx) error {
+		parent, base, err := tx.parent(m.id, name)
+		if err != nil {
+			return err
+		}
 
-	if f, ok := m.files[name]; ok {
-		delete(m.files, name)
-		return f, nil
-	}
-	return nil, &fs.PathError{Op: "removeFile", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
-}
+		if base == "" {
+			var list []memDirent
+			parent.dirents(func(d memDirent) {
+				list = append(list, d)
+			})
+			for _, d := range list {
+				tx.release(d.id)
+				tx.unlink(tx.get(parent.id), d.name)
+			}
+			return nil
+		}
 
-func (m *memFs) RemoveAll(path string) error {
-	if path == "/" {
-		m.Lock()
-		defer m.Unlock()
+		id, ok := parent.lookup(base)
+		if !ok {
+			return nil
+		}
+		if !tx.get(id).isDir && strings.HasSuffix(name, "/") {
+			return syscall.ENOTDIR
+		}
 
-		m.files = make(map[string]*memFile)
-		m.dirs = make(map[string]*memFs)
-		m.size = 0
+		tx.release(id)
+		tx.unlink(parent, base)
 		return nil
-	}
-
-	dir, fname := dirname(path)
-
-	node, exist := m.node(dir, false)
-	if !exist {
+	})
+	if errors.Is(err, fs.ErrNotExist) {
 		return nil
 	}
-
-	if strings.HasSuffix(path, "/") {
-		_, _ = node.removeDir(fname)
-		return nil
-	}
-
-	if _, err := node.removeFile(fname); err == nil {
-		return nil
+	if err != nil {
+		return &fs.PathError{Op: "unlinkat", Path: pathjoin(m.root, name), Err: err}
 	}
-
-	_, _ = node.removeDir(fname)
-
 	return nil
 }
 
-func (m *memFs) removeDir(name string) (*memFs, error) {
+// Rename follows os.Rename: an existing directory is never replaced, an
+// existing file is replaced by a file only. Renaming a directory only moves
+// its entry, whatever the size of the tree below it.
+func (m *memFs) Rename(oldpath, newpath string) error {
+	err := m.update(func(tx *memTx) error {
+		source, _, err := m.lookupLink(&tx.memTable, oldpath)
 
-	m.Lock()
-	defer m.Unlock()
+		if target, _, terr := m.lookupLink(&tx.memTable, newpath); terr == nil && target.isDir {
+			if err == nil {
+				err = fs.ErrExist
+			}
+			return err
+		}
 
-	if dir, ok := m.dirs[name]; ok {
-		delete(m.dirs, name)
-		return dir, nil
-	}
+		oparent, oldname, oerr := tx.parent(m.id, oldpath)
+		if oerr != nil {
+			return oerr
+		}
 
-	return nil, &fs.PathError{Op: "removeDir", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
-}
+		nparent, newname, nerr := tx.parent(m.id, newpath)
+		if nerr != nil {
+			return nerr
+		}
 
-func (m *memFs) Rename(oldpath, newpath string) error {
-	if strings.HasSuffix(oldpath, "/") {
-		if err := m.renameDir(oldpath, newpath); err != nil {
+		if err != nil {
 			return err
 		}
-		return nil
-	}
 
-	if err := m.renameFile(oldpath, newpath); err == nil {
-		return nil
-	}
+		if oldname == "" {
+			return syscall.EBUSY
+		}
 
-	if err := m.renameDir(oldpath, newpath); err != nil {
-		return err
-	}
+		oldpath, newpath := path.Clean("/"+oldpath), path.Clean("/"+newpath)
+		if oldpath == newpath {
+			return nil
+		}
 
+		if source.isDir && strings.HasPrefix(newpath, oldpath+"/") {
+			return syscall.EINVAL
+		}
+
+		if id, ok := nparent.lookup(newname); ok {
+			if source.isDir {
+				return syscall.ENOTDIR
+			}
+			tx.release(id)
+		}
+
+		tx.unlink(tx.get(oparent.id), oldname)
+		tx.link(tx.get(nparent.id), newname, source.id)
+		return nil
+	})
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: pathjoin(m.root, oldpath), New: pathjoin(m.root, newpath), Err: err}
+	}
 	return nil
 }
 
@@ -261,216 +323,262 @@ func (m *memFs) Sub(dir string) (filesystem.FileSystem, error) {
 		return nil, errors.New("invalid sub directory")
 	}
 
-	node, exist := m.node(dir, false)
-
-	if !exist {
-		return nil, &fs.PathError{Op: "sub", Path: pathjoin(m.root, dir), Err: fs.ErrNotExist}
+	ino, _, err := m.lookup(m.tree.load(), dir)
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: pathjoin(m.root, dir), Err: err}
+	}
+	if !ino.isDir {
+		return nil, &fs.PathError{Op: "sub", Path: pathjoin(m.root, dir), Err: syscall.ENOTDIR}
 	}
 
-	return node, nil
+	return &memFs{
+		tree: m.tree,
+		id:   ino.id,
+		root: strings.TrimRight(m.path(dir), "/") + "/",
+		life: m.life,
+	}, nil
 }
 
 func (m *memFs) Stat(name string) (fs.FileInfo, error) {
-	dir, fname := dirname(name)
-
-	node, exist := m.node(dir, false)
-	if !exist {
-		return nil, &fs.PathError{Op: "Stat", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
-	}
-
-	if node.existFile(fname) {
-		return node.files[fname].fi, nil
-	}
-
-	if node.existDir(fname) {
-		return node.dirs[fname].fi, nil
+	ino, base, err := m.lookup(m.tree.load(), name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: pathjoin(m.root, name), Err: err}
 	}
 
-	return nil, &fs.PathError{Op: "Stat", Path: pathjoin(m.root, name), Err: fs.ErrNotExist}
+	return newMemFileInfo(base, ino), nil
 }
 
-func (m *memFs) Exists(name string) bool {
-	dir, fname := dirname(name)
-
-	node, exist := m.node(dir, false)
-
-	if !exist {
-		return false
-	}
+// Chtimes changes the modification time of the named file or directory,
+// memory files keep no access time.
+func (m *memFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	err := m.update(func(tx *memTx) error {
+		ino, _, err := m.lookup(&tx.memTable, name)
+		if err != nil {
+			return err
+		}
 
-	if node.existFile(fname) || node.existDir(fname) {
-		return true
+		tx.touch(ino, mtime)
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: pathjoin(m.root, name), Err: err}
 	}
-
-	return false
+	return nil
 }
 
-func (m *memFs) IsFile(name string) bool {
-	dir, fname := dirname(name)
+// Truncate changes the size of the named file, see os.Truncate.
+func (m *memFs) Truncate(name string, size int64) error {
+	err := m.update(func(tx *memTx) error {
+		ino, _, err := m.lookup(&tx.memTable, name)
+		switch {
+		case err != nil:
+			return err
+		case ino.isDir:
+			return syscall.EISDIR
+		case size < 0:
+			return syscall.EINVAL
+		}
 
-	node, exist := m.node(dir, false)
-	if !exist {
-		return false
+		_, err = tx.change(ino, memChange{off: size, truncate: true}, time.Now())
+		return err
+	})
+	if err != nil {
+		return &fs.PathError{Op: "truncate", Path: pathjoin(m.root, name), Err: err}
 	}
-
-	return node.existFile(fname)
+	return nil
 }
 
-func (m *memFs) IsDir(name string) bool {
-	dir, fname := dirname(name)
+// Chmod changes the permission bits of the named file or directory.
+func (m *memFs) Chmod(name string, mode fs.FileMode) error {
+	err := m.update(func(tx *memTx) error {
+		ino, _, err := m.lookup(&tx.memTable, name)
+		if err != nil {
+			return err
+		}
 
-	node, exist := m.node(dir, false)
-	if !exist {
-		return false
+		tx.chmod(ino, mode)
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: pathjoin(m.root, name), Err: err}
 	}
-
-	return node.existDir(fname)
+	return nil
 }
 
-func (m *memFs) renameFile(oldpath, newpath string) error {
-	olddir, oldname := dirname(oldpath)
-	onode, oexist := m.node(olddir, false)
-
-	if !oexist {
-		return &fs.PathError{Op: "renameFile", Path: pathjoin(m.root, oldpath), Err: fs.ErrNotExist}
-	}
+// Symlink creates newname as a link to oldname. A relative oldname is
+// resolved from the directory of the link, an absolute one from the root of
+// the view it is resolved in: links never lead out of a view.
+func (m *memFs) Symlink(oldname, newname string) error {
+	err := m.update(func(tx *memTx) error {
+		parent, base, err := tx.parent(m.id, newname)
+		if err != nil {
+			return err
+		}
 
-	newdir, newname := dirname(newpath)
+		if _, ok := parent.lookup(base); ok || base == "" {
+			return fs.ErrExist
+		}
+		if oldname == "" {
+			return fs.ErrNotExist
+		}
 
-	nnode, nexist := m.node(newdir, false)
-	if !nexist {
-		return &fs.PathError{Op: "renameFile", Path: pathjoin(m.root, newdir), Err: fs.ErrNotExist}
+		link := tx.symlink(oldname)
+		tx.link(parent, base, link.id)
+		return nil
+	})
+	if err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: pathjoin(m.root, newname), Err: err}
 	}
+	return nil
+}
 
-	f, err := onode.removeFile(oldname)
+func (m *memFs) Readlink(name string) (string, error) {
+	ino, _, err := m.lookupLink(m.tree.load(), name)
+	if err == nil && !ino.isSymlink() {
+		err = syscall.EINVAL
+	}
 	if err != nil {
-		return err
+		return "", &fs.PathError{Op: "readlink", Path: pathjoin(m.root, name), Err: err}
 	}
 
-	_, _ = nnode.create(newname, f)
-	return nil
+	return ino.link, nil
 }
 
-func (m *memFs) renameDir(oldpath, newpath string) error {
-	olddir, oldname := dirname(oldpath)
-
-	onode, oexist := m.node(olddir, false)
-	if !oexist {
-		return &fs.PathError{Op: "renameDir", Path: pathjoin(m.root, oldname), Err: fs.ErrNotExist}
+func (m *memFs) Lstat(name string) (fs.FileInfo, error) {
+	ino, base, err := m.lookupLink(m.tree.load(), name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "lstat", Path: pathjoin(m.root, name), Err: err}
 	}
 
-	newdir, newname := dirname(newpath)
-
-	nnode, nexist := m.node(newdir, false)
+	return newMemFileInfo(base, ino), nil
+}
 
-	if !nexist {
-		return &fs.PathError{Op: "renameDir", Path: pathjoin(m.root, newdir), Err: fs.ErrNotExist}
+// Clone returns a filesystem on a copy of the tree, made in constant time:
+// the copies share their content until either changes it. The copy of a Sub
+// view is a view of the same directory, the copy of a named or persistent
+// tree is neither.
+func (m *memFs) Clone() (filesystem.FileSystem, error) {
+	if m.life.Closed() {
+		return nil, &fs.PathError{Op: "clone", Path: m.root, Err: fs.ErrClosed}
 	}
 
-	if nnode.existDir(newname) {
-		return &fs.PathError{Op: "renameDir", Path: pathjoin(m.root, newname), Err: fs.ErrExist}
+	return &memFs{
+		tree: m.tree.clone(),
+		id:   m.id,
+		root: m.root,
+		life: &memLife{},
+		top:  true,
+	}, nil
+}
+
+// Close closes the files still open on the filesystem, and releases the
+// named tree it was opened on: the tree is gone once every filesystem opened
+// on it is closed.
+func (m *memFs) Close() error {
+	if !m.top {
+		return nil
+	}
+	if err := m.life.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: m.root, Err: err}
 	}
 
-	dir, err := onode.removeDir(oldname)
-	if err != nil {
-		return err
+	release := m.tree.close
+	if m.life.release != nil {
+		release = m.life.release
+	}
+	if err := release(); err != nil {
+		return &fs.PathError{Op: "close", Path: m.root, Err: err}
 	}
+	return nil
+}
 
-	dir.Lock()
-	dir.root = path.Join(dir.root, "../", newname)
-	dir.fi.name = newname
-	dir.Unlock()
+func (m *memFs) OpenFiles() []string {
+	return m.life.OpenFiles()
+}
 
-	nnode.Lock()
-	nnode.dirs[newname] = dir
-	nnode.Unlock()
+func (m *memFs) Exists(name string) bool {
+	_, _, err := m.lookup(m.tree.load(), name)
 
-	return nil
+	return err == nil
 }
 
-func (m *memFs) existFile(file string) bool {
-	m.RLock()
-	defer m.RUnlock()
-	if _, ok := m.files[file]; ok {
-		return true
-	}
-	return false
+func (m *memFs) IsFile(name string) bool {
+	ino, _, err := m.lookup(m.tree.load(), name)
+
+	return err == nil && !ino.isDir
 }
 
-func (m *memFs) getFile(file string) filesystem.File {
-	m.RLock()
-	defer m.RUnlock()
+func (m *memFs) IsDir(name string) bool {
+	ino, _, err := m.lookup(m.tree.load(), name)
 
-	if f, ok := m.files[file]; ok {
-		return f
+	return err == nil && ino.isDir
+}
 
-	} else {
-		return nil
-	}
+// lookup resolves name in the table to its inode and base name, following
+// symbolic links. The base name of the root of the view is the name of its
+// directory.
+func (m *memFs) lookup(t *memTable, name string) (*memInode, string, error) {
+	return m.resolve(t, name, true)
 }
 
-func (m *memFs) existDir(dir string) bool {
-	m.RLock()
-	defer m.RUnlock()
-	if _, ok := m.dirs[dir]; ok {
-		return true
-	}
-	return false
+// lookupLink resolves name like lookup, but a symbolic link its last element
+// names is not followed.
+func (m *memFs) lookupLink(t *memTable, name string) (*memInode, string, error) {
+	return m.resolve(t, name, false)
 }
 
-func (m *memFs) node(dir string, autoCreate bool) (fs *memFs, exists bool) {
-	dir = strings.TrimRight(dir, "/")
-	if dir == "" {
-		return m, true
+func (m *memFs) resolve(t *memTable, name string, follow bool) (*memInode, string, error) {
+	if m.life.Closed() {
+		return nil, "", fs.ErrClosed
 	}
 
-	dirs := strings.Split(dir, "/")
-
-	node := m
-	top := m.top
-
-	if top == nil {
-		top = m
+	name = path.Clean("/" + name)
+	ino, err := t.resolve(m.id, name, follow, nil)
+	if err != nil {
+		return nil, "", err
 	}
 
-	if strings.HasPrefix(dir, "/") {
-		node = top
+	if name == "/" {
+		_, base := dirname(m.root)
+		return ino, base, nil
 	}
+	return ino, name[strings.LastIndex(name, "/")+1:], nil
+}
 
-	for i := 0; i < len(dirs); i++ {
-		if dirs[i] == "" {
-			continue
-		}
-		node.RLock()
-		if child, ok := node.dirs[dirs[i]]; ok {
-			node.RUnlock()
-			node = child
-			continue
-		}
-
-		node.RUnlock()
-		if !autoCreate {
-			return nil, false
-		}
-
-		child := New(m.config, node.root+dirs[i]).(*memFs)
-		child.top = top
-		node.Lock()
-
-		node.dirs[dirs[i]] = child
+// update changes the tree unless the filesystem is closed.
+func (m *memFs) update(fn func(tx *memTx) error) error {
+	if m.life.Closed() {
+		return fs.ErrClosed
+	}
+	return m.tree.update(fn)
+}
 
-		node.Unlock()
+// path returns the full path of name, relative to the view.
+func (m *memFs) path(name string) string {
+	return path.Join(m.root, path.Clean("/"+name))
+}
 
-		node = child
+// dirname splits the cleaned path into its directory and base name,
+// the root directory has an empty base name.
+func dirname(name string) (dir string, base string) {
+	name = path.Clean("/" + name)
+	if name == "/" {
+		return "", ""
 	}
 
-	return node, true
+	i := strings.LastIndex(name, "/")
+
+	return name[:i], name[i+1:]
 }
 
-func dirname(path string) (dir string, name string) {
-	dirs := strings.Split(strings.TrimRight(path, "/"), "/")
+// linkTarget returns the path the link name to link refers to.
+func linkTarget(name, link string) string {
+	if strings.HasPrefix(link, "/") {
+		return link
+	}
 
-	return strings.Join(dirs[:len(dirs)-1], "/"), dirs[len(dirs)-1]
+	dir, _ := dirname(name)
+	return dir + "/" + link
 }
 
 func pathjoin(root, dir string) string {
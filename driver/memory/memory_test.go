@@ -3,10 +3,16 @@ package memory
 import (
 	"bytes"
 	"fmt"
+	"github.com/lazychanger/go-vfs"
+	_ "github.com/lazychanger/go-vfs/driver/os"
 	"github.com/lazychanger/go-vfs/tests"
+	"github.com/lazychanger/go-vfs/vfstest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io"
 	"io/fs"
+	"sync"
+	"syscall"
 	"testing"
 )
 
@@ -50,7 +56,7 @@ func TestNew(t *testing.T) {
 	assert.Equal(t, fi.IsDir(), false)
 	assert.NotNil(t, fi.ModTime())
 	assert.Nil(t, fi.Sys())
-	assert.Equal(t, fi.Mode(), fs.FileMode(0))
+	assert.Equal(t, fi.Mode(), fs.FileMode(0666))
 
 	fb, _ := io.ReadAll(f)
 	assert.Equal(t, string(fb), testBytes.String())
@@ -60,3 +66,375 @@ func TestNew(t *testing.T) {
 func TestMemFs(t *testing.T) {
 	tests.TestDriver(t, fmt.Sprintf("memory:///?maxsize=%d", 2>>10))
 }
+
+func TestMemFsUsage(t *testing.T) {
+	vfs := New(&Config{MaxSize: 10}, "/")
+	usage := func() *filesystem.Usage {
+		t.Helper()
+		u, err := filesystem.Statfs(vfs)
+		require.NoError(t, err)
+		return u
+	}
+	assert.Equal(t, &filesystem.Usage{Total: 10, Free: 10, InodesUsed: 1}, usage())
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/f", []byte("123456")))
+	require.NoError(t, filesystem.WriteFile(vfs, "/g", []byte("12")))
+	assert.Equal(t, &filesystem.Usage{Total: 10, Used: 8, Free: 2, InodesUsed: 5}, usage())
+
+	err := filesystem.WriteFile(vfs, "/h", []byte("123"))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	assert.Equal(t, uint64(8), usage().Used)
+
+	// truncating, replacing and removing give the space back
+	require.NoError(t, filesystem.WriteFile(vfs, "/h", []byte("12")))
+	require.NoError(t, vfs.Rename("/h", "/g"))
+	assert.Equal(t, &filesystem.Usage{Total: 10, Used: 8, Free: 2, InodesUsed: 5}, usage())
+
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/f", []byte("1")))
+	assert.Equal(t, uint64(3), usage().Used)
+
+	require.NoError(t, vfs.RemoveAll("/a"))
+	assert.Equal(t, &filesystem.Usage{Total: 10, Used: 2, Free: 8, InodesUsed: 2}, usage())
+
+	require.NoError(t, vfs.Remove("/g"))
+	assert.Equal(t, &filesystem.Usage{Total: 10, Free: 10, InodesUsed: 1}, usage())
+
+	unlimited, err := filesystem.Statfs(New(nil, "/"))
+	require.NoError(t, err)
+	assert.Zero(t, unlimited.Total)
+	assert.Zero(t, unlimited.Free)
+}
+
+func TestMemFsOpenDir(t *testing.T) {
+	vfs := New(nil, "/")
+	require.NoError(t, vfs.Mkdir("/d", 0755))
+	for _, name := range []string{"/d/c", "/d/a", "/d/e"} {
+		require.NoError(t, filesystem.WriteFile(vfs, name, []byte(name)))
+	}
+	require.NoError(t, vfs.Mkdir("/d/b", 0755))
+
+	f, err := vfs.Open("/d")
+	require.NoError(t, err)
+	dir, ok := f.(filesystem.ReadDirFile)
+	require.True(t, ok)
+
+	list, err := dir.ReadDir(2)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a", "b"}, entryNames(list))
+
+	// the handle keeps iterating the entries it started with
+	require.NoError(t, vfs.Remove("/d/c"))
+	require.NoError(t, filesystem.WriteFile(vfs, "/d/0", nil))
+	list, err = dir.ReadDir(-1)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"c", "e"}, entryNames(list))
+
+	list, err = dir.ReadDir(1)
+	assert.Empty(t, list)
+	assert.ErrorIs(t, err, io.EOF)
+
+	_, err = f.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, syscall.EISDIR)
+	_, err = f.Write([]byte("x"))
+	assert.ErrorIs(t, err, syscall.EBADF)
+
+	require.NoError(t, f.Close())
+	_, err = dir.ReadDir(1)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	assert.ErrorIs(t, f.Close(), fs.ErrClosed)
+
+	// a new handle sees the changes, in order
+	root, err := vfs.Open("/")
+	require.NoError(t, err)
+	defer root.Close()
+	sub, err := vfs.Open("d")
+	require.NoError(t, err)
+	defer sub.Close()
+	list, err = sub.(filesystem.ReadDirFile).ReadDir(0)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0", "a", "b", "e"}, entryNames(list))
+}
+
+func entryNames(list []fs.DirEntry) []string {
+	names := make([]string, 0, len(list))
+	for _, d := range list {
+		names = append(names, d.Name())
+	}
+	return names
+}
+
+func TestMemFsRenameTree(t *testing.T) {
+	vfs := New(nil, "/")
+	require.NoError(t, vfs.MkdirAll("/a/b/c", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c/f", []byte("f")))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/gone", []byte("gone")))
+
+	sub, err := vfs.Sub("/a/b")
+	require.NoError(t, err)
+	f, err := vfs.Open("/a/b/c/f")
+	require.NoError(t, err)
+	gone, err := vfs.Open("/a/gone")
+	require.NoError(t, err)
+
+	require.NoError(t, vfs.Rename("/a", "/z"))
+	require.NoError(t, vfs.Remove("/z/gone"))
+
+	// views and handles follow the inodes, not the paths
+	assert.True(t, sub.IsFile("/c/f"))
+	_, err = f.Write([]byte("+"))
+	require.NoError(t, err)
+	data, err := filesystem.ReadFile(vfs, "/z/b/c/f")
+	require.NoError(t, err)
+	assert.Equal(t, "f+", string(data))
+
+	// an unlinked file stays readable and writable through its handle
+	_, err = gone.Write([]byte("!"))
+	require.NoError(t, err)
+	data, err = io.ReadAll(gone)
+	require.NoError(t, err)
+	assert.Equal(t, "gone!", string(data))
+	assert.False(t, vfs.Exists("/z/gone"))
+
+	usage, err := filesystem.Statfs(vfs)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(2), usage.Used)
+	assert.Equal(t, uint64(5), usage.InodesUsed)
+}
+
+func TestMemFsLargeFile(t *testing.T) {
+	vfs := New(nil, "/")
+	require.NoError(t, filesystem.WriteFile(vfs, "/big", []byte("head")))
+	require.NoError(t, filesystem.Truncate(vfs, "/big", 4<<30))
+
+	f, err := vfs.Open("/big")
+	require.NoError(t, err)
+	defer f.Close()
+	file := f.(interface {
+		io.ReaderAt
+		io.WriterAt
+		io.Seeker
+	})
+
+	_, err = file.WriteAt([]byte("tail"), 4<<30-4)
+	require.NoError(t, err)
+	_, err = file.WriteAt([]byte("past"), 5<<30)
+	require.NoError(t, err)
+
+	p := make([]byte, 6)
+	n, err := file.ReadAt(p, 4<<30-6)
+	require.NoError(t, err)
+	assert.Equal(t, "\x00\x00tail", string(p[:n]))
+
+	n, err = file.ReadAt(p, 5<<30)
+	assert.ErrorIs(t, err, io.EOF)
+	assert.Equal(t, "past", string(p[:n]))
+
+	pos, err := file.Seek(-4, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(5<<30), pos)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "past", string(data))
+
+	usage, err := filesystem.Statfs(vfs)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(5<<30+4), usage.Used)
+
+	require.NoError(t, filesystem.Truncate(vfs, "/big", 2))
+	data, err = filesystem.ReadFile(vfs, "/big")
+	require.NoError(t, err)
+	assert.Equal(t, "he", string(data))
+	require.NoError(t, vfs.Remove("/big"))
+	usage, err = filesystem.Statfs(vfs)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), usage.Used)
+
+	assert.ErrorIs(t, filesystem.Truncate(vfs, "/", 0), syscall.EISDIR)
+}
+
+func TestDriverNamed(t *testing.T) {
+	open := func(dsn string) filesystem.FileSystem {
+		vfs, err := filesystem.Open(dsn)
+		require.NoError(t, err)
+		return vfs
+	}
+	closeFs := func(vfs filesystem.FileSystem) error {
+		return vfs.(io.Closer).Close()
+	}
+
+	a, b := open("memory://scratch/"), open("memory://scratch/?maxsize=1")
+	require.NoError(t, filesystem.WriteFile(a, "/shared.txt", []byte("shared")))
+	data, err := filesystem.ReadFile(b, "/shared.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "shared", string(data), "the options of the first Open apply")
+
+	assert.False(t, open("memory:///").Exists("/shared.txt"))
+	assert.False(t, open("memory://other/").Exists("/shared.txt"))
+	assert.False(t, open("memory://scratch/?isolated=true").Exists("/shared.txt"))
+
+	// the tree lives as long as one filesystem on it is open
+	require.NoError(t, closeFs(a))
+	assert.ErrorIs(t, closeFs(a), fs.ErrClosed)
+	c := open("memory://scratch/")
+	assert.True(t, c.Exists("/shared.txt"))
+	require.NoError(t, closeFs(b))
+	require.NoError(t, closeFs(c))
+
+	assert.False(t, open("memory://scratch/").Exists("/shared.txt"))
+}
+
+func TestMemFsSymlink(t *testing.T) {
+	vfs := New(nil, "/")
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c.txt", []byte("c")))
+
+	// absolute links resolve from the root of the view they are walked in
+	require.NoError(t, filesystem.Symlink(vfs, "/b/c.txt", "/a/abs"))
+	assert.False(t, vfs.Exists("/a/abs"))
+	sub, err := vfs.Sub("/a")
+	require.NoError(t, err)
+	data, err := filesystem.ReadFile(sub, "/abs")
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(data))
+
+	// .. never leads out of the view
+	require.NoError(t, filesystem.Symlink(sub, "../../../b", "/up"))
+	assert.True(t, sub.IsDir("/up"))
+
+	require.NoError(t, filesystem.Symlink(vfs, "loop", "/loop"))
+	_, err = vfs.Stat("/loop")
+	assert.ErrorIs(t, err, syscall.ELOOP)
+
+	// Create through a dangling link creates its target, MkdirAll walks
+	// through links
+	require.NoError(t, filesystem.Symlink(vfs, "a/b/new.txt", "/dangling"))
+	require.NoError(t, filesystem.WriteFile(vfs, "/dangling", []byte("new")))
+	assert.True(t, vfs.IsFile("/a/b/new.txt"))
+	require.NoError(t, filesystem.Symlink(vfs, "a/b", "/dir"))
+	require.NoError(t, vfs.MkdirAll("/dir/d/e", 0755))
+	assert.True(t, vfs.IsDir("/a/b/d/e"))
+	assert.ErrorIs(t, vfs.MkdirAll("/loop/x", 0755), syscall.ELOOP)
+}
+
+func TestMemFsClone(t *testing.T) {
+	vfs := New(&Config{MaxSize: 1 << 20}, "/")
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c.txt", []byte("abc")))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/keep", []byte("keep")))
+
+	clone, err := filesystem.Clone(vfs)
+	require.NoError(t, err)
+
+	// both grow the chunk they share
+	appendTo := func(vfs filesystem.FileSystem, p string) {
+		f, err := vfs.Open("/a/b/c.txt")
+		require.NoError(t, err)
+		_, err = f.(io.Seeker).Seek(0, io.SeekEnd)
+		require.NoError(t, err)
+		_, err = f.Write([]byte(p))
+		require.NoError(t, err)
+		require.NoError(t, f.Close())
+	}
+	appendTo(vfs, "X")
+	appendTo(clone, "YY")
+
+	data, err := filesystem.ReadFile(vfs, "/a/b/c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "abcX", string(data))
+	data, err = filesystem.ReadFile(clone, "/a/b/c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "abcYY", string(data))
+
+	require.NoError(t, vfs.RemoveAll("/a"))
+	assert.True(t, clone.IsFile("/a/keep"))
+	require.NoError(t, clone.Rename("/a/keep", "/kept"))
+	assert.False(t, vfs.Exists("/kept"))
+
+	usage, err := filesystem.Statfs(clone)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(9), usage.Used)
+	assert.Equal(t, uint64(1<<20), usage.Total)
+	usage, err = filesystem.Statfs(vfs)
+	require.NoError(t, err)
+	assert.Equal(t, uint64(0), usage.Used)
+
+	// a Sub view clones into a view of the same directory
+	sub, err := clone.Sub("/a")
+	require.NoError(t, err)
+	subClone, err := filesystem.Clone(sub)
+	require.NoError(t, err)
+	assert.True(t, subClone.IsFile("/b/c.txt"))
+	require.NoError(t, subClone.Remove("/b/c.txt"))
+	assert.True(t, sub.IsFile("/b/c.txt"))
+
+	require.NoError(t, filesystem.Close(clone))
+	_, err = filesystem.Clone(clone)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+}
+
+func TestMemFsCloneConcurrent(t *testing.T) {
+	fixture := New(nil, "/")
+	for i := 0; i < 10; i++ {
+		require.NoError(t, fixture.MkdirAll(fmt.Sprintf("/dir%d", i), 0755))
+		require.NoError(t, filesystem.WriteFile(fixture, fmt.Sprintf("/dir%d/file", i), []byte("fixture")))
+	}
+
+	clones := make([]filesystem.FileSystem, 8)
+	for i := range clones {
+		var err error
+		clones[i], err = filesystem.Clone(fixture)
+		require.NoError(t, err)
+	}
+
+	var wg sync.WaitGroup
+	for i, clone := range clones {
+		wg.Add(1)
+		go func(i int, clone filesystem.FileSystem) {
+			defer wg.Done()
+
+			for j := 0; j < 10; j++ {
+				name := fmt.Sprintf("/dir%d/file", j)
+				f, err := clone.Open(name)
+				if !assert.NoError(t, err) {
+					return
+				}
+				_, err = f.(io.Seeker).Seek(0, io.SeekEnd)
+				assert.NoError(t, err)
+				_, err = fmt.Fprint(f, i)
+				assert.NoError(t, err)
+				assert.NoError(t, f.Close())
+
+				data, err := filesystem.ReadFile(clone, name)
+				assert.NoError(t, err)
+				assert.Equal(t, fmt.Sprintf("fixture%d", i), string(data))
+			}
+		}(i, clone)
+	}
+
+	// the fixture changes while its clones do
+	for i := 0; i < 10; i++ {
+		require.NoError(t, filesystem.WriteFile(fixture, fmt.Sprintf("/dir%d/file", i), []byte("changed")))
+	}
+	wg.Wait()
+
+	data, err := filesystem.ReadFile(fixture, "/dir0/file")
+	require.NoError(t, err)
+	assert.Equal(t, "changed", string(data))
+}
+
+func TestMemFsConformance(t *testing.T) {
+	vfstest.TestDriver(t, "memory:///")
+}
+
+func FuzzMemFs(f *testing.F) {
+	vfstest.Fuzz(f, "memory:///")
+}
+
+func FuzzMemFsAgainstOs(f *testing.F) {
+	vfstest.FuzzAgainst(f, "memory:///", fmt.Sprintf("os://%s/", f.TempDir()))
+}
+
+func BenchmarkMemFs(b *testing.B) {
+	vfstest.Benchmark(b, "memory:///")
+}
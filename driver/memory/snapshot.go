@@ -0,0 +1,309 @@
+package memory
+
+import (
+	"archive/tar"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// A snapshot is a tar archive in the PAX format: its global header records
+// the version of the snapshot format, then come the entries of the tree,
+// every directory before its content. Directories, regular files and
+// symbolic links keep their permission bits and modification times to the
+// nanosecond.
+//
+// Restore reads any tar archive, without a version as version 1: an archive
+// made by tar(1) loads as well.
+
+const (
+	// snapshotVersion is the version of the snapshot format.
+	snapshotVersion = "1"
+
+	// snapshotVersionKey is the record of the version in the global header.
+	snapshotVersionKey = "GOVFS.snapshot"
+
+	// snapshotInodeKey is the record of the inode id of an entry, in the
+	// checkpoints of a write-ahead log only.
+	snapshotInodeKey = "GOVFS.ino"
+)
+
+// Snapshot writes the tree below the view to w. The snapshot is of one
+// version of the tree, it goes on changing while it is written.
+func (m *memFs) Snapshot(w io.Writer) error {
+	t := m.tree.load()
+
+	root, _, err := m.lookup(t, "")
+	if err == nil {
+		err = writeSnapshot(tar.NewWriter(w), t, root, nil)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "snapshot", Path: m.root, Err: err}
+	}
+	return nil
+}
+
+// writeSnapshot writes the tree below root. A checkpoint, with the records
+// to add to the global header, keeps the root and the inode ids as well.
+func writeSnapshot(tw *tar.Writer, t *memTable, root *memInode, checkpoint map[string]string) error {
+	global := map[string]string{snapshotVersionKey: snapshotVersion}
+	for k, v := range checkpoint {
+		global[k] = v
+	}
+
+	err := tw.WriteHeader(&tar.Header{
+		Typeflag:   tar.TypeXGlobalHeader,
+		PAXRecords: global,
+		Format:     tar.FormatPAX,
+	})
+	if err != nil {
+		return err
+	}
+
+	if checkpoint != nil {
+		err = tw.WriteHeader(&tar.Header{
+			Typeflag: tar.TypeDir,
+			Name:     "./",
+			Mode:     int64(root.mode.Perm()),
+			ModTime:  root.modTime,
+			Format:   tar.FormatPAX,
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := writeSnapshotDir(tw, t, root, "", checkpoint != nil); err != nil {
+		return err
+	}
+	return tw.Close()
+}
+
+// writeSnapshotDir writes the entries of the directory by name, prefix is
+// the path of the directory in the archive.
+func writeSnapshotDir(tw *tar.Writer, t *memTable, dir *memInode, prefix string, ids bool) error {
+	var list []memDirent
+	dir.dirents(func(d memDirent) {
+		list = append(list, d)
+	})
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	for _, d := range list {
+		ino := t.get(d.id)
+		if ino == nil {
+			continue
+		}
+
+		hdr := &tar.Header{
+			Name:    prefix + d.name,
+			Mode:    int64(ino.mode.Perm()),
+			ModTime: ino.modTime,
+			Format:  tar.FormatPAX,
+		}
+		if ids {
+			hdr.PAXRecords = map[string]string{snapshotInodeKey: strconv.FormatUint(ino.id, 10)}
+		}
+		switch {
+		case ino.isDir:
+			hdr.Typeflag = tar.TypeDir
+			hdr.Name += "/"
+		case ino.isSymlink():
+			hdr.Typeflag = tar.TypeSymlink
+			hdr.Linkname = ino.link
+		default:
+			hdr.Typeflag = tar.TypeReg
+			hdr.Size = ino.size()
+		}
+
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+
+		switch {
+		case ino.isDir:
+			if err := writeSnapshotDir(tw, t, ino, hdr.Name, ids); err != nil {
+				return err
+			}
+		case !ino.isSymlink():
+			if err := writeSnapshotData(tw, ino.data); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func writeSnapshotData(w io.Writer, data memData) error {
+	buf := make([]byte, minInt(chunkSize, int(data.size)))
+	for off := int64(0); off < data.size; {
+		n := data.readAt(buf, off)
+		if _, err := w.Write(buf[:n]); err != nil {
+			return err
+		}
+		off += int64(n)
+	}
+	return nil
+}
+
+// Restore adds the entries of the tar archive read from r below the view,
+// directories are merged with the ones already there, other entries replace
+// the files of the same name. Nothing changes unless the whole archive is
+// restored.
+func (m *memFs) Restore(r io.Reader) error {
+	err := m.update(func(tx *memTx) error {
+		_, err := m.restore(tx, tar.NewReader(r), false)
+		return err
+	})
+	if err != nil {
+		return &fs.PathError{Op: "restore", Path: m.root, Err: err}
+	}
+	return nil
+}
+
+// restore adds the entries of the archive to the tree, with the inode ids
+// they record when ids. It returns the records of the global header.
+func (m *memFs) restore(tx *memTx, tr *tar.Reader, ids bool) (map[string]string, error) {
+	global := map[string]string{}
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return global, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+		if hdr.Typeflag == tar.TypeXGlobalHeader {
+			for k, v := range hdr.PAXRecords {
+				global[k] = v
+			}
+		}
+
+		var id uint64
+		if ids {
+			id, _ = strconv.ParseUint(hdr.PAXRecords[snapshotInodeKey], 10, 64)
+		}
+		if err := m.restoreEntry(tx, hdr, tr, id); err != nil {
+			return nil, fmt.Errorf("%s: %w", hdr.Name, err)
+		}
+	}
+}
+
+// restoreEntry adds the entry of the archive to the tree under the inode id,
+// or the next free one when id is 0. r reads the content of the entry.
+func (m *memFs) restoreEntry(tx *memTx, hdr *tar.Header, r io.Reader, id uint64) error {
+	if hdr.Typeflag == tar.TypeXGlobalHeader {
+		if v, ok := hdr.PAXRecords[snapshotVersionKey]; ok && v != snapshotVersion {
+			return fmt.Errorf("unsupported snapshot version %s", v)
+		}
+		return nil
+	}
+
+	dir, base := dirname(hdr.Name)
+	parent, err := tx.mkdirAll(m.id, dir, 0755)
+	if err != nil {
+		return err
+	}
+
+	perm := fs.FileMode(hdr.Mode).Perm()
+
+	if existing, ok := parent.lookup(base); ok || base == "" {
+		ino := parent
+		if base != "" {
+			ino = tx.get(existing)
+		}
+
+		switch {
+		case ino.isDir && hdr.Typeflag == tar.TypeDir:
+			tx.touch(tx.chmod(ino, perm), hdr.ModTime)
+			return nil
+		case ino.isDir:
+			return syscall.EISDIR
+		}
+
+		tx.release(existing)
+		tx.unlink(parent, base)
+		parent = tx.get(parent.id)
+	}
+
+	ino := &memInode{id: id, mode: perm, modTime: hdr.ModTime}
+	switch hdr.Typeflag {
+	case tar.TypeDir:
+		ino.isDir = true
+		ino = tx.add(ino)
+	case tar.TypeSymlink:
+		ino.mode, ino.link = fs.ModeSymlink|fs.ModePerm, hdr.Linkname
+		ino = tx.add(ino)
+	case tar.TypeReg:
+		if ino, err = restoreData(tx, tx.add(ino), r, hdr.Size, hdr.ModTime); err != nil {
+			return err
+		}
+	case tar.TypeLink:
+		// a hard link is a copy in memory, it shares the content of the file
+		// until either changes
+		source, err := tx.walk(m.id, path.Clean("/"+hdr.Linkname))
+		if err != nil {
+			return err
+		}
+		if source.isDir {
+			return syscall.EISDIR
+		}
+		if ino, err = tx.share(tx.add(ino), source); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unsupported entry type %q", hdr.Typeflag)
+	}
+
+	tx.link(parent, base, ino.id)
+	return nil
+}
+
+// restoreData reads the size bytes of the file within the transaction,
+// blocks of zeros are left as holes.
+func restoreData(tx *memTx, ino *memInode, r io.Reader, size int64, mtime time.Time) (*memInode, error) {
+	buf := make([]byte, minInt(chunkSize, int(size)))
+	for off := int64(0); off < size; {
+		n, err := io.ReadFull(r, buf[:minInt(len(buf), int(size-off))])
+		if err != nil {
+			return nil, err
+		}
+
+		if !zeros(buf[:n]) {
+			if ino, err = tx.change(ino, memChange{p: buf[:n], off: off}, mtime); err != nil {
+				return nil, err
+			}
+		}
+		off += int64(n)
+	}
+
+	if ino.size() < size {
+		return tx.change(ino, memChange{off: size, truncate: true}, mtime)
+	}
+	return ino, nil
+}
+
+func zeros(p []byte) bool {
+	for _, b := range p {
+		if b != 0 {
+			return false
+		}
+	}
+	return true
+}
+
+// load restores the snapshot in the named file of the host.
+func (m *memFs) load(name string) error {
+	f, err := os.Open(name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return m.Restore(f)
+}
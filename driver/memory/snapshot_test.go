@@ -0,0 +1,216 @@
+package memory
+
+import (
+	"archive/tar"
+	"bytes"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestSnapshot(t *testing.T) {
+	vfs := New(nil, "/")
+	mtime := time.Date(2021, 2, 3, 4, 5, 6, 789, time.UTC)
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0750))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c.txt", []byte("content")))
+	require.NoError(t, filesystem.WriteFile(vfs, "/empty", nil))
+	require.NoError(t, filesystem.Chmod(vfs, "/a/b/c.txt", 0600))
+	require.NoError(t, filesystem.Symlink(vfs, "b/c.txt", "/a/link"))
+
+	// a sparse file stays sparse
+	f, err := vfs.Create("/sparse")
+	require.NoError(t, err)
+	_, err = f.(interface {
+		WriteAt([]byte, int64) (int, error)
+	}).WriteAt([]byte("end"), 10*chunkSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	for _, name := range []string{"/a", "/a/b", "/a/b/c.txt", "/empty", "/sparse"} {
+		require.NoError(t, filesystem.Chtimes(vfs, name, mtime, mtime))
+	}
+
+	var buf bytes.Buffer
+	require.NoError(t, filesystem.Snapshot(vfs, &buf))
+
+	restored := New(nil, "/")
+	require.NoError(t, filesystem.Restore(restored, bytes.NewReader(buf.Bytes())))
+
+	for _, name := range []string{"/a", "/a/b", "/a/b/c.txt", "/a/link", "/empty", "/sparse"} {
+		want, err := filesystem.Lstat(vfs, name)
+		require.NoError(t, err)
+		got, err := filesystem.Lstat(restored, name)
+		require.NoError(t, err)
+
+		assert.Equal(t, want.Mode(), got.Mode(), name)
+		assert.Equal(t, want.Size(), got.Size(), name)
+		if !want.ModTime().Equal(mtime) {
+			continue
+		}
+		assert.True(t, got.ModTime().Equal(mtime), "%s: modtime %s, want %s", name, got.ModTime(), mtime)
+	}
+
+	data, err := filesystem.ReadFile(restored, "/a/link")
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+
+	data, err = filesystem.ReadFile(restored, "/sparse")
+	require.NoError(t, err)
+	assert.Equal(t, append(make([]byte, 10*chunkSize), "end"...), data)
+	ino, _, err := restored.(*memFs).lookup(restored.(*memFs).tree.load(), "/sparse")
+	require.NoError(t, err)
+	assert.Equal(t, 1, ino.data.chunks.Len())
+
+	// snapshots are reproducible
+	var again bytes.Buffer
+	require.NoError(t, filesystem.Snapshot(restored, &again))
+	assert.Equal(t, buf.Bytes(), again.Bytes())
+
+	// a Sub view snapshots the tree below it
+	sub, err := vfs.Sub("/a")
+	require.NoError(t, err)
+	buf.Reset()
+	require.NoError(t, filesystem.Snapshot(sub, &buf))
+	restored = New(nil, "/")
+	require.NoError(t, filesystem.Restore(restored, &buf))
+	assert.True(t, restored.IsFile("/b/c.txt"))
+	assert.True(t, restored.IsFile("/link"))
+	assert.False(t, restored.Exists("/a"))
+}
+
+// archive builds a tar archive like tar(1) does, without a version.
+func archive(t *testing.T, entries ...*tar.Header) []byte {
+	var buf bytes.Buffer
+	tw := tar.NewWriter(&buf)
+	for _, hdr := range entries {
+		require.NoError(t, tw.WriteHeader(hdr))
+		if hdr.Typeflag == tar.TypeReg {
+			_, err := tw.Write(bytes.Repeat([]byte("x"), int(hdr.Size)))
+			require.NoError(t, err)
+		}
+	}
+	require.NoError(t, tw.Close())
+	return buf.Bytes()
+}
+
+func TestRestore(t *testing.T) {
+	vfs := New(nil, "/")
+	require.NoError(t, vfs.MkdirAll("/dir/keep", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/dir/file", []byte("old")))
+
+	require.NoError(t, filesystem.Restore(vfs, bytes.NewReader(archive(t,
+		&tar.Header{Typeflag: tar.TypeDir, Name: "./", Mode: 0755},
+		&tar.Header{Typeflag: tar.TypeDir, Name: "./dir/", Mode: 0700},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "./dir/file", Mode: 0644, Size: 3},
+		&tar.Header{Typeflag: tar.TypeLink, Name: "./dir/hard", Linkname: "./dir/file", Mode: 0644},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "implicit/dirs/file", Mode: 0644, Size: 1},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "../../escape", Mode: 0644, Size: 1},
+	))))
+
+	// directories merge, files are replaced
+	assert.True(t, vfs.IsDir("/dir/keep"))
+	fi, err := vfs.Stat("/dir")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeDir|0700, fi.Mode())
+	data, err := filesystem.ReadFile(vfs, "/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "xxx", string(data))
+	data, err = filesystem.ReadFile(vfs, "/dir/hard")
+	require.NoError(t, err)
+	assert.Equal(t, "xxx", string(data))
+	assert.True(t, vfs.IsFile("/implicit/dirs/file"))
+	assert.True(t, vfs.IsFile("/escape"))
+
+	// a hard link is a copy in memory
+	require.NoError(t, filesystem.WriteFile(vfs, "/dir/hard", []byte("y")))
+	data, err = filesystem.ReadFile(vfs, "/dir/file")
+	require.NoError(t, err)
+	assert.Equal(t, "xxx", string(data))
+}
+
+func TestRestoreFails(t *testing.T) {
+	vfs := New(&Config{MaxSize: 10}, "/")
+	require.NoError(t, filesystem.WriteFile(vfs, "/file", []byte("old")))
+	usage, err := filesystem.Statfs(vfs)
+	require.NoError(t, err)
+
+	unchanged := func() {
+		t.Helper()
+		data, err := filesystem.ReadFile(vfs, "/file")
+		require.NoError(t, err)
+		assert.Equal(t, "old", string(data))
+		assert.False(t, vfs.Exists("/new"))
+
+		after, err := filesystem.Statfs(vfs)
+		require.NoError(t, err)
+		assert.Equal(t, usage, after)
+	}
+
+	// nothing changes unless the whole archive is restored
+	err = filesystem.Restore(vfs, bytes.NewReader(archive(t,
+		&tar.Header{Typeflag: tar.TypeReg, Name: "new", Size: 1},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "file", Size: 1},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "big", Size: 20},
+	)))
+	assert.ErrorIs(t, err, syscall.ENOSPC)
+	unchanged()
+
+	err = filesystem.Restore(vfs, bytes.NewReader(archive(t,
+		&tar.Header{Typeflag: tar.TypeReg, Name: "new", Size: 1},
+		&tar.Header{Typeflag: tar.TypeFifo, Name: "fifo"},
+	)))
+	assert.ErrorContains(t, err, "unsupported entry type")
+	unchanged()
+
+	err = filesystem.Restore(vfs, bytes.NewReader(archive(t,
+		&tar.Header{
+			Typeflag:   tar.TypeXGlobalHeader,
+			PAXRecords: map[string]string{snapshotVersionKey: "2"},
+			Format:     tar.FormatPAX,
+		},
+		&tar.Header{Typeflag: tar.TypeReg, Name: "new", Size: 1},
+	)))
+	assert.ErrorContains(t, err, "unsupported snapshot version 2")
+	unchanged()
+
+	data := archive(t, &tar.Header{Typeflag: tar.TypeReg, Name: "new", Size: 5})
+	err = filesystem.Restore(vfs, bytes.NewReader(data[:512+3]))
+	assert.Error(t, err)
+	unchanged()
+}
+
+func TestDriverLoad(t *testing.T) {
+	src := New(nil, "/")
+	require.NoError(t, filesystem.WriteFile(src, "/fixture.txt", []byte("fixture")))
+
+	name := filepath.Join(t.TempDir(), "snapshot.tar")
+	f, err := os.Create(name)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Snapshot(src, f))
+	require.NoError(t, f.Close())
+
+	for _, dsn := range []string{"memory:///?load=%s", "memory://loaded/?load=%s"} {
+		vfs, err := filesystem.Open(fmt.Sprintf(dsn, name))
+		require.NoError(t, err)
+
+		data, err := filesystem.ReadFile(vfs, "/fixture.txt")
+		require.NoError(t, err)
+		assert.Equal(t, "fixture", string(data))
+		require.NoError(t, filesystem.Close(vfs))
+	}
+
+	_, err = filesystem.Open("memory://loaded/?load=/noexist.tar")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	vfs, err := filesystem.Open("memory://loaded/")
+	require.NoError(t, err)
+	assert.False(t, vfs.Exists("/fixture.txt"), "the tree goes with its last filesystem")
+	require.NoError(t, filesystem.Close(vfs))
+}
@@ -0,0 +1,110 @@
+package memory
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io/fs"
+	"sync/atomic"
+	"syscall"
+)
+
+// memAccount counts the bytes and inodes of a memory tree, shared by all of
+// its directories and files.
+type memAccount struct {
+	max int64
+
+	bytes int64
+
+	inodes int64
+}
+
+func newMemAccount(max int64) *memAccount {
+	return &memAccount{max: max, inodes: 1}
+}
+
+// reserve accounts n more bytes, the error is ENOSPC when that exceeds the
+// maximum size.
+func (a *memAccount) reserve(n int64) error {
+	for {
+		used := atomic.LoadInt64(&a.bytes)
+		if a.max > 0 && used+n > a.max {
+			return syscall.ENOSPC
+		}
+		if atomic.CompareAndSwapInt64(&a.bytes, used, used+n) {
+			return nil
+		}
+	}
+}
+
+func (a *memAccount) release(n int64) {
+	atomic.AddInt64(&a.bytes, -n)
+}
+
+// mark returns the counts, for reset to restore them.
+func (a *memAccount) mark() memAccount {
+	return memAccount{bytes: atomic.LoadInt64(&a.bytes), inodes: atomic.LoadInt64(&a.inodes)}
+}
+
+func (a *memAccount) reset(mark memAccount) {
+	atomic.StoreInt64(&a.bytes, mark.bytes)
+	atomic.StoreInt64(&a.inodes, mark.inodes)
+}
+
+func (a *memAccount) link() {
+	atomic.AddInt64(&a.inodes, 1)
+}
+
+func (a *memAccount) unlink() {
+	atomic.AddInt64(&a.inodes, -1)
+}
+
+// Usage reports the bytes of all files of the tree against MaxSize, there is
+// no inode limit.
+func (m *memFs) Usage() (*filesystem.Usage, error) {
+	if m.life.Closed() {
+		return nil, &fs.PathError{Op: "statfs", Path: m.root, Err: fs.ErrClosed}
+	}
+
+	used := atomic.LoadInt64(&m.tree.account.bytes)
+
+	usage := &filesystem.Usage{
+		Used:       uint64(used),
+		InodesUsed: uint64(atomic.LoadInt64(&m.tree.account.inodes)),
+	}
+	if m.tree.account.max > 0 {
+		usage.Total = uint64(m.tree.account.max)
+		usage.Free = uint64(m.tree.account.max - used)
+	}
+	return usage, nil
+}
+
+func (m *memFs) DiskUsage(name string) (*filesystem.DirUsage, error) {
+	t := m.tree.load()
+
+	ino, _, err := m.lookup(t, name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "du", Path: pathjoin(m.root, name), Err: err}
+	}
+
+	if !ino.isDir {
+		return &filesystem.DirUsage{Size: ino.size(), Files: 1}, nil
+	}
+
+	usage := &filesystem.DirUsage{}
+	diskUsage(t, ino, usage)
+	return usage, nil
+}
+
+func diskUsage(t *memTable, dir *memInode, usage *filesystem.DirUsage) {
+	dir.dirents(func(d memDirent) {
+		ino := t.get(d.id)
+		switch {
+		case ino == nil:
+		case ino.isDir:
+			usage.Dirs++
+			diskUsage(t, ino, usage)
+		default:
+			usage.Size += ino.size()
+			usage.Files++
+		}
+	})
+}
@@ -0,0 +1,726 @@
+package memory
+
+import (
+	"archive/tar"
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// A persistent tree keeps a write-ahead log in a directory of the host:
+//
+//	checkpoint.tar          the tree as of a transaction, a snapshot
+//	00000000000000000042.wal  the transactions from the 42nd on
+//
+// Every transaction is appended to the last segment of the log as one
+// frame before it is published: the length of its body, the CRC-32C of the
+// body, then the body, which is the sequence number of the transaction
+// followed by its records. Opening the tree restores the checkpoint and
+// replays the frames that came after it, a torn frame at the end of the log
+// is dropped.
+//
+// Once the last segment grows past the compaction size a new segment is
+// started, and the tree as of the end of the previous one is written to a
+// new checkpoint in the background; the segments it covers are removed.
+
+const (
+	walCheckpoint = "checkpoint.tar"
+	walSegment    = ".wal"
+
+	// walSequenceKey is the record of the sequence number of the last
+	// transaction in a checkpoint.
+	walSequenceKey = "GOVFS.sequence"
+
+	walFrameHeader = 12
+
+	defaultSyncInterval = time.Second
+	defaultCompactSize  = 64 << 20
+)
+
+// Sync policies of the write-ahead log.
+const (
+	// SyncAlways syncs the log to disk before every change is published.
+	SyncAlways = "always"
+	// SyncInterval syncs the log every SyncInterval.
+	SyncInterval = "interval"
+	// SyncNever leaves syncing to the operating system.
+	SyncNever = "never"
+)
+
+var walTable = crc32.MakeTable(crc32.Castagnoli)
+
+// errCorrupt reports a log that cannot be replayed.
+var errCorrupt = errors.New("corrupt write-ahead log")
+
+// walDirs are the directories of the logs open in the process.
+var walDirs = struct {
+	open map[string]bool
+	sync.Mutex
+}{open: make(map[string]bool)}
+
+// memWAL is the write-ahead log of a tree.
+type memWAL struct {
+	dir string
+
+	sync     string
+	interval time.Duration
+	compact  int64
+
+	// f is the last segment, size its size, seq the sequence number of the
+	// last transaction logged.
+	f    *os.File
+	size int64
+	seq  uint64
+
+	// dirty tells whether f has writes to sync.
+	dirty bool
+
+	// compacting is set while a checkpoint is written, err holds the first
+	// error of the background work.
+	compacting bool
+	err        error
+
+	stop chan struct{}
+	wg   sync.WaitGroup
+
+	// mu guards the fields above against the background work, the tree
+	// serializes the rest.
+	mu sync.Mutex
+}
+
+// openWAL restores the tree of vfs from the log in conf.WAL and logs its
+// changes from then on. It returns whether the log held any change.
+func openWAL(vfs *memFs, conf *Config) (bool, error) {
+	w := &memWAL{
+		sync:     conf.Sync,
+		interval: conf.SyncInterval,
+		compact:  conf.CompactSize,
+		stop:     make(chan struct{}),
+	}
+	switch w.sync {
+	case "":
+		w.sync = SyncInterval
+	case SyncAlways, SyncInterval, SyncNever:
+	default:
+		return false, fmt.Errorf("unknown sync policy %q", w.sync)
+	}
+	if w.interval <= 0 {
+		w.interval = defaultSyncInterval
+	}
+	if w.compact <= 0 {
+		w.compact = defaultCompactSize
+	}
+
+	dir, err := filepath.Abs(conf.WAL)
+	if err != nil {
+		return false, err
+	}
+	w.dir = dir
+
+	walDirs.Lock()
+	defer walDirs.Unlock()
+	if walDirs.open[dir] {
+		return false, &fs.PathError{Op: "open", Path: dir, Err: syscall.EBUSY}
+	}
+
+	restored, err := w.restore(vfs)
+	if err != nil {
+		if w.f != nil {
+			_ = w.f.Close()
+		}
+		return false, err
+	}
+
+	walDirs.open[dir] = true
+	vfs.tree.wal = w
+	if w.sync == SyncInterval {
+		w.wg.Add(1)
+		go w.syncLoop()
+	}
+	return restored, nil
+}
+
+// restore loads the checkpoint and replays the segments of the log into the
+// tree, then opens the last segment for appending.
+func (w *memWAL) restore(vfs *memFs) (bool, error) {
+	if err := os.MkdirAll(w.dir, 0755); err != nil {
+		return false, err
+	}
+	_ = os.Remove(filepath.Join(w.dir, walCheckpoint+".tmp"))
+
+	f, err := os.Open(filepath.Join(w.dir, walCheckpoint))
+	switch {
+	case err == nil:
+		defer f.Close()
+		err = vfs.tree.update(func(tx *memTx) error {
+			global, err := vfs.restore(tx, tar.NewReader(bufio.NewReader(f)), true)
+			if err != nil {
+				return err
+			}
+			w.seq, err = strconv.ParseUint(global[walSequenceKey], 10, 64)
+			return err
+		})
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", f.Name(), err)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return false, err
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return false, err
+	}
+
+	for i, first := range segments {
+		name := w.segment(first)
+		size, err := w.replay(vfs.tree, name, i == len(segments)-1)
+		if err != nil {
+			return false, fmt.Errorf("%s: %w", name, err)
+		}
+
+		if i == len(segments)-1 {
+			if w.f, err = os.OpenFile(name, os.O_WRONLY|os.O_APPEND, 0644); err != nil {
+				return false, err
+			}
+			w.size = size
+		}
+	}
+
+	if w.f == nil {
+		if err := w.create(); err != nil {
+			return false, err
+		}
+	}
+	return w.seq > 0, nil
+}
+
+// segments returns the sequence numbers the segments of the log start at,
+// in order.
+func (w *memWAL) segments() ([]uint64, error) {
+	list, err := os.ReadDir(w.dir)
+	if err != nil {
+		return nil, err
+	}
+
+	var segments []uint64
+	for _, entry := range list {
+		name := entry.Name()
+		if !strings.HasSuffix(name, walSegment) {
+			continue
+		}
+		first, err := strconv.ParseUint(strings.TrimSuffix(name, walSegment), 10, 64)
+		if err != nil {
+			continue
+		}
+		segments = append(segments, first)
+	}
+	sort.Slice(segments, func(i, j int) bool { return segments[i] < segments[j] })
+	return segments, nil
+}
+
+func (w *memWAL) segment(first uint64) string {
+	return filepath.Join(w.dir, fmt.Sprintf("%020d%s", first, walSegment))
+}
+
+// create starts a new segment for the transactions after the last one.
+func (w *memWAL) create() error {
+	f, err := os.OpenFile(w.segment(w.seq+1), os.O_WRONLY|os.O_CREATE|os.O_EXCL|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	if err := syncDir(w.dir); err != nil {
+		_ = f.Close()
+		return err
+	}
+
+	w.f, w.size = f, 0
+	return nil
+}
+
+// replay applies the frames of the segment the tree has not seen yet, and
+// returns the size of the frames that are whole. A torn or corrupt frame
+// ends the last segment, it fails the others.
+func (w *memWAL) replay(tree *memTree, name string, last bool) (int64, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, err
+	}
+
+	r := bufio.NewReader(f)
+	var size int64
+	for size < info.Size() {
+		seq, records, err := readFrame(r, info.Size()-size)
+		if err != nil && last {
+			// the frame was being written when the process stopped
+			return size, os.Truncate(name, size)
+		}
+		if err != nil {
+			return 0, err
+		}
+		if seq > w.seq+1 {
+			return 0, fmt.Errorf("%w: transaction %d follows %d", errCorrupt, seq, w.seq)
+		}
+
+		if seq == w.seq+1 {
+			err = tree.update(func(tx *memTx) error {
+				return replay(tx, records)
+			})
+			if err != nil {
+				return 0, fmt.Errorf("transaction %d: %w", seq, err)
+			}
+			w.seq = seq
+		}
+		size += walFrameHeader + int64(len(records)) + int64(uvarintLen(seq))
+	}
+	return size, nil
+}
+
+// readFrame reads a frame of at most max bytes, and returns the sequence
+// number and the records of its transaction.
+func readFrame(r io.Reader, max int64) (uint64, []byte, error) {
+	var header [walFrameHeader]byte
+	if _, err := io.ReadFull(r, header[:]); err != nil {
+		return 0, nil, err
+	}
+
+	n := binary.LittleEndian.Uint64(header[:8])
+	if n > uint64(max-walFrameHeader) {
+		return 0, nil, io.ErrUnexpectedEOF
+	}
+
+	body := make([]byte, n)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	if crc32.Checksum(body, walTable) != binary.LittleEndian.Uint32(header[8:]) {
+		return 0, nil, fmt.Errorf("%w: checksum mismatch", errCorrupt)
+	}
+
+	seq, k := binary.Uvarint(body)
+	if k <= 0 {
+		return 0, nil, errCorrupt
+	}
+	return seq, body[k:], nil
+}
+
+// append logs the records of a transaction, table is the tree once they are
+// applied. The transaction is durable on return with SyncAlways.
+func (w *memWAL) append(records []byte, table *memTable) error {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	seq := w.seq + 1
+
+	var header [walFrameHeader + binary.MaxVarintLen64]byte
+	k := binary.PutUvarint(header[walFrameHeader:], seq)
+	binary.LittleEndian.PutUint64(header[:8], uint64(k+len(records)))
+	crc := crc32.Update(crc32.Checksum(header[walFrameHeader:walFrameHeader+k], walTable), walTable, records)
+	binary.LittleEndian.PutUint32(header[8:], crc)
+
+	_, err := w.f.Write(header[:walFrameHeader+k])
+	if err == nil {
+		_, err = w.f.Write(records)
+	}
+	if err == nil && w.sync == SyncAlways {
+		err = w.f.Sync()
+	}
+	if err != nil {
+		// the transaction fails, so does its frame
+		_ = w.f.Truncate(w.size)
+		return err
+	}
+
+	w.seq = seq
+	w.size += int64(walFrameHeader + k + len(records))
+	w.dirty = w.sync != SyncAlways
+
+	if w.size >= w.compact && !w.compacting {
+		w.rotate(table)
+	}
+	return nil
+}
+
+// rotate starts a new segment and writes the checkpoint of table, the tree
+// as of the end of the previous segment, in the background.
+func (w *memWAL) rotate(table *memTable) {
+	previous := w.f
+	if err := w.create(); err != nil {
+		// go on with the segment there is
+		w.fail(err)
+		return
+	}
+	if w.sync != SyncNever {
+		w.fail(previous.Sync())
+	}
+	w.fail(previous.Close())
+
+	w.compacting = true
+	w.wg.Add(1)
+	go func(seq uint64) {
+		defer w.wg.Done()
+
+		err := w.checkpoint(table, seq)
+
+		w.mu.Lock()
+		defer w.mu.Unlock()
+		w.compacting = false
+		w.fail(err)
+	}(w.seq)
+}
+
+// checkpoint writes the tree as of the transaction seq and removes the
+// segments it covers.
+func (w *memWAL) checkpoint(table *memTable, seq uint64) error {
+	name := filepath.Join(w.dir, walCheckpoint)
+	f, err := os.Create(name + ".tmp")
+	if err != nil {
+		return err
+	}
+
+	b := bufio.NewWriter(f)
+	err = writeSnapshot(tar.NewWriter(b), table, table.get(rootID), map[string]string{
+		walSequenceKey: strconv.FormatUint(seq, 10),
+	})
+	if err == nil {
+		err = b.Flush()
+	}
+	if err == nil {
+		err = f.Sync()
+	}
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(name+".tmp", name)
+	}
+	if err == nil {
+		err = syncDir(w.dir)
+	}
+	if err != nil {
+		_ = os.Remove(name + ".tmp")
+		return err
+	}
+
+	segments, err := w.segments()
+	if err != nil {
+		return err
+	}
+	for _, first := range segments {
+		if first <= seq {
+			if err := os.Remove(w.segment(first)); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// fail records the first error of the background work.
+func (w *memWAL) fail(err error) {
+	if w.err == nil {
+		w.err = err
+	}
+}
+
+func (w *memWAL) syncLoop() {
+	defer w.wg.Done()
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-w.stop:
+			return
+		case <-ticker.C:
+			w.mu.Lock()
+			if w.dirty {
+				w.fail(w.f.Sync())
+				w.dirty = false
+			}
+			w.mu.Unlock()
+		}
+	}
+}
+
+// close waits for the background work, syncs and closes the log. The error
+// is the first the background work met, if any.
+func (w *memWAL) close() error {
+	close(w.stop)
+	w.wg.Wait()
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.sync != SyncNever {
+		w.fail(w.f.Sync())
+	}
+	w.fail(w.f.Close())
+
+	walDirs.Lock()
+	delete(walDirs.open, w.dir)
+	walDirs.Unlock()
+
+	return w.err
+}
+
+func syncDir(dir string) error {
+	f, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	return f.Sync()
+}
+
+// The records of a transaction.
+const (
+	walCreate byte = iota + 1
+	walLink
+	walUnlink
+	walRelease
+	walWrite
+	walTruncate
+	walShare
+	walChmod
+	walTouch
+)
+
+// walBuf encodes the records of a transaction.
+type walBuf []byte
+
+func (b *walBuf) uvarint(v uint64) {
+	var buf [binary.MaxVarintLen64]byte
+	*b = append(*b, buf[:binary.PutUvarint(buf[:], v)]...)
+}
+
+func (b *walBuf) varint(v int64) {
+	var buf [binary.MaxVarintLen64]byte
+	*b = append(*b, buf[:binary.PutVarint(buf[:], v)]...)
+}
+
+func (b *walBuf) bytes(p []byte) {
+	b.uvarint(uint64(len(p)))
+	*b = append(*b, p...)
+}
+
+func (b *walBuf) string(s string) {
+	b.uvarint(uint64(len(s)))
+	*b = append(*b, s...)
+}
+
+func (b *walBuf) time(t time.Time) {
+	b.varint(t.Unix())
+	b.uvarint(uint64(t.Nanosecond()))
+}
+
+func (b *walBuf) create(ino *memInode) {
+	mode := ino.mode
+	if ino.isDir {
+		mode |= fs.ModeDir
+	}
+
+	*b = append(*b, walCreate)
+	b.uvarint(ino.id)
+	b.uvarint(uint64(mode))
+	b.time(ino.modTime)
+	b.string(ino.link)
+}
+
+func (b *walBuf) link(dir uint64, name string, id uint64) {
+	*b = append(*b, walLink)
+	b.uvarint(dir)
+	b.string(name)
+	b.uvarint(id)
+}
+
+func (b *walBuf) unlink(dir uint64, name string) {
+	*b = append(*b, walUnlink)
+	b.uvarint(dir)
+	b.string(name)
+}
+
+func (b *walBuf) release(id uint64) {
+	*b = append(*b, walRelease)
+	b.uvarint(id)
+}
+
+func (b *walBuf) change(id uint64, c memChange, mtime time.Time) {
+	if c.truncate {
+		*b = append(*b, walTruncate)
+		b.uvarint(id)
+		b.varint(c.off)
+	} else {
+		*b = append(*b, walWrite)
+		b.uvarint(id)
+		b.varint(c.off)
+		b.bytes(c.p)
+	}
+	b.time(mtime)
+}
+
+func (b *walBuf) share(id, src uint64) {
+	*b = append(*b, walShare)
+	b.uvarint(id)
+	b.uvarint(src)
+}
+
+func (b *walBuf) chmod(id uint64, mode fs.FileMode) {
+	*b = append(*b, walChmod)
+	b.uvarint(id)
+	b.uvarint(uint64(mode))
+}
+
+func (b *walBuf) touch(id uint64, mtime time.Time) {
+	*b = append(*b, walTouch)
+	b.uvarint(id)
+	b.time(mtime)
+}
+
+// walReader decodes the records of a transaction, the first error sticks.
+type walReader struct {
+	b   []byte
+	err error
+}
+
+func (r *walReader) uvarint() uint64 {
+	v, k := binary.Uvarint(r.b)
+	if k <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[k:]
+	return v
+}
+
+func (r *walReader) varint() int64 {
+	v, k := binary.Varint(r.b)
+	if k <= 0 {
+		r.fail()
+		return 0
+	}
+	r.b = r.b[k:]
+	return v
+}
+
+func (r *walReader) bytes() []byte {
+	n := r.uvarint()
+	if n > uint64(len(r.b)) {
+		r.fail()
+		return nil
+	}
+	p := r.b[:n]
+	r.b = r.b[n:]
+	return p
+}
+
+func (r *walReader) string() string {
+	return string(r.bytes())
+}
+
+func (r *walReader) time() time.Time {
+	sec := r.varint()
+	return time.Unix(sec, int64(r.uvarint()))
+}
+
+// inode returns the inode of the id the next field holds.
+func (r *walReader) inode(tx *memTx) *memInode {
+	ino := tx.get(r.uvarint())
+	if ino == nil {
+		r.fail()
+	}
+	return ino
+}
+
+func (r *walReader) fail() {
+	if r.err == nil {
+		r.err = errCorrupt
+	}
+	r.b = nil
+}
+
+// replay applies the records of a transaction.
+func replay(tx *memTx, records []byte) error {
+	r := &walReader{b: records}
+	for len(r.b) > 0 && r.err == nil {
+		op := r.b[0]
+		r.b = r.b[1:]
+
+		var err error
+		switch op {
+		case walCreate:
+			id, mode, mtime, link := r.uvarint(), fs.FileMode(r.uvarint()), r.time(), r.string()
+			if r.err == nil {
+				tx.add(&memInode{id: id, isDir: mode.IsDir(), mode: mode &^ fs.ModeDir, link: link, modTime: mtime})
+			}
+		case walLink:
+			dir, name, id := r.inode(tx), r.string(), r.uvarint()
+			if r.err == nil {
+				tx.link(dir, name, id)
+			}
+		case walUnlink:
+			dir, name := r.inode(tx), r.string()
+			if r.err == nil {
+				tx.unlink(dir, name)
+			}
+		case walRelease:
+			tx.release(r.uvarint())
+		case walWrite:
+			ino, off, p, mtime := r.inode(tx), r.varint(), r.bytes(), r.time()
+			if r.err == nil {
+				_, err = tx.change(ino, memChange{p: p, off: off}, mtime)
+			}
+		case walTruncate:
+			ino, size, mtime := r.inode(tx), r.varint(), r.time()
+			if r.err == nil {
+				_, err = tx.change(ino, memChange{off: size, truncate: true}, mtime)
+			}
+		case walShare:
+			ino, src := r.inode(tx), r.inode(tx)
+			if r.err == nil {
+				_, err = tx.share(ino, src)
+			}
+		case walChmod:
+			ino, mode := r.inode(tx), fs.FileMode(r.uvarint())
+			if r.err == nil {
+				tx.chmod(ino, mode)
+			}
+		case walTouch:
+			ino, mtime := r.inode(tx), r.time()
+			if r.err == nil {
+				tx.touch(ino, mtime)
+			}
+		default:
+			r.fail()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return r.err
+}
+
+func uvarintLen(v uint64) int {
+	var buf [binary.MaxVarintLen64]byte
+	return binary.PutUvarint(buf[:], v)
+}
@@ -0,0 +1,239 @@
+package memory
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func openWALFs(t *testing.T, dir, options string) filesystem.FileSystem {
+	t.Helper()
+	vfs, err := filesystem.Open(fmt.Sprintf("memory:///?wal=%s%s", dir, options))
+	require.NoError(t, err)
+	return vfs
+}
+
+func snapshot(t *testing.T, vfs filesystem.FileSystem) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	require.NoError(t, filesystem.Snapshot(vfs, &buf))
+	return buf.Bytes()
+}
+
+// changeAll changes the tree every way a transaction can.
+func changeAll(t *testing.T, vfs filesystem.FileSystem) {
+	require.NoError(t, vfs.MkdirAll("/a/b", 0750))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c.txt", []byte("content")))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/gone", []byte("gone")))
+	require.NoError(t, filesystem.Chmod(vfs, "/a/b/c.txt", 0600))
+	require.NoError(t, filesystem.Symlink(vfs, "c.txt", "/a/link"))
+	require.NoError(t, vfs.Rename("/a/b/c.txt", "/a/c.txt"))
+	require.NoError(t, vfs.Remove("/a/gone"))
+	require.NoError(t, filesystem.Truncate(vfs, "/a/c.txt", 4))
+	require.NoError(t, filesystem.Chtimes(vfs, "/a/b", time.Unix(1, 2), time.Unix(1, 2)))
+
+	f, err := vfs.Create("/sparse")
+	require.NoError(t, err)
+	_, err = f.Write([]byte("head"))
+	require.NoError(t, err)
+	_, err = f.(io.WriterAt).WriteAt([]byte("end"), 3*chunkSize)
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+}
+
+// crash copies the log as it is on disk, as if the process had stopped.
+func crash(t *testing.T, dir string) string {
+	t.Helper()
+	copied := t.TempDir()
+	list, err := os.ReadDir(dir)
+	require.NoError(t, err)
+	for _, entry := range list {
+		data, err := os.ReadFile(filepath.Join(dir, entry.Name()))
+		require.NoError(t, err)
+		require.NoError(t, os.WriteFile(filepath.Join(copied, entry.Name()), data, 0644))
+	}
+	return copied
+}
+
+func lastSegment(t *testing.T, dir string) string {
+	t.Helper()
+	names, err := filepath.Glob(filepath.Join(dir, "*"+walSegment))
+	require.NoError(t, err)
+	require.NotEmpty(t, names)
+	return names[len(names)-1]
+}
+
+func TestWALReopen(t *testing.T) {
+	dir := t.TempDir()
+
+	vfs := openWALFs(t, dir, "")
+	changeAll(t, vfs)
+	want := snapshot(t, vfs)
+	require.NoError(t, filesystem.Close(vfs))
+
+	vfs = openWALFs(t, dir, "")
+	assert.Equal(t, want, snapshot(t, vfs))
+
+	data, err := filesystem.ReadFile(vfs, "/a/link")
+	require.NoError(t, err)
+	assert.Equal(t, "cont", string(data))
+	require.NoError(t, filesystem.Close(vfs))
+
+	// a named tree keeps its log until the last filesystem closes
+	vfs, err = filesystem.Open(fmt.Sprintf("memory://persistent/?wal=%s", dir))
+	require.NoError(t, err)
+	other, err := filesystem.Open("memory://persistent/")
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Close(vfs))
+	require.NoError(t, filesystem.WriteFile(other, "/named", nil))
+	require.NoError(t, filesystem.Close(other))
+
+	vfs = openWALFs(t, dir, "")
+	assert.True(t, vfs.IsFile("/named"))
+	require.NoError(t, filesystem.Close(vfs))
+}
+
+func TestWALCrash(t *testing.T) {
+	dir := t.TempDir()
+
+	vfs := openWALFs(t, dir, "&fsync=always")
+	defer filesystem.Close(vfs)
+	changeAll(t, vfs)
+	want := snapshot(t, vfs)
+
+	// the log is in use
+	_, err := filesystem.Open(fmt.Sprintf("memory:///?wal=%s", dir))
+	assert.ErrorIs(t, err, syscall.EBUSY)
+
+	copied := crash(t, dir)
+	restored := openWALFs(t, copied, "")
+	assert.Equal(t, want, snapshot(t, restored))
+	require.NoError(t, filesystem.Close(restored))
+
+	// a torn frame at the end is dropped, the log goes on after it
+	f, err := os.OpenFile(lastSegment(t, copied), os.O_WRONLY|os.O_APPEND, 0644)
+	require.NoError(t, err)
+	_, err = f.Write([]byte{42, 0, 0, 0, 0, 0, 0, 0, 1, 2})
+	require.NoError(t, err)
+	require.NoError(t, f.Close())
+
+	restored = openWALFs(t, copied, "")
+	assert.Equal(t, want, snapshot(t, restored))
+	require.NoError(t, filesystem.WriteFile(restored, "/after", []byte("after")))
+	require.NoError(t, filesystem.Close(restored))
+
+	restored = openWALFs(t, copied, "")
+	data, err := filesystem.ReadFile(restored, "/after")
+	require.NoError(t, err)
+	assert.Equal(t, "after", string(data))
+	require.NoError(t, filesystem.Close(restored))
+}
+
+func TestWALCompact(t *testing.T) {
+	dir := t.TempDir()
+
+	vfs := openWALFs(t, dir, "&compact=4096")
+	for i := 0; i < 100; i++ {
+		name := fmt.Sprintf("/file%d", i%10)
+		require.NoError(t, filesystem.WriteFile(vfs, name, bytes.Repeat([]byte{byte(i)}, 512)))
+	}
+	changeAll(t, vfs)
+	want := snapshot(t, vfs)
+	require.NoError(t, filesystem.Close(vfs))
+
+	assert.FileExists(t, filepath.Join(dir, walCheckpoint))
+	segments, err := filepath.Glob(filepath.Join(dir, "*"+walSegment))
+	require.NoError(t, err)
+	assert.Less(t, len(segments), 3, "the compacted segments are removed")
+
+	vfs = openWALFs(t, dir, "")
+	assert.Equal(t, want, snapshot(t, vfs))
+
+	// the inodes keep their ids, the log goes on from the checkpoint
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/c.txt", []byte("new")))
+	require.NoError(t, filesystem.Close(vfs))
+	vfs = openWALFs(t, dir, "")
+	data, err := filesystem.ReadFile(vfs, "/a/link")
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	require.NoError(t, filesystem.Close(vfs))
+}
+
+func TestWALCorrupt(t *testing.T) {
+	dir := t.TempDir()
+
+	vfs := openWALFs(t, dir, "")
+	changeAll(t, vfs)
+	require.NoError(t, filesystem.Close(vfs))
+
+	// the last segment is not the one corrupted
+	segment := lastSegment(t, dir)
+	data, err := os.ReadFile(segment)
+	require.NoError(t, err)
+	data[walFrameHeader+2] ^= 0xff
+	require.NoError(t, os.WriteFile(segment, data, 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, fmt.Sprintf("%020d%s", 1000, walSegment)), nil, 0644))
+
+	_, err = filesystem.Open(fmt.Sprintf("memory:///?wal=%s", dir))
+	assert.ErrorIs(t, err, errCorrupt)
+}
+
+func TestWALOptions(t *testing.T) {
+	_, err := filesystem.Open(fmt.Sprintf("memory:///?wal=%s&fsync=sometimes", t.TempDir()))
+	assert.ErrorContains(t, err, `unknown sync policy "sometimes"`)
+
+	for _, options := range []string{"&fsync=never", "&fsync=interval&fsyncinterval=1ms"} {
+		dir := t.TempDir()
+		vfs := openWALFs(t, dir, options)
+		require.NoError(t, filesystem.WriteFile(vfs, "/file", []byte("data")))
+		time.Sleep(5 * time.Millisecond)
+		require.NoError(t, filesystem.Close(vfs))
+
+		vfs = openWALFs(t, dir, options)
+		assert.True(t, vfs.IsFile("/file"), options)
+		require.NoError(t, filesystem.Close(vfs))
+	}
+
+	// load only fills a tree the log has nothing of
+	src := New(nil, "/")
+	require.NoError(t, filesystem.WriteFile(src, "/fixture", nil))
+	snap := filepath.Join(t.TempDir(), "snapshot.tar")
+	require.NoError(t, os.WriteFile(snap, snapshot(t, src), 0644))
+
+	dir := t.TempDir()
+	vfs := openWALFs(t, dir, "&load="+snap)
+	require.NoError(t, vfs.Remove("/fixture"))
+	require.NoError(t, filesystem.Close(vfs))
+	vfs = openWALFs(t, dir, "&load="+snap)
+	assert.False(t, vfs.Exists("/fixture"))
+	require.NoError(t, filesystem.Close(vfs))
+}
+
+func TestWALFails(t *testing.T) {
+	dir := t.TempDir()
+
+	vfs := openWALFs(t, dir, "&fsync=always")
+	require.NoError(t, filesystem.WriteFile(vfs, "/file", []byte("old")))
+
+	// a change the log cannot take is not made
+	w := vfs.(*memFs).tree.wal
+	w.mu.Lock()
+	require.NoError(t, w.f.Close())
+	w.mu.Unlock()
+
+	err := filesystem.WriteFile(vfs, "/file", []byte("new"))
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	data, err := filesystem.ReadFile(vfs, "/file")
+	require.NoError(t, err)
+	assert.Equal(t, "old", string(data))
+	assert.Error(t, filesystem.Close(vfs))
+}
@@ -0,0 +1,85 @@
+package nested
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
+)
+
+// options are the keys of the query the wrapper takes.
+var options = []string{"mounts"}
+
+type Config struct {
+	filesystem.Config
+
+	// FileSystem is the filesystem browsed, it stays open once the wrapper
+	// is closed.
+	FileSystem filesystem.FileSystem
+
+	// Stack is the DSN of the filesystem browsed when FileSystem is nil,
+	// opened and closed with the wrapper.
+	Stack string
+
+	// MaxMounts is the most archives kept mounted once no file is open on
+	// them, the least recently used are unmounted past it, 16 by default.
+	MaxMounts int
+}
+
+// stack returns the DSN of Stack parsed, nil when there is none.
+func (conf *Config) stack() *url.URL {
+	if conf.Stack == "" {
+		return nil
+	}
+	uri, err := url.Parse(conf.Stack)
+	if err != nil {
+		return nil
+	}
+	return uri
+}
+
+func (conf *Config) Driver() string {
+	if uri := conf.stack(); uri != nil {
+		return Driver + "+" + uri.Scheme
+	}
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	if uri := conf.stack(); uri != nil {
+		return uri.Host
+	}
+	return ""
+}
+
+func (conf *Config) Path() string {
+	if uri := conf.stack(); uri != nil {
+		return uri.Path
+	}
+	return ""
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if uri := conf.stack(); uri != nil {
+		return uri.User
+	}
+	return nil
+}
+
+// Encode the options to url.Values, with the ones of the filesystem browsed
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if uri := conf.stack(); uri != nil {
+		values = uri.Query()
+	}
+	if conf.MaxMounts != 0 {
+		values.Set("mounts", strconv.Itoa(conf.MaxMounts))
+	}
+	return values
+}
+
+// Decode mounts, the filesystem browsed decodes its own options
+func (conf *Config) Decode(query url.Values) error {
+	conf.MaxMounts, _ = strconv.Atoi(query.Get("mounts"))
+
+	return nil
+}
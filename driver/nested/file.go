@@ -0,0 +1,165 @@
+package nested
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"sync"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// archiveInfo describes an archive as the directory it is browsed as.
+type archiveInfo struct {
+	fs.FileInfo
+}
+
+func (fi archiveInfo) Mode() fs.FileMode {
+	return fs.ModeDir | 0555
+}
+
+func (fi archiveInfo) IsDir() bool {
+	return true
+}
+
+// browse returns the entries, the files named like an archive listed as
+// directories.
+func browse(list []fs.DirEntry) []fs.DirEntry {
+	entries := make([]fs.DirEntry, len(list))
+	for i, e := range list {
+		entries[i] = e
+		if !e.Type().IsRegular() || kindOf(e.Name()) == kindNone {
+			continue
+		}
+		if info, err := e.Info(); err == nil {
+			entries[i] = fs.FileInfoToDirEntry(archiveInfo{info})
+		}
+	}
+	return entries
+}
+
+// nestedFile is a file of the filesystem browsed or of an archive, it keeps
+// the mount it is open on until it is closed.
+type nestedFile struct {
+	filesystem.File
+
+	conn  *nestedConn
+	name  string
+	mount *mount
+
+	// info describes an archive opened as a directory.
+	info fs.FileInfo
+
+	release func()
+	once    sync.Once
+}
+
+// wrap returns the file, seeking and reading at an offset when the file it
+// wraps does, so that an archive held by an archive is read in place.
+func (f *nestedFile) wrap() filesystem.File {
+	switch f.File.(type) {
+	case interface {
+		io.Seeker
+		io.ReaderAt
+	}:
+		return &readerAtFile{f}
+	case io.Seeker:
+		return &seekFile{f}
+	case io.ReaderAt:
+		return &readAtFile{f}
+	}
+	return f
+}
+
+func (f *nestedFile) Stat() (fs.FileInfo, error) {
+	if f.info != nil {
+		return f.info, nil
+	}
+	return f.File.Stat()
+}
+
+// ReadDir lists the files named like an archive as directories.
+func (f *nestedFile) ReadDir(n int) ([]fs.DirEntry, error) {
+	d, ok := f.File.(fs.ReadDirFile)
+	if !ok {
+		return nil, &fs.PathError{Op: "readdir", Path: f.name, Err: syscall.ENOTDIR}
+	}
+	list, err := d.ReadDir(n)
+	return browse(list), err
+}
+
+func (f *nestedFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(func() {
+		f.release()
+		f.conn.release(f.mount)
+	})
+	return err
+}
+
+type seekFile struct {
+	*nestedFile
+}
+
+func (f *seekFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+type readerAtFile struct {
+	*nestedFile
+}
+
+func (f *readerAtFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+func (f *readerAtFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.File.(io.ReaderAt).ReadAt(p, off)
+}
+
+// readAtFile reads at an offset a file that does not seek.
+type readAtFile struct {
+	*nestedFile
+}
+
+func (f *readAtFile) ReadAt(p []byte, off int64) (int, error) {
+	return f.File.(io.ReaderAt).ReadAt(p, off)
+}
+
+var (
+	_ filesystem.ReadDirFile = (*nestedFile)(nil)
+	_ io.Seeker              = (*seekFile)(nil)
+	_ io.ReaderAt            = (*readerAtFile)(nil)
+	_ io.ReaderAt            = (*readAtFile)(nil)
+)
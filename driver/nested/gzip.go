@@ -0,0 +1,332 @@
+package nested
+
+import (
+	"bytes"
+	"compress/gzip"
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+)
+
+// gzipFs is a file compressed with gzip, browsed as a directory holding the
+// file decompressed, named as the archive without its extension. Its size
+// is counted once, decompressing the file when it is mounted.
+type gzipFs struct {
+	// ra reads the archive, archive closes its file.
+	ra      io.ReaderAt
+	size    int64
+	archive io.Closer
+
+	// dir describes the directory, file the file decompressed.
+	dir  *fileInfo
+	file *fileInfo
+}
+
+// newGzip mounts the file name of fsys.
+func newGzip(fsys filesystem.FileSystem, name string) (filesystem.FileSystem, error) {
+	f, err := fsys.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	vfs, err := readGzip(f, name)
+	if err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return vfs, nil
+}
+
+// readGzip counts the size of the file f decompressed.
+func readGzip(f fs.File, name string) (*gzipFs, error) {
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	size := info.Size()
+	ra, ok := f.(io.ReaderAt)
+	if !ok {
+		data, err := io.ReadAll(f)
+		if err != nil {
+			return nil, err
+		}
+		ra, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	vfs := &gzipFs{ra: ra, size: size, archive: f}
+	r, err := vfs.stream()
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+	defer r.Close()
+	n, err := io.Copy(io.Discard, r)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: name, Err: err}
+	}
+
+	modTime := r.Header.ModTime
+	if modTime.IsZero() {
+		modTime = info.ModTime()
+	}
+	base := path.Base(name)
+	vfs.dir = &fileInfo{name: base, mode: fs.ModeDir | 0555, modTime: info.ModTime()}
+	vfs.file = &fileInfo{name: base[:len(base)-len(".gz")], size: n, mode: info.Mode().Perm(), modTime: modTime}
+	return vfs, nil
+}
+
+// stream returns the file decompressed, from its start.
+func (vfs *gzipFs) stream() (*gzip.Reader, error) {
+	return gzip.NewReader(io.NewSectionReader(vfs.ra, 0, vfs.size))
+}
+
+// lookup returns the file or the directory at name.
+func (vfs *gzipFs) lookup(op, name string) (*fileInfo, error) {
+	switch p := path.Clean("/" + name); p {
+	case "/":
+		return vfs.dir, nil
+	case "/" + vfs.file.name:
+		return vfs.file, nil
+	default:
+		return nil, &fs.PathError{Op: op, Path: p, Err: fs.ErrNotExist}
+	}
+}
+
+func (vfs *gzipFs) Open(name string) (filesystem.File, error) {
+	info, err := vfs.lookup("open", name)
+	if err != nil {
+		return nil, err
+	}
+	if info.IsDir() {
+		return &gzipDir{vfs: vfs, list: []fs.DirEntry{fs.FileInfoToDirEntry(vfs.file)}}, nil
+	}
+	return &gzipFile{vfs: vfs}, nil
+}
+
+func (vfs *gzipFs) Create(name string) (filesystem.File, error) {
+	return nil, &fs.PathError{Op: "open", Path: name, Err: fs.ErrPermission}
+}
+
+func (vfs *gzipFs) Mkdir(name string, perm os.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (vfs *gzipFs) MkdirAll(name string, perm os.FileMode) error {
+	return &fs.PathError{Op: "mkdir", Path: name, Err: fs.ErrPermission}
+}
+
+func (vfs *gzipFs) Remove(name string) error {
+	return &fs.PathError{Op: "remove", Path: name, Err: fs.ErrPermission}
+}
+
+func (vfs *gzipFs) RemoveAll(name string) error {
+	return &fs.PathError{Op: "unlinkat", Path: name, Err: fs.ErrPermission}
+}
+
+func (vfs *gzipFs) Rename(oldpath, newpath string) error {
+	return &os.LinkError{Op: "rename", Old: oldpath, New: newpath, Err: fs.ErrPermission}
+}
+
+// Sub returns the filesystem for its root, it has no other directory.
+func (vfs *gzipFs) Sub(dir string) (filesystem.FileSystem, error) {
+	info, err := vfs.lookup("sub", dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: syscall.ENOTDIR}
+	}
+	return vfs, nil
+}
+
+func (vfs *gzipFs) Stat(name string) (os.FileInfo, error) {
+	return vfs.lookup("stat", name)
+}
+
+func (vfs *gzipFs) Exists(name string) bool {
+	_, err := vfs.lookup("stat", name)
+	return err == nil
+}
+
+func (vfs *gzipFs) IsFile(name string) bool {
+	info, err := vfs.lookup("stat", name)
+	return err == nil && !info.IsDir()
+}
+
+func (vfs *gzipFs) IsDir(name string) bool {
+	info, err := vfs.lookup("stat", name)
+	return err == nil && info.IsDir()
+}
+
+// Close closes the archive, the wrapper unmounts it once no file is open on
+// it.
+func (vfs *gzipFs) Close() error {
+	return vfs.archive.Close()
+}
+
+// gzipFile decompresses the archive as it is read. A seek forward skips the
+// content in between, a seek back decompresses the archive again from its
+// start.
+type gzipFile struct {
+	vfs *gzipFs
+
+	mu     sync.Mutex
+	closed bool
+
+	// off is the offset of the next read, r reads the file at pos.
+	off int64
+	r   *gzip.Reader
+	pos int64
+}
+
+func (f *gzipFile) Read(p []byte) (int, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	name := f.vfs.file.name
+	if f.closed {
+		return 0, &fs.PathError{Op: "read", Path: name, Err: fs.ErrClosed}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.off >= f.vfs.file.size {
+		return 0, io.EOF
+	}
+
+	if f.r == nil || f.pos > f.off {
+		r, err := f.vfs.stream()
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+		f.r, f.pos = r, 0
+	}
+	if f.pos < f.off {
+		n, err := io.CopyN(io.Discard, f.r, f.off-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: name, Err: err}
+		}
+	}
+
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	f.off = f.pos
+	if err == io.EOF && f.off < f.vfs.file.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		return n, &fs.PathError{Op: "read", Path: name, Err: err}
+	}
+	return n, err
+}
+
+func (f *gzipFile) Seek(offset int64, whence int) (int64, error) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.file.name, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.vfs.file.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.file.name, Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *gzipFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.file.name, Err: syscall.EBADF}
+}
+
+func (f *gzipFile) Stat() (fs.FileInfo, error) {
+	return f.vfs.file, nil
+}
+
+func (f *gzipFile) Close() error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if f.closed {
+		return &fs.PathError{Op: "close", Path: f.vfs.file.name, Err: fs.ErrClosed}
+	}
+	f.closed = true
+	if f.r != nil {
+		_ = f.r.Close()
+		f.r = nil
+	}
+	return nil
+}
+
+// gzipDir lists the file decompressed.
+type gzipDir struct {
+	vfs *gzipFs
+
+	mu     sync.Mutex
+	closed bool
+
+	list []fs.DirEntry
+	off  int
+}
+
+func (d *gzipDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return nil, &fs.PathError{Op: "readdir", Path: "/", Err: fs.ErrClosed}
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *gzipDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: "/", Err: syscall.EISDIR}
+}
+
+func (d *gzipDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: "/", Err: syscall.EISDIR}
+}
+
+func (d *gzipDir) Stat() (fs.FileInfo, error) {
+	return d.vfs.dir, nil
+}
+
+func (d *gzipDir) Close() error {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.closed {
+		return &fs.PathError{Op: "close", Path: "/", Err: fs.ErrClosed}
+	}
+	d.closed = true
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*gzipDir)(nil)
+	_ io.Seeker              = (*gzipFile)(nil)
+)
@@ -0,0 +1,240 @@
+package nested
+
+import (
+	"container/list"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/driver/tar"
+	"github.com/lazychanger/go-vfs/driver/zip"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// The kinds of archive a file is browsed as.
+const (
+	kindNone = iota
+	kindZip
+	kindTar
+	kindGzip
+)
+
+// extensions name the kinds of archive, the longer ones first.
+var extensions = []struct {
+	ext  string
+	kind int
+}{
+	{".zip", kindZip},
+	{".tar", kindTar},
+	{".tar.gz", kindTar},
+	{".tgz", kindTar},
+	{".tar.zst", kindTar},
+	{".tzst", kindTar},
+	{".gz", kindGzip},
+}
+
+// kindOf returns the kind of archive the name of a file names.
+func kindOf(name string) int {
+	lower := strings.ToLower(name)
+	for _, e := range extensions {
+		if len(lower) > len(e.ext) && strings.HasSuffix(lower, e.ext) {
+			return e.kind
+		}
+	}
+	return kindNone
+}
+
+// mount is an archive browsed as a directory.
+type mount struct {
+	// key is the absolute path of the archive, vfs its content.
+	key string
+	vfs filesystem.FileSystem
+
+	// info describes the archive when it was mounted, the mount is stale
+	// once the archive changed.
+	info fs.FileInfo
+
+	// parent is the mount holding the archive, nil for the filesystem
+	// browsed.
+	parent *mount
+
+	// refs counts the operations and the files using the mount, and the
+	// mounts of the archives it holds. A stale mount is unmounted once it
+	// has none.
+	refs  int
+	stale bool
+	elem  *list.Element
+}
+
+// open mounts the archive name of fsys.
+func open(kind int, fsys filesystem.FileSystem, name string) (filesystem.FileSystem, error) {
+	switch kind {
+	case kindZip:
+		return zip.New(&zip.Config{Archive: name, FileSystem: fsys})
+	case kindTar:
+		return tar.New(&tar.Config{Archive: name, FileSystem: fsys})
+	}
+	return newGzip(fsys, name)
+}
+
+// fsys returns the filesystem of the mount, the one browsed for nil.
+func (conn *nestedConn) fsys(m *mount) filesystem.FileSystem {
+	if m == nil {
+		return conn.src
+	}
+	return m.vfs
+}
+
+// resolve returns the mount of the innermost archive the absolute path p
+// descends into, and the path in it: nil and p when it descends into none.
+// The archive p names descends too when last is set, unless it cannot be
+// read, it is a file then. The mount is referenced until release.
+func (conn *nestedConn) resolve(p string, last bool) (*mount, string, error) {
+	var m *mount
+	fsys, inner := conn.src, "/"
+
+	elems := strings.Split(strings.TrimPrefix(p, "/"), "/")
+	for i, elem := range elems {
+		inner = path.Join(inner, elem)
+		kind := kindOf(elem)
+		if kind == kindNone || i == len(elems)-1 && !last {
+			continue
+		}
+		// a directory named like an archive, or a file missing, fails
+		// later in the filesystem holding it
+		info, err := fsys.Stat(inner)
+		if err != nil || !info.Mode().IsRegular() {
+			continue
+		}
+
+		key := "/" + strings.Join(elems[:i+1], "/")
+		child, err := conn.mount(m, kind, key, fsys, inner, info)
+		if err != nil {
+			if i == len(elems)-1 {
+				break
+			}
+			conn.release(m)
+			return nil, "", err
+		}
+		conn.release(m)
+		m, fsys, inner = child, child.vfs, "/"
+	}
+	return m, inner, nil
+}
+
+// mount returns the archive at key mounted, the file name of fsys the
+// mount parent holds. A mount of the archive as info describes it is shared.
+func (conn *nestedConn) mount(parent *mount, kind int, key string, fsys filesystem.FileSystem, name string, info fs.FileInfo) (*mount, error) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	if conn.Closed() {
+		return nil, &fs.PathError{Op: "open", Path: key, Err: fs.ErrClosed}
+	}
+	if m, ok := conn.mounts[key]; ok {
+		if m.parent == parent && m.info.Size() == info.Size() && m.info.ModTime().Equal(info.ModTime()) {
+			m.refs++
+			conn.lru.MoveToFront(m.elem)
+			return m, nil
+		}
+		conn.invalidate(key)
+	}
+
+	vfs, err := open(kind, fsys, name)
+	if err != nil {
+		return nil, relocate(key, err)
+	}
+	m := &mount{key: key, vfs: vfs, info: info, parent: parent, refs: 1}
+	if parent != nil {
+		parent.refs++
+	}
+	m.elem = conn.lru.PushFront(m)
+	conn.mounts[key] = m
+	conn.trim()
+	return m, nil
+}
+
+// release releases the mount resolve returned.
+func (conn *nestedConn) release(m *mount) {
+	if m == nil {
+		return
+	}
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.unref(m)
+	conn.trim()
+}
+
+// unref releases a reference to the mount, mu is held.
+func (conn *nestedConn) unref(m *mount) {
+	m.refs--
+	if m.refs == 0 && m.stale {
+		conn.unmount(m)
+	}
+}
+
+// unmount closes the mount no longer used, mu is held.
+func (conn *nestedConn) unmount(m *mount) {
+	_ = filesystem.Close(m.vfs)
+	if m.parent != nil {
+		conn.unref(m.parent)
+	}
+}
+
+// drop removes the mount from the cache, it is unmounted once no longer
+// used, mu is held.
+func (conn *nestedConn) drop(m *mount) {
+	delete(conn.mounts, m.key)
+	conn.lru.Remove(m.elem)
+	m.stale = true
+	if m.refs == 0 {
+		conn.unmount(m)
+	}
+}
+
+// invalidate drops the mounts of the archives at or below the absolute
+// path p, mu is held.
+func (conn *nestedConn) invalidate(p string) {
+	prefix := strings.TrimSuffix(p, "/") + "/"
+	for key, m := range conn.mounts {
+		if key == p || strings.HasPrefix(key, prefix) {
+			conn.drop(m)
+		}
+	}
+}
+
+// changed drops the mounts of the archives a change to the absolute path p
+// replaced.
+func (conn *nestedConn) changed(p string) {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	conn.invalidate(p)
+}
+
+// trim drops the least recently used mounts no longer used past the most
+// kept, mu is held.
+func (conn *nestedConn) trim() {
+	for conn.lru.Len() > conn.max {
+		var victim *mount
+		for e := conn.lru.Back(); e != nil; e = e.Prev() {
+			if m := e.Value.(*mount); m.refs == 0 {
+				victim = m
+				break
+			}
+		}
+		if victim == nil {
+			return
+		}
+		conn.drop(victim)
+	}
+}
+
+// relocate returns err with the path of a PathError, the one in the
+// filesystem holding the file, replaced by the absolute path p.
+func relocate(p string, err error) error {
+	if pe, ok := err.(*fs.PathError); ok {
+		return &fs.PathError{Op: pe.Op, Path: p, Err: pe.Err}
+	}
+	return err
+}
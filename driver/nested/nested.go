@@ -0,0 +1,467 @@
+// Package nested wraps a filesystem.FileSystem to browse the archives it
+// holds as directories, bundle.zip/logs/2024.tar.gz/app.log reads app.log
+// of the archive 2024.tar.gz held by the archive bundle.zip.
+//
+// The archives are the regular files named like one: .zip, .tar, .tar.gz,
+// .tgz, .tar.zst and .tzst, read by the zip and tar drivers, and .gz, a
+// file compressed with gzip browsed as a directory holding the file
+// decompressed, named without the extension. A path is resolved element by
+// element, each archive met is mounted and the rest of the path resolved
+// in it. The archive a path names is a directory, unless it cannot be read:
+// it is the file it is then. A listing names the archives as directories
+// from their names only.
+//
+// The mounts are kept in a cache by path, shared by the operations and the
+// files open on them, and dropped once the archive changes, through the
+// wrapper or, as its size and modification time tell, below it. The least
+// recently used mounts no file is open on are unmounted past
+// Config.MaxMounts.
+//
+// The archives are read-only: a change inside one fails with
+// fs.ErrPermission. The other paths are the ones of the filesystem below,
+// the changes to them, the archives as files included, pass through.
+package nested
+
+import (
+	"container/list"
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"io/fs"
+	"os"
+	"path"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// defaultMaxMounts is the most archives kept mounted by default.
+const defaultMaxMounts = 16
+
+type nestedFs struct {
+	config *Config
+
+	// root is the absolute path the filesystem is rooted at.
+	root string
+
+	// conn is the filesystem browsed and its mounts, which the Sub views
+	// share, only the owner unmounts them and closes a stacked filesystem.
+	conn  *nestedConn
+	owner bool
+}
+
+// nestedConn is the filesystem browsed, the archives mounted and the files
+// open on them.
+type nestedConn struct {
+	filesystem.Tracker
+
+	// src is the filesystem browsed, stack the one of Config.Stack.
+	src   filesystem.FileSystem
+	stack filesystem.FileSystem
+
+	// mu guards the mounts by the absolute path of their archive, lru
+	// orders them, the most recently used first, max is the most kept.
+	mu     sync.Mutex
+	mounts map[string]*mount
+	lru    *list.List
+	max    int
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if config.MaxMounts <= 0 {
+		config.MaxMounts = defaultMaxMounts
+	}
+
+	conn := &nestedConn{
+		src:    config.FileSystem,
+		mounts: map[string]*mount{},
+		lru:    list.New(),
+		max:    config.MaxMounts,
+	}
+	if conn.src == nil {
+		if config.Stack == "" {
+			return nil, fs.ErrInvalid
+		}
+		stack, err := filesystem.Open(config.Stack)
+		if err != nil {
+			return nil, err
+		}
+		conn.src, conn.stack = stack, stack
+	}
+
+	return &nestedFs{
+		config: config,
+		root:   "/",
+		conn:   conn,
+		owner:  true,
+	}, nil
+}
+
+func (vfs *nestedFs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	m, inner, err := vfs.conn.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	f, err := vfs.conn.fsys(m).Open(inner)
+	if err != nil {
+		vfs.conn.release(m)
+		return nil, relocate(p, err)
+	}
+
+	var info fs.FileInfo
+	if m != nil && inner == "/" {
+		info = archiveInfo{m.info}
+	}
+	return vfs.track(p, f, m, info)
+}
+
+func (vfs *nestedFs) Create(name string) (filesystem.File, error) {
+	p, err := vfs.change("open", name)
+	if err != nil {
+		return nil, err
+	}
+	defer vfs.conn.changed(p)
+
+	f, err := vfs.conn.src.Create(p)
+	if err != nil {
+		return nil, relocate(p, err)
+	}
+	return vfs.track(p, f, nil, nil)
+}
+
+func (vfs *nestedFs) Mkdir(name string, perm fs.FileMode) error {
+	p, err := vfs.change("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return relocate(p, vfs.conn.src.Mkdir(p, perm))
+}
+
+func (vfs *nestedFs) MkdirAll(name string, perm fs.FileMode) error {
+	p, err := vfs.change("mkdir", name)
+	if err != nil {
+		return err
+	}
+	return relocate(p, vfs.conn.src.MkdirAll(p, perm))
+}
+
+func (vfs *nestedFs) Remove(name string) error {
+	p, err := vfs.change("remove", name)
+	if err != nil {
+		return err
+	}
+	defer vfs.conn.changed(p)
+
+	return relocate(p, vfs.conn.src.Remove(p))
+}
+
+func (vfs *nestedFs) RemoveAll(name string) error {
+	p, err := vfs.change("unlinkat", name)
+	if err != nil {
+		return err
+	}
+	defer vfs.conn.changed(p)
+
+	return relocate(p, vfs.conn.src.RemoveAll(p))
+}
+
+func (vfs *nestedFs) Rename(oldpath, newpath string) error {
+	oldp, err := vfs.change("rename", oldpath)
+	if err != nil {
+		return linkError("rename", vfs.abs(oldpath), vfs.abs(newpath), err)
+	}
+	newp, err := vfs.change("rename", newpath)
+	if err != nil {
+		return linkError("rename", oldp, vfs.abs(newpath), err)
+	}
+	defer vfs.conn.changed(oldp)
+	defer vfs.conn.changed(newp)
+
+	if err := vfs.conn.src.Rename(oldp, newp); err != nil {
+		return linkError("rename", oldp, newp, err)
+	}
+	return nil
+}
+
+// Stat describes an archive as a directory.
+func (vfs *nestedFs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	m, inner, err := vfs.conn.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	defer vfs.conn.release(m)
+
+	if m != nil && inner == "/" {
+		return archiveInfo{m.info}, nil
+	}
+	info, err := vfs.conn.fsys(m).Stat(inner)
+	if err != nil {
+		return nil, relocate(p, err)
+	}
+	return info, nil
+}
+
+// ReadDir lists the files named like an archive as directories.
+func (vfs *nestedFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	m, inner, err := vfs.conn.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	defer vfs.conn.release(m)
+
+	list, err := filesystem.ReadDir(vfs.conn.fsys(m), inner)
+	if err != nil {
+		return nil, relocate(p, err)
+	}
+	return browse(list), nil
+}
+
+func (vfs *nestedFs) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	m, inner, err := vfs.conn.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	defer vfs.conn.release(m)
+
+	data, err := filesystem.ReadFile(vfs.conn.fsys(m), inner)
+	if err != nil {
+		return nil, relocate(p, err)
+	}
+	return data, nil
+}
+
+func (vfs *nestedFs) WriteFile(name string, data []byte) error {
+	p, err := vfs.change("open", name)
+	if err != nil {
+		return err
+	}
+	defer vfs.conn.changed(p)
+
+	return relocate(p, filesystem.WriteFile(vfs.conn.src, p, data))
+}
+
+func (vfs *nestedFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	p, err := vfs.change("chtimes", name)
+	if err != nil {
+		return err
+	}
+	defer vfs.conn.changed(p)
+
+	return relocate(p, filesystem.Chtimes(vfs.conn.src, p, atime, mtime))
+}
+
+func (vfs *nestedFs) Chmod(name string, mode fs.FileMode) error {
+	p, err := vfs.change("chmod", name)
+	if err != nil {
+		return err
+	}
+	return relocate(p, filesystem.Chmod(vfs.conn.src, p, mode))
+}
+
+func (vfs *nestedFs) Truncate(name string, size int64) error {
+	p, err := vfs.change("truncate", name)
+	if err != nil {
+		return err
+	}
+	defer vfs.conn.changed(p)
+
+	return relocate(p, filesystem.Truncate(vfs.conn.src, p, size))
+}
+
+func (vfs *nestedFs) Symlink(oldname, newname string) error {
+	p, err := vfs.change("symlink", newname)
+	if err != nil {
+		return linkError("symlink", oldname, vfs.abs(newname), err)
+	}
+	defer vfs.conn.changed(p)
+
+	if err := filesystem.Symlink(vfs.conn.src, oldname, p); err != nil {
+		return linkError("symlink", oldname, p, err)
+	}
+	return nil
+}
+
+func (vfs *nestedFs) Readlink(name string) (string, error) {
+	if err := vfs.closed("readlink", name); err != nil {
+		return "", err
+	}
+
+	p := vfs.abs(name)
+	m, inner, err := vfs.conn.resolve(p, true)
+	if err != nil {
+		return "", err
+	}
+	defer vfs.conn.release(m)
+
+	if m != nil && inner == "/" {
+		return "", &fs.PathError{Op: "readlink", Path: p, Err: syscall.EINVAL}
+	}
+	target, err := filesystem.Readlink(vfs.conn.fsys(m), inner)
+	if err != nil {
+		return "", relocate(p, err)
+	}
+	return target, nil
+}
+
+// Lstat describes the symbolic link a path names, the archives it descends
+// into followed.
+func (vfs *nestedFs) Lstat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("lstat", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	m, inner, err := vfs.conn.resolve(p, true)
+	if err != nil {
+		return nil, err
+	}
+	defer vfs.conn.release(m)
+
+	if m != nil && inner == "/" {
+		return archiveInfo{m.info}, nil
+	}
+	info, err := filesystem.Lstat(vfs.conn.fsys(m), inner)
+	if err != nil {
+		return nil, relocate(p, err)
+	}
+	return info, nil
+}
+
+func (vfs *nestedFs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	p := vfs.abs(dir)
+	info, err := vfs.Stat(dir)
+	if err != nil {
+		return nil, err
+	}
+	if !info.IsDir() {
+		return nil, &fs.PathError{Op: "sub", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	return &nestedFs{
+		config: vfs.config,
+		root:   p,
+		conn:   vfs.conn,
+	}, nil
+}
+
+func (vfs *nestedFs) Exists(name string) bool {
+	_, err := vfs.Stat(name)
+	return err == nil
+}
+
+func (vfs *nestedFs) IsFile(name string) bool {
+	info, err := vfs.Stat(name)
+	return err == nil && !info.IsDir()
+}
+
+func (vfs *nestedFs) IsDir(name string) bool {
+	info, err := vfs.Stat(name)
+	return err == nil && info.IsDir()
+}
+
+// Close closes the files still open on the wrapper, unmounts the archives,
+// then closes the filesystem of Config.Stack.
+func (vfs *nestedFs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.conn.Tracker.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.root, Err: err}
+	}
+
+	vfs.conn.changed("/")
+	if vfs.conn.stack != nil {
+		return filesystem.Close(vfs.conn.stack)
+	}
+	return nil
+}
+
+func (vfs *nestedFs) OpenFiles() []string {
+	return vfs.conn.OpenFiles()
+}
+
+// change returns the absolute path of name for a change to it in the
+// filesystem browsed, the error is fs.ErrPermission inside an archive.
+func (vfs *nestedFs) change(op, name string) (string, error) {
+	if err := vfs.closed(op, name); err != nil {
+		return "", err
+	}
+
+	p := vfs.abs(name)
+	m, _, err := vfs.conn.resolve(p, false)
+	if err != nil {
+		return "", err
+	}
+	if m != nil {
+		vfs.conn.release(m)
+		return "", &fs.PathError{Op: op, Path: p, Err: fs.ErrPermission}
+	}
+	return p, nil
+}
+
+// closed fails op on name once the mounts are dropped, before a path is
+// resolved through the filesystem browsed.
+func (vfs *nestedFs) closed(op, name string) error {
+	if vfs.conn.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.abs(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// track records the opened file until it is closed, the file keeps the
+// mount it is open on. info describes the file when it is an archive.
+func (vfs *nestedFs) track(p string, f filesystem.File, m *mount, info fs.FileInfo) (filesystem.File, error) {
+	file := &nestedFile{File: f, conn: vfs.conn, name: p, mount: m, info: info}
+
+	var err error
+	file.release, err = vfs.conn.Track(p, file)
+	if err != nil {
+		_ = f.Close()
+		vfs.conn.release(m)
+		return nil, &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+	return file.wrap(), nil
+}
+
+// abs returns the absolute path of the name.
+func (vfs *nestedFs) abs(name string) string {
+	return path.Join(vfs.root, path.Clean("/"+name))
+}
+
+// linkError returns err of the operation op on the two paths, the error of
+// a PathError or a LinkError of the filesystem below unwrapped.
+func linkError(op, oldpath, newpath string, err error) error {
+	switch e := err.(type) {
+	case *fs.PathError:
+		err = e.Err
+	case *os.LinkError:
+		err = e.Err
+	}
+	return &os.LinkError{Op: op, Old: oldpath, New: newpath, Err: err}
+}
@@ -0,0 +1,428 @@
+package nested
+
+import (
+	archivetar "archive/tar"
+	archivezip "archive/zip"
+	"bytes"
+	"compress/gzip"
+	"github.com/lazychanger/go-vfs"
+	_ "github.com/lazychanger/go-vfs/driver/memory"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+)
+
+var applog = strings.Repeat("2024-01-01 app started\n", 500)
+
+func gz(t *testing.T, data string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	_, err := io.WriteString(w, data)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// tgz returns a tar archive compressed with gzip of the files by name.
+func tgz(t *testing.T, files map[string]string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := gzip.NewWriter(&buf)
+	tw := archivetar.NewWriter(w)
+	for name, data := range files {
+		require.NoError(t, tw.WriteHeader(&archivetar.Header{Name: name, Mode: 0644, Size: int64(len(data))}))
+		_, err := io.WriteString(tw, data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// zipOf returns a zip archive of the files by name, stored without
+// compression when store is set.
+func zipOf(t *testing.T, files map[string][]byte, store bool) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	zw := archivezip.NewWriter(&buf)
+	for name, data := range files {
+		hdr := &archivezip.FileHeader{Name: name, Method: archivezip.Deflate}
+		if store {
+			hdr.Method = archivezip.Store
+		}
+		w, err := zw.CreateHeader(hdr)
+		require.NoError(t, err)
+		_, err = w.Write(data)
+		require.NoError(t, err)
+	}
+	require.NoError(t, zw.Close())
+	return buf.Bytes()
+}
+
+// bundle writes to dir the archives of the log tooling: a zip holding a
+// tar.gz, a zip and a gzip file, a gzip file, and files named like an
+// archive that are none.
+func bundle(t *testing.T, dir string) {
+	t.Helper()
+	inner := zipOf(t, map[string][]byte{"y.txt": []byte("inner")}, true)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bundle.zip"), zipOf(t, map[string][]byte{
+		"logs/2024.tar.gz":  tgz(t, map[string]string{"app.log": applog, "sub/x.txt": "x"}),
+		"logs/notes.txt.gz": gz(t, "notes"),
+		"inner.zip":         inner,
+		"readme.txt":        []byte("readme"),
+	}, false), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "plain.log.gz"), gz(t, applog), 0644))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "broken.zip"), []byte("not an archive"), 0644))
+	require.NoError(t, os.Mkdir(filepath.Join(dir, "dir.zip"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "dir.zip", "a.txt"), []byte("a"), 0644))
+}
+
+func openDir(t *testing.T, dir string) filesystem.FileSystem {
+	t.Helper()
+	return vfstest.Open(t, "nested://"+filepath.ToSlash(dir))
+}
+
+func TestNestedConformance(t *testing.T) {
+	vfstest.TestDriver(t, "nested+memory:///")
+}
+
+func TestNestedRead(t *testing.T) {
+	dir := t.TempDir()
+	bundle(t, dir)
+	vfs := openDir(t, dir)
+
+	data, err := filesystem.ReadFile(vfs, "bundle.zip/logs/2024.tar.gz/app.log")
+	require.NoError(t, err)
+	assert.Equal(t, applog, string(data))
+	data, err = filesystem.ReadFile(vfs, "/bundle.zip/logs/2024.tar.gz/sub/x.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "x", string(data))
+	data, err = filesystem.ReadFile(vfs, "/bundle.zip/inner.zip/y.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "inner", string(data))
+	data, err = filesystem.ReadFile(vfs, "/bundle.zip/logs/notes.txt.gz/notes.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "notes", string(data))
+
+	// the archives are directories, the files named like one that are none
+	// are what they are
+	info, err := vfs.Stat("/bundle.zip")
+	require.NoError(t, err)
+	assert.Equal(t, "bundle.zip", info.Name())
+	assert.Equal(t, fs.ModeDir|0555, info.Mode())
+	assert.True(t, vfs.IsDir("/bundle.zip/logs/2024.tar.gz"))
+	assert.True(t, vfs.IsFile("/broken.zip"))
+	data, err = filesystem.ReadFile(vfs, "/broken.zip")
+	require.NoError(t, err)
+	assert.Equal(t, "not an archive", string(data))
+	assert.True(t, vfs.IsFile("/dir.zip/a.txt"))
+
+	list, err := filesystem.ReadDir(vfs, "/")
+	require.NoError(t, err)
+	kinds := map[string]bool{}
+	for _, e := range list {
+		kinds[e.Name()] = e.IsDir()
+	}
+	assert.Equal(t, map[string]bool{"bundle.zip": true, "plain.log.gz": true, "broken.zip": true, "dir.zip": true}, kinds)
+	list, err = filesystem.ReadDir(vfs, "/bundle.zip/logs")
+	require.NoError(t, err)
+	require.Len(t, list, 2)
+	assert.Equal(t, "2024.tar.gz", list[0].Name())
+	assert.True(t, list[0].IsDir())
+
+	f, err := vfs.Open("/bundle.zip")
+	require.NoError(t, err)
+	entries, err := f.(filesystem.ReadDirFile).ReadDir(-1)
+	require.NoError(t, err)
+	assert.Len(t, entries, 3)
+	info, err = f.Stat()
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	require.NoError(t, f.Close())
+
+	// a file compressed with gzip is a directory holding it decompressed
+	list, err = filesystem.ReadDir(vfs, "/plain.log.gz")
+	require.NoError(t, err)
+	require.Len(t, list, 1)
+	assert.Equal(t, "plain.log", list[0].Name())
+	info, err = vfs.Stat("/plain.log.gz/plain.log")
+	require.NoError(t, err)
+	assert.Equal(t, int64(len(applog)), info.Size())
+
+	f, err = vfs.Open("/plain.log.gz/plain.log")
+	require.NoError(t, err)
+	_, err = f.(io.Seeker).Seek(-23, io.SeekEnd)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "2024-01-01 app started\n", string(rest))
+	_, err = f.(io.Seeker).Seek(5, io.SeekStart)
+	require.NoError(t, err)
+	buf := make([]byte, 5)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "01-01", string(buf))
+	require.NoError(t, f.Close())
+
+	// a file of the filesystem browsed keeps what it can do
+	f, err = vfs.Open("/bundle.zip/inner.zip/y.txt")
+	require.NoError(t, err)
+	_, ok := f.(io.ReaderAt)
+	assert.True(t, ok, "stored in a zip")
+	require.NoError(t, f.Close())
+
+	sub, err := vfs.Sub("/bundle.zip/logs")
+	require.NoError(t, err)
+	data, err = filesystem.ReadFile(sub, "2024.tar.gz/app.log")
+	require.NoError(t, err)
+	assert.Equal(t, applog, string(data))
+
+	_, err = vfs.Stat("/bundle.zip/logs/2024.tar.gz/missing.log")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	var pe *fs.PathError
+	require.ErrorAs(t, err, &pe)
+	assert.Equal(t, "/bundle.zip/logs/2024.tar.gz/missing.log", pe.Path)
+	_, err = vfs.Stat("/broken.zip/x")
+	assert.Error(t, err)
+	_, err = vfs.Sub("/bundle.zip/readme.txt")
+	assert.ErrorIs(t, err, syscall.ENOTDIR)
+}
+
+func TestNestedReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	bundle(t, dir)
+	vfs := openDir(t, dir)
+
+	_, err := vfs.Create("/bundle.zip/new.txt")
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.WriteFile(vfs, "/bundle.zip/logs/2024.tar.gz/app.log", nil), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Mkdir("/plain.log.gz/dir", 0755), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.MkdirAll("/bundle.zip/a/b", 0755), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Remove("/bundle.zip/readme.txt"), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.RemoveAll("/bundle.zip/logs"), fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.Chmod(vfs, "/bundle.zip/readme.txt", 0600), fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.Symlink(vfs, "/readme", "/bundle.zip/link"), fs.ErrPermission)
+	err = vfs.Rename("/bundle.zip/readme.txt", "/readme.txt")
+	var le *os.LinkError
+	require.ErrorAs(t, err, &le)
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Rename("/broken.zip", "/bundle.zip/broken.zip"), fs.ErrPermission)
+
+	// the archives themselves are files of the filesystem browsed
+	require.NoError(t, filesystem.WriteFile(vfs, "/notes.txt", []byte("notes")))
+	require.NoError(t, vfs.Rename("/plain.log.gz", "/old.log.gz"))
+	assert.True(t, vfs.IsFile("/old.log.gz/old.log"))
+	require.NoError(t, vfs.Remove("/old.log.gz"))
+	assert.False(t, vfs.Exists("/old.log.gz"))
+	_, err = os.Stat(filepath.Join(dir, "old.log.gz"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestNestedCache(t *testing.T) {
+	dir := t.TempDir()
+	bundle(t, dir)
+	vfs := openDir(t, dir)
+	conn := vfs.(*nestedFs).conn
+
+	require.True(t, vfs.IsFile("/bundle.zip/logs/2024.tar.gz/app.log"))
+	first := conn.mounts["/bundle.zip/logs/2024.tar.gz"]
+	require.NotNil(t, first)
+	require.True(t, vfs.IsFile("/bundle.zip/logs/2024.tar.gz/sub/x.txt"))
+	assert.Same(t, first, conn.mounts["/bundle.zip/logs/2024.tar.gz"], "mounted once")
+	assert.Equal(t, 0, first.refs)
+	assert.Equal(t, 1, conn.mounts["/bundle.zip"].refs, "held by the mount of the archive it holds")
+
+	// an archive replaced through the wrapper is mounted again
+	require.NoError(t, filesystem.WriteFile(vfs, "/bundle.zip", zipOf(t, map[string][]byte{"new.txt": []byte("new")}, false)))
+	assert.Empty(t, conn.mounts)
+	data, err := filesystem.ReadFile(vfs, "/bundle.zip/new.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+
+	// and one replaced below it too
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "bundle.zip"), zipOf(t, map[string][]byte{"other.txt": []byte("other!")}, false), 0644))
+	data, err = filesystem.ReadFile(vfs, "/bundle.zip/other.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "other!", string(data))
+	assert.False(t, vfs.Exists("/bundle.zip/new.txt"))
+	assert.Len(t, conn.mounts, 1)
+}
+
+func TestNestedMaxMounts(t *testing.T) {
+	dir := t.TempDir()
+	for _, name := range []string{"a", "b", "c"} {
+		require.NoError(t, os.WriteFile(filepath.Join(dir, name+".log.gz"), gz(t, name), 0644))
+	}
+	vfs, err := New(&Config{Stack: "os://" + filepath.ToSlash(dir), MaxMounts: 1})
+	require.NoError(t, err)
+	conn := vfs.(*nestedFs).conn
+
+	f, err := vfs.Open("/a.log.gz/a.log")
+	require.NoError(t, err)
+	assert.True(t, vfs.IsFile("/b.log.gz/b.log"))
+	assert.True(t, vfs.IsFile("/c.log.gz/c.log"))
+	assert.Equal(t, []string{"/a.log.gz"}, keys(conn), "the one a file is open on stays")
+
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+	require.NoError(t, f.Close())
+	assert.Equal(t, []string{"/a.log.gz"}, keys(conn))
+
+	// Close closes the files and unmounts the archives
+	f, err = vfs.Open("/c.log.gz/c.log")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/c.log.gz"}, keys(conn))
+	assert.Equal(t, []string{"/c.log.gz/c.log"}, vfs.(filesystem.OpenFilesFS).OpenFiles())
+	require.NoError(t, filesystem.Close(vfs))
+	assert.Empty(t, conn.mounts)
+	assert.Equal(t, 0, conn.lru.Len())
+	_, err = vfs.Stat("/c.log.gz")
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	assert.ErrorIs(t, filesystem.Close(vfs), fs.ErrClosed)
+}
+
+// keys returns the paths of the archives mounted.
+func keys(conn *nestedConn) []string {
+	conn.mu.Lock()
+	defer conn.mu.Unlock()
+
+	var keys []string
+	for e := conn.lru.Front(); e != nil; e = e.Next() {
+		keys = append(keys, e.Value.(*mount).key)
+	}
+	return keys
+}
+
+func TestNestedFileSystem(t *testing.T) {
+	// any filesystem, here one whose files read at no offset
+	mem, err := filesystem.Open("memory:///")
+	require.NoError(t, err)
+	defer filesystem.Close(mem)
+	require.NoError(t, mem.MkdirAll("/srv", 0755))
+	require.NoError(t, filesystem.WriteFile(mem, "/srv/bundle.zip", zipOf(t, map[string][]byte{
+		"logs/2024.tar.gz": tgz(t, map[string]string{"app.log": applog}),
+	}, true)))
+
+	vfs, err := New(&Config{FileSystem: mem})
+	require.NoError(t, err)
+	sub, err := vfs.Sub("/srv")
+	require.NoError(t, err)
+	data, err := filesystem.ReadFile(sub, "bundle.zip/logs/2024.tar.gz/app.log")
+	require.NoError(t, err)
+	assert.Equal(t, applog, string(data))
+	require.NoError(t, filesystem.Close(vfs))
+	assert.True(t, mem.Exists("/srv/bundle.zip"), "the filesystem browsed stays open")
+}
+
+// counting counts the bytes read from the files of the filesystem.
+type counting struct {
+	filesystem.FileSystem
+	n int64
+}
+
+func (c *counting) Open(name string) (filesystem.File, error) {
+	f, err := c.FileSystem.Open(name)
+	if err != nil {
+		return nil, err
+	}
+	return &countingFile{File: f, n: &c.n}, nil
+}
+
+type countingFile struct {
+	filesystem.File
+	n *int64
+}
+
+func (f *countingFile) Read(p []byte) (int, error) {
+	n, err := f.File.Read(p)
+	*f.n += int64(n)
+	return n, err
+}
+
+func (f *countingFile) ReadAt(p []byte, off int64) (int, error) {
+	n, err := f.File.(io.ReaderAt).ReadAt(p, off)
+	*f.n += int64(n)
+	return n, err
+}
+
+func (f *countingFile) Seek(offset int64, whence int) (int64, error) {
+	return f.File.(io.Seeker).Seek(offset, whence)
+}
+
+// readerAt reads at an offset without seeking.
+type readerAt struct {
+	filesystem.File
+}
+
+func (f readerAt) ReadAt(p []byte, off int64) (int, error) {
+	return 0, io.EOF
+}
+
+func TestNestedZipInZip(t *testing.T) {
+	dir := t.TempDir()
+	inner := zipOf(t, map[string][]byte{
+		"filler.bin": bytes.Repeat([]byte("x"), 1<<20),
+		"y.txt":      []byte("inner"),
+	}, true)
+	require.NoError(t, os.WriteFile(filepath.Join(dir, "outer.zip"), zipOf(t, map[string][]byte{"inner.zip": inner}, true), 0644))
+
+	src, err := filesystem.Open("os://" + filepath.ToSlash(dir))
+	require.NoError(t, err)
+	defer filesystem.Close(src)
+	spy := &counting{FileSystem: src}
+	vfs, err := New(&Config{FileSystem: spy})
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+
+	f, err := vfs.Open("/outer.zip/inner.zip/y.txt")
+	require.NoError(t, err)
+	defer f.Close()
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "inner", string(data))
+	require.Implements(t, (*io.Seeker)(nil), f)
+	require.Implements(t, (*io.ReaderAt)(nil), f)
+	p := make([]byte, 3)
+	_, err = f.(io.ReaderAt).ReadAt(p, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "ner", string(p))
+
+	// the inner archive is read in place, not buffered whole
+	assert.Less(t, spy.n, int64(len(inner)/16))
+
+	// a file reading at an offset without seeking keeps reading at one
+	file := &nestedFile{File: readerAt{f}}
+	assert.Implements(t, (*io.ReaderAt)(nil), file.wrap())
+	_, ok := file.wrap().(io.Seeker)
+	assert.False(t, ok)
+}
+
+func TestNestedOpen(t *testing.T) {
+	dir := filepath.ToSlash(t.TempDir())
+
+	vfs, err := filesystem.Open("nested+os://" + dir + "?mounts=4&temp=false")
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+	conf := vfs.(*nestedFs).config
+	assert.Equal(t, 4, conf.MaxMounts)
+	assert.Equal(t, "os://"+dir+"?temp=false", conf.Stack, "without the options of the wrapper")
+	assert.Equal(t, "nested+os://"+dir, filesystem.BuildDsn(conf))
+
+	vfs, err = filesystem.Open("nested://" + dir)
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+	assert.Equal(t, "os://"+dir, vfs.(*nestedFs).config.Stack)
+	assert.Equal(t, defaultMaxMounts, vfs.(*nestedFs).config.MaxMounts)
+
+	_, err = New(&Config{})
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+}
@@ -2,12 +2,19 @@ package os
 
 import (
 	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
 )
 
 type Config struct {
 	filesystem.Config
 
 	Root string
+
+	// Temp roots the filesystem in a new temporary directory inside Root,
+	// or inside the default directory for temporary files when Root is
+	// empty. Close removes it.
+	Temp bool
 }
 
 func (conf *Config) Driver() string {
@@ -17,3 +24,19 @@ func (conf *Config) Driver() string {
 func (conf *Config) Path() string {
 	return conf.Root
 }
+
+// Encode sets temp when the root is a temporary directory
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if conf.Temp {
+		values.Set("temp", "true")
+	}
+	return values
+}
+
+// Decode reads temp
+func (conf *Config) Decode(query url.Values) error {
+	conf.Temp, _ = strconv.ParseBool(query.Get("temp"))
+
+	return nil
+}
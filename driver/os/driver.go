@@ -16,7 +16,8 @@ type osDriver struct {
 
 // Open opens a file using the given path
 func (o *osDriver) Open(uri *url.URL) (filesystem.FileSystem, error) {
-	return New(&Config{
-		Root: uri.Path,
-	})
+	conf := &Config{Root: uri.Path}
+	_ = conf.Decode(uri.Query())
+
+	return New(conf)
 }
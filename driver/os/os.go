@@ -4,10 +4,12 @@ import (
 	"errors"
 	"github.com/lazychanger/go-vfs"
 	"io/fs"
-	"log"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
+	"sync"
+	"time"
 )
 
 // fileSystem is the file system implementation for the os package.
@@ -19,9 +21,38 @@ type fileSystem struct {
 	parent *fileSystem
 
 	children map[string]*fileSystem
+
+	// life is the same for the Sub views as for the filesystem New
+	// returned, the owner, whose Close also removes a temporary root.
+	life  *osLife
+	owner bool
+}
+
+// osLife tracks the files open on a filesystem until it is closed.
+type osLife struct {
+	filesystem.Tracker
+
+	// temp is the temporary root removed by Close.
+	temp string
 }
 
 func New(config *Config) (filesystem.FileSystem, error) {
+	life := &osLife{}
+	if config.Temp {
+		dir := config.Root
+		if dir == "/" {
+			dir = ""
+		}
+		if dir != "" && !strings.HasPrefix(dir, "/") {
+			return nil, errors.New("root must be absolute path")
+		}
+		root, err := os.MkdirTemp(dir, "vfs-")
+		if err != nil {
+			return nil, err
+		}
+		config.Root, life.temp = root, root
+	}
+
 	if config.Root == "" {
 		return nil, fs.ErrInvalid
 	}
@@ -39,77 +70,193 @@ func New(config *Config) (filesystem.FileSystem, error) {
 	}
 
 	if err := vfs.init(); err != nil {
+		if life.temp != "" {
+			_ = os.RemoveAll(life.temp)
+		}
 		return nil, err
 	}
 
 	return &fileSystem{
 		config: config,
+		life:   life,
+		owner:  true,
 	}, nil
 }
 
 func (vfs *fileSystem) init() error {
 	vfs.config.Root = strings.TrimRight(vfs.config.Root, "/")
 
-	dirs := strings.Split(vfs.config.Root, "/")
-
-	dir, _ := strings.Join(dirs[:len(dirs)-1], "/"), dirs[len(dirs)-1]
-
-	if _, err := os.Stat(dir); err != nil {
+	if _, err := os.Stat(path.Dir(vfs.config.Root)); err != nil {
 		return err
 	}
-	log.Println(vfs.config.Root)
 	return os.MkdirAll(vfs.config.Root, 0755)
 }
 
 func (vfs *fileSystem) Open(name string) (filesystem.File, error) {
-	return os.Open(vfs.path(name))
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+	return vfs.track(os.Open(vfs.path(name)))
 }
 
 func (vfs *fileSystem) Create(name string) (filesystem.File, error) {
-	return os.Create(vfs.path(name))
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+	return vfs.track(os.Create(vfs.path(name)))
 }
 
 func (vfs *fileSystem) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
 	return os.Mkdir(vfs.path(name), perm)
 }
 
 func (vfs *fileSystem) MkdirAll(path string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", path); err != nil {
+		return err
+	}
 	return os.MkdirAll(vfs.path(path), perm)
 }
 
 func (vfs *fileSystem) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
 	return os.Remove(vfs.path(name))
 }
 
 func (vfs *fileSystem) RemoveAll(path string) error {
+	if err := vfs.closed("unlinkat", path); err != nil {
+		return err
+	}
 	return os.RemoveAll(vfs.path(path))
 }
 
 func (vfs *fileSystem) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
 	return os.Rename(vfs.path(oldpath), vfs.path(newpath))
 }
 
 func (vfs *fileSystem) Stat(name string) (os.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
 	return os.Stat(path.Join(vfs.config.Root, name))
 }
 
 func (vfs *fileSystem) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
 	return os.ReadDir(vfs.path(name))
 }
 
 func (vfs *fileSystem) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
 	return os.ReadFile(vfs.path(name))
 }
 
 func (vfs *fileSystem) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
 	return os.WriteFile(vfs.path(name), data, 0755)
 }
 
 func (vfs *fileSystem) OpenFile(name string) (filesystem.File, error) {
-	return os.OpenFile(vfs.path(name), os.O_RDONLY, 0755)
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+	return vfs.track(os.OpenFile(vfs.path(name), os.O_RDONLY, 0755))
+}
+
+func (vfs *fileSystem) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := vfs.closed("chtimes", name); err != nil {
+		return err
+	}
+	return os.Chtimes(vfs.path(name), atime, mtime)
+}
+
+func (vfs *fileSystem) Truncate(name string, size int64) error {
+	if err := vfs.closed("truncate", name); err != nil {
+		return err
+	}
+	return os.Truncate(vfs.path(name), size)
+}
+
+func (vfs *fileSystem) Chmod(name string, mode fs.FileMode) error {
+	if err := vfs.closed("chmod", name); err != nil {
+		return err
+	}
+	return os.Chmod(vfs.path(name), mode)
+}
+
+// Symlink creates newname as a link to oldname, oldname is stored as it is:
+// an absolute one refers to the root of the host, not of the filesystem.
+func (vfs *fileSystem) Symlink(oldname, newname string) error {
+	if err := vfs.closed("symlink", newname); err != nil {
+		return err
+	}
+	return os.Symlink(oldname, vfs.path(newname))
+}
+
+func (vfs *fileSystem) Readlink(name string) (string, error) {
+	if err := vfs.closed("readlink", name); err != nil {
+		return "", err
+	}
+	return os.Readlink(vfs.path(name))
+}
+
+func (vfs *fileSystem) Lstat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("lstat", name); err != nil {
+		return nil, err
+	}
+	return os.Lstat(vfs.path(name))
+}
+
+func (vfs *fileSystem) DiskUsage(name string) (*filesystem.DirUsage, error) {
+	if err := vfs.closed("du", name); err != nil {
+		return nil, err
+	}
+	root := vfs.path(name)
+	usage := &filesystem.DirUsage{}
+
+	err := filepath.WalkDir(root, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p != root {
+				usage.Dirs++
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		usage.Size += info.Size()
+		usage.Files++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
 }
 
 func (vfs *fileSystem) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
 	if dir == "." || dir == ".." {
 		return nil, errors.New("invalid sub directory")
 	}
@@ -120,24 +267,92 @@ func (vfs *fileSystem) Sub(dir string) (filesystem.FileSystem, error) {
 
 	return &fileSystem{
 		config: &Config{Root: vfs.path(dir)},
+		life:   vfs.life,
 	}, nil
 }
 
 func (vfs *fileSystem) Exists(name string) bool {
+	if vfs.life.Closed() {
+		return false
+	}
 	_, err := os.Stat(vfs.path(name))
 	return err == nil
 }
 
 func (vfs *fileSystem) IsFile(name string) bool {
+	if vfs.life.Closed() {
+		return false
+	}
 	info, err := os.Stat(vfs.path(name))
 	return err == nil && !info.IsDir()
 }
 
 func (vfs *fileSystem) IsDir(name string) bool {
+	if vfs.life.Closed() {
+		return false
+	}
 	info, err := os.Stat(vfs.path(name))
 	return err == nil && info.IsDir()
 }
 
+// Close closes the files still open on the filesystem and removes a
+// temporary root.
+func (vfs *fileSystem) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.life.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.config.Root, Err: err}
+	}
+
+	if vfs.life.temp != "" {
+		return os.RemoveAll(vfs.life.temp)
+	}
+	return nil
+}
+
+func (vfs *fileSystem) OpenFiles() []string {
+	return vfs.life.OpenFiles()
+}
+
+// closed fails op on name once the filesystem is closed, the directory it
+// is rooted at may well still be there.
+func (vfs *fileSystem) closed(op, name string) error {
+	if vfs.life.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.path(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// track records the opened file until it is closed.
+func (vfs *fileSystem) track(f *os.File, err error) (filesystem.File, error) {
+	if err != nil {
+		return nil, err
+	}
+
+	file := &osFile{File: f}
+	file.release, err = vfs.life.Track(f.Name(), file)
+	if err != nil {
+		_ = f.Close()
+		return nil, &fs.PathError{Op: "open", Path: f.Name(), Err: err}
+	}
+	return file, nil
+}
+
+// osFile is an open file the filesystem tracks.
+type osFile struct {
+	*os.File
+
+	release func()
+	once    sync.Once
+}
+
+func (f *osFile) Close() error {
+	err := f.File.Close()
+	f.once.Do(f.release)
+	return err
+}
+
 func (vfs *fileSystem) path(p string) string {
 	return path.Join(vfs.config.Root, p)
 }
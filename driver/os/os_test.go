@@ -2,11 +2,15 @@ package os
 
 import (
 	"fmt"
+	"github.com/lazychanger/go-vfs"
 	"github.com/lazychanger/go-vfs/tests"
+	"github.com/lazychanger/go-vfs/vfstest"
 	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
 	"io/fs"
 	"os"
 	"path"
+	"path/filepath"
 	"strings"
 	"testing"
 )
@@ -43,10 +47,50 @@ func TestNew(t *testing.T) {
 
 }
 
+func TestOsFsTemp(t *testing.T) {
+	parent := t.TempDir()
+
+	vfs, err := filesystem.Open(fmt.Sprintf("os://%s?temp=true", parent))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteFile(vfs, "/a.txt", []byte("a")))
+
+	entries, err := os.ReadDir(parent)
+	require.NoError(t, err)
+	require.Len(t, entries, 1, "the root is a new directory inside the path")
+
+	require.NoError(t, filesystem.Close(vfs))
+	entries, err = os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Empty(t, entries, "Close removes the temporary root")
+
+	// a relative path is refused before the temporary root is made in it
+	wd, err := os.Getwd()
+	require.NoError(t, err)
+	rel, err := filepath.Rel(wd, parent)
+	require.NoError(t, err)
+	_, err = New(&Config{Root: rel, Temp: true})
+	assert.Error(t, err)
+	entries, err = os.ReadDir(parent)
+	require.NoError(t, err)
+	assert.Empty(t, entries)
+}
+
 func TestOsFs(t *testing.T) {
 	tests.TestDriver(t, fmt.Sprintf("os://%s/", tmpDir()))
 }
 
+func TestOsFsConformance(t *testing.T) {
+	vfstest.TestDriver(t, fmt.Sprintf("os://%s/", tmpDir()))
+}
+
+func FuzzOsFs(f *testing.F) {
+	vfstest.Fuzz(f, fmt.Sprintf("os://%s/", f.TempDir()))
+}
+
+func BenchmarkOsFs(b *testing.B) {
+	vfstest.Benchmark(b, fmt.Sprintf("os://%s/", b.TempDir()))
+}
+
 func tmpDir() string {
 
 	wd, _ := os.Getwd()
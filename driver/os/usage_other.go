@@ -0,0 +1,12 @@
+//go:build !linux && !darwin && !freebsd
+
+package os
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io/fs"
+)
+
+func (vfs *fileSystem) Usage() (*filesystem.Usage, error) {
+	return nil, &fs.PathError{Op: "statfs", Path: vfs.config.Root, Err: filesystem.ErrNotSupported}
+}
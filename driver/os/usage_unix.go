@@ -0,0 +1,28 @@
+//go:build linux || darwin || freebsd
+
+package os
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io/fs"
+	"syscall"
+)
+
+// Usage reports the capacity of the filesystem holding the root, Free is
+// what is available to unprivileged users.
+func (vfs *fileSystem) Usage() (*filesystem.Usage, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(vfs.config.Root, &st); err != nil {
+		return nil, &fs.PathError{Op: "statfs", Path: vfs.config.Root, Err: err}
+	}
+
+	bsize := uint64(st.Bsize)
+	return &filesystem.Usage{
+		Total:      uint64(st.Blocks) * bsize,
+		Used:       (uint64(st.Blocks) - uint64(st.Bfree)) * bsize,
+		Free:       uint64(st.Bavail) * bsize,
+		Inodes:     uint64(st.Files),
+		InodesUsed: uint64(st.Files) - uint64(st.Ffree),
+		InodesFree: uint64(st.Ffree),
+	}, nil
+}
@@ -0,0 +1,96 @@
+package redis
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	filesystem.Config
+
+	// Addr is the host of the server, and its port, 6379 when it has none.
+	Addr string
+
+	// DB is the number of the database.
+	DB int
+
+	// Prefix namespaces the keys of the filesystem, "vfs" by default, so
+	// that several filesystems share a database.
+	Prefix string
+
+	User     string
+	Password string
+
+	// TLS talks to the server over TLS, Insecure accepts any certificate.
+	TLS      bool
+	Insecure bool
+
+	// TTL is the time a file lives after it is written, forever when zero.
+	TTL time.Duration
+
+	// ChunkSize is the size of the chunks of the files larger than it, kept
+	// in a hash rather than a string, 1 MiB by default.
+	ChunkSize int64
+
+	// Timeout bounds the time to connect and the time of every request, 5s
+	// by default.
+	Timeout time.Duration
+}
+
+func (conf *Config) Driver() string {
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	return conf.Addr
+}
+
+func (conf *Config) Path() string {
+	return "/" + strconv.Itoa(conf.DB)
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if conf.User == "" && conf.Password == "" {
+		return nil
+	}
+	return url.UserPassword(conf.User, conf.Password)
+}
+
+// Encode the options that differ from the defaults, durations as in
+// time.Duration.String
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if conf.Prefix != "" {
+		values.Set("prefix", conf.Prefix)
+	}
+	if conf.TLS {
+		values.Set("tls", "true")
+	}
+	if conf.Insecure {
+		values.Set("insecure", "true")
+	}
+	if conf.TTL != 0 {
+		values.Set("ttl", conf.TTL.String())
+	}
+	if conf.ChunkSize != 0 {
+		values.Set("chunksize", strconv.FormatInt(conf.ChunkSize, 10))
+	}
+	if conf.Timeout != 0 {
+		values.Set("timeout", conf.Timeout.String())
+	}
+	return values
+}
+
+// Decode the options, ttl and timeout as in time.ParseDuration
+func (conf *Config) Decode(query url.Values) error {
+	conf.Prefix = query.Get("prefix")
+	conf.TLS, _ = strconv.ParseBool(query.Get("tls"))
+	conf.Insecure, _ = strconv.ParseBool(query.Get("insecure"))
+	conf.TTL, _ = time.ParseDuration(query.Get("ttl"))
+	conf.ChunkSize, _ = strconv.ParseInt(query.Get("chunksize"), 10, 64)
+	conf.Timeout, _ = time.ParseDuration(query.Get("timeout"))
+
+	return nil
+}
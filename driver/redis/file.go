@@ -0,0 +1,391 @@
+package redis
+
+import (
+	"github.com/lazychanger/go-vfs"
+	goredis "github.com/redis/go-redis/v9"
+	"io"
+	"io/fs"
+	"path"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+
+	// chunk is the size of the chunks of the content, zero when it is a
+	// string.
+	chunk int64
+}
+
+// newFileInfo describes the file named name from its metadata.
+func newFileInfo(name string, meta map[string]string) *fileInfo {
+	info := &fileInfo{name: name, dir: meta["type"] != "file"}
+	info.size, _ = strconv.ParseInt(meta["size"], 10, 64)
+	info.chunk, _ = strconv.ParseInt(meta["chunk"], 10, 64)
+	if ns, err := strconv.ParseInt(meta["mtime"], 10, 64); err == nil {
+		info.modTime = time.Unix(0, ns)
+	}
+	return info
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// redisFile reads a file a chunk at a time, a string being a single chunk,
+// and keeps the last chunk it read for the next read.
+type redisFile struct {
+	filesystem.Handle
+
+	vfs  *redisFs
+	name string
+	info *fileInfo
+
+	off int64
+
+	// chunk is the content of the chunk at index, nil until a read.
+	chunk []byte
+	index int64
+}
+
+// readAt reads at off, mu is held.
+func (f *redisFile) readAt(p []byte, off int64) (int, error) {
+	size := f.info.chunk
+	if size == 0 {
+		size = f.info.size
+	}
+
+	n := 0
+	for n < len(p) && off < f.info.size {
+		i := off / size
+		chunk, err := f.load(i)
+		if err != nil {
+			return n, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: err}
+		}
+
+		start := off - i*size
+		if start >= int64(len(chunk)) {
+			// the file shrank since it was opened
+			break
+		}
+		c := copy(p[n:], chunk[start:])
+		n += c
+		off += int64(c)
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load returns the chunk at index i.
+func (f *redisFile) load(i int64) ([]byte, error) {
+	if f.chunk != nil && f.index == i {
+		return f.chunk, nil
+	}
+
+	ctx, cancel := f.vfs.conn.context()
+	defer cancel()
+
+	key := f.vfs.conn.key("data", f.vfs.abs(f.name))
+	var chunk []byte
+	var err error
+	if f.info.chunk == 0 {
+		chunk, err = f.vfs.conn.client.Get(ctx, key).Bytes()
+	} else {
+		chunk, err = f.vfs.conn.client.HGet(ctx, key, strconv.FormatInt(i, 10)).Bytes()
+	}
+	switch {
+	case err == goredis.Nil:
+		return nil, fs.ErrNotExist
+	case err != nil:
+		return nil, errno(err)
+	}
+
+	f.chunk, f.index = chunk, i
+	return chunk, nil
+}
+
+func (f *redisFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := f.readAt(p, f.off)
+	f.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (f *redisFile) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+	return f.readAt(p, off)
+}
+
+func (f *redisFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *redisFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.abs(f.name), Err: syscall.EBADF}
+}
+
+func (f *redisFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *redisFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.abs(f.name), Err: err}
+	}
+	f.chunk = nil
+	return nil
+}
+
+// redisWriter stores the content written to it once it is closed. Content
+// larger than a chunk is uploaded to a hash of chunks as they fill up, which
+// replaces the content of the file on Close.
+type redisWriter struct {
+	filesystem.Handle
+
+	vfs  *redisFs
+	name string
+
+	// buf holds what is written and not uploaded yet.
+	buf  []byte
+	size int64
+
+	// upload is the key of the hash of the chunks uploaded, empty until
+	// the first.
+	upload string
+	chunks int
+
+	// err is the first error of an upload, the file fails once it has one.
+	err error
+}
+
+func (w *redisWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Closed() {
+		return 0, &fs.PathError{Op: "write", Path: w.vfs.abs(w.name), Err: fs.ErrClosed}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf = append(w.buf, p...)
+	w.size += int64(len(p))
+
+	chunkSize := int(w.vfs.config.ChunkSize)
+	for len(w.buf) > chunkSize {
+		if err := w.flush(w.buf[:chunkSize]); err != nil {
+			w.err = &fs.PathError{Op: "write", Path: w.vfs.abs(w.name), Err: err}
+			return len(p), w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[chunkSize:]...)
+	}
+	return len(p), nil
+}
+
+// flush uploads the next chunk.
+func (w *redisWriter) flush(chunk []byte) error {
+	if w.upload == "" {
+		w.upload = w.vfs.conn.uploadKey()
+	}
+
+	ctx, cancel := w.vfs.conn.context()
+	defer cancel()
+
+	pipe := w.vfs.conn.client.TxPipeline()
+	pipe.HSet(ctx, w.upload, strconv.Itoa(w.chunks), chunk)
+	pipe.PExpire(ctx, w.upload, uploadTTL)
+	if _, err := pipe.Exec(ctx); err != nil {
+		return errno(err)
+	}
+	w.chunks++
+	return nil
+}
+
+func (w *redisWriter) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.vfs.abs(w.name), Err: syscall.EBADF}
+}
+
+func (w *redisWriter) Stat() (fs.FileInfo, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	return &fileInfo{name: path.Base(w.vfs.abs(w.name)), size: w.size, modTime: time.Now()}, nil
+}
+
+// Close stores the content: as a string when it fits in a chunk, else as
+// the hash of the chunks with the rest as the last one.
+func (w *redisWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.abs(w.name), Err: err}
+	}
+
+	p := w.vfs.abs(w.name)
+	err := w.err
+	switch {
+	case err != nil:
+	case w.upload == "":
+		err = w.vfs.write(p, w.size, "", 0, w.buf)
+	case len(w.buf) > 0:
+		err = w.flush(w.buf)
+	}
+	if err == nil && w.upload != "" {
+		err = w.vfs.write(p, w.size, w.upload, w.vfs.config.ChunkSize, nil)
+	}
+	if err != nil && w.upload != "" {
+		ctx, cancel := w.vfs.conn.context()
+		_ = w.vfs.conn.client.Del(ctx, w.upload).Err()
+		cancel()
+	}
+	w.buf = nil
+
+	if err != nil {
+		return &fs.PathError{Op: "close", Path: p, Err: err}
+	}
+	return nil
+}
+
+// redisDir lists a directory on its first ReadDir.
+type redisDir struct {
+	filesystem.Handle
+
+	vfs  *redisFs
+	name string
+	info *fileInfo
+
+	list []fs.DirEntry
+	read bool
+	off  int
+}
+
+func (d *redisDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: fs.ErrClosed}
+	}
+	if !d.read {
+		list, err := d.vfs.readDir(d.vfs.abs(d.name))
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: err}
+		}
+		d.list, d.read = list, true
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *redisDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *redisDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *redisDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *redisDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.abs(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*redisDir)(nil)
+	_ io.ReaderAt            = (*redisFile)(nil)
+	_ io.Seeker              = (*redisFile)(nil)
+)
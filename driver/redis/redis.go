@@ -0,0 +1,509 @@
+// Package redis implements filesystem.FileSystem on the keys of a Redis
+// database, as storage shared by the replicas of a service.
+//
+// Every file and directory has a hash of metadata: its type, size and
+// modification time. The content of a file is a string, or a hash of chunks
+// when the file is larger than a chunk, and the names in a directory are a
+// set. The keys start with the prefix of the filesystem in braces, a hash
+// tag keeping them in one slot of a cluster.
+//
+// Every change runs as a Lua script, so it is atomic, Rename and RemoveAll
+// of a whole tree included, and publishes the names it changed on the
+// channel of the prefix: Watch sees the changes of every replica. Files
+// written with a TTL expire, an expired file leaves its directory on the
+// next change of the directory, without an event.
+package redis
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	goredis "github.com/redis/go-redis/v9"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultPort      = "6379"
+	defaultPrefix    = "vfs"
+	defaultChunkSize = 1 << 20
+	defaultTimeout   = 5 * time.Second
+
+	// uploadTTL bounds the life of the chunks uploaded by a writer that is
+	// never closed.
+	uploadTTL = 24 * time.Hour
+)
+
+type redisFs struct {
+	config *Config
+
+	// root is the absolute path the filesystem is rooted at.
+	root string
+
+	// conn is the server client the Sub views share, only the owner closes
+	// it and ends their watches.
+	conn  *redisConn
+	owner bool
+}
+
+// redisConn is the client of the server and the files open on it.
+type redisConn struct {
+	filesystem.Tracker
+
+	client  *goredis.Client
+	timeout time.Duration
+
+	// tag starts every key of the filesystem.
+	tag string
+
+	// ctx is canceled once the filesystem is closed, ending its watches.
+	ctx    context.Context
+	cancel context.CancelFunc
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if config.Addr == "" {
+		return nil, fs.ErrInvalid
+	}
+	if config.Prefix == "" {
+		config.Prefix = defaultPrefix
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = defaultChunkSize
+	}
+	if config.Timeout == 0 {
+		config.Timeout = defaultTimeout
+	}
+
+	addr := config.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+	}
+	options := &goredis.Options{
+		Addr:         addr,
+		Username:     config.User,
+		Password:     config.Password,
+		DB:           config.DB,
+		DialTimeout:  config.Timeout,
+		ReadTimeout:  config.Timeout,
+		WriteTimeout: config.Timeout,
+	}
+	if config.TLS {
+		host, _, _ := net.SplitHostPort(addr)
+		options.TLSConfig = &tls.Config{ServerName: host, InsecureSkipVerify: config.Insecure}
+	}
+
+	conn := &redisConn{
+		client:  goredis.NewClient(options),
+		timeout: config.Timeout,
+		tag:     "{" + config.Prefix + "}",
+	}
+	conn.ctx, conn.cancel = context.WithCancel(context.Background())
+
+	ctx, cancel := conn.context()
+	defer cancel()
+	if err := conn.client.Ping(ctx).Err(); err != nil {
+		conn.cancel()
+		_ = conn.client.Close()
+		return nil, errno(err)
+	}
+
+	return &redisFs{
+		config: config,
+		root:   "/",
+		conn:   conn,
+		owner:  true,
+	}, nil
+}
+
+func (vfs *redisFs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	info, err := vfs.stat(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	if info.dir {
+		d := &redisDir{vfs: vfs, name: name, info: info}
+		if err := d.Track(&vfs.conn.Tracker, vfs.abs(name), d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	f := &redisFile{vfs: vfs, name: name, info: info}
+	if err := f.Track(&vfs.conn.Tracker, vfs.abs(name), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create writes an empty file, the content written to the file replaces it
+// once the file is closed.
+func (vfs *redisFs) Create(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	if err := vfs.write(p, 0, "", 0, nil); err != nil {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	w := &redisWriter{vfs: vfs, name: name}
+	if err := w.Track(&vfs.conn.Tracker, vfs.abs(name), w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+// write replaces the content of the file at p with content, or with the
+// chunks uploaded to the hash at upload.
+func (vfs *redisFs) write(p string, size int64, upload string, chunk int64, content []byte) error {
+	return vfs.run(writeScript, p, formatTime(time.Now()), size, upload, chunk, content, vfs.config.TTL.Milliseconds())
+}
+
+func (vfs *redisFs) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	if err := vfs.run(mkdirScript, p, formatTime(time.Now())); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *redisFs) MkdirAll(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	if err := vfs.run(mkdirAllScript, p, formatTime(time.Now())); err != nil {
+		return &fs.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *redisFs) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	if p == vfs.root {
+		return &fs.PathError{Op: "remove", Path: p, Err: syscall.EBUSY}
+	}
+	if err := vfs.run(removeScript, p); err != nil {
+		return &fs.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
+
+// RemoveAll removes the tree in one script, the root of the filesystem
+// keeps existing.
+func (vfs *redisFs) RemoveAll(name string) error {
+	if err := vfs.closed("unlinkat", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	keep := "0"
+	if p == vfs.root {
+		keep = "1"
+	}
+	if err := vfs.run(removeAllScript, p, keep); err != nil {
+		return &fs.PathError{Op: "unlinkat", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Rename renames the keys of the file, or of the whole tree, in one script.
+func (vfs *redisFs) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
+
+	po, pn := vfs.abs(oldpath), vfs.abs(newpath)
+	var err error = syscall.EBUSY
+	if po != vfs.root && pn != vfs.root {
+		err = vfs.run(renameScript, po, pn)
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: po, New: pn, Err: err}
+	}
+	return nil
+}
+
+func (vfs *redisFs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	info, err := vfs.stat(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: p, Err: err}
+	}
+	return info, nil
+}
+
+// stat reads the metadata of the absolute path p.
+func (vfs *redisFs) stat(p string) (*fileInfo, error) {
+	ctx, cancel := vfs.conn.context()
+	defer cancel()
+
+	meta, err := vfs.conn.client.HGetAll(ctx, vfs.conn.key("meta", p)).Result()
+	if err != nil {
+		return nil, errno(err)
+	}
+	if len(meta) == 0 && p != "/" {
+		return nil, fs.ErrNotExist
+	}
+	return newFileInfo(path.Base(p), meta), nil
+}
+
+// ReadDir reads the metadata of the names in the directory in one
+// pipeline.
+func (vfs *redisFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	list, err := vfs.readDir(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: p, Err: err}
+	}
+	return list, nil
+}
+
+func (vfs *redisFs) readDir(p string) ([]fs.DirEntry, error) {
+	info, err := vfs.stat(p)
+	if err != nil {
+		return nil, err
+	}
+	if !info.dir {
+		return nil, syscall.ENOTDIR
+	}
+
+	ctx, cancel := vfs.conn.context()
+	defer cancel()
+
+	names, err := vfs.conn.client.SMembers(ctx, vfs.conn.key("dir", p)).Result()
+	if err != nil {
+		return nil, errno(err)
+	}
+	pipe := vfs.conn.client.Pipeline()
+	metas := make([]*goredis.MapStringStringCmd, len(names))
+	for i, name := range names {
+		metas[i] = pipe.HGetAll(ctx, vfs.conn.key("meta", path.Join(p, name)))
+	}
+	if len(names) > 0 {
+		if _, err := pipe.Exec(ctx); err != nil {
+			return nil, errno(err)
+		}
+	}
+
+	list := make([]fs.DirEntry, 0, len(names))
+	for i, name := range names {
+		// an expired file
+		if meta := metas[i].Val(); len(meta) > 0 {
+			list = append(list, fs.FileInfoToDirEntry(newFileInfo(name, meta)))
+		}
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// WriteFile uploads data through a writer of its own, the file is not
+// emptied by a Create first.
+func (vfs *redisFs) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
+
+	w := &redisWriter{vfs: vfs, name: name}
+	_, err := w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Chtimes sets the mtime field of the meta hash, which has no access time.
+func (vfs *redisFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := vfs.closed("chtimes", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	if err := vfs.run(chtimesScript, p, formatTime(mtime)); err != nil {
+		return &fs.PathError{Op: "chtimes", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *redisFs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	p := vfs.abs(dir)
+	info, err := vfs.stat(p)
+	if err == nil && !info.dir {
+		err = syscall.ENOTDIR
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: p, Err: err}
+	}
+
+	return &redisFs{
+		config: vfs.config,
+		root:   p,
+		conn:   vfs.conn,
+	}, nil
+}
+
+func (vfs *redisFs) Exists(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	_, err := vfs.stat(vfs.abs(name))
+	return err == nil
+}
+
+func (vfs *redisFs) IsFile(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	info, err := vfs.stat(vfs.abs(name))
+	return err == nil && !info.dir
+}
+
+func (vfs *redisFs) IsDir(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	info, err := vfs.stat(vfs.abs(name))
+	return err == nil && info.dir
+}
+
+// Close ends the watches and closes the client once the files are closed.
+func (vfs *redisFs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.conn.Tracker.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.root, Err: err}
+	}
+
+	vfs.conn.cancel()
+	return vfs.conn.client.Close()
+}
+
+func (vfs *redisFs) OpenFiles() []string {
+	return vfs.conn.OpenFiles()
+}
+
+// closed fails op on name once the client is closed, before a command is
+// sent on it.
+func (vfs *redisFs) closed(op, name string) error {
+	if vfs.conn.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.abs(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// run runs the script on the absolute path p and returns the error it
+// reports.
+func (vfs *redisFs) run(script *goredis.Script, p string, args ...interface{}) error {
+	ctx, cancel := vfs.conn.context()
+	defer cancel()
+
+	res, err := script.Run(ctx, vfs.conn.client, nil, append([]interface{}{vfs.conn.tag, p}, args...)...).Text()
+	if err != nil {
+		return errno(err)
+	}
+	if err, ok := scriptErrors[res]; ok {
+		return err
+	}
+	return nil
+}
+
+// abs returns the absolute path of the name.
+func (vfs *redisFs) abs(name string) string {
+	return path.Join(vfs.root, path.Clean("/"+name))
+}
+
+// context returns the context of a request, bounded by the timeout.
+func (conn *redisConn) context() (context.Context, context.CancelFunc) {
+	return context.WithTimeout(conn.ctx, conn.timeout)
+}
+
+// key returns the key of the kind of the absolute path p: meta, data or
+// dir.
+func (conn *redisConn) key(kind, p string) string {
+	return conn.tag + ":" + kind + ":" + p
+}
+
+// uploadKey returns a fresh key to upload the chunks of a file to.
+func (conn *redisConn) uploadKey() string {
+	id := make([]byte, 8)
+	_, _ = rand.Read(id)
+	return conn.key("upload", hex.EncodeToString(id))
+}
+
+func formatTime(t time.Time) string {
+	return strconv.FormatInt(t.UnixNano(), 10)
+}
+
+// redisError is an error of the server, matching fs.ErrPermission when it
+// denies access.
+type redisError struct {
+	err error
+}
+
+func (e *redisError) Error() string {
+	return e.err.Error()
+}
+
+func (e *redisError) Unwrap() error {
+	return e.err
+}
+
+func (e *redisError) Is(target error) bool {
+	return target == fs.ErrPermission
+}
+
+// errno returns the error of the client, one matching fs.ErrPermission when
+// the server refuses the credentials or the command.
+func errno(err error) error {
+	var reply goredis.Error
+	if errors.As(err, &reply) {
+		switch code, _, _ := strings.Cut(reply.Error(), " "); code {
+		case "NOAUTH", "WRONGPASS", "NOPERM":
+			return &redisError{err: err}
+		}
+	}
+	return err
+}
@@ -0,0 +1,181 @@
+package redis
+
+import (
+	"context"
+	"fmt"
+	"github.com/alicebob/miniredis/v2"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"testing"
+	"time"
+)
+
+// database returns the DSN of the database 0 of the server, query adds to
+// the options.
+func database(s *miniredis.Miniredis, query string) string {
+	return fmt.Sprintf("redis://%s/0?timeout=5s&%s", s.Addr(), query)
+}
+
+func TestRedisConformance(t *testing.T) {
+	vfstest.TestDriver(t, database(miniredis.RunT(t), "prefix=conformance"))
+}
+
+func TestRedisLayout(t *testing.T) {
+	s := miniredis.RunT(t)
+	vfs := vfstest.Open(t, database(s, "prefix=app&chunksize=4"))
+
+	require.NoError(t, vfs.Mkdir("/dir", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/dir/small", []byte("abc")))
+	require.NoError(t, filesystem.WriteFile(vfs, "/dir/large", []byte("0123456789")))
+
+	small, err := s.Get("{app}:data:/dir/small")
+	require.NoError(t, err)
+	assert.Equal(t, "abc", small, "a file in a chunk is a string")
+	chunks, err := s.HKeys("{app}:data:/dir/large")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"0", "1", "2"}, chunks, "a larger file is a hash of chunks")
+	assert.Equal(t, "0123", s.HGet("{app}:data:/dir/large", "0"))
+	members, err := s.Members("{app}:dir:/dir")
+	require.NoError(t, err)
+	assert.Equal(t, []string{"large", "small"}, members, "a directory is a set")
+	for _, key := range s.Keys() {
+		assert.NotContains(t, key, ":upload:", "the upload is renamed into place")
+	}
+
+	f, err := vfs.Open("/dir/large")
+	require.NoError(t, err)
+	defer f.Close()
+	buf := make([]byte, 5)
+	n, err := f.(io.ReaderAt).ReadAt(buf, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "34567", string(buf[:n]), "a read across chunks")
+	n, err = f.(io.ReaderAt).ReadAt(buf, 8)
+	assert.Equal(t, io.EOF, err)
+	assert.Equal(t, "89", string(buf[:n]))
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	// a rewrite smaller than a chunk is a string again
+	require.NoError(t, filesystem.WriteFile(vfs, "/dir/large", []byte("x")))
+	large, err := s.Get("{app}:data:/dir/large")
+	require.NoError(t, err)
+	assert.Equal(t, "x", large)
+
+	// another prefix is another filesystem
+	other := vfstest.Open(t, database(s, "prefix=other"))
+	assert.False(t, other.Exists("/dir"))
+}
+
+func TestRedisTTL(t *testing.T) {
+	s := miniredis.RunT(t)
+	vfs := vfstest.Open(t, database(s, "ttl=1m"))
+
+	require.NoError(t, vfs.Mkdir("/tmp", 0755))
+	require.NoError(t, filesystem.WriteFile(vfs, "/tmp/session", []byte("a")))
+	assert.Equal(t, time.Minute, s.TTL("{vfs}:data:/tmp/session"))
+	assert.Zero(t, s.TTL("{vfs}:meta:/tmp"), "directories do not expire")
+
+	s.FastForward(2 * time.Minute)
+	assert.False(t, vfs.Exists("/tmp/session"))
+	list, err := filesystem.ReadDir(vfs, "/tmp")
+	require.NoError(t, err)
+	assert.Empty(t, list)
+	assert.NoError(t, vfs.Remove("/tmp"), "an expired file leaves its directory empty")
+}
+
+func TestRedisAtomicTree(t *testing.T) {
+	s := miniredis.RunT(t)
+	vfs := vfstest.Open(t, database(s, ""))
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	for i := 0; i < 10; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/a/b/%d", i), []byte{byte(i)}))
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, filesystem.Chtimes(vfs, "/a/b/0", mtime, mtime))
+
+	require.NoError(t, vfs.Rename("/a", "/c"))
+	assert.False(t, vfs.Exists("/a"))
+	list, err := filesystem.ReadDir(vfs, "/c/b")
+	require.NoError(t, err)
+	assert.Len(t, list, 10)
+	info, err := vfs.Stat("/c/b/0")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime), "the metadata moves with the files")
+
+	require.NoError(t, vfs.RemoveAll("/c"))
+	assert.Empty(t, s.Keys(), "no key left of the tree")
+
+	// the root of a sub view stays
+	require.NoError(t, vfs.MkdirAll("/d/e", 0755))
+	sub, err := vfs.Sub("/d")
+	require.NoError(t, err)
+	require.NoError(t, sub.RemoveAll("/"))
+	assert.True(t, vfs.IsDir("/d"))
+	assert.False(t, vfs.Exists("/d/e"))
+}
+
+func TestRedisWatch(t *testing.T) {
+	s := miniredis.RunT(t)
+	vfs := vfstest.Open(t, database(s, ""))
+	other := vfstest.Open(t, database(s, ""))
+	require.NoError(t, vfs.MkdirAll("/app/conf", 0755))
+
+	_, err := filesystem.Watch(context.Background(), vfs, "/noexist")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	sub, err := vfs.Sub("/app")
+	require.NoError(t, err)
+	events, err := filesystem.Watch(context.Background(), sub, "/conf")
+	require.NoError(t, err)
+
+	// the changes of other replicas, not of the other files
+	require.NoError(t, filesystem.WriteFile(other, "/app/conf.bak", []byte("a")))
+	require.NoError(t, filesystem.WriteFile(other, "/app/conf/a.yaml", []byte("a")))
+	require.NoError(t, filesystem.WriteFile(other, "/app/conf/a.yaml", []byte("b")))
+	require.NoError(t, other.Rename("/app/conf/a.yaml", "/app/conf/b.yaml"))
+
+	for _, want := range []filesystem.Event{
+		{Name: "/conf/a.yaml", Op: filesystem.EventCreate},
+		{Name: "/conf/a.yaml", Op: filesystem.EventWrite},
+		{Name: "/conf/a.yaml", Op: filesystem.EventRemove},
+		{Name: "/conf/b.yaml", Op: filesystem.EventCreate},
+	} {
+		select {
+		case e := <-events:
+			assert.Equal(t, want, e)
+		case <-time.After(5 * time.Second):
+			t.Fatalf("no %s event", want.Op)
+		}
+	}
+
+	// Close ends the watches
+	require.NoError(t, filesystem.Close(vfs))
+	select {
+	case _, ok := <-events:
+		assert.False(t, ok)
+	case <-time.After(5 * time.Second):
+		t.Fatal("events not closed with the filesystem")
+	}
+}
+
+func TestRedisAuth(t *testing.T) {
+	s := miniredis.RunT(t)
+	s.RequireUserAuth("app", "secret")
+
+	vfs, err := filesystem.Open(fmt.Sprintf("redis://app:secret@%s/0", s.Addr()))
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteFile(vfs, "/a", []byte("a")))
+	require.NoError(t, filesystem.Close(vfs))
+
+	_, err = filesystem.Open(fmt.Sprintf("redis://app:wrong@%s/0", s.Addr()))
+	assert.ErrorIs(t, err, fs.ErrPermission)
+
+	_, err = filesystem.Open(fmt.Sprintf("redis://%s/db", s.Addr()))
+	assert.Error(t, err)
+}
@@ -0,0 +1,275 @@
+package redis
+
+import (
+	goredis "github.com/redis/go-redis/v9"
+	"io/fs"
+	"syscall"
+)
+
+// The changes run as scripts, so each of them is atomic and publishes its
+// events along. The first argument of a script is the tag of the keys, the
+// second the absolute path it works on. A script returns OK, or the name of
+// the errno the change fails with.
+
+// lib holds the helpers of the scripts.
+const lib = `
+local tag = ARGV[1]
+
+local function key(kind, p)
+	return tag .. ':' .. kind .. ':' .. p
+end
+
+local function kind(p)
+	if p == '/' then
+		return 'dir'
+	end
+	return redis.call('HGET', key('meta', p), 'type')
+end
+
+local function parent(p)
+	local d = string.match(p, '^(.*)/[^/]*$')
+	if d == '' then
+		return '/'
+	end
+	return d
+end
+
+local function base(p)
+	return string.match(p, '[^/]*$')
+end
+
+local function join(d, name)
+	if d == '/' then
+		return '/' .. name
+	end
+	return d .. '/' .. name
+end
+
+-- children returns the names in the directory, forgetting the files that
+-- expired
+local function children(p)
+	local names = {}
+	for _, name in ipairs(redis.call('SMEMBERS', key('dir', p))) do
+		if redis.call('EXISTS', key('meta', join(p, name))) == 1 then
+			table.insert(names, name)
+		else
+			redis.call('SREM', key('dir', p), name)
+		end
+	end
+	table.sort(names)
+	return names
+end
+
+local function publish(op, p)
+	redis.call('PUBLISH', tag .. ':events', op .. ' ' .. p)
+end
+
+local function dir(p)
+	local k = kind(p)
+	if not k then
+		return 'ENOENT'
+	end
+	if k ~= 'dir' then
+		return 'ENOTDIR'
+	end
+end
+`
+
+// mkdirScript creates the directory, ARGV[3] is its modification time.
+var mkdirScript = goredis.NewScript(lib + `
+local p = ARGV[2]
+if kind(p) then
+	return 'EEXIST'
+end
+local err = dir(parent(p))
+if err then
+	return err
+end
+
+redis.call('HSET', key('meta', p), 'type', 'dir', 'mtime', ARGV[3])
+redis.call('SADD', key('dir', parent(p)), base(p))
+publish('create', p)
+return 'OK'
+`)
+
+// mkdirAllScript creates the missing directories of the path.
+var mkdirAllScript = goredis.NewScript(lib + `
+local d = '/'
+for name in string.gmatch(ARGV[2], '[^/]+') do
+	d = join(d, name)
+	local k = kind(d)
+	if not k then
+		redis.call('HSET', key('meta', d), 'type', 'dir', 'mtime', ARGV[3])
+		redis.call('SADD', key('dir', parent(d)), name)
+		publish('create', d)
+	elseif k ~= 'dir' then
+		return 'ENOTDIR'
+	end
+end
+return 'OK'
+`)
+
+// writeScript replaces the content of the file: with the string ARGV[7], or
+// with the hash of chunks of ARGV[6] bytes uploaded at the key ARGV[5]. The
+// file is ARGV[4] bytes long, modified at ARGV[3], and expires after ARGV[8]
+// milliseconds unless it is zero.
+var writeScript = goredis.NewScript(lib + `
+local p = ARGV[2]
+local k = kind(p)
+if k == 'dir' then
+	return 'EISDIR'
+end
+local err = dir(parent(p))
+if err then
+	return err
+end
+
+local data = key('data', p)
+if ARGV[5] == '' then
+	redis.call('SET', data, ARGV[7])
+else
+	redis.call('RENAME', ARGV[5], data)
+end
+redis.call('HSET', key('meta', p), 'type', 'file', 'mtime', ARGV[3], 'size', ARGV[4], 'chunk', ARGV[6])
+redis.call('SADD', key('dir', parent(p)), base(p))
+
+local ttl = tonumber(ARGV[8])
+for _, t in ipairs({key('meta', p), data}) do
+	if ttl > 0 then
+		redis.call('PEXPIRE', t, ttl)
+	else
+		redis.call('PERSIST', t)
+	end
+end
+
+if k then
+	publish('write', p)
+else
+	publish('create', p)
+end
+return 'OK'
+`)
+
+// removeScript removes the file or the empty directory.
+var removeScript = goredis.NewScript(lib + `
+local p = ARGV[2]
+if p == '/' then
+	return 'EBUSY'
+end
+local k = kind(p)
+if not k then
+	return 'ENOENT'
+end
+if k == 'dir' and #children(p) > 0 then
+	return 'ENOTEMPTY'
+end
+
+redis.call('DEL', key('meta', p), key('data', p), key('dir', p))
+redis.call('SREM', key('dir', parent(p)), base(p))
+publish('remove', p)
+return 'OK'
+`)
+
+// removeAllScript removes the tree, or only what is below it when ARGV[3] is
+// 1 or the tree is the root.
+var removeAllScript = goredis.NewScript(lib + `
+local function drop(p, keep)
+	if kind(p) == 'dir' then
+		for _, name in ipairs(children(p)) do
+			drop(join(p, name), false)
+		end
+	end
+	if keep then
+		redis.call('DEL', key('dir', p))
+	else
+		redis.call('DEL', key('meta', p), key('data', p), key('dir', p))
+		publish('remove', p)
+	end
+end
+
+local p = ARGV[2]
+local keep = p == '/' or ARGV[3] == '1'
+if not kind(p) then
+	return 'OK'
+end
+drop(p, keep)
+if not keep then
+	redis.call('SREM', key('dir', parent(p)), base(p))
+end
+return 'OK'
+`)
+
+// renameScript moves the tree at ARGV[2] to ARGV[3], renaming its keys.
+var renameScript = goredis.NewScript(lib + `
+local function move(from, to)
+	if kind(from) == 'dir' then
+		for _, name in ipairs(children(from)) do
+			move(join(from, name), join(to, name))
+		end
+	end
+	for _, t in ipairs({'meta', 'data', 'dir'}) do
+		if redis.call('EXISTS', key(t, from)) == 1 then
+			redis.call('RENAME', key(t, from), key(t, to))
+		end
+	end
+end
+
+local old, new = ARGV[2], ARGV[3]
+if old == '/' or new == '/' then
+	return 'EBUSY'
+end
+local src = kind(old)
+if not src then
+	return 'ENOENT'
+end
+if old == new then
+	return 'OK'
+end
+local err = dir(parent(new))
+if err then
+	return err
+end
+
+local dst = kind(new)
+if dst == 'file' and src == 'dir' then
+	return 'ENOTDIR'
+end
+if dst == 'dir' and src == 'file' then
+	return 'EISDIR'
+end
+if dst == 'dir' and #children(new) > 0 then
+	return 'ENOTEMPTY'
+end
+if src == 'dir' and string.sub(new .. '/', 1, #old + 1) == old .. '/' then
+	return 'EINVAL'
+end
+
+redis.call('DEL', key('meta', new), key('data', new), key('dir', new))
+move(old, new)
+redis.call('SREM', key('dir', parent(old)), base(old))
+redis.call('SADD', key('dir', parent(new)), base(new))
+publish('remove', old)
+publish('create', new)
+return 'OK'
+`)
+
+// chtimesScript sets the modification time of the file to ARGV[3].
+var chtimesScript = goredis.NewScript(lib + `
+local p = ARGV[2]
+if not kind(p) then
+	return 'ENOENT'
+end
+redis.call('HSET', key('meta', p), 'mtime', ARGV[3])
+return 'OK'
+`)
+
+// scriptErrors are the errors the scripts return by name.
+var scriptErrors = map[string]error{
+	"ENOENT":    fs.ErrNotExist,
+	"EEXIST":    fs.ErrExist,
+	"ENOTDIR":   syscall.ENOTDIR,
+	"EISDIR":    syscall.EISDIR,
+	"ENOTEMPTY": syscall.ENOTEMPTY,
+	"EBUSY":     syscall.EBUSY,
+	"EINVAL":    syscall.EINVAL,
+}
@@ -0,0 +1,75 @@
+package redis
+
+import (
+	"context"
+	"github.com/lazychanger/go-vfs"
+	"io/fs"
+	"path"
+	"strings"
+)
+
+// Watch subscribes to the channel of the prefix and reports the changes of
+// the name and below it, made by any client of the filesystem. Pub/sub does
+// not replay: the changes made while the subscriber is disconnected are
+// lost. The events stop when ctx is done or the filesystem is closed.
+func (vfs *redisFs) Watch(ctx context.Context, name string) (<-chan filesystem.Event, error) {
+	if err := vfs.closed("watch", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	if _, err := vfs.stat(p); err != nil {
+		return nil, &fs.PathError{Op: "watch", Path: p, Err: err}
+	}
+	match := func(k string) bool {
+		return p == "/" || k == p || strings.HasPrefix(k, p+"/")
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	ps := vfs.conn.client.Subscribe(ctx, vfs.conn.tag+":events")
+	if _, err := ps.Receive(ctx); err != nil {
+		cancel()
+		_ = ps.Close()
+		return nil, &fs.PathError{Op: "watch", Path: p, Err: errno(err)}
+	}
+	go func() {
+		select {
+		case <-vfs.conn.ctx.Done():
+		case <-ctx.Done():
+		}
+		cancel()
+		_ = ps.Close()
+	}()
+
+	events := make(chan filesystem.Event)
+	go func() {
+		defer close(events)
+		defer cancel()
+
+		for msg := range ps.Channel() {
+			op, k, ok := strings.Cut(msg.Payload, " ")
+			if !ok || !match(k) {
+				continue
+			}
+
+			e := filesystem.Event{Name: path.Join("/", strings.TrimPrefix(k, vfs.root))}
+			switch op {
+			case "create":
+				e.Op = filesystem.EventCreate
+			case "write":
+				e.Op = filesystem.EventWrite
+			case "remove":
+				e.Op = filesystem.EventRemove
+			default:
+				continue
+			}
+
+			select {
+			case events <- e:
+			case <-ctx.Done():
+				return
+			}
+		}
+	}()
+	return events, nil
+}
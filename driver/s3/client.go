@@ -0,0 +1,500 @@
+package s3
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// client speaks the subset of the S3 REST API the driver needs, signing its
+// requests with AWS Signature Version 4.
+type client struct {
+	http *http.Client
+
+	// endpoint is the scheme and host of the service.
+	endpoint *url.URL
+
+	bucket    string
+	region    string
+	pathStyle bool
+
+	accessKey string
+	secretKey string
+	token     string
+}
+
+// object is an entry of a listing.
+type object struct {
+	Key          string    `xml:"Key"`
+	LastModified time.Time `xml:"LastModified"`
+	ETag         string    `xml:"ETag"`
+	Size         int64     `xml:"Size"`
+}
+
+type listResult struct {
+	Contents              []object `xml:"Contents"`
+	CommonPrefixes        []string `xml:"CommonPrefixes>Prefix"`
+	IsTruncated           bool     `xml:"IsTruncated"`
+	NextContinuationToken string   `xml:"NextContinuationToken"`
+}
+
+type completedPart struct {
+	PartNumber int    `xml:"PartNumber"`
+	ETag       string `xml:"ETag"`
+}
+
+// s3Error is an error response of the service, it matches fs.ErrNotExist
+// and fs.ErrPermission as its status says.
+type s3Error struct {
+	StatusCode int    `xml:"-"`
+	Code       string `xml:"Code"`
+	Message    string `xml:"Message"`
+}
+
+func (e *s3Error) Error() string {
+	if e.Message == "" {
+		return fmt.Sprintf("s3: %s (%d)", e.Code, e.StatusCode)
+	}
+	return fmt.Sprintf("s3: %s: %s", e.Code, e.Message)
+}
+
+func (e *s3Error) Is(target error) bool {
+	switch target {
+	case fs.ErrNotExist:
+		return e.StatusCode == http.StatusNotFound || e.Code == "NoSuchKey"
+	case fs.ErrPermission:
+		return e.StatusCode == http.StatusForbidden
+	}
+	return false
+}
+
+// request is a request to the bucket, on key when it is not empty.
+type request struct {
+	method string
+	key    string
+	query  url.Values
+	header http.Header
+	body   []byte
+
+	// ok is the status of a success, 200 when 0.
+	ok int
+}
+
+// do sends the request and returns the response of a success, whose body
+// the caller closes. Any other status is an *s3Error.
+func (c *client) do(r *request) (*http.Response, error) {
+	u := *c.endpoint
+	u.Path, u.RawPath = "/", "/"
+	if c.pathStyle {
+		u.Path += c.bucket + "/"
+		u.RawPath += uriEncode(c.bucket, true) + "/"
+	} else {
+		u.Host = c.bucket + "." + u.Host
+	}
+	u.Path += r.key
+	u.RawPath += uriEncode(r.key, false)
+	u.RawQuery = canonicalQuery(r.query)
+
+	var body io.Reader
+	if r.body != nil {
+		body = bytes.NewReader(r.body)
+	}
+	req, err := http.NewRequest(r.method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	req.URL = &u
+	for k, v := range r.header {
+		req.Header[k] = v
+	}
+	req.ContentLength = int64(len(r.body))
+	c.sign(req, r.body, time.Now())
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return nil, err
+	}
+
+	ok := r.ok
+	if ok == 0 {
+		ok = http.StatusOK
+	}
+	if resp.StatusCode != ok {
+		defer resp.Body.Close()
+		return nil, responseError(resp)
+	}
+	return resp, nil
+}
+
+// call sends the request and decodes the XML of the response into v, when
+// not nil. Some calls report errors with a success status, in the body.
+func (c *client) call(r *request, v interface{}) error {
+	resp, err := c.do(r)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	data, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if bytes.Contains(data, []byte("<Error>")) {
+		e := &s3Error{StatusCode: resp.StatusCode}
+		if xml.Unmarshal(data, e) == nil && e.Code != "" {
+			return e
+		}
+	}
+	if v == nil {
+		return nil
+	}
+	return xml.Unmarshal(data, v)
+}
+
+func responseError(resp *http.Response) error {
+	e := &s3Error{StatusCode: resp.StatusCode}
+	data, _ := io.ReadAll(io.LimitReader(resp.Body, 64<<10))
+	if xml.Unmarshal(data, e) != nil || e.Code == "" {
+		e.Code = strings.ReplaceAll(http.StatusText(resp.StatusCode), " ", "")
+	}
+	return e
+}
+
+// head returns the size and modification time of the object.
+func (c *client) head(key string) (object, error) {
+	resp, err := c.do(&request{method: http.MethodHead, key: key})
+	if err != nil {
+		return object{}, err
+	}
+	resp.Body.Close()
+
+	mtime, _ := http.ParseTime(resp.Header.Get("Last-Modified"))
+	return object{Key: key, Size: resp.ContentLength, LastModified: mtime, ETag: resp.Header.Get("ETag")}, nil
+}
+
+// get reads the object from off on, n bytes of it or all of them when n is
+// negative.
+func (c *client) get(key string, off, n int64) (io.ReadCloser, error) {
+	r := &request{method: http.MethodGet, key: key}
+	if off > 0 || n >= 0 {
+		end := ""
+		if n >= 0 {
+			end = strconv.FormatInt(off+n-1, 10)
+		}
+		r.header = http.Header{"Range": {fmt.Sprintf("bytes=%d-%s", off, end)}}
+		r.ok = http.StatusPartialContent
+	}
+
+	resp, err := c.do(r)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (c *client) put(key string, data []byte) error {
+	return c.call(&request{method: http.MethodPut, key: key, body: data}, nil)
+}
+
+func (c *client) delete(key string) error {
+	return c.call(&request{method: http.MethodDelete, key: key, ok: http.StatusNoContent}, nil)
+}
+
+// deleteMany deletes up to 1000 objects at once.
+func (c *client) deleteMany(keys []string) error {
+	type key struct {
+		Key string `xml:"Key"`
+	}
+	var doc struct {
+		XMLName xml.Name `xml:"Delete"`
+		Quiet   bool     `xml:"Quiet"`
+		Objects []key    `xml:"Object"`
+	}
+	doc.Quiet = true
+	for _, k := range keys {
+		doc.Objects = append(doc.Objects, key{k})
+	}
+
+	body, err := xml.Marshal(doc)
+	if err != nil {
+		return err
+	}
+	sum := md5.Sum(body)
+
+	var result struct {
+		Errors []struct {
+			Key     string `xml:"Key"`
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		} `xml:"Error"`
+	}
+	err = c.call(&request{
+		method: http.MethodPost,
+		query:  url.Values{"delete": {""}},
+		header: http.Header{"Content-Md5": {base64.StdEncoding.EncodeToString(sum[:])}},
+		body:   body,
+	}, &result)
+	if err != nil {
+		return err
+	}
+	if len(result.Errors) > 0 {
+		e := result.Errors[0]
+		return fmt.Errorf("%s: %w", e.Key, &s3Error{Code: e.Code, Message: e.Message})
+	}
+	return nil
+}
+
+// copy copies the object src to dst, size is the size of src.
+func (c *client) copy(src, dst string, size int64) error {
+	if size > maxCopySize {
+		return c.copyParts(src, dst, size)
+	}
+	return c.call(&request{
+		method: http.MethodPut,
+		key:    dst,
+		header: http.Header{"X-Amz-Copy-Source": {c.copySource(src)}},
+	}, nil)
+}
+
+// copyParts copies an object too large for a single copy as a multipart
+// upload.
+func (c *client) copyParts(src, dst string, size int64) error {
+	upload, err := c.createUpload(dst)
+	if err != nil {
+		return err
+	}
+
+	var parts []completedPart
+	for off := int64(0); off < size; off += maxCopySize {
+		end := off + maxCopySize
+		if end > size {
+			end = size
+		}
+
+		var result struct {
+			ETag string `xml:"ETag"`
+		}
+		err = c.call(&request{
+			method: http.MethodPut,
+			key:    dst,
+			query:  url.Values{"partNumber": {strconv.Itoa(len(parts) + 1)}, "uploadId": {upload}},
+			header: http.Header{
+				"X-Amz-Copy-Source":       {c.copySource(src)},
+				"X-Amz-Copy-Source-Range": {fmt.Sprintf("bytes=%d-%d", off, end-1)},
+			},
+		}, &result)
+		if err != nil {
+			_ = c.abortUpload(dst, upload)
+			return err
+		}
+		parts = append(parts, completedPart{PartNumber: len(parts) + 1, ETag: result.ETag})
+	}
+
+	return c.completeUpload(dst, upload, parts)
+}
+
+func (c *client) copySource(key string) string {
+	return "/" + uriEncode(c.bucket, true) + "/" + uriEncode(key, false)
+}
+
+// list returns a page of the objects below prefix, grouped by delimiter
+// when not empty, from the continuation token on.
+func (c *client) list(prefix, delimiter, token string, max int) (*listResult, error) {
+	query := url.Values{"list-type": {"2"}, "prefix": {prefix}}
+	if delimiter != "" {
+		query.Set("delimiter", delimiter)
+	}
+	if token != "" {
+		query.Set("continuation-token", token)
+	}
+	if max > 0 {
+		query.Set("max-keys", strconv.Itoa(max))
+	}
+
+	result := &listResult{}
+	if err := c.call(&request{method: http.MethodGet, query: query}, result); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// walk calls fn with every page of the listing of prefix.
+func (c *client) walk(prefix, delimiter string, fn func(page *listResult) error) error {
+	token := ""
+	for {
+		page, err := c.list(prefix, delimiter, token, 0)
+		if err != nil {
+			return err
+		}
+		if err := fn(page); err != nil {
+			return err
+		}
+		if !page.IsTruncated || page.NextContinuationToken == "" {
+			return nil
+		}
+		token = page.NextContinuationToken
+	}
+}
+
+func (c *client) createUpload(key string) (string, error) {
+	var result struct {
+		UploadID string `xml:"UploadId"`
+	}
+	err := c.call(&request{method: http.MethodPost, key: key, query: url.Values{"uploads": {""}}}, &result)
+	return result.UploadID, err
+}
+
+func (c *client) uploadPart(key, upload string, n int, data []byte) (string, error) {
+	resp, err := c.do(&request{
+		method: http.MethodPut,
+		key:    key,
+		query:  url.Values{"partNumber": {strconv.Itoa(n)}, "uploadId": {upload}},
+		body:   data,
+	})
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	return resp.Header.Get("ETag"), nil
+}
+
+func (c *client) completeUpload(key, upload string, parts []completedPart) error {
+	body, err := xml.Marshal(struct {
+		XMLName xml.Name        `xml:"CompleteMultipartUpload"`
+		Parts   []completedPart `xml:"Part"`
+	}{Parts: parts})
+	if err != nil {
+		return err
+	}
+
+	err = c.call(&request{method: http.MethodPost, key: key, query: url.Values{"uploadId": {upload}}, body: body}, nil)
+	if err != nil {
+		_ = c.abortUpload(key, upload)
+	}
+	return err
+}
+
+func (c *client) abortUpload(key, upload string) error {
+	return c.call(&request{
+		method: http.MethodDelete,
+		key:    key,
+		query:  url.Values{"uploadId": {upload}},
+		ok:     http.StatusNoContent,
+	}, nil)
+}
+
+// sign adds the headers of AWS Signature Version 4 to req, anonymous
+// clients send unsigned requests.
+func (c *client) sign(req *http.Request, body []byte, now time.Time) {
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	date := now.UTC().Format("20060102T150405Z")
+
+	req.Header.Set("X-Amz-Content-Sha256", payload)
+	req.Header.Set("X-Amz-Date", date)
+	if c.token != "" {
+		req.Header.Set("X-Amz-Security-Token", c.token)
+	}
+	if c.accessKey == "" {
+		return
+	}
+
+	signed := []string{"host"}
+	for k := range req.Header {
+		signed = append(signed, strings.ToLower(k))
+	}
+	sort.Strings(signed)
+
+	scope := date[:8] + "/" + c.region + "/s3/aws4_request"
+	signature := signature(c.secretKey, scope, date, canonicalRequest(req, signed, payload))
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s",
+		c.accessKey, scope, strings.Join(signed, ";"), signature))
+}
+
+// canonicalRequest is the request as Signature Version 4 signs it, with the
+// signed headers.
+func canonicalRequest(req *http.Request, signed []string, payload string) string {
+	var b strings.Builder
+	b.WriteString(req.Method + "\n")
+	b.WriteString(req.URL.EscapedPath() + "\n")
+	b.WriteString(canonicalQuery(req.URL.Query()) + "\n")
+	for _, k := range signed {
+		v := req.Header.Get(k)
+		if k == "host" {
+			v = req.Host
+			if v == "" {
+				v = req.URL.Host
+			}
+		}
+		b.WriteString(k + ":" + strings.TrimSpace(v) + "\n")
+	}
+	b.WriteString("\n" + strings.Join(signed, ";") + "\n")
+	b.WriteString(payload)
+	return b.String()
+}
+
+func signature(secret, scope, date, canonical string) string {
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + date + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+
+	key := []byte("AWS4" + secret)
+	for _, part := range strings.Split(scope, "/") {
+		key = hmacSHA256(key, part)
+	}
+	return hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(data))
+	return h.Sum(nil)
+}
+
+// canonicalQuery encodes the query sorted by name, then value.
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	var pairs []string
+	for _, k := range keys {
+		values := append([]string(nil), query[k]...)
+		sort.Strings(values)
+		for _, v := range values {
+			pairs = append(pairs, uriEncode(k, true)+"="+uriEncode(v, true))
+		}
+	}
+	return strings.Join(pairs, "&")
+}
+
+// uriEncode escapes every byte but the unreserved characters, and slashes
+// unless encodeSlash.
+func uriEncode(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		switch {
+		case 'A' <= c && c <= 'Z', 'a' <= c && c <= 'z', '0' <= c && c <= '9',
+			c == '-', c == '_', c == '.', c == '~', c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
@@ -0,0 +1,100 @@
+package s3
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
+)
+
+type Config struct {
+	filesystem.Config
+
+	// Endpoint is the host of the service, and its port, AWS when empty.
+	Endpoint string
+
+	Bucket string
+
+	// Prefix is the key prefix the filesystem is rooted at, without a
+	// leading slash.
+	Prefix string
+
+	Region string
+
+	AccessKey string
+	SecretKey string
+
+	// SessionToken goes with temporary credentials.
+	SessionToken string
+
+	// Insecure talks plain HTTP to the endpoint.
+	Insecure bool
+
+	// PathStyle puts the bucket in the path of the requests rather than in
+	// the host, the default for endpoints other than AWS.
+	PathStyle bool
+
+	// PartSize is the size of the parts of multipart uploads, 8 MiB by
+	// default and 5 MiB at least.
+	PartSize int64
+
+	// NoMarkers keeps directories implicit: no marker object is written for
+	// them, so an empty directory does not persist.
+	NoMarkers bool
+}
+
+func (conf *Config) Driver() string {
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	return conf.Endpoint
+}
+
+func (conf *Config) Path() string {
+	return "/" + conf.Bucket + "/" + conf.Prefix
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if conf.AccessKey == "" {
+		return nil
+	}
+	return url.UserPassword(conf.AccessKey, conf.SecretKey)
+}
+
+// Encode the options, markers=false when directories have no marker objects
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if conf.Region != "" {
+		values.Set("region", conf.Region)
+	}
+	if conf.SessionToken != "" {
+		values.Set("token", conf.SessionToken)
+	}
+	if conf.Insecure {
+		values.Set("insecure", "true")
+	}
+	if conf.PathStyle {
+		values.Set("pathstyle", "true")
+	}
+	if conf.PartSize != 0 {
+		values.Set("partsize", strconv.FormatInt(conf.PartSize, 10))
+	}
+	if conf.NoMarkers {
+		values.Set("markers", "false")
+	}
+	return values
+}
+
+// Decode the options, the session token is token
+func (conf *Config) Decode(query url.Values) error {
+	conf.Region = query.Get("region")
+	conf.SessionToken = query.Get("token")
+	conf.Insecure, _ = strconv.ParseBool(query.Get("insecure"))
+	conf.PathStyle, _ = strconv.ParseBool(query.Get("pathstyle"))
+	conf.PartSize, _ = strconv.ParseInt(query.Get("partsize"), 10, 64)
+	if markers, err := strconv.ParseBool(query.Get("markers")); err == nil {
+		conf.NoMarkers = !markers
+	}
+
+	return nil
+}
@@ -0,0 +1,37 @@
+package s3
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strings"
+)
+
+const Driver = "s3"
+
+func init() {
+	filesystem.RegisterDriver(Driver, &s3Driver{})
+}
+
+type s3Driver struct {
+}
+
+// Open opens s3://key:secret@host/bucket/prefix?region=us-east-1, the bucket
+// is the first element of the path and the filesystem is rooted at the rest.
+// Without a host the service is AWS, the credentials come from the
+// environment when the DSN has none. An endpoint other than AWS is addressed
+// in path style unless pathstyle=false.
+func (d *s3Driver) Open(uri *url.URL) (filesystem.FileSystem, error) {
+	conf := &Config{Endpoint: uri.Host}
+	_ = conf.Decode(uri.Query())
+
+	conf.Bucket, conf.Prefix, _ = strings.Cut(strings.TrimPrefix(uri.Path, "/"), "/")
+	if uri.User != nil {
+		conf.AccessKey = uri.User.Username()
+		conf.SecretKey, _ = uri.User.Password()
+	}
+	if conf.Endpoint != "" && uri.Query().Get("pathstyle") == "" {
+		conf.PathStyle = true
+	}
+
+	return New(conf)
+}
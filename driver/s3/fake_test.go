@@ -0,0 +1,413 @@
+package s3
+
+import (
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+const (
+	fakeAccessKey = "AKIDEXAMPLE"
+	fakeSecretKey = "wJalrXUtnFEMI/K7MDENG+bPxRfiCYEXAMPLEKEY"
+)
+
+// fakeS3 is an in-process S3 service with one bucket in memory. It checks
+// the signature of every request, and the size of the parts of multipart
+// uploads like the service does.
+type fakeS3 struct {
+	*httptest.Server
+
+	bucket string
+
+	// pageSize is the most keys of a listing page, minPart the size of the
+	// smallest part but the last.
+	pageSize int
+	minPart  int
+
+	objects map[string]fakeObject
+	uploads map[string]map[int][]byte
+	seq     int
+
+	// calls counts the requests by operation.
+	calls map[string]int
+
+	mu sync.Mutex
+}
+
+type fakeObject struct {
+	data    []byte
+	modTime time.Time
+}
+
+func newFakeS3(t *testing.T) *fakeS3 {
+	f := &fakeS3{
+		bucket:   "bucket",
+		pageSize: 1000,
+		minPart:  minPartSize,
+		objects:  make(map[string]fakeObject),
+		uploads:  make(map[string]map[int][]byte),
+		calls:    make(map[string]int),
+	}
+	f.Server = httptest.NewServer(f)
+	t.Cleanup(f.Close)
+	return f
+}
+
+// dsn returns the DSN of the bucket with the options.
+func (f *fakeS3) dsn(options string) string {
+	u, _ := url.Parse(f.URL)
+	return fmt.Sprintf("s3://%s:%s@%s/%s?insecure=true%s", fakeAccessKey, url.QueryEscape(fakeSecretKey), u.Host, f.bucket, options)
+}
+
+func (f *fakeS3) keys() []string {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func (f *fakeS3) count(op string) int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	return f.calls[op]
+}
+
+func (f *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, err := io.ReadAll(r.Body)
+	if err != nil {
+		fakeError(w, http.StatusBadRequest, "IncompleteBody")
+		return
+	}
+	if !f.verify(r, body) {
+		fakeError(w, http.StatusForbidden, "SignatureDoesNotMatch")
+		return
+	}
+
+	bucket, key, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+	if bucket != f.bucket {
+		fakeError(w, http.StatusNotFound, "NoSuchBucket")
+		return
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	query := r.URL.Query()
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		f.calls["list"]++
+		f.list(w, query)
+	case r.Method == http.MethodPost && query.Has("delete"):
+		f.calls["deletemany"]++
+		f.deleteMany(w, r, body)
+	case r.Method == http.MethodPost && query.Has("uploads"):
+		f.calls["createupload"]++
+		f.seq++
+		id := strconv.Itoa(f.seq)
+		f.uploads[id] = make(map[int][]byte)
+		fakeXML(w, struct {
+			XMLName  xml.Name `xml:"InitiateMultipartUploadResult"`
+			UploadID string   `xml:"UploadId"`
+		}{UploadID: id})
+	case r.Method == http.MethodPut && query.Has("uploadId"):
+		f.calls["uploadpart"]++
+		f.uploadPart(w, r, query, body)
+	case r.Method == http.MethodPost && query.Has("uploadId"):
+		f.calls["completeupload"]++
+		f.complete(w, key, query.Get("uploadId"), body)
+	case r.Method == http.MethodDelete && query.Has("uploadId"):
+		f.calls["abortupload"]++
+		delete(f.uploads, query.Get("uploadId"))
+		w.WriteHeader(http.StatusNoContent)
+	case r.Method == http.MethodPut && r.Header.Get("X-Amz-Copy-Source") != "":
+		f.calls["copy"]++
+		data, ok := f.source(w, r)
+		if ok {
+			f.objects[key] = fakeObject{data: data, modTime: time.Now()}
+			fakeXML(w, struct {
+				XMLName xml.Name `xml:"CopyObjectResult"`
+				ETag    string   `xml:"ETag"`
+			}{ETag: etag(data)})
+		}
+	case r.Method == http.MethodPut:
+		f.calls["put"]++
+		f.objects[key] = fakeObject{data: body, modTime: time.Now()}
+		w.Header().Set("ETag", etag(body))
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		f.calls[strings.ToLower(r.Method)]++
+		f.get(w, r, key)
+	case r.Method == http.MethodDelete:
+		f.calls["delete"]++
+		delete(f.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		fakeError(w, http.StatusMethodNotAllowed, "MethodNotAllowed")
+	}
+}
+
+// verify checks the signature of the request with the secret key.
+func (f *fakeS3) verify(r *http.Request, body []byte) bool {
+	auth := strings.TrimPrefix(r.Header.Get("Authorization"), "AWS4-HMAC-SHA256 ")
+	fields := map[string]string{}
+	for _, field := range strings.Split(auth, ", ") {
+		k, v, _ := strings.Cut(field, "=")
+		fields[k] = v
+	}
+
+	credential := strings.SplitN(fields["Credential"], "/", 2)
+	if len(credential) != 2 || credential[0] != fakeAccessKey {
+		return false
+	}
+
+	sum := sha256.Sum256(body)
+	payload := hex.EncodeToString(sum[:])
+	if r.Header.Get("X-Amz-Content-Sha256") != payload {
+		return false
+	}
+
+	signed := strings.Split(fields["SignedHeaders"], ";")
+	canonical := canonicalRequest(r, signed, payload)
+	return signature(fakeSecretKey, credential[1], r.Header.Get("X-Amz-Date"), canonical) == fields["Signature"]
+}
+
+func (f *fakeS3) list(w http.ResponseWriter, query url.Values) {
+	prefix, delimiter := query.Get("prefix"), query.Get("delimiter")
+	max := f.pageSize
+	if n, err := strconv.Atoi(query.Get("max-keys")); err == nil && n < max {
+		max = n
+	}
+
+	keys := make([]string, 0, len(f.objects))
+	for k := range f.objects {
+		if strings.HasPrefix(k, prefix) && k > query.Get("continuation-token") {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	result := listResult{}
+	seen := map[string]bool{}
+	for _, k := range keys {
+		if len(result.Contents)+len(result.CommonPrefixes) == max {
+			result.IsTruncated = true
+			break
+		}
+
+		if i := strings.Index(k[len(prefix):], delimiter); delimiter != "" && i >= 0 {
+			common := k[:len(prefix)+i+len(delimiter)]
+			if !seen[common] {
+				seen[common] = true
+				result.CommonPrefixes = append(result.CommonPrefixes, common)
+			}
+			result.NextContinuationToken = common + "\xff"
+			continue
+		}
+
+		obj := f.objects[k]
+		result.Contents = append(result.Contents, object{Key: k, Size: int64(len(obj.data)), LastModified: obj.modTime, ETag: etag(obj.data)})
+		result.NextContinuationToken = k
+	}
+	if !result.IsTruncated {
+		result.NextContinuationToken = ""
+	}
+
+	type prefixEntry struct {
+		Prefix string `xml:"Prefix"`
+	}
+	doc := struct {
+		XMLName               xml.Name      `xml:"ListBucketResult"`
+		Contents              []object      `xml:"Contents"`
+		CommonPrefixes        []prefixEntry `xml:"CommonPrefixes"`
+		IsTruncated           bool          `xml:"IsTruncated"`
+		NextContinuationToken string        `xml:"NextContinuationToken,omitempty"`
+	}{Contents: result.Contents, IsTruncated: result.IsTruncated, NextContinuationToken: result.NextContinuationToken}
+	for _, p := range result.CommonPrefixes {
+		doc.CommonPrefixes = append(doc.CommonPrefixes, prefixEntry{p})
+	}
+	fakeXML(w, doc)
+}
+
+func (f *fakeS3) deleteMany(w http.ResponseWriter, r *http.Request, body []byte) {
+	sum := md5.Sum(body)
+	if r.Header.Get("Content-Md5") != base64.StdEncoding.EncodeToString(sum[:]) {
+		fakeError(w, http.StatusBadRequest, "InvalidDigest")
+		return
+	}
+
+	var doc struct {
+		Objects []struct {
+			Key string `xml:"Key"`
+		} `xml:"Object"`
+	}
+	if err := xml.Unmarshal(body, &doc); err != nil || len(doc.Objects) > deleteBatch {
+		fakeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+	for _, obj := range doc.Objects {
+		delete(f.objects, obj.Key)
+	}
+	fakeXML(w, struct {
+		XMLName xml.Name `xml:"DeleteResult"`
+	}{})
+}
+
+// source returns the range of the object a copy request reads.
+func (f *fakeS3) source(w http.ResponseWriter, r *http.Request) ([]byte, bool) {
+	source, err := url.PathUnescape(r.Header.Get("X-Amz-Copy-Source"))
+	if err != nil || !strings.HasPrefix(source, "/"+f.bucket+"/") {
+		fakeError(w, http.StatusBadRequest, "InvalidArgument")
+		return nil, false
+	}
+
+	obj, ok := f.objects[strings.TrimPrefix(source, "/"+f.bucket+"/")]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchKey")
+		return nil, false
+	}
+
+	data := obj.data
+	if rng := r.Header.Get("X-Amz-Copy-Source-Range"); rng != "" {
+		var start, end int
+		if _, err := fmt.Sscanf(rng, "bytes=%d-%d", &start, &end); err != nil || end >= len(data) || start > end {
+			fakeError(w, http.StatusBadRequest, "InvalidArgument")
+			return nil, false
+		}
+		data = data[start : end+1]
+	}
+	return append([]byte(nil), data...), true
+}
+
+func (f *fakeS3) uploadPart(w http.ResponseWriter, r *http.Request, query url.Values, body []byte) {
+	parts, ok := f.uploads[query.Get("uploadId")]
+	n, err := strconv.Atoi(query.Get("partNumber"))
+	if !ok || err != nil || n < 1 || n > 10000 {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	if r.Header.Get("X-Amz-Copy-Source") != "" {
+		data, ok := f.source(w, r)
+		if !ok {
+			return
+		}
+		parts[n] = data
+		fakeXML(w, struct {
+			XMLName xml.Name `xml:"CopyPartResult"`
+			ETag    string   `xml:"ETag"`
+		}{ETag: etag(data)})
+		return
+	}
+
+	parts[n] = body
+	w.Header().Set("ETag", etag(body))
+}
+
+func (f *fakeS3) complete(w http.ResponseWriter, key, id string, body []byte) {
+	parts, ok := f.uploads[id]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchUpload")
+		return
+	}
+
+	var doc struct {
+		Parts []completedPart `xml:"Part"`
+	}
+	if err := xml.Unmarshal(body, &doc); err != nil || len(doc.Parts) == 0 {
+		fakeError(w, http.StatusBadRequest, "MalformedXML")
+		return
+	}
+
+	var data []byte
+	for i, part := range doc.Parts {
+		p, ok := parts[part.PartNumber]
+		if !ok || part.PartNumber != i+1 || part.ETag != etag(p) {
+			fakeError(w, http.StatusBadRequest, "InvalidPart")
+			return
+		}
+		if i < len(doc.Parts)-1 && len(p) < f.minPart {
+			fakeError(w, http.StatusBadRequest, "EntityTooSmall")
+			return
+		}
+		data = append(data, p...)
+	}
+
+	delete(f.uploads, id)
+	f.objects[key] = fakeObject{data: data, modTime: time.Now()}
+	fakeXML(w, struct {
+		XMLName xml.Name `xml:"CompleteMultipartUploadResult"`
+		Key     string   `xml:"Key"`
+	}{Key: key})
+}
+
+func (f *fakeS3) get(w http.ResponseWriter, r *http.Request, key string) {
+	obj, ok := f.objects[key]
+	if !ok {
+		fakeError(w, http.StatusNotFound, "NoSuchKey")
+		return
+	}
+
+	w.Header().Set("Last-Modified", obj.modTime.UTC().Format(http.TimeFormat))
+	w.Header().Set("ETag", etag(obj.data))
+
+	data, status := obj.data, http.StatusOK
+	if rng := r.Header.Get("Range"); rng != "" {
+		start, end := 0, len(data)-1
+		spec := strings.TrimPrefix(rng, "bytes=")
+		from, to, _ := strings.Cut(spec, "-")
+		start, err := strconv.Atoi(from)
+		if to != "" {
+			end, _ = strconv.Atoi(to)
+		}
+		if err != nil || start >= len(data) {
+			fakeError(w, http.StatusRequestedRangeNotSatisfiable, "InvalidRange")
+			return
+		}
+		if end >= len(data) {
+			end = len(data) - 1
+		}
+		w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, end, len(data)))
+		data, status = data[start:end+1], http.StatusPartialContent
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(len(data)))
+	w.WriteHeader(status)
+	if r.Method == http.MethodGet {
+		_, _ = w.Write(data)
+	}
+}
+
+func fakeXML(w http.ResponseWriter, v interface{}) {
+	data, _ := xml.Marshal(v)
+	w.Header().Set("Content-Type", "application/xml")
+	_, _ = w.Write(append([]byte(xml.Header), data...))
+}
+
+func fakeError(w http.ResponseWriter, status int, code string) {
+	w.Header().Set("Content-Type", "application/xml")
+	w.WriteHeader(status)
+	_, _ = fmt.Fprintf(w, "%s<Error><Code>%s</Code><Message>%s</Message></Error>", xml.Header, code, code)
+}
+
+func etag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
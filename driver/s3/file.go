@@ -0,0 +1,358 @@
+package s3
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"path"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | 0755
+	}
+	return 0644
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// s3File reads an object: Read streams it from a range request starting at
+// the offset, which Seek moves, ReadAt requests the range it reads.
+type s3File struct {
+	filesystem.Handle
+
+	vfs  *s3Fs
+	name string
+	key  string
+	info *fileInfo
+
+	off int64
+
+	// body reads the object from pos on, nil until the next Read.
+	body io.ReadCloser
+	pos  int64
+}
+
+func (f *s3File) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+	if f.off >= f.info.size {
+		return 0, io.EOF
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if f.body != nil && f.pos != f.off {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	if f.body == nil {
+		body, err := f.vfs.client.get(f.key, f.off, -1)
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: err}
+		}
+		f.body, f.pos = body, f.off
+	}
+
+	n, err := f.body.Read(p)
+	f.off += int64(n)
+	f.pos += int64(n)
+	switch {
+	case err == io.EOF:
+		_ = f.body.Close()
+		f.body = nil
+		if n > 0 {
+			err = nil
+		}
+	case err != nil:
+		err = &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: err}
+	}
+	return n, err
+}
+
+func (f *s3File) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	closed := f.Closed()
+	f.Unlock()
+
+	if closed {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: syscall.EINVAL}
+	}
+	if off >= f.info.size {
+		return 0, io.EOF
+	}
+
+	n := int64(len(p))
+	if off+n > f.info.size {
+		n = f.info.size - off
+	}
+	body, err := f.vfs.client.get(f.key, off, n)
+	if err != nil {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: err}
+	}
+	defer body.Close()
+
+	read, err := io.ReadFull(body, p[:n])
+	if err != nil {
+		return read, &fs.PathError{Op: "read", Path: f.vfs.path(f.name), Err: err}
+	}
+	if read < len(p) {
+		return read, io.EOF
+	}
+	return read, nil
+}
+
+func (f *s3File) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.path(f.name), Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.info.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.path(f.name), Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *s3File) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.path(f.name), Err: syscall.EBADF}
+}
+
+func (f *s3File) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *s3File) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.path(f.name), Err: err}
+	}
+	if f.body != nil {
+		_ = f.body.Close()
+		f.body = nil
+	}
+	return nil
+}
+
+// s3Writer uploads the content written to it once it is closed, in the
+// parts of a multipart upload as soon as they fill up.
+type s3Writer struct {
+	filesystem.Handle
+
+	vfs  *s3Fs
+	name string
+	key  string
+
+	// buf holds what is written and not uploaded yet.
+	buf  []byte
+	size int64
+
+	upload string
+	parts  []completedPart
+
+	// err is the first error of an upload, the file fails once it has one.
+	err error
+}
+
+func (w *s3Writer) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Closed() {
+		return 0, &fs.PathError{Op: "write", Path: w.vfs.path(w.name), Err: fs.ErrClosed}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf = append(w.buf, p...)
+	w.size += int64(len(p))
+
+	partSize := int(w.vfs.config.PartSize)
+	for len(w.buf) >= partSize {
+		if err := w.flush(w.buf[:partSize]); err != nil {
+			w.err = &fs.PathError{Op: "write", Path: w.vfs.path(w.name), Err: err}
+			return len(p), w.err
+		}
+		w.buf = append(w.buf[:0], w.buf[partSize:]...)
+	}
+	return len(p), nil
+}
+
+// flush uploads the next part, starting the multipart upload with the first.
+func (w *s3Writer) flush(part []byte) error {
+	if w.upload == "" {
+		upload, err := w.vfs.client.createUpload(w.key)
+		if err != nil {
+			return err
+		}
+		w.upload = upload
+	}
+
+	etag, err := w.vfs.client.uploadPart(w.key, w.upload, len(w.parts)+1, part)
+	if err != nil {
+		return err
+	}
+	w.parts = append(w.parts, completedPart{PartNumber: len(w.parts) + 1, ETag: etag})
+	return nil
+}
+
+func (w *s3Writer) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.vfs.path(w.name), Err: syscall.EBADF}
+}
+
+func (w *s3Writer) Stat() (fs.FileInfo, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	return &fileInfo{name: path.Base("/" + rel(w.name)), size: w.size, modTime: time.Now()}, nil
+}
+
+// Close uploads the rest of the content: in one request when it fits in a
+// part, else as the last part of the upload.
+func (w *s3Writer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.path(w.name), Err: err}
+	}
+
+	err := w.err
+	switch {
+	case err != nil:
+	case w.upload == "":
+		err = w.vfs.client.put(w.key, w.buf)
+	case len(w.buf) > 0:
+		err = w.flush(w.buf)
+	}
+	if err == nil && w.upload != "" {
+		err = w.vfs.client.completeUpload(w.key, w.upload, w.parts)
+	} else if w.upload != "" {
+		_ = w.vfs.client.abortUpload(w.key, w.upload)
+	}
+	w.buf = nil
+
+	if err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.path(w.name), Err: err}
+	}
+	return nil
+}
+
+// s3Dir lists a directory on its first ReadDir.
+type s3Dir struct {
+	filesystem.Handle
+
+	vfs  *s3Fs
+	name string
+	info *fileInfo
+
+	list []fs.DirEntry
+	read bool
+	off  int
+}
+
+func (d *s3Dir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.path(d.name), Err: fs.ErrClosed}
+	}
+	if !d.read {
+		list, err := d.vfs.readDir(d.name)
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.vfs.path(d.name), Err: err}
+		}
+		d.list, d.read = list, true
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *s3Dir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *s3Dir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *s3Dir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *s3Dir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.path(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*s3Dir)(nil)
+	_ io.ReaderAt            = (*s3File)(nil)
+	_ io.Seeker              = (*s3File)(nil)
+)
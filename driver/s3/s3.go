@@ -0,0 +1,723 @@
+package s3
+
+import (
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+)
+
+// A file is an object, a directory is the prefix of the objects below it.
+// Mkdir writes a marker, an empty object named after the directory with a
+// trailing slash, so that the directory exists while it is empty; a listing
+// shows the directories of the objects below a prefix whether they have a
+// marker or not. Rename copies the objects, then deletes the originals: it
+// is not atomic, and a directory is renamed one object at a time.
+
+const (
+	defaultRegion = "us-east-1"
+
+	defaultPartSize = 8 << 20
+	minPartSize     = 5 << 20
+
+	// deleteBatch is the most objects a request deletes.
+	deleteBatch = 1000
+)
+
+// maxCopySize is the size of the largest object a single request copies.
+var maxCopySize int64 = 5 << 30
+
+// s3Fs is a filesystem on the objects of a bucket below a prefix.
+type s3Fs struct {
+	client *client
+	config *Config
+
+	// root is the prefix of the keys of the filesystem, empty or ending
+	// with a slash.
+	root string
+
+	// life tracks the objects open through the filesystem and its Sub
+	// views, only the owner closes it and the idle connections of client.
+	life  *filesystem.Tracker
+	owner bool
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if config.Bucket == "" {
+		return nil, errors.New("bucket is required")
+	}
+	if config.Region == "" {
+		config.Region = defaultRegion
+	}
+	if config.AccessKey == "" {
+		config.AccessKey = os.Getenv("AWS_ACCESS_KEY_ID")
+		config.SecretKey = os.Getenv("AWS_SECRET_ACCESS_KEY")
+		config.SessionToken = os.Getenv("AWS_SESSION_TOKEN")
+	}
+	switch {
+	case config.PartSize == 0:
+		config.PartSize = defaultPartSize
+	case config.PartSize < minPartSize:
+		config.PartSize = minPartSize
+	}
+
+	endpoint := &url.URL{Scheme: "https", Host: config.Endpoint}
+	if config.Insecure {
+		endpoint.Scheme = "http"
+	}
+	if endpoint.Host == "" {
+		endpoint.Host = "s3." + config.Region + ".amazonaws.com"
+	}
+
+	vfs := &s3Fs{
+		client: &client{
+			http:      &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()},
+			endpoint:  endpoint,
+			bucket:    config.Bucket,
+			region:    config.Region,
+			pathStyle: config.PathStyle,
+			accessKey: config.AccessKey,
+			secretKey: config.SecretKey,
+			token:     config.SessionToken,
+		},
+		config: config,
+		life:   &filesystem.Tracker{},
+		owner:  true,
+	}
+
+	if prefix := strings.Trim(config.Prefix, "/"); prefix != "" {
+		if err := vfs.MkdirAll(prefix, 0755); err != nil {
+			return nil, err
+		}
+		vfs.root = prefix + "/"
+	}
+	return vfs, nil
+}
+
+func (vfs *s3Fs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	info, err := vfs.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+
+	if info.dir {
+		d := &s3Dir{vfs: vfs, name: name, info: info}
+		if err := d.Track(vfs.life, vfs.path(name), d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	f := &s3File{vfs: vfs, name: name, key: vfs.key(name), info: info}
+	if err := f.Track(vfs.life, vfs.path(name), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create writes an empty object, the content written to the file replaces
+// it once the file is closed.
+func (vfs *s3Fs) Create(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	key, err := vfs.writable(name)
+	if err == nil {
+		err = vfs.client.put(key, nil)
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+
+	w := &s3Writer{vfs: vfs, name: name, key: key}
+	if err := w.Track(vfs.life, vfs.path(name), w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (vfs *s3Fs) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	err := vfs.mkdir(name)
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+func (vfs *s3Fs) mkdir(name string) error {
+	if rel(name) == "" {
+		return fs.ErrExist
+	}
+	if err := vfs.parent(name); err != nil {
+		return err
+	}
+
+	if _, err := vfs.stat(name); err == nil {
+		return fs.ErrExist
+	} else if !errors.Is(err, fs.ErrNotExist) {
+		return err
+	}
+	return vfs.marker(vfs.key(name))
+}
+
+// MkdirAll writes the markers of the missing directories of the path.
+func (vfs *s3Fs) MkdirAll(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	p := rel(name)
+	if p == "" {
+		return nil
+	}
+
+	elems := strings.Split(p, "/")
+	for i := range elems {
+		dir := strings.Join(elems[:i+1], "/")
+
+		info, err := vfs.stat(dir)
+		switch {
+		case err == nil && !info.dir:
+			return &fs.PathError{Op: "mkdir", Path: vfs.path(dir), Err: syscall.ENOTDIR}
+		case err == nil:
+			continue
+		case !errors.Is(err, fs.ErrNotExist):
+			return &fs.PathError{Op: "mkdir", Path: vfs.path(dir), Err: err}
+		}
+
+		// the rest of the path is missing as well
+		for j := i; j < len(elems); j++ {
+			dir := strings.Join(elems[:j+1], "/")
+			if err := vfs.marker(vfs.key(dir)); err != nil {
+				return &fs.PathError{Op: "mkdir", Path: vfs.path(dir), Err: err}
+			}
+		}
+		return nil
+	}
+	return nil
+}
+
+// marker writes the marker of the directory at key, unless markers are off.
+func (vfs *s3Fs) marker(key string) error {
+	if vfs.config.NoMarkers {
+		return nil
+	}
+	return vfs.client.put(key+"/", nil)
+}
+
+func (vfs *s3Fs) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
+
+	err := vfs.remove(name)
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+func (vfs *s3Fs) remove(name string) error {
+	if rel(name) == "" {
+		return syscall.EBUSY
+	}
+
+	info, err := vfs.stat(name)
+	if err != nil {
+		return err
+	}
+	key := vfs.key(name)
+	if !info.dir {
+		return vfs.client.delete(key)
+	}
+
+	page, err := vfs.client.list(key+"/", "", "", 2)
+	if err != nil {
+		return err
+	}
+	for _, obj := range page.Contents {
+		if obj.Key != key+"/" {
+			return syscall.ENOTEMPTY
+		}
+	}
+	return vfs.client.delete(key + "/")
+}
+
+// RemoveAll deletes the object of the name and every object below it, the
+// root keeps its marker.
+func (vfs *s3Fs) RemoveAll(name string) error {
+	if err := vfs.closed("unlinkat", name); err != nil {
+		return err
+	}
+
+	err := vfs.removeAll(name)
+	if err != nil {
+		return &fs.PathError{Op: "unlinkat", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+func (vfs *s3Fs) removeAll(name string) error {
+	prefix := vfs.root
+	if p := rel(name); p != "" {
+		if err := vfs.client.delete(vfs.root + p); err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		prefix = vfs.root + p + "/"
+	}
+
+	return vfs.client.walk(prefix, "", func(page *listResult) error {
+		keys := make([]string, 0, len(page.Contents))
+		for _, obj := range page.Contents {
+			if obj.Key != vfs.root {
+				keys = append(keys, obj.Key)
+			}
+		}
+		return vfs.deleteAll(keys)
+	})
+}
+
+func (vfs *s3Fs) deleteAll(keys []string) error {
+	for len(keys) > 0 {
+		n := len(keys)
+		if n > deleteBatch {
+			n = deleteBatch
+		}
+		if err := vfs.client.deleteMany(keys[:n]); err != nil {
+			return err
+		}
+		keys = keys[n:]
+	}
+	return nil
+}
+
+// Rename copies the file, or every object below the directory, to the new
+// name and deletes the originals once all of them are copied.
+func (vfs *s3Fs) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
+
+	err := vfs.rename(oldpath, newpath)
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: vfs.path(oldpath), New: vfs.path(newpath), Err: err}
+	}
+	return nil
+}
+
+func (vfs *s3Fs) rename(oldpath, newpath string) error {
+	po, pn := rel(oldpath), rel(newpath)
+	if po == "" || pn == "" {
+		return syscall.EBUSY
+	}
+
+	src, err := vfs.stat(po)
+	if err != nil {
+		return err
+	}
+	if po == pn {
+		return nil
+	}
+	if err := vfs.parent(pn); err != nil {
+		return err
+	}
+
+	dst, err := vfs.stat(pn)
+	switch {
+	case err == nil && src.dir && !dst.dir:
+		return syscall.ENOTDIR
+	case err == nil && !src.dir && dst.dir:
+		return syscall.EISDIR
+	case err == nil && src.dir:
+		page, err := vfs.client.list(vfs.key(pn)+"/", "", "", 2)
+		if err != nil {
+			return err
+		}
+		for _, obj := range page.Contents {
+			if obj.Key != vfs.key(pn)+"/" {
+				return syscall.ENOTEMPTY
+			}
+		}
+	case err != nil && !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	okey, nkey := vfs.key(po), vfs.key(pn)
+	if !src.dir {
+		if err := vfs.client.copy(okey, nkey, src.size); err != nil {
+			return err
+		}
+		return vfs.client.delete(okey)
+	}
+	if strings.HasPrefix(pn+"/", po+"/") {
+		return syscall.EINVAL
+	}
+
+	var objects []object
+	err = vfs.client.walk(okey+"/", "", func(page *listResult) error {
+		objects = append(objects, page.Contents...)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	keys := make([]string, 0, len(objects))
+	for _, obj := range objects {
+		if err := vfs.client.copy(obj.Key, nkey+strings.TrimPrefix(obj.Key, okey), obj.Size); err != nil {
+			return err
+		}
+		keys = append(keys, obj.Key)
+	}
+	if len(objects) == 0 {
+		// a directory without a marker or objects is only the implicit
+		// parent of nothing
+		if err := vfs.marker(nkey); err != nil {
+			return err
+		}
+	}
+	return vfs.deleteAll(keys)
+}
+
+func (vfs *s3Fs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+
+	info, err := vfs.stat(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: vfs.path(name), Err: err}
+	}
+	return info, nil
+}
+
+// stat finds the object of the name, or else the objects below it.
+func (vfs *s3Fs) stat(name string) (*fileInfo, error) {
+	p := rel(name)
+	if p == "" {
+		return &fileInfo{name: path.Base("/" + vfs.root), dir: true}, nil
+	}
+	key := vfs.root + p
+
+	obj, err := vfs.client.head(key)
+	if err == nil {
+		return &fileInfo{name: path.Base(p), size: obj.Size, modTime: obj.LastModified}, nil
+	}
+	if !errors.Is(err, fs.ErrNotExist) {
+		return nil, err
+	}
+
+	page, err := vfs.client.list(key+"/", "", "", 1)
+	if err != nil {
+		return nil, err
+	}
+	if len(page.Contents) == 0 {
+		return nil, fs.ErrNotExist
+	}
+
+	info := &fileInfo{name: path.Base(p), dir: true}
+	if marker := page.Contents[0]; marker.Key == key+"/" {
+		info.modTime = marker.LastModified
+	}
+	return info, nil
+}
+
+// parent checks that the parent directory of the name exists. Without
+// markers any missing directory is implicit, only a file is in the way.
+func (vfs *s3Fs) parent(name string) error {
+	dir := path.Dir(rel(name))
+	if dir == "." {
+		return nil
+	}
+
+	info, err := vfs.stat(dir)
+	if errors.Is(err, fs.ErrNotExist) && vfs.config.NoMarkers {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if !info.dir {
+		return syscall.ENOTDIR
+	}
+	return nil
+}
+
+// writable returns the key of the file to write, whose parent must exist
+// and which must not be a directory.
+func (vfs *s3Fs) writable(name string) (string, error) {
+	p := rel(name)
+	if p == "" {
+		return "", syscall.EISDIR
+	}
+	if err := vfs.parent(p); err != nil {
+		return "", err
+	}
+
+	key := vfs.root + p
+	page, err := vfs.client.list(key+"/", "", "", 1)
+	if err != nil {
+		return "", err
+	}
+	if len(page.Contents) > 0 {
+		return "", syscall.EISDIR
+	}
+	return key, nil
+}
+
+// ReadDir lists the directory, the directories below it are the common
+// prefixes of the listing.
+func (vfs *s3Fs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+
+	list, err := vfs.readDir(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: vfs.path(name), Err: err}
+	}
+	return list, nil
+}
+
+func (vfs *s3Fs) readDir(name string) ([]fs.DirEntry, error) {
+	prefix := vfs.root
+	if p := rel(name); p != "" {
+		prefix += p + "/"
+	}
+
+	var list []fs.DirEntry
+	found := false
+	err := vfs.client.walk(prefix, "/", func(page *listResult) error {
+		for _, dir := range page.CommonPrefixes {
+			found = true
+			name := strings.TrimSuffix(strings.TrimPrefix(dir, prefix), "/")
+			list = append(list, fs.FileInfoToDirEntry(&fileInfo{name: name, dir: true}))
+		}
+		for _, obj := range page.Contents {
+			found = true
+			if obj.Key == prefix {
+				continue
+			}
+			info := &fileInfo{name: strings.TrimPrefix(obj.Key, prefix), size: obj.Size, modTime: obj.LastModified}
+			list = append(list, fs.FileInfoToDirEntry(info))
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	if !found && prefix != vfs.root {
+		// a file, or nothing
+		if _, err := vfs.client.head(strings.TrimSuffix(prefix, "/")); err != nil {
+			return nil, err
+		}
+		return nil, syscall.ENOTDIR
+	}
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (vfs *s3Fs) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	body, err := vfs.client.get(vfs.key(name), 0, -1)
+	if err != nil {
+		if errors.Is(err, fs.ErrNotExist) && vfs.IsDir(name) {
+			err = syscall.EISDIR
+		}
+		return nil, &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+	defer body.Close()
+
+	return io.ReadAll(body)
+}
+
+// WriteFile puts the object in one request.
+func (vfs *s3Fs) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
+
+	key, err := vfs.writable(name)
+	if err == nil {
+		err = vfs.client.put(key, data)
+	}
+	if err != nil {
+		return &fs.PathError{Op: "open", Path: vfs.path(name), Err: err}
+	}
+	return nil
+}
+
+// DiskUsage sums the sizes of the objects below the name from a listing.
+func (vfs *s3Fs) DiskUsage(name string) (*filesystem.DirUsage, error) {
+	if err := vfs.closed("du", name); err != nil {
+		return nil, err
+	}
+
+	usage, err := vfs.diskUsage(name)
+	if err != nil {
+		return nil, &fs.PathError{Op: "du", Path: vfs.path(name), Err: err}
+	}
+	return usage, nil
+}
+
+func (vfs *s3Fs) diskUsage(name string) (*filesystem.DirUsage, error) {
+	prefix := vfs.root
+	if p := rel(name); p != "" {
+		obj, err := vfs.client.head(vfs.root + p)
+		if err == nil {
+			return &filesystem.DirUsage{Size: obj.Size, Files: 1}, nil
+		}
+		if !errors.Is(err, fs.ErrNotExist) {
+			return nil, err
+		}
+		prefix += p + "/"
+	}
+
+	usage := &filesystem.DirUsage{}
+	dirs := make(map[string]bool)
+	found := false
+	err := vfs.client.walk(prefix, "", func(page *listResult) error {
+		for _, obj := range page.Contents {
+			found = true
+			rest := strings.TrimPrefix(obj.Key, prefix)
+			if rest == "" {
+				continue
+			}
+			if strings.HasSuffix(rest, "/") {
+				dirs[strings.TrimSuffix(rest, "/")] = true
+			} else {
+				usage.Size += obj.Size
+				usage.Files++
+			}
+			for dir := path.Dir(strings.TrimSuffix(rest, "/")); dir != "."; dir = path.Dir(dir) {
+				dirs[dir] = true
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if !found && prefix != vfs.root {
+		return nil, fs.ErrNotExist
+	}
+
+	usage.Dirs = int64(len(dirs))
+	return usage, nil
+}
+
+func (vfs *s3Fs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	info, err := vfs.stat(dir)
+	if err == nil && !info.dir {
+		err = syscall.ENOTDIR
+	}
+	if err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: vfs.path(dir), Err: err}
+	}
+
+	root := vfs.key(dir)
+	if root != "" {
+		root += "/"
+	}
+	return &s3Fs{
+		client: vfs.client,
+		config: vfs.config,
+		root:   root,
+		life:   vfs.life,
+	}, nil
+}
+
+func (vfs *s3Fs) Exists(name string) bool {
+	if vfs.life.Closed() {
+		return false
+	}
+	_, err := vfs.stat(name)
+	return err == nil
+}
+
+func (vfs *s3Fs) IsFile(name string) bool {
+	if vfs.life.Closed() {
+		return false
+	}
+	info, err := vfs.stat(name)
+	return err == nil && !info.dir
+}
+
+func (vfs *s3Fs) IsDir(name string) bool {
+	if vfs.life.Closed() {
+		return false
+	}
+	info, err := vfs.stat(name)
+	return err == nil && info.dir
+}
+
+// Close closes the files still open on the filesystem, the uploads of the
+// files being written complete, and the idle connections.
+func (vfs *s3Fs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.life.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.path("/"), Err: err}
+	}
+
+	vfs.client.http.CloseIdleConnections()
+	return nil
+}
+
+func (vfs *s3Fs) OpenFiles() []string {
+	return vfs.life.OpenFiles()
+}
+
+// closed fails op on the object of name once the owner is closed, the
+// client is still usable but the filesystem is not.
+func (vfs *s3Fs) closed(op, name string) error {
+	if vfs.life.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.path(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// key returns the key of the object of the name.
+func (vfs *s3Fs) key(name string) string {
+	return vfs.root + rel(name)
+}
+
+// path returns the name as a path in the bucket, for errors.
+func (vfs *s3Fs) path(name string) string {
+	return "/" + vfs.config.Bucket + "/" + vfs.key(name)
+}
+
+// rel returns the cleaned name without its leading slash, empty for the
+// root.
+func rel(name string) string {
+	return strings.TrimPrefix(path.Clean("/"+name), "/")
+}
@@ -0,0 +1,93 @@
+package sftp
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Config struct {
+	filesystem.Config
+
+	// Addr is the host of the server, and its port, 22 when it has none.
+	Addr string
+
+	// Root is the directory the filesystem is rooted at, the working
+	// directory of the server when empty.
+	Root string
+
+	User     string
+	Password string
+
+	// KeyFile is the path of a private key to authenticate with, besides
+	// the password.
+	KeyFile string
+
+	// Passphrase decrypts the private key.
+	Passphrase string
+
+	// KnownHosts is the path of the known_hosts file the key of the server
+	// is verified against, ~/.ssh/known_hosts by default.
+	KnownHosts string
+
+	// Insecure accepts any host key.
+	Insecure bool
+
+	// Timeout bounds the time to connect, 30s by default.
+	Timeout time.Duration
+}
+
+func (conf *Config) Driver() string {
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	return conf.Addr
+}
+
+func (conf *Config) Path() string {
+	return conf.Root
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if conf.User == "" {
+		return nil
+	}
+	if conf.Password == "" {
+		return url.User(conf.User)
+	}
+	return url.UserPassword(conf.User, conf.Password)
+}
+
+// Encode the key, its passphrase, the host checks and the timeout
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if conf.KeyFile != "" {
+		values.Set("key", conf.KeyFile)
+	}
+	if conf.Passphrase != "" {
+		values.Set("passphrase", conf.Passphrase)
+	}
+	if conf.KnownHosts != "" {
+		values.Set("knownhosts", conf.KnownHosts)
+	}
+	if conf.Insecure {
+		values.Set("insecure", "true")
+	}
+	if conf.Timeout != 0 {
+		values.Set("timeout", conf.Timeout.String())
+	}
+	return values
+}
+
+// Decode the key, its passphrase, the host checks and the timeout
+func (conf *Config) Decode(query url.Values) error {
+	conf.KeyFile = query.Get("key")
+	conf.Passphrase = query.Get("passphrase")
+	conf.KnownHosts = query.Get("knownhosts")
+	conf.Insecure, _ = strconv.ParseBool(query.Get("insecure"))
+	conf.Timeout, _ = time.ParseDuration(query.Get("timeout"))
+
+	return nil
+}
@@ -0,0 +1,171 @@
+package sftp
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"github.com/pkg/sftp"
+	"io"
+	"io/fs"
+	"syscall"
+)
+
+// sftpFile is an open file the filesystem tracks. The client does not know a
+// closed file from another, so the file fails with fs.ErrClosed on its own.
+// The lock guards the check only, the client serves concurrent requests.
+type sftpFile struct {
+	filesystem.Handle
+
+	file *sftp.File
+}
+
+// check returns the error of op on a closed file.
+func (f *sftpFile) check(op string) error {
+	f.Lock()
+	closed := f.Closed()
+	f.Unlock()
+
+	if closed {
+		return &fs.PathError{Op: op, Path: f.file.Name(), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+func (f *sftpFile) Read(p []byte) (int, error) {
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	return f.file.Read(p)
+}
+
+func (f *sftpFile) ReadAt(p []byte, off int64) (int, error) {
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	return f.file.ReadAt(p, off)
+}
+
+// WriteTo reads the file with concurrent requests, for io.Copy.
+func (f *sftpFile) WriteTo(w io.Writer) (int64, error) {
+	if err := f.check("read"); err != nil {
+		return 0, err
+	}
+	return f.file.WriteTo(w)
+}
+
+func (f *sftpFile) Write(p []byte) (int, error) {
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	return f.file.Write(p)
+}
+
+func (f *sftpFile) WriteAt(p []byte, off int64) (int, error) {
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	return f.file.WriteAt(p, off)
+}
+
+// ReadFrom writes the file with concurrent requests, for io.Copy.
+func (f *sftpFile) ReadFrom(r io.Reader) (int64, error) {
+	if err := f.check("write"); err != nil {
+		return 0, err
+	}
+	return f.file.ReadFrom(r)
+}
+
+func (f *sftpFile) Seek(offset int64, whence int) (int64, error) {
+	if err := f.check("seek"); err != nil {
+		return 0, err
+	}
+	return f.file.Seek(offset, whence)
+}
+
+func (f *sftpFile) Stat() (fs.FileInfo, error) {
+	if err := f.check("stat"); err != nil {
+		return nil, err
+	}
+	return f.file.Stat()
+}
+
+func (f *sftpFile) Close() error {
+	f.Lock()
+	err := f.MarkClosed()
+	f.Unlock()
+
+	if err != nil {
+		return &fs.PathError{Op: "close", Path: f.file.Name(), Err: err}
+	}
+	return f.file.Close()
+}
+
+// sftpDir is an open directory, listed on its first ReadDir.
+type sftpDir struct {
+	filesystem.Handle
+
+	vfs  *sftpFs
+	name string
+	info fs.FileInfo
+
+	list []fs.DirEntry
+	read bool
+	off  int
+}
+
+func (d *sftpDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.path(d.name), Err: fs.ErrClosed}
+	}
+	if !d.read {
+		list, err := d.vfs.readDir(d.name)
+		if err != nil {
+			return nil, d.vfs.wrap("readdir", d.name, err)
+		}
+		d.list, d.read = list, true
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *sftpDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *sftpDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.path(d.name), Err: syscall.EISDIR}
+}
+
+func (d *sftpDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *sftpDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.path(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*sftpDir)(nil)
+	_ io.ReaderAt            = (*sftpFile)(nil)
+	_ io.Seeker              = (*sftpFile)(nil)
+	_ io.WriterAt            = (*sftpFile)(nil)
+)
@@ -0,0 +1,182 @@
+package sftp
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/x509"
+	"encoding/pem"
+	"fmt"
+	"github.com/pkg/sftp"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+const (
+	testUser     = "vfs"
+	testPassword = "secret"
+)
+
+// sshServer is an SSH server running the SFTP subsystem on a temporary
+// directory, it accepts testUser with testPassword or the key in keyFile.
+type sshServer struct {
+	listener net.Listener
+	config   *ssh.ServerConfig
+
+	// dir is the directory the files are served from, the paths of the
+	// server are the paths of the host.
+	dir string
+
+	hostKey ssh.PublicKey
+
+	// keyFile holds the private key of the client, knownHosts the host key.
+	keyFile    string
+	knownHosts string
+
+	// conns counts the connections accepted.
+	conns int32
+
+	mu   sync.Mutex
+	open []net.Conn
+	wg   sync.WaitGroup
+}
+
+func newSSHServer(t *testing.T) *sshServer {
+	t.Helper()
+
+	_, hostKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	hostSigner, err := ssh.NewSignerFromKey(hostKey)
+	require.NoError(t, err)
+
+	clientPub, clientKey, err := ed25519.GenerateKey(rand.Reader)
+	require.NoError(t, err)
+	authorized, err := ssh.NewPublicKey(clientPub)
+	require.NoError(t, err)
+
+	tmp := t.TempDir()
+	s := &sshServer{
+		dir:        filepath.Join(tmp, "data"),
+		hostKey:    hostSigner.PublicKey(),
+		keyFile:    filepath.Join(tmp, "id_ed25519"),
+		knownHosts: filepath.Join(tmp, "known_hosts"),
+	}
+	require.NoError(t, os.Mkdir(s.dir, 0755))
+
+	der, err := x509.MarshalPKCS8PrivateKey(clientKey)
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(s.keyFile, pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der}), 0600))
+
+	s.config = &ssh.ServerConfig{
+		PasswordCallback: func(conn ssh.ConnMetadata, password []byte) (*ssh.Permissions, error) {
+			if conn.User() == testUser && string(password) == testPassword {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("password rejected for %s", conn.User())
+		},
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == testUser && string(key.Marshal()) == string(authorized.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+
+	s.listener, err = net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	require.NoError(t, os.WriteFile(s.knownHosts, []byte(knownhosts.Line([]string{s.listener.Addr().String()}, s.hostKey)+"\n"), 0600))
+
+	s.wg.Add(1)
+	go s.serve()
+	t.Cleanup(func() {
+		_ = s.listener.Close()
+		s.mu.Lock()
+		for _, conn := range s.open {
+			_ = conn.Close()
+		}
+		s.mu.Unlock()
+		s.wg.Wait()
+	})
+	return s
+}
+
+// login returns the config of a filesystem rooted at root in the served
+// directory, logging in with the password and knowing the host key.
+func (s *sshServer) login(root string) *Config {
+	return &Config{
+		Addr:       s.listener.Addr().String(),
+		Root:       filepath.Join(s.dir, root),
+		User:       testUser,
+		Password:   testPassword,
+		KnownHosts: s.knownHosts,
+	}
+}
+
+func (s *sshServer) serve() {
+	defer s.wg.Done()
+
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		atomic.AddInt32(&s.conns, 1)
+		s.mu.Lock()
+		s.open = append(s.open, conn)
+		s.mu.Unlock()
+
+		s.wg.Add(1)
+		go func() {
+			defer s.wg.Done()
+			s.handle(conn)
+		}()
+	}
+}
+
+// handle runs the SFTP subsystem on the sessions of the connection.
+func (s *sshServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	_, chans, reqs, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		return
+	}
+	go ssh.DiscardRequests(reqs)
+
+	for newChannel := range chans {
+		if newChannel.ChannelType() != "session" {
+			_ = newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			return
+		}
+
+		go func() {
+			for req := range requests {
+				ok := req.Type == "subsystem" && len(req.Payload) > 4 && string(req.Payload[4:]) == "sftp"
+				_ = req.Reply(ok, nil)
+				if !ok {
+					continue
+				}
+
+				go func() {
+					defer channel.Close()
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						return
+					}
+					_ = server.Serve()
+				}()
+			}
+		}()
+	}
+}
@@ -0,0 +1,589 @@
+// Package sftp implements filesystem.FileSystem on a directory of an SSH
+// server through the SFTP protocol.
+//
+// The filesystem keeps one connection, its Sub views share it and Close
+// closes it. Rename replaces an existing file with the posix-rename
+// extension when the server has it, OpenSSH does.
+package sftp
+
+import (
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/fs"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultPort    = "22"
+	defaultTimeout = 30 * time.Second
+
+	// posixRename is the extension renaming onto an existing file.
+	posixRename = "posix-rename@openssh.com"
+)
+
+type sftpFs struct {
+	config *Config
+
+	// root is the absolute path on the server the filesystem is rooted at.
+	root string
+
+	// conn is the SSH session the Sub views share, only the owner closes
+	// it.
+	conn  *sftpConn
+	owner bool
+}
+
+// sftpConn is the connection to the server and the files open on it.
+type sftpConn struct {
+	filesystem.Tracker
+
+	ssh    *ssh.Client
+	client *sftp.Client
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if config.Addr == "" {
+		return nil, fs.ErrInvalid
+	}
+
+	clientConfig, err := config.clientConfig()
+	if err != nil {
+		return nil, err
+	}
+
+	addr := config.Addr
+	if _, _, err := net.SplitHostPort(addr); err != nil {
+		addr = net.JoinHostPort(strings.Trim(addr, "[]"), defaultPort)
+	}
+	sshClient, err := ssh.Dial("tcp", addr, clientConfig)
+	if err != nil {
+		return nil, err
+	}
+	client, err := sftp.NewClient(sshClient)
+	if err != nil {
+		_ = sshClient.Close()
+		return nil, err
+	}
+	conn := &sftpConn{ssh: sshClient, client: client}
+
+	root := config.Root
+	if root == "" {
+		if root, err = client.Getwd(); err != nil {
+			_ = conn.close()
+			return nil, err
+		}
+	}
+
+	vfs := &sftpFs{
+		config: config,
+		root:   path.Clean("/" + root),
+		conn:   conn,
+		owner:  true,
+	}
+	if err := vfs.mkdirAll(vfs.root, 0755); err != nil {
+		_ = conn.close()
+		return nil, err
+	}
+	return vfs, nil
+}
+
+// clientConfig returns the SSH configuration: the password and the key to
+// authenticate with, and how to verify the host.
+func (conf *Config) clientConfig() (*ssh.ClientConfig, error) {
+	var auth []ssh.AuthMethod
+	if conf.KeyFile != "" {
+		key, err := os.ReadFile(conf.KeyFile)
+		if err != nil {
+			return nil, err
+		}
+
+		var signer ssh.Signer
+		if conf.Passphrase != "" {
+			signer, err = ssh.ParsePrivateKeyWithPassphrase(key, []byte(conf.Passphrase))
+		} else {
+			signer, err = ssh.ParsePrivateKey(key)
+		}
+		if err != nil {
+			return nil, err
+		}
+		auth = append(auth, ssh.PublicKeys(signer))
+	}
+	if conf.Password != "" {
+		password := conf.Password
+		auth = append(auth, ssh.Password(password), ssh.KeyboardInteractive(
+			func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+				answers := make([]string, len(questions))
+				for i := range answers {
+					answers[i] = password
+				}
+				return answers, nil
+			}))
+	}
+
+	hostKey := ssh.InsecureIgnoreHostKey()
+	if !conf.Insecure {
+		file := conf.KnownHosts
+		if file == "" {
+			home, err := os.UserHomeDir()
+			if err != nil {
+				return nil, err
+			}
+			file = filepath.Join(home, ".ssh", "known_hosts")
+		}
+
+		var err error
+		if hostKey, err = knownhosts.New(file); err != nil {
+			return nil, err
+		}
+	}
+
+	user := conf.User
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	timeout := conf.Timeout
+	if timeout == 0 {
+		timeout = defaultTimeout
+	}
+
+	return &ssh.ClientConfig{
+		User:            user,
+		Auth:            auth,
+		HostKeyCallback: hostKey,
+		Timeout:         timeout,
+	}, nil
+}
+
+func (vfs *sftpFs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	info, err := vfs.conn.client.Stat(vfs.path(name))
+	if err != nil {
+		return nil, vfs.wrap("open", name, err)
+	}
+	if info.IsDir() {
+		dir := &sftpDir{vfs: vfs, name: name, info: info}
+		if err := dir.Track(&vfs.conn.Tracker, vfs.path(name), dir); err != nil {
+			return nil, err
+		}
+		return dir, nil
+	}
+	return vfs.openFile(name, os.O_RDONLY)
+}
+
+func (vfs *sftpFs) Create(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+	return vfs.openFile(name, os.O_RDWR|os.O_CREATE|os.O_TRUNC)
+}
+
+// OpenFile opens the named file for reading, like the os driver.
+func (vfs *sftpFs) OpenFile(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+	return vfs.openFile(name, os.O_RDONLY)
+}
+
+func (vfs *sftpFs) openFile(name string, flag int) (filesystem.File, error) {
+	f, err := vfs.conn.client.OpenFile(vfs.path(name), flag)
+	if err != nil {
+		return nil, vfs.wrap("open", name, err)
+	}
+
+	file := &sftpFile{file: f}
+	if err := file.Track(&vfs.conn.Tracker, vfs.path(name), file); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return file, nil
+}
+
+func (vfs *sftpFs) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+	return vfs.wrap("mkdir", name, vfs.mkdir(vfs.path(name), perm))
+}
+
+// mkdir creates the directory p, the server decides of its mode so it is
+// changed to perm once created.
+func (vfs *sftpFs) mkdir(p string, perm fs.FileMode) error {
+	if err := vfs.conn.client.Mkdir(p); err != nil {
+		return vfs.exist(p, err)
+	}
+	return vfs.conn.client.Chmod(p, perm)
+}
+
+func (vfs *sftpFs) MkdirAll(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+	return vfs.wrap("mkdir", name, vfs.mkdirAll(vfs.path(name), perm))
+}
+
+func (vfs *sftpFs) mkdirAll(p string, perm fs.FileMode) error {
+	info, err := vfs.conn.client.Stat(p)
+	if err == nil {
+		if info.IsDir() {
+			return nil
+		}
+		return &fs.PathError{Op: "mkdir", Path: p, Err: syscall.ENOTDIR}
+	}
+
+	if parent := path.Dir(p); parent != p {
+		if err := vfs.mkdirAll(parent, perm); err != nil {
+			return err
+		}
+	}
+	if err := vfs.mkdir(p, perm); err != nil {
+		if info, err := vfs.conn.client.Lstat(p); err == nil && info.IsDir() {
+			return nil
+		}
+		return err
+	}
+	return nil
+}
+
+func (vfs *sftpFs) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
+	return vfs.wrap("remove", name, vfs.conn.client.Remove(vfs.path(name)))
+}
+
+// RemoveAll removes the tree below path, symbolic links are removed and not
+// followed.
+func (vfs *sftpFs) RemoveAll(name string) error {
+	if err := vfs.closed("unlinkat", name); err != nil {
+		return err
+	}
+	return vfs.wrap("unlinkat", name, vfs.removeAll(vfs.path(name)))
+}
+
+func (vfs *sftpFs) removeAll(p string) error {
+	info, err := vfs.conn.client.Lstat(p)
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	if info.IsDir() {
+		var list []fs.FileInfo
+		list, err = vfs.conn.client.ReadDir(p)
+		if err != nil && !errors.Is(err, fs.ErrNotExist) {
+			return err
+		}
+		for _, child := range list {
+			if err := vfs.removeAll(path.Join(p, child.Name())); err != nil {
+				return err
+			}
+		}
+		err = vfs.conn.client.RemoveDirectory(p)
+	} else {
+		err = vfs.conn.client.Remove(p)
+	}
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// Rename renames with the posix-rename extension, which replaces newpath.
+// Without it, an existing file at newpath is removed before the rename.
+func (vfs *sftpFs) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
+
+	oldname, newname := vfs.path(oldpath), vfs.path(newpath)
+	client := vfs.conn.client
+
+	var err error
+	if _, ok := client.HasExtension(posixRename); ok {
+		err = client.PosixRename(oldname, newname)
+	} else if err = client.Rename(oldname, newname); err != nil {
+		if info, e := client.Lstat(newname); e == nil && !info.IsDir() {
+			if _, e := client.Lstat(oldname); e == nil {
+				if err = client.Remove(newname); err == nil {
+					err = client.Rename(oldname, newname)
+				}
+			}
+		}
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: oldname, New: newname, Err: err}
+	}
+	return nil
+}
+
+func (vfs *sftpFs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+	info, err := vfs.conn.client.Stat(vfs.path(name))
+	if err != nil {
+		return nil, vfs.wrap("stat", name, err)
+	}
+	return info, nil
+}
+
+func (vfs *sftpFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+	list, err := vfs.readDir(name)
+	if err != nil {
+		return nil, vfs.wrap("readdir", name, err)
+	}
+	return list, nil
+}
+
+// readDir lists the directory sorted by name, the entries of symbolic links
+// describe the links.
+func (vfs *sftpFs) readDir(name string) ([]fs.DirEntry, error) {
+	infos, err := vfs.conn.client.ReadDir(vfs.path(name))
+	if err != nil {
+		return nil, err
+	}
+
+	list := make([]fs.DirEntry, 0, len(infos))
+	for _, info := range infos {
+		list = append(list, fs.FileInfoToDirEntry(info))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+func (vfs *sftpFs) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	f, err := vfs.conn.client.Open(vfs.path(name))
+	if err != nil {
+		return nil, vfs.wrap("open", name, err)
+	}
+	defer f.Close()
+
+	data, err := io.ReadAll(f)
+	if err != nil {
+		return nil, vfs.wrap("read", name, err)
+	}
+	return data, nil
+}
+
+func (vfs *sftpFs) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
+
+	f, err := vfs.conn.client.OpenFile(vfs.path(name), os.O_WRONLY|os.O_CREATE|os.O_TRUNC)
+	if err != nil {
+		return vfs.wrap("open", name, err)
+	}
+	_, err = f.Write(data)
+	if cerr := f.Close(); err == nil {
+		err = cerr
+	}
+	return vfs.wrap("write", name, err)
+}
+
+func (vfs *sftpFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := vfs.closed("chtimes", name); err != nil {
+		return err
+	}
+	return vfs.wrap("chtimes", name, vfs.conn.client.Chtimes(vfs.path(name), atime, mtime))
+}
+
+func (vfs *sftpFs) Truncate(name string, size int64) error {
+	if err := vfs.closed("truncate", name); err != nil {
+		return err
+	}
+	return vfs.wrap("truncate", name, vfs.conn.client.Truncate(vfs.path(name), size))
+}
+
+func (vfs *sftpFs) Chmod(name string, mode fs.FileMode) error {
+	if err := vfs.closed("chmod", name); err != nil {
+		return err
+	}
+	return vfs.wrap("chmod", name, vfs.conn.client.Chmod(vfs.path(name), mode))
+}
+
+// Symlink creates newname as a link to oldname, oldname is stored as it is:
+// an absolute one refers to the root of the server, not of the filesystem.
+func (vfs *sftpFs) Symlink(oldname, newname string) error {
+	if err := vfs.closed("symlink", newname); err != nil {
+		return err
+	}
+
+	p := vfs.path(newname)
+	if err := vfs.conn.client.Symlink(oldname, p); err != nil {
+		return &os.LinkError{Op: "symlink", Old: oldname, New: p, Err: vfs.exist(p, err)}
+	}
+	return nil
+}
+
+func (vfs *sftpFs) Readlink(name string) (string, error) {
+	if err := vfs.closed("readlink", name); err != nil {
+		return "", err
+	}
+	target, err := vfs.conn.client.ReadLink(vfs.path(name))
+	if err != nil {
+		return "", vfs.wrap("readlink", name, err)
+	}
+	return target, nil
+}
+
+func (vfs *sftpFs) Lstat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("lstat", name); err != nil {
+		return nil, err
+	}
+	info, err := vfs.conn.client.Lstat(vfs.path(name))
+	if err != nil {
+		return nil, vfs.wrap("lstat", name, err)
+	}
+	return info, nil
+}
+
+// Usage reports the capacity of the filesystem of the server, with the
+// statvfs extension.
+func (vfs *sftpFs) Usage() (*filesystem.Usage, error) {
+	if err := vfs.closed("statfs", "/"); err != nil {
+		return nil, err
+	}
+
+	stat, err := vfs.conn.client.StatVFS(vfs.root)
+	if err != nil {
+		return nil, vfs.wrap("statfs", "/", err)
+	}
+	return &filesystem.Usage{
+		Total:      stat.Blocks * stat.Frsize,
+		Used:       (stat.Blocks - stat.Bfree) * stat.Frsize,
+		Free:       stat.Bavail * stat.Frsize,
+		Inodes:     stat.Files,
+		InodesUsed: stat.Files - stat.Ffree,
+		InodesFree: stat.Ffree,
+	}, nil
+}
+
+func (vfs *sftpFs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	if !vfs.IsDir(dir) {
+		return nil, &fs.PathError{Op: "sub", Path: dir, Err: fs.ErrNotExist}
+	}
+
+	return &sftpFs{
+		config: vfs.config,
+		root:   vfs.path(dir),
+		conn:   vfs.conn,
+	}, nil
+}
+
+func (vfs *sftpFs) Exists(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	_, err := vfs.conn.client.Stat(vfs.path(name))
+	return err == nil
+}
+
+func (vfs *sftpFs) IsFile(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	info, err := vfs.conn.client.Stat(vfs.path(name))
+	return err == nil && !info.IsDir()
+}
+
+func (vfs *sftpFs) IsDir(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	info, err := vfs.conn.client.Stat(vfs.path(name))
+	return err == nil && info.IsDir()
+}
+
+// Close closes the files still open on the filesystem and the connection.
+func (vfs *sftpFs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.conn.Tracker.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.root, Err: err}
+	}
+	return vfs.conn.close()
+}
+
+func (vfs *sftpFs) OpenFiles() []string {
+	return vfs.conn.OpenFiles()
+}
+
+// close closes the SFTP session and the SSH connection it runs in.
+func (conn *sftpConn) close() error {
+	err := conn.client.Close()
+	if cerr := conn.ssh.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// closed fails op on name once the session is closed, before the client
+// answers with an error of its own.
+func (vfs *sftpFs) closed(op, name string) error {
+	if vfs.conn.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.path(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// wrap returns the error of the client as the *fs.PathError of op on name,
+// the client returns bare errors.
+func (vfs *sftpFs) wrap(op, name string, err error) error {
+	if err == nil {
+		return nil
+	}
+	var pathErr *fs.PathError
+	if errors.As(err, &pathErr) {
+		return err
+	}
+	return &fs.PathError{Op: op, Path: vfs.path(name), Err: err}
+}
+
+// exist returns fs.ErrExist for a failure of the server to create p when p
+// is taken, the protocol reports both as a mere failure.
+func (vfs *sftpFs) exist(p string, err error) error {
+	var status *sftp.StatusError
+	if errors.As(err, &status) {
+		if _, e := vfs.conn.client.Lstat(p); e == nil {
+			return fs.ErrExist
+		}
+	}
+	return err
+}
+
+func (vfs *sftpFs) path(p string) string {
+	return path.Join(vfs.root, p)
+}
@@ -0,0 +1,137 @@
+package sftp
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/crypto/ssh/knownhosts"
+	"io"
+	"io/fs"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"testing"
+)
+
+func TestSFTPConformance(t *testing.T) {
+	conf := newSSHServer(t).login("root")
+	dsn := &url.URL{Scheme: Driver, User: conf.UserInfo(), Host: conf.Addr, Path: conf.Root, RawQuery: conf.Encode().Encode()}
+	vfstest.TestDriver(t, dsn.String())
+}
+
+func TestSFTPAuth(t *testing.T) {
+	s := newSSHServer(t)
+
+	// the key is enough
+	conf := s.login("")
+	conf.Password, conf.KeyFile = "", s.keyFile
+	vfs, err := New(conf)
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteFile(vfs, "/a.txt", []byte("a")))
+	require.NoError(t, filesystem.Close(vfs))
+
+	data, err := os.ReadFile(filepath.Join(s.dir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a", string(data))
+
+	conf = s.login("")
+	conf.Password = "wrong"
+	_, err = New(conf)
+	assert.ErrorContains(t, err, "unable to authenticate")
+
+	conf = s.login("")
+	conf.KeyFile = "/noexist"
+	_, err = New(conf)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func TestSFTPHostKey(t *testing.T) {
+	s := newSSHServer(t)
+	other := newSSHServer(t)
+
+	// the known hosts of another server do not know this one
+	conf := s.login("")
+	conf.KnownHosts = other.knownHosts
+	_, err := New(conf)
+	assert.ErrorContains(t, err, "knownhosts")
+
+	// a known host with another key
+	line := knownhosts.Line([]string{s.listener.Addr().String()}, other.hostKey)
+	require.NoError(t, os.WriteFile(other.knownHosts, []byte(line+"\n"), 0600))
+	_, err = New(conf)
+	assert.ErrorContains(t, err, "key mismatch")
+
+	conf.Insecure = true
+	vfs, err := New(conf)
+	require.NoError(t, err)
+	assert.NoError(t, filesystem.Close(vfs))
+}
+
+func TestSFTPSub(t *testing.T) {
+	s := newSSHServer(t)
+
+	vfs, err := New(s.login("root"))
+	require.NoError(t, err)
+	require.NoError(t, vfs.MkdirAll("/a/b", 0750))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c.txt", []byte("c")))
+
+	info, err := os.Stat(filepath.Join(s.dir, "root", "a", "b"))
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeDir|0750, info.Mode())
+
+	sub, err := vfs.Sub("/a")
+	require.NoError(t, err)
+	subsub, err := sub.Sub("/b")
+	require.NoError(t, err)
+
+	f, err := subsub.Open("/c.txt")
+	require.NoError(t, err)
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "c", string(data))
+	assert.Equal(t, []string{filepath.Join(s.dir, "root", "a", "b", "c.txt")}, sub.(filesystem.OpenFilesFS).OpenFiles())
+	assert.Equal(t, int32(1), atomic.LoadInt32(&s.conns), "the views share the connection")
+
+	assert.NoError(t, filesystem.Close(sub), "a view does not close the connection")
+	assert.True(t, subsub.IsFile("/c.txt"))
+
+	require.NoError(t, filesystem.Close(vfs))
+	_, err = f.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, fs.ErrClosed, "the files still open are closed")
+	_, err = subsub.Stat("/c.txt")
+	assert.ErrorIs(t, err, fs.ErrClosed, "Sub views close with their filesystem")
+	assert.ErrorIs(t, filesystem.Close(vfs), fs.ErrClosed)
+}
+
+func TestSFTPRemoveAllSymlink(t *testing.T) {
+	s := newSSHServer(t)
+
+	vfs, err := New(s.login("root"))
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+
+	require.NoError(t, os.MkdirAll(filepath.Join(s.dir, "outside"), 0755))
+	require.NoError(t, os.WriteFile(filepath.Join(s.dir, "outside", "keep.txt"), []byte("keep"), 0644))
+
+	require.NoError(t, vfs.Mkdir("/dir", 0755))
+	require.NoError(t, filesystem.Symlink(vfs, filepath.Join(s.dir, "outside"), "/dir/link"))
+	require.NoError(t, vfs.RemoveAll("/dir"))
+
+	assert.False(t, vfs.Exists("/dir"))
+	assert.FileExists(t, filepath.Join(s.dir, "outside", "keep.txt"), "links are not followed")
+}
+
+func TestSFTPUsage(t *testing.T) {
+	s := newSSHServer(t)
+
+	vfs, err := New(s.login(""))
+	require.NoError(t, err)
+	defer filesystem.Close(vfs)
+
+	usage, err := filesystem.Statfs(vfs)
+	require.NoError(t, err)
+	assert.NotZero(t, usage.Total)
+	assert.LessOrEqual(t, usage.Used, usage.Total)
+}
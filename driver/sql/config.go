@@ -0,0 +1,108 @@
+package sql
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"strconv"
+)
+
+type Config struct {
+	filesystem.Config
+
+	// Dialect names the dialect of the database, sqlite by default.
+	Dialect string
+
+	// DriverName is the database/sql driver the database is opened with,
+	// the one of the dialect when empty. The driver is registered by its
+	// package, imported by the program.
+	DriverName string
+
+	// DataSource is the data source name the driver opens, made by the
+	// dialect from the fields below when empty.
+	DataSource string
+
+	// Addr is the host of the server, and its port.
+	Addr string
+
+	// Database is the path of the database: the file of a SQLite database,
+	// the name of a Postgres one.
+	Database string
+
+	User     string
+	Password string
+
+	// Options are the options of the driver, such as sslmode, added to the
+	// data source name.
+	Options url.Values
+
+	// Table prefixes the names of the tables, "vfs" by default, so that
+	// several filesystems share a database.
+	Table string
+
+	// ChunkSize is the size of the chunks the content of the files is
+	// stored in, 256 KiB by default.
+	ChunkSize int64
+}
+
+func (conf *Config) Driver() string {
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	return conf.Addr
+}
+
+func (conf *Config) Path() string {
+	return conf.Database
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if conf.User == "" && conf.Password == "" {
+		return nil
+	}
+	return url.UserPassword(conf.User, conf.Password)
+}
+
+// Encode the options of the database driver along with dialect, driver,
+// table and chunksize
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	for k, v := range conf.Options {
+		values[k] = append([]string(nil), v...)
+	}
+	if conf.Dialect != "" {
+		values.Set("dialect", conf.Dialect)
+	}
+	if conf.DriverName != "" {
+		values.Set("driver", conf.DriverName)
+	}
+	if conf.Table != "" {
+		values.Set("table", conf.Table)
+	}
+	if conf.ChunkSize != 0 {
+		values.Set("chunksize", strconv.FormatInt(conf.ChunkSize, 10))
+	}
+	return values
+}
+
+// Decode the url.Values to options, the ones of the filesystem are taken
+// out, the others are the options of the driver.
+func (conf *Config) Decode(query url.Values) error {
+	conf.Options = url.Values{}
+	for k, v := range query {
+		switch k {
+		case "dialect":
+			conf.Dialect = query.Get(k)
+		case "driver":
+			conf.DriverName = query.Get(k)
+		case "table":
+			conf.Table = query.Get(k)
+		case "chunksize":
+			conf.ChunkSize, _ = strconv.ParseInt(query.Get(k), 10, 64)
+		default:
+			conf.Options[k] = v
+		}
+	}
+
+	return nil
+}
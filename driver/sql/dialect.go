@@ -0,0 +1,178 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"errors"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// Dialect is what the filesystem needs to know of a database beyond the
+// SQL the supported databases share: the statements are written with ?
+// placeholders, WITH RECURSIVE queries and INSERT ... RETURNING.
+type Dialect interface {
+	// DriverName is the database/sql driver the dialect opens by default.
+	DriverName() string
+
+	// DataSource returns the data source name of the database of conf.
+	DataSource(conf *Config) string
+
+	// Schema returns the statements creating the tables of the filesystem,
+	// the names of the tables are prefixed with prefix. They must keep
+	// existing tables: they run every time a filesystem is opened.
+	Schema(prefix string) []string
+
+	// Placeholder returns the placeholder of the nth parameter of a
+	// statement, from 1.
+	Placeholder(n int) string
+
+	// TxOptions returns the options of the transactions the changes run in.
+	TxOptions() *dbsql.TxOptions
+
+	// Retry reports whether a transaction failed with err because of a
+	// concurrent one, and may succeed once run again.
+	Retry(err error) bool
+}
+
+var dialects = map[string]Dialect{
+	"sqlite":   &sqliteDialect{},
+	"postgres": &postgresDialect{},
+}
+
+// RegisterDialect registers the dialect of a database under name, the
+// dialect option of the DSN.
+func RegisterDialect(name string, d Dialect) {
+	dialects[name] = d
+}
+
+// sqliteDialect talks to a SQLite database through modernc.org/sqlite, or a
+// driver taking the same options. The transactions take the write lock as
+// they begin, so they serialize rather than fail on upgrading their lock,
+// and wait for the lock rather than fail at once.
+type sqliteDialect struct {
+}
+
+func (d *sqliteDialect) DriverName() string {
+	return "sqlite"
+}
+
+func (d *sqliteDialect) DataSource(conf *Config) string {
+	options := url.Values{}
+	options.Add("_pragma", "busy_timeout(10000)")
+	options.Add("_pragma", "journal_mode(WAL)")
+	options.Set("_txlock", "immediate")
+	for k, v := range conf.Options {
+		options[k] = append(options[k], v...)
+	}
+	return conf.Database + "?" + options.Encode()
+}
+
+func (d *sqliteDialect) Schema(prefix string) []string {
+	return []string{
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `_inodes (
+			id INTEGER PRIMARY KEY,
+			dir INTEGER NOT NULL,
+			mode INTEGER NOT NULL,
+			size INTEGER NOT NULL,
+			mtime INTEGER NOT NULL,
+			chunk INTEGER NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `_entries (
+			parent INTEGER NOT NULL,
+			name TEXT NOT NULL,
+			inode INTEGER NOT NULL UNIQUE,
+			PRIMARY KEY (parent, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `_chunks (
+			inode INTEGER NOT NULL,
+			idx INTEGER NOT NULL,
+			data BLOB NOT NULL,
+			PRIMARY KEY (inode, idx)
+		)`,
+	}
+}
+
+func (d *sqliteDialect) Placeholder(n int) string {
+	return "?"
+}
+
+func (d *sqliteDialect) TxOptions() *dbsql.TxOptions {
+	return nil
+}
+
+// Retry retries SQLITE_BUSY and SQLITE_LOCKED, and their extended codes.
+func (d *sqliteDialect) Retry(err error) bool {
+	var e interface{ Code() int }
+	if !errors.As(err, &e) {
+		return false
+	}
+	code := e.Code() & 0xff
+	return code == 5 || code == 6
+}
+
+// postgresDialect talks to a Postgres database through
+// github.com/jackc/pgx/v5/stdlib, or another driver with driver=postgres.
+// The transactions are serializable and retried on serialization failures.
+type postgresDialect struct {
+}
+
+func (d *postgresDialect) DriverName() string {
+	return "pgx"
+}
+
+func (d *postgresDialect) DataSource(conf *Config) string {
+	uri := &url.URL{
+		Scheme:   "postgres",
+		User:     conf.UserInfo(),
+		Host:     conf.Addr,
+		Path:     "/" + strings.TrimPrefix(conf.Database, "/"),
+		RawQuery: conf.Options.Encode(),
+	}
+	return uri.String()
+}
+
+func (d *postgresDialect) Schema(prefix string) []string {
+	return []string{
+		// 1 is the root, inserted with its id
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `_inodes (
+			id BIGINT GENERATED BY DEFAULT AS IDENTITY (START WITH 2) PRIMARY KEY,
+			dir SMALLINT NOT NULL,
+			mode BIGINT NOT NULL,
+			size BIGINT NOT NULL,
+			mtime BIGINT NOT NULL,
+			chunk BIGINT NOT NULL
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `_entries (
+			parent BIGINT NOT NULL,
+			name TEXT NOT NULL,
+			inode BIGINT NOT NULL UNIQUE,
+			PRIMARY KEY (parent, name)
+		)`,
+		`CREATE TABLE IF NOT EXISTS ` + prefix + `_chunks (
+			inode BIGINT NOT NULL,
+			idx BIGINT NOT NULL,
+			data BYTEA NOT NULL,
+			PRIMARY KEY (inode, idx)
+		)`,
+	}
+}
+
+func (d *postgresDialect) Placeholder(n int) string {
+	return "$" + strconv.Itoa(n)
+}
+
+func (d *postgresDialect) TxOptions() *dbsql.TxOptions {
+	return &dbsql.TxOptions{Isolation: dbsql.LevelSerializable}
+}
+
+// Retry retries serialization failures and deadlocks, the SQLSTATE of the
+// error is read from the SQLState method pgx and lib/pq errors have.
+func (d *postgresDialect) Retry(err error) bool {
+	var e interface{ SQLState() string }
+	if !errors.As(err, &e) {
+		return false
+	}
+	state := e.SQLState()
+	return state == "40001" || state == "40P01"
+}
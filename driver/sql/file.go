@@ -0,0 +1,222 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/internal/chunked"
+	"io"
+	"io/fs"
+	"path"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | fi.mode
+	}
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// sqlFile reads the inode it was opened on a chunk at a time. Once the file
+// is replaced, the chunks not read yet fail with fs.ErrNotExist.
+type sqlFile struct {
+	chunked.Reader
+
+	vfs  *sqlFs
+	node *node
+	info *fileInfo
+}
+
+// Chunk selects the chunk at index i, a missing row is a hole unless the
+// inode is gone.
+func (f *sqlFile) Chunk(i int64) ([]byte, error) {
+	s := f.vfs.conn.store()
+	var chunk []byte
+	err := s.row(`SELECT data FROM {chunks} WHERE inode = ? AND idx = ?`, f.node.id, i).Scan(&chunk)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		if _, err := s.node(f.node.id); err != nil {
+			return nil, err
+		}
+		return nil, nil
+	}
+	return chunk, err
+}
+
+func (f *sqlFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+// sqlWriter streams the content written to it to an inode without a name, a
+// chunk at a time, and names it after the file once it is closed.
+type sqlWriter struct {
+	chunked.Writer
+
+	vfs  *sqlFs
+	name string
+
+	// id is the inode written, zero until the first chunk.
+	id int64
+}
+
+func newSQLWriter(vfs *sqlFs, name string) *sqlWriter {
+	w := &sqlWriter{vfs: vfs, name: name}
+	w.Writer = chunked.Writer{Sink: w, ChunkSize: int(vfs.config.ChunkSize), Path: vfs.abs(name)}
+	return w
+}
+
+// alloc inserts the inode written, once.
+func (w *sqlWriter) alloc() error {
+	if w.id != 0 {
+		return nil
+	}
+	id, err := w.vfs.conn.store().alloc(false, 0644, time.Now(), w.vfs.config.ChunkSize)
+	if err != nil {
+		return err
+	}
+	w.id = id
+	return nil
+}
+
+// Flush inserts the chunk at index i, outside of a transaction.
+func (w *sqlWriter) Flush(i int64, chunk []byte) error {
+	if err := w.alloc(); err != nil {
+		return err
+	}
+	return w.vfs.conn.store().exec(`INSERT INTO {chunks} (inode, idx, data) VALUES (?, ?, ?)`, w.id, i, chunk)
+}
+
+// Commit inserts the last chunk, then names the inode after the file in a
+// transaction.
+func (w *sqlWriter) Commit(i int64, last []byte, size int64) error {
+	if len(last) > 0 {
+		if err := w.Flush(i, last); err != nil {
+			return err
+		}
+	}
+	if err := w.alloc(); err != nil {
+		return err
+	}
+	return w.vfs.conn.tx(func(s store) error {
+		// gone when the writer was left open too long
+		if _, err := s.node(w.id); err != nil {
+			return err
+		}
+		if err := s.exec(`UPDATE {inodes} SET size = ?, mtime = ? WHERE id = ?`, size, time.Now().UnixNano(), w.id); err != nil {
+			return err
+		}
+		return s.put(w.vfs.abs(w.name), w.id)
+	})
+}
+
+// Abort deletes the inode written and its chunks.
+func (w *sqlWriter) Abort() {
+	if w.id != 0 {
+		_ = w.vfs.conn.store().free(w.id)
+	}
+}
+
+func (w *sqlWriter) Stat() (fs.FileInfo, error) {
+	return &fileInfo{name: path.Base(w.vfs.abs(w.name)), size: w.Size(), mode: 0644, modTime: time.Now()}, nil
+}
+
+// sqlDir lists a directory on its first ReadDir.
+type sqlDir struct {
+	filesystem.Handle
+
+	vfs  *sqlFs
+	name string
+	info *fileInfo
+
+	list []fs.DirEntry
+	read bool
+	off  int
+}
+
+func (d *sqlDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: fs.ErrClosed}
+	}
+	if !d.read {
+		list, err := d.vfs.readDir(d.vfs.abs(d.name))
+		if err != nil {
+			return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: err}
+		}
+		d.list, d.read = list, true
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *sqlDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *sqlDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *sqlDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *sqlDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.abs(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*sqlDir)(nil)
+	_ io.ReaderAt            = (*sqlFile)(nil)
+	_ io.Seeker              = (*sqlFile)(nil)
+	_ chunked.Sink           = (*sqlWriter)(nil)
+)
@@ -0,0 +1,762 @@
+// Package sql implements filesystem.FileSystem on the tables of a SQL
+// database, through database/sql.
+//
+// A filesystem is three tables: the inodes, with the type, mode, size and
+// modification time of the files and directories, the entries naming the
+// inodes in their parent directory, and the chunks of the content of the
+// files. The root is the inode 1. A path is resolved an entry at a time on
+// the primary key of the entries, the key ReadDir lists a directory by.
+//
+// Every change runs in a transaction. Rename moves an entry, whatever the
+// size of the tree below it, and RemoveAll removes a tree with recursive
+// queries. A File streams its content a chunk at a time to an inode of its
+// own, which replaces the file once it is closed. A missing chunk reads as
+// zeros, so Truncate grows a file without writing it.
+//
+// The dialects of SQLite and Postgres are built in, other databases register
+// theirs with RegisterDialect. The database/sql driver is imported by the
+// program: modernc.org/sqlite for SQLite, pgx for Postgres.
+package sql
+
+import (
+	"context"
+	dbsql "database/sql"
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/internal/chunked"
+	"io/fs"
+	"os"
+	"path"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+const (
+	defaultDialect   = "sqlite"
+	defaultTable     = "vfs"
+	defaultChunkSize = 256 << 10
+
+	// rootID is the inode of the root directory.
+	rootID = 1
+
+	// maxRetries bounds the runs of a transaction failing because of
+	// concurrent ones.
+	maxRetries = 16
+
+	// orphanTTL bounds the life of the inodes of the files never closed,
+	// removed by the next filesystem opened on the database.
+	orphanTTL = 24 * time.Hour
+)
+
+// tableName is the prefix of the names of the tables, used in statements
+// as is.
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+
+type sqlFs struct {
+	config *Config
+
+	// root is the absolute path the filesystem is rooted at.
+	root string
+
+	// conn is the database the Sub views share, only the owner closes it
+	// once the writers left open are stored.
+	conn  *sqlConn
+	owner bool
+}
+
+// sqlConn is the database and the files open on it.
+type sqlConn struct {
+	filesystem.Tracker
+
+	db      *dbsql.DB
+	dialect Dialect
+
+	// tables names the tables in the statements, queries caches the
+	// statements rewritten for the tables and the dialect.
+	tables  *strings.Replacer
+	queries sync.Map
+}
+
+func New(config *Config) (filesystem.FileSystem, error) {
+	if config.Dialect == "" {
+		config.Dialect = defaultDialect
+	}
+	dialect, ok := dialects[config.Dialect]
+	if !ok {
+		return nil, errors.New("unknown dialect " + config.Dialect)
+	}
+	if config.DriverName == "" {
+		config.DriverName = dialect.DriverName()
+	}
+	if config.DataSource == "" {
+		if config.Database == "" && config.Addr == "" {
+			return nil, fs.ErrInvalid
+		}
+		config.DataSource = dialect.DataSource(config)
+	}
+	if config.Table == "" {
+		config.Table = defaultTable
+	}
+	if !tableName.MatchString(config.Table) {
+		return nil, errors.New("invalid table " + config.Table)
+	}
+	if config.ChunkSize <= 0 {
+		config.ChunkSize = defaultChunkSize
+	}
+
+	db, err := dbsql.Open(config.DriverName, config.DataSource)
+	if err != nil {
+		return nil, err
+	}
+
+	conn := &sqlConn{
+		db:      db,
+		dialect: dialect,
+		tables:  newTables(config.Table),
+	}
+	if err := conn.init(config.Table); err != nil {
+		_ = db.Close()
+		return nil, err
+	}
+
+	return &sqlFs{
+		config: config,
+		root:   "/",
+		conn:   conn,
+		owner:  true,
+	}, nil
+}
+
+// init creates the tables and the root when missing, and removes the
+// inodes of the files never closed.
+func (conn *sqlConn) init(prefix string) error {
+	return conn.tx(func(s store) error {
+		for _, stmt := range conn.dialect.Schema(prefix) {
+			if _, err := s.q.Exec(stmt); err != nil {
+				return err
+			}
+		}
+
+		now := time.Now()
+		err := s.exec(`INSERT INTO {inodes} (id, dir, mode, size, mtime, chunk) VALUES (?, 1, ?, 0, ?, 0) ON CONFLICT DO NOTHING`,
+			rootID, int64(0755), now.UnixNano())
+		if err != nil {
+			return err
+		}
+
+		const orphans = `SELECT i.id FROM {inodes} i WHERE i.id <> ? AND i.mtime < ? AND NOT EXISTS (SELECT 1 FROM {entries} e WHERE e.inode = i.id)`
+		before := now.Add(-orphanTTL).UnixNano()
+		if err := s.exec(`DELETE FROM {chunks} WHERE inode IN (`+orphans+`)`, rootID, before); err != nil {
+			return err
+		}
+		return s.exec(`DELETE FROM {inodes} WHERE id IN (`+orphans+`)`, rootID, before)
+	})
+}
+
+func (vfs *sqlFs) Open(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	n, err := vfs.conn.store().lookup(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	if n.dir {
+		d := &sqlDir{vfs: vfs, name: name, info: n.info(path.Base(p))}
+		if err := d.Track(&vfs.conn.Tracker, vfs.abs(name), d); err != nil {
+			return nil, err
+		}
+		return d, nil
+	}
+
+	f := &sqlFile{vfs: vfs, node: n, info: n.info(path.Base(p))}
+	f.Reader = chunked.Reader{Chunks: f, Size: n.size, ChunkSize: n.chunk, Path: p}
+	if err := f.Track(&vfs.conn.Tracker, vfs.abs(name), f); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+// Create names an empty inode after the file, the content written to the
+// file replaces it once the file is closed.
+func (vfs *sqlFs) Create(name string) (filesystem.File, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.tx(func(s store) error {
+		id, err := s.alloc(false, 0644, time.Now(), vfs.config.ChunkSize)
+		if err != nil {
+			return err
+		}
+		return s.put(p, id)
+	})
+	if err != nil {
+		return nil, &fs.PathError{Op: "open", Path: p, Err: err}
+	}
+
+	w := newSQLWriter(vfs, name)
+	if err := w.Track(&vfs.conn.Tracker, vfs.abs(name), w); err != nil {
+		return nil, err
+	}
+	return w, nil
+}
+
+func (vfs *sqlFs) Mkdir(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.tx(func(s store) error {
+		_, err := s.lookup(p)
+		switch {
+		case err == nil:
+			return fs.ErrExist
+		case !errors.Is(err, fs.ErrNotExist):
+			return err
+		}
+
+		parent, err := s.dir(path.Dir(p))
+		if err != nil {
+			return err
+		}
+		id, err := s.alloc(true, perm, time.Now(), 0)
+		if err != nil {
+			return err
+		}
+		return s.link(parent.id, path.Base(p), id)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *sqlFs) MkdirAll(name string, perm fs.FileMode) error {
+	if err := vfs.closed("mkdir", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.tx(func(s store) error {
+		n, err := s.node(rootID)
+		if err != nil {
+			return err
+		}
+		for _, elem := range split(p) {
+			if !n.dir {
+				return syscall.ENOTDIR
+			}
+
+			child, err := s.child(n.id, elem)
+			if errors.Is(err, fs.ErrNotExist) {
+				var id int64
+				if id, err = s.alloc(true, perm, time.Now(), 0); err != nil {
+					return err
+				}
+				if err = s.link(n.id, elem, id); err != nil {
+					return err
+				}
+				child, err = s.node(id)
+			}
+			if err != nil {
+				return err
+			}
+			n = child
+		}
+		if !n.dir {
+			return syscall.ENOTDIR
+		}
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "mkdir", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *sqlFs) Remove(name string) error {
+	if err := vfs.closed("remove", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	if p == vfs.root {
+		return &fs.PathError{Op: "remove", Path: p, Err: syscall.EBUSY}
+	}
+	err := vfs.conn.tx(func(s store) error {
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		if n.dir {
+			empty, err := s.empty(n.id)
+			if err != nil {
+				return err
+			}
+			if !empty {
+				return syscall.ENOTEMPTY
+			}
+		}
+		if err := s.exec(`DELETE FROM {entries} WHERE inode = ?`, n.id); err != nil {
+			return err
+		}
+		return s.free(n.id)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "remove", Path: p, Err: err}
+	}
+	return nil
+}
+
+// tree selects the ids of the inodes of a tree, its root included.
+const tree = `WITH RECURSIVE tree(id) AS (SELECT CAST(? AS BIGINT) UNION ALL SELECT e.inode FROM {entries} e JOIN tree t ON e.parent = t.id) `
+
+// RemoveAll removes the tree in one transaction, the root of the filesystem
+// keeps existing.
+func (vfs *sqlFs) RemoveAll(name string) error {
+	if err := vfs.closed("unlinkat", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.tx(func(s store) error {
+		n, err := s.lookup(p)
+		if errors.Is(err, fs.ErrNotExist) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+
+		// the inode not to remove
+		var keep int64
+		if p == vfs.root {
+			keep = n.id
+		}
+		if err := s.exec(tree+`DELETE FROM {chunks} WHERE inode IN (SELECT id FROM tree)`, n.id); err != nil {
+			return err
+		}
+		if err := s.exec(tree+`DELETE FROM {inodes} WHERE id IN (SELECT id FROM tree) AND id <> ?`, n.id, keep); err != nil {
+			return err
+		}
+		if err := s.exec(tree+`DELETE FROM {entries} WHERE parent IN (SELECT id FROM tree)`, n.id); err != nil {
+			return err
+		}
+		if keep == 0 {
+			return s.exec(`DELETE FROM {entries} WHERE inode = ?`, n.id)
+		}
+		return nil
+	})
+	if err != nil {
+		return &fs.PathError{Op: "unlinkat", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Rename moves the entry of the file, a directory moves with the tree below
+// it in a single update.
+func (vfs *sqlFs) Rename(oldpath, newpath string) error {
+	if err := vfs.closed("rename", oldpath); err != nil {
+		return err
+	}
+
+	po, pn := vfs.abs(oldpath), vfs.abs(newpath)
+	var err error = syscall.EBUSY
+	if po != vfs.root && pn != vfs.root {
+		err = vfs.conn.tx(func(s store) error {
+			return s.rename(po, pn)
+		})
+	}
+	if err != nil {
+		return &os.LinkError{Op: "rename", Old: po, New: pn, Err: err}
+	}
+	return nil
+}
+
+func (vfs *sqlFs) Stat(name string) (fs.FileInfo, error) {
+	if err := vfs.closed("stat", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	n, err := vfs.conn.store().lookup(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "stat", Path: p, Err: err}
+	}
+	return n.info(path.Base(p)), nil
+}
+
+// ReadDir lists the entries of the directory in one query.
+func (vfs *sqlFs) ReadDir(name string) ([]fs.DirEntry, error) {
+	if err := vfs.closed("readdir", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	list, err := vfs.readDir(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "readdir", Path: p, Err: err}
+	}
+	return list, nil
+}
+
+func (vfs *sqlFs) readDir(p string) ([]fs.DirEntry, error) {
+	s := vfs.conn.store()
+	n, err := s.dir(p)
+	if err != nil {
+		return nil, err
+	}
+
+	rows, err := s.rows(`SELECT e.name, `+nodeColumns+` FROM {entries} e JOIN {inodes} i ON i.id = e.inode WHERE e.parent = ?`, n.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var list []fs.DirEntry
+	for rows.Next() {
+		var name string
+		child := &node{}
+		if err := rows.Scan(append([]interface{}{&name}, child.fields()...)...); err != nil {
+			return nil, err
+		}
+		list = append(list, fs.FileInfoToDirEntry(child.info(name)))
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+
+	// the collation of the database may not be bytewise
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list, nil
+}
+
+// ReadFile reads the chunks of the file in one query.
+func (vfs *sqlFs) ReadFile(name string) ([]byte, error) {
+	if err := vfs.closed("open", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	data, err := vfs.readFile(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "read", Path: p, Err: err}
+	}
+	return data, nil
+}
+
+func (vfs *sqlFs) readFile(p string) ([]byte, error) {
+	s := vfs.conn.store()
+	n, err := s.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if n.dir {
+		return nil, syscall.EISDIR
+	}
+
+	rows, err := s.rows(`SELECT idx, data FROM {chunks} WHERE inode = ?`, n.id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	data := make([]byte, n.size)
+	for rows.Next() {
+		var idx int64
+		var chunk []byte
+		if err := rows.Scan(&idx, &chunk); err != nil {
+			return nil, err
+		}
+		if off := idx * n.chunk; off < n.size {
+			copy(data[off:], chunk)
+		}
+	}
+	return data, rows.Err()
+}
+
+// WriteFile inserts the chunks of data under a new inode and points the
+// entry at it once they are all stored, no empty file shows in between.
+func (vfs *sqlFs) WriteFile(name string, data []byte) error {
+	if err := vfs.closed("open", name); err != nil {
+		return err
+	}
+
+	w := newSQLWriter(vfs, name)
+	_, err := w.Write(data)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	return err
+}
+
+// Chtimes updates the mtime column, the table has none for the access time.
+func (vfs *sqlFs) Chtimes(name string, atime time.Time, mtime time.Time) error {
+	if err := vfs.closed("chtimes", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.tx(func(s store) error {
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		return s.exec(`UPDATE {inodes} SET mtime = ? WHERE id = ?`, mtime.UnixNano(), n.id)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "chtimes", Path: p, Err: err}
+	}
+	return nil
+}
+
+func (vfs *sqlFs) Chmod(name string, mode fs.FileMode) error {
+	if err := vfs.closed("chmod", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.tx(func(s store) error {
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		return s.exec(`UPDATE {inodes} SET mode = ? WHERE id = ?`, int64(mode.Perm()), n.id)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "chmod", Path: p, Err: err}
+	}
+	return nil
+}
+
+// Truncate removes the chunks past the size and cuts the last one, a file
+// grows by its size alone as the chunks missing read as zeros.
+func (vfs *sqlFs) Truncate(name string, size int64) error {
+	if err := vfs.closed("truncate", name); err != nil {
+		return err
+	}
+
+	p := vfs.abs(name)
+	err := vfs.conn.tx(func(s store) error {
+		if size < 0 {
+			return syscall.EINVAL
+		}
+		n, err := s.lookup(p)
+		if err != nil {
+			return err
+		}
+		if n.dir {
+			return syscall.EISDIR
+		}
+
+		if size < n.size {
+			keep := (size + n.chunk - 1) / n.chunk
+			if err := s.exec(`DELETE FROM {chunks} WHERE inode = ? AND idx >= ?`, n.id, keep); err != nil {
+				return err
+			}
+			if rest := size % n.chunk; rest != 0 {
+				err := s.exec(`UPDATE {chunks} SET data = substr(data, 1, ?) WHERE inode = ? AND idx = ?`, rest, n.id, size/n.chunk)
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return s.exec(`UPDATE {inodes} SET size = ?, mtime = ? WHERE id = ?`, size, time.Now().UnixNano(), n.id)
+	})
+	if err != nil {
+		return &fs.PathError{Op: "truncate", Path: p, Err: err}
+	}
+	return nil
+}
+
+// DiskUsage sums the sizes of the tree in one query.
+func (vfs *sqlFs) DiskUsage(name string) (*filesystem.DirUsage, error) {
+	if err := vfs.closed("du", name); err != nil {
+		return nil, err
+	}
+
+	p := vfs.abs(name)
+	s := vfs.conn.store()
+	n, err := s.lookup(p)
+	if err != nil {
+		return nil, &fs.PathError{Op: "du", Path: p, Err: err}
+	}
+	if !n.dir {
+		return &filesystem.DirUsage{Size: n.size, Files: 1}, nil
+	}
+
+	usage := &filesystem.DirUsage{}
+	var count int64
+	err = s.row(tree+`SELECT COUNT(*), CAST(COALESCE(SUM(i.dir), 0) AS BIGINT), CAST(COALESCE(SUM(i.size), 0) AS BIGINT)
+		FROM tree t JOIN {inodes} i ON i.id = t.id WHERE t.id <> ?`, n.id, n.id).Scan(&count, &usage.Dirs, &usage.Size)
+	if err != nil {
+		return nil, &fs.PathError{Op: "du", Path: p, Err: err}
+	}
+	usage.Files = count - usage.Dirs
+	return usage, nil
+}
+
+// Usage counts the inodes and their bytes, the database has no limit the
+// filesystem knows of.
+func (vfs *sqlFs) Usage() (*filesystem.Usage, error) {
+	if err := vfs.closed("statfs", "/"); err != nil {
+		return nil, err
+	}
+
+	var inodes, size int64
+	err := vfs.conn.store().row(`SELECT COUNT(*), CAST(COALESCE(SUM(size), 0) AS BIGINT) FROM {inodes}`).Scan(&inodes, &size)
+	if err != nil {
+		return nil, &fs.PathError{Op: "statfs", Path: vfs.root, Err: err}
+	}
+	return &filesystem.Usage{Used: uint64(size), InodesUsed: uint64(inodes)}, nil
+}
+
+func (vfs *sqlFs) Sub(dir string) (filesystem.FileSystem, error) {
+	if err := vfs.closed("sub", dir); err != nil {
+		return nil, err
+	}
+	if dir == "." || dir == ".." {
+		return nil, errors.New("invalid sub directory")
+	}
+
+	p := vfs.abs(dir)
+	if _, err := vfs.conn.store().dir(p); err != nil {
+		return nil, &fs.PathError{Op: "sub", Path: p, Err: err}
+	}
+
+	return &sqlFs{
+		config: vfs.config,
+		root:   p,
+		conn:   vfs.conn,
+	}, nil
+}
+
+func (vfs *sqlFs) Exists(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	_, err := vfs.conn.store().lookup(vfs.abs(name))
+	return err == nil
+}
+
+func (vfs *sqlFs) IsFile(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	n, err := vfs.conn.store().lookup(vfs.abs(name))
+	return err == nil && !n.dir
+}
+
+func (vfs *sqlFs) IsDir(name string) bool {
+	if vfs.conn.Closed() {
+		return false
+	}
+	n, err := vfs.conn.store().lookup(vfs.abs(name))
+	return err == nil && n.dir
+}
+
+// Close closes the database after the files open on it.
+func (vfs *sqlFs) Close() error {
+	if !vfs.owner {
+		return nil
+	}
+	if err := vfs.conn.Tracker.Close(); err != nil {
+		return &fs.PathError{Op: "close", Path: vfs.root, Err: err}
+	}
+	return vfs.conn.db.Close()
+}
+
+func (vfs *sqlFs) OpenFiles() []string {
+	return vfs.conn.OpenFiles()
+}
+
+// closed fails op on name once the database is closed, database/sql
+// would only say sql: database is closed.
+func (vfs *sqlFs) closed(op, name string) error {
+	if vfs.conn.Closed() {
+		return &fs.PathError{Op: op, Path: vfs.abs(name), Err: fs.ErrClosed}
+	}
+	return nil
+}
+
+// abs returns the absolute path of the name.
+func (vfs *sqlFs) abs(name string) string {
+	return path.Join(vfs.root, path.Clean("/"+name))
+}
+
+// tx runs fn in a transaction, again while it fails because of concurrent
+// transactions.
+func (conn *sqlConn) tx(fn func(s store) error) error {
+	for i := 1; ; i++ {
+		err := conn.run(fn)
+		if err == nil || i == maxRetries || !conn.dialect.Retry(err) {
+			return err
+		}
+		time.Sleep(time.Duration(i) * time.Millisecond)
+	}
+}
+
+func (conn *sqlConn) run(fn func(s store) error) error {
+	tx, err := conn.db.BeginTx(context.Background(), conn.dialect.TxOptions())
+	if err != nil {
+		return err
+	}
+	if err := fn(store{q: tx, conn: conn}); err != nil {
+		_ = tx.Rollback()
+		return err
+	}
+	return tx.Commit()
+}
+
+// store returns the statements run on the database, outside of a
+// transaction.
+func (conn *sqlConn) store() store {
+	return store{q: conn.db, conn: conn}
+}
+
+// query rewrites the statement for the tables and the dialect.
+func (conn *sqlConn) query(query string) string {
+	if q, ok := conn.queries.Load(query); ok {
+		return q.(string)
+	}
+
+	var b strings.Builder
+	n := 0
+	for _, r := range conn.tables.Replace(query) {
+		if r == '?' {
+			n++
+			b.WriteString(conn.dialect.Placeholder(n))
+			continue
+		}
+		b.WriteRune(r)
+	}
+	conn.queries.Store(query, b.String())
+	return b.String()
+}
+
+// newTables names the tables of the statements after the prefix.
+func newTables(prefix string) *strings.Replacer {
+	return strings.NewReplacer(
+		"{inodes}", prefix+"_inodes",
+		"{entries}", prefix+"_entries",
+		"{chunks}", prefix+"_chunks",
+	)
+}
+
+// split returns the names of the absolute path p.
+func split(p string) []string {
+	if p == "/" {
+		return nil
+	}
+	return strings.Split(p[1:], "/")
+}
@@ -0,0 +1,190 @@
+package sql
+
+import (
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	_ "modernc.org/sqlite"
+	"path/filepath"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+// sqlite returns the DSN of the tables vfs of a new SQLite database, query
+// adds to the options.
+func sqlite(t *testing.T, query string) string {
+	return "sql://" + filepath.ToSlash(filepath.Join(t.TempDir(), "vfs.db")) + "?table=vfs&" + query
+}
+
+// count returns the number of rows of the table.
+func count(t *testing.T, vfs filesystem.FileSystem, table string) int {
+	t.Helper()
+	var n int
+	require.NoError(t, vfs.(*sqlFs).conn.db.QueryRow("SELECT COUNT(*) FROM "+table).Scan(&n))
+	return n
+}
+
+func TestSQLConformance(t *testing.T) {
+	vfstest.TestDriver(t, sqlite(t, ""))
+}
+
+func TestSQLLayout(t *testing.T) {
+	vfs := vfstest.Open(t, sqlite(t, "chunksize=4"))
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0700))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c", []byte("0123456789")))
+	assert.Equal(t, 4, count(t, vfs, "vfs_inodes"), "the root, two directories and a file")
+	assert.Equal(t, 3, count(t, vfs, "vfs_entries"))
+	assert.Equal(t, 3, count(t, vfs, "vfs_chunks"), "the content in chunks")
+
+	info, err := vfs.Stat("/a")
+	require.NoError(t, err)
+	assert.Equal(t, fs.ModeDir|0700, info.Mode(), "the mode of MkdirAll")
+
+	f, err := vfs.Open("/a/b/c")
+	require.NoError(t, err)
+	defer f.Close()
+	buf := make([]byte, 5)
+	n, err := f.(io.ReaderAt).ReadAt(buf, 3)
+	require.NoError(t, err)
+	assert.Equal(t, "34567", string(buf[:n]), "a read across chunks")
+	data, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(data))
+
+	// a rewrite replaces the inode and its chunks
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/c", []byte("x")))
+	assert.Equal(t, 4, count(t, vfs, "vfs_inodes"))
+	assert.Equal(t, 1, count(t, vfs, "vfs_chunks"))
+	_, err = f.(io.ReaderAt).ReadAt(buf, 0)
+	assert.ErrorIs(t, err, fs.ErrNotExist, "the file opened on the inode replaced")
+
+	// another table prefix is another filesystem in the database
+	other := vfstest.Open(t, "sql://"+vfs.(*sqlFs).config.Database+"?table=other")
+	assert.False(t, other.Exists("/a"))
+}
+
+func TestSQLSparse(t *testing.T) {
+	vfs := vfstest.Open(t, sqlite(t, "chunksize=4"))
+
+	require.NoError(t, filesystem.WriteFile(vfs, "/f", []byte("abcdefghij")))
+	require.NoError(t, filesystem.Truncate(vfs, "/f", 5))
+	assert.Equal(t, 2, count(t, vfs, "vfs_chunks"))
+
+	// growing adds no chunk, the cut chunk reads as zeros past its data
+	require.NoError(t, filesystem.Truncate(vfs, "/f", 1024))
+	assert.Equal(t, 2, count(t, vfs, "vfs_chunks"))
+	data, err := filesystem.ReadFile(vfs, "/f")
+	require.NoError(t, err)
+	assert.Len(t, data, 1024)
+	assert.Equal(t, "abcde\x00\x00\x00", string(data[:8]))
+
+	f, err := vfs.Open("/f")
+	require.NoError(t, err)
+	defer f.Close()
+	streamed, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, data, streamed)
+}
+
+func TestSQLTree(t *testing.T) {
+	vfs := vfstest.Open(t, sqlite(t, ""))
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	for i := 0; i < 100; i++ {
+		require.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/a/b/%d", i), []byte{byte(i)}))
+	}
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	require.NoError(t, filesystem.Chtimes(vfs, "/a/b/0", mtime, mtime))
+
+	require.NoError(t, vfs.Rename("/a", "/c"))
+	assert.False(t, vfs.Exists("/a"))
+	list, err := filesystem.ReadDir(vfs, "/c/b")
+	require.NoError(t, err)
+	assert.Len(t, list, 100)
+	info, err := vfs.Stat("/c/b/0")
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(mtime), "the inodes move with their entries")
+
+	err = vfs.Rename("/c", "/c/b/d")
+	assert.ErrorIs(t, err, syscall.EINVAL, "a directory into itself")
+
+	usage, err := filesystem.DiskUsage(vfs, "/c")
+	require.NoError(t, err)
+	assert.Equal(t, &filesystem.DirUsage{Size: 100, Files: 100, Dirs: 1}, usage)
+
+	require.NoError(t, vfs.RemoveAll("/c"))
+	assert.Equal(t, 1, count(t, vfs, "vfs_inodes"), "the root alone")
+	assert.Zero(t, count(t, vfs, "vfs_entries"))
+	assert.Zero(t, count(t, vfs, "vfs_chunks"))
+}
+
+func TestSQLShared(t *testing.T) {
+	source := sqlite(t, "")
+	a, b := vfstest.Open(t, source), vfstest.Open(t, source)
+
+	// writers of two filesystems on the database
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vfs := a
+			if i%2 == 1 {
+				vfs = b
+			}
+			assert.NoError(t, vfs.MkdirAll("/shared", 0755))
+			assert.NoError(t, filesystem.WriteFile(vfs, fmt.Sprintf("/shared/%d", i), []byte("x")))
+		}(i)
+	}
+	wg.Wait()
+
+	list, err := filesystem.ReadDir(a, "/shared")
+	require.NoError(t, err)
+	assert.Len(t, list, 8)
+
+	// a writer never closed leaves an inode without a name, removed once
+	// it is old enough
+	w, err := b.Create("/shared/open")
+	require.NoError(t, err)
+	_, err = w.Write(make([]byte, 1<<20))
+	require.NoError(t, err)
+	old := time.Now().Add(-2 * orphanTTL).UnixNano()
+	_, err = b.(*sqlFs).conn.db.Exec("UPDATE vfs_inodes SET mtime = ? WHERE id = ?", old, w.(*sqlWriter).id)
+	require.NoError(t, err)
+	before := count(t, a, "vfs_inodes")
+	vfstest.Open(t, source)
+	assert.Equal(t, before-1, count(t, a, "vfs_inodes"))
+	assert.Error(t, w.Close(), "the inode of the writer is gone")
+}
+
+func TestSQLOpen(t *testing.T) {
+	_, err := filesystem.Open(sqlite(t, "dialect=oracle"))
+	assert.Error(t, err)
+	_, err = filesystem.Open("sql://" + filepath.ToSlash(filepath.Join(t.TempDir(), "vfs.db")) + "?table=vfs-1")
+	assert.Error(t, err)
+	_, err = filesystem.Open("sql://")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	conf := &Config{Addr: "db:5432", Database: "/vfs", User: "app", Password: "secret", Options: map[string][]string{"sslmode": {"disable"}}}
+	assert.Equal(t, "postgres://app:secret@db:5432/vfs?sslmode=disable", dialects["postgres"].DataSource(conf))
+	assert.Equal(t, "SELECT a FROM t_inodes WHERE b = $1 AND c = $2", (&sqlConn{
+		dialect: dialects["postgres"],
+		tables:  newTables("t"),
+	}).query("SELECT a FROM {inodes} WHERE b = ? AND c = ?"))
+
+	// a registered dialect, on the driver of another one
+	RegisterDialect("custom", &sqliteDialect{})
+	vfs := vfstest.Open(t, sqlite(t, "dialect=custom"))
+	require.NoError(t, filesystem.WriteFile(vfs, "/a", []byte("a")))
+	assert.Equal(t, 1, count(t, vfs, "vfs_chunks"))
+
+	_, err = filesystem.Open(sqlite(t, "driver=nodriver"))
+	assert.Error(t, err)
+}
@@ -0,0 +1,237 @@
+package sql
+
+import (
+	dbsql "database/sql"
+	"errors"
+	"io/fs"
+	"path"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// querier is a *sql.DB or a *sql.Tx.
+type querier interface {
+	Exec(query string, args ...interface{}) (dbsql.Result, error)
+	Query(query string, args ...interface{}) (*dbsql.Rows, error)
+	QueryRow(query string, args ...interface{}) *dbsql.Row
+}
+
+// store runs the statements of the filesystem on the database or in a
+// transaction. The statements name the tables {inodes}, {entries} and
+// {chunks}, and take ? placeholders.
+type store struct {
+	q    querier
+	conn *sqlConn
+}
+
+func (s store) exec(query string, args ...interface{}) error {
+	_, err := s.q.Exec(s.conn.query(query), args...)
+	return err
+}
+
+func (s store) rows(query string, args ...interface{}) (*dbsql.Rows, error) {
+	return s.q.Query(s.conn.query(query), args...)
+}
+
+func (s store) row(query string, args ...interface{}) *dbsql.Row {
+	return s.q.QueryRow(s.conn.query(query), args...)
+}
+
+// node is an inode.
+type node struct {
+	id    int64
+	dir   bool
+	mode  int64
+	size  int64
+	mtime int64
+
+	// chunk is the size of the chunks of the content, zero for a
+	// directory.
+	chunk int64
+}
+
+// nodeColumns are the columns of the inode i a node scans.
+const nodeColumns = `i.id, i.dir, i.mode, i.size, i.mtime, i.chunk`
+
+func (n *node) fields() []interface{} {
+	return []interface{}{&n.id, &n.dir, &n.mode, &n.size, &n.mtime, &n.chunk}
+}
+
+func (n *node) info(name string) *fileInfo {
+	return &fileInfo{
+		name:    name,
+		size:    n.size,
+		mode:    fs.FileMode(n.mode).Perm(),
+		modTime: time.Unix(0, n.mtime),
+		dir:     n.dir,
+	}
+}
+
+// scan scans the node of the row, a missing one is fs.ErrNotExist.
+func scan(row *dbsql.Row) (*node, error) {
+	n := &node{}
+	err := row.Scan(n.fields()...)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return nil, fs.ErrNotExist
+	}
+	if err != nil {
+		return nil, err
+	}
+	return n, nil
+}
+
+// node returns the inode id.
+func (s store) node(id int64) (*node, error) {
+	return scan(s.row(`SELECT `+nodeColumns+` FROM {inodes} i WHERE i.id = ?`, id))
+}
+
+// child returns the inode named name in the directory parent.
+func (s store) child(parent int64, name string) (*node, error) {
+	return scan(s.row(`SELECT `+nodeColumns+` FROM {entries} e JOIN {inodes} i ON i.id = e.inode WHERE e.parent = ? AND e.name = ?`, parent, name))
+}
+
+// lookup resolves the absolute path p an entry at a time.
+func (s store) lookup(p string) (*node, error) {
+	n, err := s.node(rootID)
+	if err != nil {
+		return nil, err
+	}
+	for _, name := range split(p) {
+		if !n.dir {
+			return nil, syscall.ENOTDIR
+		}
+		if n, err = s.child(n.id, name); err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// dir resolves the absolute path p of a directory.
+func (s store) dir(p string) (*node, error) {
+	n, err := s.lookup(p)
+	if err != nil {
+		return nil, err
+	}
+	if !n.dir {
+		return nil, syscall.ENOTDIR
+	}
+	return n, nil
+}
+
+// empty reports whether the directory id has no entries.
+func (s store) empty(id int64) (bool, error) {
+	var one int
+	err := s.row(`SELECT 1 FROM {entries} WHERE parent = ? LIMIT 1`, id).Scan(&one)
+	if errors.Is(err, dbsql.ErrNoRows) {
+		return true, nil
+	}
+	return false, err
+}
+
+// alloc inserts an inode without a name, the chunks of a file are chunk
+// bytes long.
+func (s store) alloc(dir bool, perm fs.FileMode, mtime time.Time, chunk int64) (int64, error) {
+	d := 0
+	if dir {
+		d = 1
+	}
+
+	var id int64
+	err := s.row(`INSERT INTO {inodes} (dir, mode, size, mtime, chunk) VALUES (?, ?, 0, ?, ?) RETURNING id`,
+		d, int64(perm.Perm()), mtime.UnixNano(), chunk).Scan(&id)
+	return id, err
+}
+
+// link names the inode id in the directory parent.
+func (s store) link(parent int64, name string, id int64) error {
+	return s.exec(`INSERT INTO {entries} (parent, name, inode) VALUES (?, ?, ?)`, parent, name, id)
+}
+
+// free removes the inode id and its chunks, its entry is removed already.
+func (s store) free(id int64) error {
+	if err := s.exec(`DELETE FROM {chunks} WHERE inode = ?`, id); err != nil {
+		return err
+	}
+	return s.exec(`DELETE FROM {inodes} WHERE id = ?`, id)
+}
+
+// put names the file inode id p, replacing the file named p and keeping its
+// mode.
+func (s store) put(p string, id int64) error {
+	if p == "/" {
+		return syscall.EISDIR
+	}
+	parent, err := s.dir(path.Dir(p))
+	if err != nil {
+		return err
+	}
+
+	old, err := s.child(parent.id, path.Base(p))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		return s.link(parent.id, path.Base(p), id)
+	case err != nil:
+		return err
+	case old.dir:
+		return syscall.EISDIR
+	}
+
+	if err := s.exec(`UPDATE {inodes} SET mode = ? WHERE id = ?`, old.mode, id); err != nil {
+		return err
+	}
+	if err := s.exec(`UPDATE {entries} SET inode = ? WHERE inode = ?`, id, old.id); err != nil {
+		return err
+	}
+	return s.free(old.id)
+}
+
+// rename moves the entry of the absolute path po to pn, replacing a file or
+// an empty directory.
+func (s store) rename(po, pn string) error {
+	src, err := s.lookup(po)
+	if err != nil {
+		return err
+	}
+	if po == pn {
+		return nil
+	}
+	if src.dir && strings.HasPrefix(pn+"/", po+"/") {
+		return syscall.EINVAL
+	}
+	parent, err := s.dir(path.Dir(pn))
+	if err != nil {
+		return err
+	}
+
+	dst, err := s.child(parent.id, path.Base(pn))
+	switch {
+	case errors.Is(err, fs.ErrNotExist):
+		dst = nil
+	case err != nil:
+		return err
+	case dst.dir && !src.dir:
+		return syscall.EISDIR
+	case !dst.dir && src.dir:
+		return syscall.ENOTDIR
+	case dst.dir:
+		empty, err := s.empty(dst.id)
+		if err != nil {
+			return err
+		}
+		if !empty {
+			return syscall.ENOTEMPTY
+		}
+	}
+
+	if dst != nil {
+		if err := s.exec(`DELETE FROM {entries} WHERE inode = ?`, dst.id); err != nil {
+			return err
+		}
+		if err := s.free(dst.id); err != nil {
+			return err
+		}
+	}
+	return s.exec(`UPDATE {entries} SET parent = ?, name = ? WHERE inode = ?`, parent.id, path.Base(pn), src.id)
+}
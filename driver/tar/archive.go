@@ -0,0 +1,247 @@
+package tar
+
+import (
+	archive "archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"github.com/klauspost/compress/zstd"
+	"io"
+	"path"
+	"sort"
+	"strings"
+)
+
+// The magic numbers starting the compressed archives.
+var (
+	gzipMagic = []byte{0x1f, 0x8b}
+	zstdMagic = []byte{0x28, 0xb5, 0x2f, 0xfd}
+)
+
+// detect returns the compression of the archive from its first bytes.
+func detect(ra io.ReaderAt) string {
+	magic := make([]byte, 4)
+	n, _ := ra.ReadAt(magic, 0)
+	switch magic = magic[:n]; {
+	case bytes.HasPrefix(magic, gzipMagic):
+		return Gzip
+	case bytes.HasPrefix(magic, zstdMagic):
+		return Zstd
+	}
+	return None
+}
+
+// compressionOf returns the compression the extension of the archive names.
+func compressionOf(name string) string {
+	switch ext := path.Ext(name); ext {
+	case ".gz", ".tgz":
+		return Gzip
+	case ".zst", ".zstd", ".tzst":
+		return Zstd
+	}
+	return None
+}
+
+// decompress returns the archive compressed with compression decompressed,
+// read from its start.
+func decompress(r io.Reader, compression string) (io.ReadCloser, error) {
+	switch compression {
+	case Gzip:
+		return gzip.NewReader(r)
+	case Zstd:
+		d, err := zstd.NewReader(r, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return d.IOReadCloser(), nil
+	case None:
+		return io.NopCloser(r), nil
+	}
+	return nil, errors.New("unknown compression " + compression)
+}
+
+// compress returns a writer compressing to w with compression, closing it
+// ends the compressed stream.
+func compress(w io.Writer, compression string) (io.WriteCloser, error) {
+	switch compression {
+	case Gzip:
+		return gzip.NewWriter(w), nil
+	case Zstd:
+		return zstd.NewWriter(w, zstd.WithEncoderConcurrency(1))
+	case None:
+		return nopWriteCloser{w}, nil
+	}
+	return nil, errors.New("unknown compression " + compression)
+}
+
+type nopWriteCloser struct {
+	io.Writer
+}
+
+func (nopWriteCloser) Close() error {
+	return nil
+}
+
+// counter counts the bytes read from r.
+type counter struct {
+	r io.Reader
+	n int64
+}
+
+func (c *counter) Read(p []byte) (int, error) {
+	n, err := c.r.Read(p)
+	c.n += int64(n)
+	return n, err
+}
+
+// sequence reads contents at increasing offsets of the archive decompressed
+// in a single pass.
+type sequence struct {
+	conn *tarConn
+	r    io.ReadCloser
+	pos  int64
+}
+
+// reader returns the content c.
+func (s *sequence) reader(c *content) (io.Reader, error) {
+	if c.mem {
+		return bytes.NewReader(c.data), nil
+	}
+	if s.conn.compression == None {
+		return io.NewSectionReader(s.conn.ra, c.off, c.size), nil
+	}
+
+	if s.r == nil || s.pos > c.off {
+		if s.r != nil {
+			_ = s.r.Close()
+		}
+		r, err := s.conn.stream()
+		if err != nil {
+			return nil, err
+		}
+		s.r, s.pos = r, 0
+	}
+	n, err := io.CopyN(io.Discard, s.r, c.off-s.pos)
+	s.pos += n
+	if err != nil {
+		return nil, err
+	}
+	s.pos += c.size
+	return io.LimitReader(s.r, c.size), nil
+}
+
+func (s *sequence) close() {
+	if s.r != nil {
+		_ = s.r.Close()
+	}
+}
+
+// writeArchive writes the tree of root as an archive to w: the directories
+// and symbolic links, parents first, then the files in the order of their
+// content in the archive read, the hard links of a content after the first
+// of its files.
+func (conn *tarConn) writeArchive(w io.Writer, compression string) error {
+	type file struct {
+		name string
+		e    *entry
+	}
+	var dirs, files []file
+	var collect func(name string, e *entry)
+	collect = func(name string, e *entry) {
+		names := make([]string, 0, len(e.children))
+		for child := range e.children {
+			names = append(names, child)
+		}
+		sort.Strings(names)
+		for _, child := range names {
+			c := e.children[child]
+			switch p := strings.TrimPrefix(name+"/"+child, "/"); {
+			case c.isDir():
+				dirs = append(dirs, file{p + "/", c})
+				collect(p, c)
+			case c.isSymlink():
+				dirs = append(dirs, file{p, c})
+			default:
+				files = append(files, file{p, c})
+			}
+		}
+	}
+	collect("", conn.root)
+	sort.SliceStable(files, func(i, j int) bool {
+		a, b := files[i].e.content, files[j].e.content
+		if a.mem != b.mem {
+			return !a.mem
+		}
+		return !a.mem && a.off < b.off
+	})
+
+	cw, err := compress(w, compression)
+	if err != nil {
+		return err
+	}
+	tw := archive.NewWriter(cw)
+	seq := &sequence{conn: conn}
+	defer seq.close()
+
+	written := map[*content]string{}
+	for _, f := range append(dirs, files...) {
+		hdr := header(f.name, f.e)
+		if f.e.content != nil {
+			if first, ok := written[f.e.content]; ok {
+				hdr.Typeflag, hdr.Linkname, hdr.Size = archive.TypeLink, first, 0
+			}
+		}
+		if err := tw.WriteHeader(hdr); err != nil {
+			return err
+		}
+		if hdr.Typeflag != archive.TypeReg {
+			continue
+		}
+
+		written[f.e.content] = f.name
+		r, err := seq.reader(f.e.content)
+		if err != nil {
+			return err
+		}
+		if _, err := io.CopyN(tw, r, f.e.content.size); err != nil {
+			return err
+		}
+	}
+
+	if err := tw.Close(); err != nil {
+		return err
+	}
+	return cw.Close()
+}
+
+// header returns the header of the entry named name, with the owner and the
+// records of the header it was read from.
+func header(name string, e *entry) *archive.Header {
+	hdr := &archive.Header{
+		Name:    name,
+		Mode:    int64(e.mode.Perm()),
+		ModTime: e.modTime,
+	}
+	if e.hdr != nil {
+		hdr.Uid, hdr.Gid = e.hdr.Uid, e.hdr.Gid
+		hdr.Uname, hdr.Gname = e.hdr.Uname, e.hdr.Gname
+		for k, v := range e.hdr.PAXRecords {
+			if strings.HasPrefix(k, "SCHILY.") || strings.HasPrefix(k, "LIBARCHIVE.") {
+				if hdr.PAXRecords == nil {
+					hdr.PAXRecords = map[string]string{}
+				}
+				hdr.PAXRecords[k] = v
+			}
+		}
+	}
+
+	switch {
+	case e.isDir():
+		hdr.Typeflag = archive.TypeDir
+	case e.isSymlink():
+		hdr.Typeflag, hdr.Linkname = archive.TypeSymlink, e.link
+	default:
+		hdr.Typeflag, hdr.Size = archive.TypeReg, e.content.size
+	}
+	return hdr
+}
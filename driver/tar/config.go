@@ -0,0 +1,107 @@
+package tar
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"path"
+	"strconv"
+)
+
+// The compressions of an archive.
+const (
+	Gzip = "gzip"
+	Zstd = "zstd"
+	None = "none"
+)
+
+// options are the keys of the query the archive takes.
+var options = []string{"write", "compression"}
+
+type Config struct {
+	filesystem.Config
+
+	// Archive is the path of the archive, in FileSystem or Stack when one
+	// is set, on the local disk otherwise.
+	Archive string
+
+	// FileSystem holds the archive, it stays open once the archive is
+	// closed.
+	FileSystem filesystem.FileSystem
+
+	// Stack is the DSN of the filesystem holding the archive when
+	// FileSystem is nil, opened and closed with the archive.
+	Stack string
+
+	// Write allows changes, kept in memory until Close writes a new archive
+	// replacing the one read, created when missing.
+	Write bool
+
+	// Compression is the one of the archive written, Gzip, Zstd or None.
+	// By default it is the one of the archive read, or the one its
+	// extension names for a new archive.
+	Compression string
+}
+
+// stack returns the DSN of Stack parsed, nil when there is none.
+func (conf *Config) stack() *url.URL {
+	if conf.Stack == "" {
+		return nil
+	}
+	uri, err := url.Parse(conf.Stack)
+	if err != nil {
+		return nil
+	}
+	return uri
+}
+
+func (conf *Config) Driver() string {
+	if uri := conf.stack(); uri != nil {
+		return Driver + "+" + uri.Scheme
+	}
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	if uri := conf.stack(); uri != nil {
+		return uri.Host
+	}
+	return ""
+}
+
+func (conf *Config) Path() string {
+	if uri := conf.stack(); uri != nil {
+		return path.Join(uri.Path, conf.Archive)
+	}
+	return conf.Archive
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if uri := conf.stack(); uri != nil {
+		return uri.User
+	}
+	return nil
+}
+
+// Encode the options to url.Values, with the ones of the filesystem stacked
+// on
+func (conf *Config) Encode() url.Values {
+	values := url.Values{}
+	if uri := conf.stack(); uri != nil {
+		values = uri.Query()
+	}
+	if conf.Write {
+		values.Set("write", "true")
+	}
+	if conf.Compression != "" {
+		values.Set("compression", conf.Compression)
+	}
+	return values
+}
+
+// Decode write and compression, the query of Stack keeps the rest
+func (conf *Config) Decode(query url.Values) error {
+	conf.Write, _ = strconv.ParseBool(query.Get("write"))
+	conf.Compression = query.Get("compression")
+
+	return nil
+}
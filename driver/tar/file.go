@@ -0,0 +1,330 @@
+package tar
+
+import (
+	"bytes"
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"path"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.mode.IsDir()
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// tarFile reads a content at its offset, in a plain archive or in memory.
+type tarFile struct {
+	filesystem.Handle
+
+	vfs     *tarFs
+	name    string
+	info    *fileInfo
+	section *io.SectionReader
+}
+
+func (f *tarFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	return f.section.Read(p)
+}
+
+func (f *tarFile) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+	return f.section.ReadAt(p, off)
+}
+
+func (f *tarFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	off, err := f.section.Seek(offset, whence)
+	if err != nil {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+	return off, nil
+}
+
+func (f *tarFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.abs(f.name), Err: syscall.EBADF}
+}
+
+func (f *tarFile) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *tarFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.abs(f.name), Err: err}
+	}
+	return nil
+}
+
+// tarStream decompresses the archive up to a content on its first read. A
+// seek forward skips the content in between, a seek back decompresses the
+// archive again from its start.
+type tarStream struct {
+	filesystem.Handle
+
+	vfs     *tarFs
+	name    string
+	info    *fileInfo
+	content *content
+
+	// off is the offset of the next read, seq reads the archive.
+	off int64
+	seq *sequence
+	r   io.Reader
+	pos int64
+}
+
+func (f *tarStream) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+	if f.off >= f.content.size {
+		return 0, io.EOF
+	}
+
+	if f.r == nil || f.pos > f.off {
+		if f.seq != nil {
+			f.seq.close()
+		}
+		f.seq = &sequence{conn: f.vfs.conn}
+		r, err := f.seq.reader(f.content)
+		if err != nil {
+			f.r = nil
+			return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: err}
+		}
+		f.r, f.pos = r, 0
+	}
+	if f.pos < f.off {
+		n, err := io.CopyN(io.Discard, f.r, f.off-f.pos)
+		f.pos += n
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: err}
+		}
+	}
+
+	n, err := f.r.Read(p)
+	f.pos += int64(n)
+	f.off = f.pos
+	if err == io.EOF && f.off < f.content.size {
+		err = io.ErrUnexpectedEOF
+	}
+	if err != nil && err != io.EOF {
+		return n, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: err}
+	}
+	return n, err
+}
+
+func (f *tarStream) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += f.content.size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *tarStream) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.abs(f.name), Err: syscall.EBADF}
+}
+
+func (f *tarStream) Stat() (fs.FileInfo, error) {
+	return f.info, nil
+}
+
+func (f *tarStream) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.abs(f.name), Err: err}
+	}
+	if f.seq != nil {
+		f.seq.close()
+		f.seq, f.r = nil, nil
+	}
+	return nil
+}
+
+// tarWriter holds the content written to it in memory, and replaces the
+// content of the file with it once it is closed.
+type tarWriter struct {
+	filesystem.Handle
+
+	vfs  *tarFs
+	name string
+	buf  bytes.Buffer
+}
+
+func (w *tarWriter) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Closed() {
+		return 0, &fs.PathError{Op: "write", Path: w.vfs.abs(w.name), Err: fs.ErrClosed}
+	}
+	return w.buf.Write(p)
+}
+
+func (w *tarWriter) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.vfs.abs(w.name), Err: syscall.EBADF}
+}
+
+func (w *tarWriter) Stat() (fs.FileInfo, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	return &fileInfo{name: path.Base(w.vfs.abs(w.name)), size: int64(w.buf.Len()), mode: 0644, modTime: time.Now()}, nil
+}
+
+// Close replaces the content of the file, kept in the archive written when
+// the filesystem is closed, by this close as well.
+func (w *tarWriter) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.abs(w.name), Err: err}
+	}
+
+	w.vfs.conn.mu.Lock()
+	defer w.vfs.conn.mu.Unlock()
+
+	if err := w.vfs.put(w.name, w.buf.Bytes()); err != nil {
+		return &fs.PathError{Op: "close", Path: w.vfs.abs(w.name), Err: err}
+	}
+	w.vfs.conn.changed = true
+	return nil
+}
+
+// tarDir lists the directory as it was opened.
+type tarDir struct {
+	filesystem.Handle
+
+	vfs  *tarFs
+	name string
+	info *fileInfo
+
+	list []fs.DirEntry
+	off  int
+}
+
+func (d *tarDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: fs.ErrClosed}
+	}
+
+	rest := d.list[d.off:]
+	if n <= 0 {
+		d.off = len(d.list)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *tarDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *tarDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *tarDir) Stat() (fs.FileInfo, error) {
+	return d.info, nil
+}
+
+func (d *tarDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.abs(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*tarDir)(nil)
+	_ io.ReaderAt            = (*tarFile)(nil)
+	_ io.Seeker              = (*tarFile)(nil)
+	_ io.Seeker              = (*tarStream)(nil)
+)
@@ -0,0 +1,242 @@
+package tar
+
+import (
+	archive "archive/tar"
+	"errors"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// entry is a file, a directory or a symbolic link of the archive.
+type entry struct {
+	name    string
+	mode    fs.FileMode
+	modTime time.Time
+
+	// content is the one of a file, shared by its hard links.
+	content *content
+
+	// link is the target of a symbolic link.
+	link string
+
+	// children are the entries of a directory by name.
+	children map[string]*entry
+
+	// hdr is the header the entry was read from, nil for the ones the
+	// archive has none for, its owner and records are written again.
+	hdr *archive.Header
+}
+
+// content is the content of a file, at an offset of the archive
+// decompressed, or in memory once written.
+type content struct {
+	size int64
+	off  int64
+
+	// data is the content in memory, for a file written or sparse.
+	data []byte
+	mem  bool
+}
+
+func newDir(name string, perm fs.FileMode, modTime time.Time) *entry {
+	return &entry{name: name, mode: fs.ModeDir | perm.Perm(), modTime: modTime, children: map[string]*entry{}}
+}
+
+func newFile(name string, perm fs.FileMode, data []byte) *entry {
+	return &entry{
+		name:    name,
+		mode:    perm.Perm(),
+		modTime: time.Now(),
+		content: &content{size: int64(len(data)), data: data, mem: true},
+	}
+}
+
+func (e *entry) isDir() bool {
+	return e.mode.IsDir()
+}
+
+func (e *entry) isSymlink() bool {
+	return e.mode&fs.ModeSymlink != 0
+}
+
+func (e *entry) info() *fileInfo {
+	var size int64
+	switch {
+	case e.content != nil:
+		size = e.content.size
+	case e.isSymlink():
+		size = int64(len(e.link))
+	}
+	return &fileInfo{name: e.name, size: size, mode: e.mode, modTime: e.modTime}
+}
+
+// list returns the entries of the directory, sorted by name.
+func (e *entry) list() []fs.DirEntry {
+	list := make([]fs.DirEntry, 0, len(e.children))
+	for _, child := range e.children {
+		list = append(list, fs.FileInfoToDirEntry(child.info()))
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Name() < list[j].Name() })
+	return list
+}
+
+// maxLinks is the most symbolic links a walk follows, like the kernel.
+const maxLinks = 40
+
+// walk resolves the path p below the directory top, following the symbolic
+// links but the one p names unless follow. The target of a link is walked in
+// its place: a relative one from the directory of the link, an absolute one
+// from top. A walk never goes above top.
+func walk(top *entry, p string, follow bool) (*entry, error) {
+	stack := []*entry{top}
+	links := 0
+
+	for name := p; name != ""; {
+		var elem string
+		if i := strings.IndexByte(name, '/'); i >= 0 {
+			elem, name = name[:i], name[i+1:]
+		} else {
+			elem, name = name, ""
+		}
+
+		switch elem {
+		case "", ".":
+			continue
+		case "..":
+			if len(stack) > 1 {
+				stack = stack[:len(stack)-1]
+			}
+			continue
+		}
+
+		parent := stack[len(stack)-1]
+		if !parent.isDir() {
+			return nil, syscall.ENOTDIR
+		}
+		e, ok := parent.children[elem]
+		if !ok {
+			return nil, fs.ErrNotExist
+		}
+		if !e.isSymlink() || !follow && name == "" {
+			stack = append(stack, e)
+			continue
+		}
+
+		links++
+		switch {
+		case links > maxLinks:
+			return nil, syscall.ELOOP
+		case strings.HasPrefix(e.link, "/"):
+			stack = stack[:1]
+		}
+		if name == "" {
+			name = e.link
+		} else {
+			name = e.link + "/" + name
+		}
+	}
+	return stack[len(stack)-1], nil
+}
+
+// readIndex reads the headers of the archive decompressed, pos returns the
+// offset r is at. The parents the archive has no entry for are directories
+// modified at modTime, a directory wins over a file of the same name and a
+// later entry over an earlier one. The content of a sparse file is read in
+// memory, the one of the other files stays in the archive.
+func readIndex(r io.Reader, pos func() int64, modTime time.Time) (*entry, error) {
+	root := newDir("/", 0755, modTime)
+	tr := archive.NewReader(r)
+
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return root, nil
+		}
+		if err != nil {
+			return nil, err
+		}
+
+		// names escaping the root stay in it
+		p := path.Clean("/" + hdr.Name)
+		if p == "/" {
+			continue
+		}
+
+		e := &entry{name: path.Base(p), modTime: hdr.ModTime, hdr: hdr}
+		perm := fs.FileMode(hdr.Mode).Perm()
+		switch hdr.Typeflag {
+		case archive.TypeDir:
+			e.mode, e.children = fs.ModeDir|perm, map[string]*entry{}
+		case archive.TypeSymlink:
+			e.mode, e.link = fs.ModeSymlink|0777, hdr.Linkname
+		case archive.TypeLink:
+			target, err := walk(root, path.Clean("/"+hdr.Linkname), false)
+			if errors.Is(err, fs.ErrNotExist) || err == nil && target.content == nil {
+				// a link to a file the archive does not have
+				continue
+			}
+			if err != nil {
+				return nil, err
+			}
+			e.mode, e.content = perm, target.content
+		case archive.TypeReg, archive.TypeGNUSparse:
+			e.mode, e.content = perm, &content{size: hdr.Size, off: pos()}
+			if sparse(hdr) {
+				data, err := io.ReadAll(tr)
+				if err != nil {
+					return nil, err
+				}
+				e.content = &content{size: int64(len(data)), data: data, mem: true}
+			}
+		default:
+			// devices and pipes are no files of a filesystem
+			continue
+		}
+
+		parent := mkdirAll(root, path.Dir(p), modTime)
+		if old, ok := parent.children[e.name]; ok && old.isDir() {
+			if !e.isDir() {
+				continue
+			}
+			e.children = old.children
+		}
+		parent.children[e.name] = e
+	}
+}
+
+// sparse reports whether the header is the one of a sparse file, the
+// content of which is not at an offset of the archive.
+func sparse(hdr *archive.Header) bool {
+	if hdr.Typeflag == archive.TypeGNUSparse {
+		return true
+	}
+	for k := range hdr.PAXRecords {
+		if strings.HasPrefix(k, "GNU.sparse.") {
+			return true
+		}
+	}
+	return false
+}
+
+// mkdirAll returns the directory at the cleaned absolute path p below root,
+// added with its parents when missing.
+func mkdirAll(root *entry, p string, modTime time.Time) *entry {
+	dir := root
+	for _, name := range strings.Split(p, "/") {
+		if name == "" {
+			continue
+		}
+		e, ok := dir.children[name]
+		if !ok || !e.isDir() {
+			e = newDir(name, 0755, modTime)
+			dir.children[name] = e
+		}
+		dir = e
+	}
+	return dir
+}
@@ -0,0 +1,342 @@
+package tar
+
+import (
+	archive "archive/tar"
+	"bytes"
+	"compress/gzip"
+	"github.com/lazychanger/go-vfs"
+	_ "github.com/lazychanger/go-vfs/driver/memory"
+	_ "github.com/lazychanger/go-vfs/driver/os"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var (
+	mtime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	// long is a name too long for a ustar header.
+	long = strings.Repeat("long/", 30) + "name.txt"
+)
+
+// build returns an archive compressed with compression: a file with implicit
+// parents, names too long for ustar in PAX and GNU headers, a symbolic link
+// and a hard link.
+func build(t *testing.T, compression string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	cw, err := compress(&buf, compression)
+	require.NoError(t, err)
+
+	tw := archive.NewWriter(cw)
+	for _, hdr := range []*archive.Header{
+		{Name: "a/b/c.txt", Typeflag: archive.TypeReg, Mode: 0640, Size: 9000, Uname: "app"},
+		{Name: "e/", Typeflag: archive.TypeDir, Mode: 0700},
+		{Name: long, Typeflag: archive.TypeReg, Mode: 0644, Size: 4, Format: archive.FormatPAX},
+		{Name: "gnu/" + long, Typeflag: archive.TypeReg, Mode: 0644, Size: 3, Format: archive.FormatGNU},
+		{Name: "e/link", Typeflag: archive.TypeSymlink, Linkname: "../a/b"},
+		{Name: "hard.txt", Typeflag: archive.TypeLink, Linkname: "a/b/c.txt"},
+		{Name: "dev", Typeflag: archive.TypeChar},
+	} {
+		hdr.ModTime = mtime
+		require.NoError(t, tw.WriteHeader(hdr))
+		switch hdr.Name {
+		case "a/b/c.txt":
+			_, err = io.WriteString(tw, strings.Repeat("content ", 1125))
+		case long:
+			_, err = io.WriteString(tw, "pax!")
+		case "gnu/" + long:
+			_, err = io.WriteString(tw, "gnu")
+		}
+		require.NoError(t, err)
+	}
+	require.NoError(t, tw.Close())
+	require.NoError(t, cw.Close())
+	return buf.Bytes()
+}
+
+// logs returns the path of an archive on the local disk.
+func logs(t *testing.T, name, compression string) string {
+	t.Helper()
+	p := filepath.Join(t.TempDir(), name)
+	require.NoError(t, os.WriteFile(p, build(t, compression), 0644))
+	return p
+}
+
+func TestTarConformance(t *testing.T) {
+	vfstest.TestDriver(t, "tar://"+filepath.ToSlash(filepath.Join(t.TempDir(), "vfs.tar.gz"))+"?write=true")
+}
+
+func TestTarRead(t *testing.T) {
+	for _, c := range []struct{ name, compression string }{
+		{"logs.tar", None},
+		{"logs.tar.gz", Gzip},
+		{"logs.tar.zst", Zstd},
+		{"logs.bin", Gzip},
+	} {
+		t.Run(c.name, func(t *testing.T) {
+			vfs := vfstest.Open(t, "tar://"+filepath.ToSlash(logs(t, c.name, c.compression)))
+			assert.Equal(t, c.compression, vfs.(*tarFs).conn.compression, "detected from the first bytes")
+
+			list, err := filesystem.ReadDir(vfs, "/")
+			require.NoError(t, err)
+			var names []string
+			for _, e := range list {
+				names = append(names, e.Name())
+			}
+			assert.Equal(t, []string{"a", "e", "gnu", "hard.txt", "long"}, names, "no devices")
+
+			data, err := filesystem.ReadFile(vfs, "/a/b/c.txt")
+			require.NoError(t, err)
+			assert.Equal(t, strings.Repeat("content ", 1125), string(data))
+			data, err = filesystem.ReadFile(vfs, long)
+			require.NoError(t, err)
+			assert.Equal(t, "pax!", string(data))
+			data, err = filesystem.ReadFile(vfs, "/gnu/"+long)
+			require.NoError(t, err)
+			assert.Equal(t, "gnu", string(data))
+
+			info, err := vfs.Stat("/a/b/c.txt")
+			require.NoError(t, err)
+			assert.Equal(t, fs.FileMode(0640), info.Mode())
+			assert.True(t, info.ModTime().Equal(mtime))
+			info, err = vfs.Stat("/e")
+			require.NoError(t, err)
+			assert.Equal(t, fs.ModeDir|0700, info.Mode())
+
+			// the symbolic link is followed, the hard link shares the content
+			data, err = filesystem.ReadFile(vfs, "/e/link/c.txt")
+			require.NoError(t, err)
+			assert.Len(t, data, 9000)
+			target, err := filesystem.Readlink(vfs, "/e/link")
+			require.NoError(t, err)
+			assert.Equal(t, "../a/b", target)
+			info, err = filesystem.Lstat(vfs, "/e/link")
+			require.NoError(t, err)
+			assert.Equal(t, fs.ModeSymlink, info.Mode().Type())
+			assert.True(t, vfs.IsDir("/e/link"))
+			data, err = filesystem.ReadFile(vfs, "/hard.txt")
+			require.NoError(t, err)
+			assert.Len(t, data, 9000)
+
+			// a file seeks, back as well
+			f, err := vfs.Open("/a/b/c.txt")
+			require.NoError(t, err)
+			defer f.Close()
+			_, err = f.(io.Seeker).Seek(-8, io.SeekEnd)
+			require.NoError(t, err)
+			rest, err := io.ReadAll(f)
+			require.NoError(t, err)
+			assert.Equal(t, "content ", string(rest))
+			_, err = f.(io.Seeker).Seek(1, io.SeekStart)
+			require.NoError(t, err)
+			buf := make([]byte, 6)
+			_, err = io.ReadFull(f, buf)
+			require.NoError(t, err)
+			assert.Equal(t, "ontent", string(buf))
+			_, ok := f.(io.ReaderAt)
+			assert.Equal(t, c.compression == None, ok, "a file of a plain archive reads at an offset")
+
+			sub, err := vfs.Sub("/e/link")
+			require.NoError(t, err)
+			assert.True(t, sub.IsFile("c.txt"))
+		})
+	}
+}
+
+func TestTarReadOnly(t *testing.T) {
+	vfs := vfstest.Open(t, "tar://"+filepath.ToSlash(logs(t, "logs.tar", None)))
+
+	_, err := vfs.Create("/new")
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Mkdir("/new", 0755), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.MkdirAll("/a/new", 0755), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Remove("/hard.txt"), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.RemoveAll("/a"), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Rename("/a", "/b"), fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.WriteFile(vfs, "/hard.txt", nil), fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.Symlink(vfs, "a", "/b"), fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.Chmod(vfs, "/hard.txt", 0600), fs.ErrPermission)
+
+	_, err = filesystem.Open("tar://" + filepath.ToSlash(filepath.Join(t.TempDir(), "missing.tar")))
+	assert.ErrorIs(t, err, fs.ErrNotExist, "created only to be written")
+}
+
+func TestTarWrite(t *testing.T) {
+	archivePath := logs(t, "logs.tar.zst", Zstd)
+	vfs, err := filesystem.Open("tar://" + filepath.ToSlash(archivePath) + "?write=true")
+	require.NoError(t, err)
+
+	require.NoError(t, filesystem.WriteFile(vfs, "/a/b/new.txt", []byte("new")))
+	require.NoError(t, vfs.Rename("/a", "/z"))
+	require.NoError(t, vfs.RemoveAll("/gnu"))
+	require.NoError(t, filesystem.Symlink(vfs, "/z/b/new.txt", "/latest"))
+	require.NoError(t, filesystem.Truncate(vfs, "/z/b/c.txt", 7))
+	w, err := vfs.Create("/open.txt")
+	require.NoError(t, err)
+	_, err = io.WriteString(w, "kept by Close")
+	require.NoError(t, err)
+
+	before, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+	assert.Equal(t, build(t, Zstd), before, "the archive is written on Close")
+	require.NoError(t, filesystem.Close(vfs))
+	_, err = os.Stat(archivePath + ".tmp")
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	vfs = vfstest.Open(t, "tar://"+filepath.ToSlash(archivePath))
+	assert.Equal(t, Zstd, vfs.(*tarFs).conn.compression, "the compression of the archive read")
+	data, err := filesystem.ReadFile(vfs, "/latest")
+	require.NoError(t, err)
+	assert.Equal(t, "new", string(data))
+	data, err = filesystem.ReadFile(vfs, "/z/b/c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "content", string(data))
+	data, err = filesystem.ReadFile(vfs, "/hard.txt")
+	require.NoError(t, err)
+	assert.Len(t, data, 9000, "the link keeps the content it had")
+	data, err = filesystem.ReadFile(vfs, "/open.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "kept by Close", string(data))
+	data, err = filesystem.ReadFile(vfs, long)
+	require.NoError(t, err)
+	assert.Equal(t, "pax!", string(data))
+	assert.False(t, vfs.Exists("/a"))
+	assert.False(t, vfs.Exists("/gnu"))
+
+	// the headers keep their owner, the shared contents their hard links
+	headers := read(t, archivePath)
+	assert.Equal(t, "app", headers["z/b/c.txt"].Uname)
+	assert.Equal(t, byte(archive.TypeDir), headers["z/"].Typeflag)
+	assert.Equal(t, byte(archive.TypeSymlink), headers["latest"].Typeflag)
+	assert.Equal(t, byte(archive.TypeReg), headers["hard.txt"].Typeflag, "the content of the link is no longer shared")
+
+	// a new archive, with the compression of its extension
+	created := filepath.Join(t.TempDir(), "new.tgz")
+	vfs, err = filesystem.Open("tar://" + filepath.ToSlash(created) + "?write=true")
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteFile(vfs, "/a", []byte("a")))
+	require.NoError(t, filesystem.WriteFile(vfs, "/b", []byte("b")))
+	require.NoError(t, vfs.(filesystem.SymlinkFS).Symlink("a", "/c"))
+	require.NoError(t, filesystem.Close(vfs))
+	raw, err := os.ReadFile(created)
+	require.NoError(t, err)
+	_, err = gzip.NewReader(bytes.NewReader(raw))
+	assert.NoError(t, err)
+
+	// a hard link written again as one
+	archivePath = logs(t, "logs.tar", None)
+	vfs = vfstest.Open(t, "tar://"+filepath.ToSlash(archivePath)+"?write=true&compression=none")
+	require.NoError(t, vfs.Remove("/e/link"))
+	require.NoError(t, filesystem.Close(vfs))
+	headers = read(t, archivePath)
+	assert.Equal(t, byte(archive.TypeLink), headers["hard.txt"].Typeflag)
+	assert.Equal(t, "a/b/c.txt", headers["hard.txt"].Linkname)
+	assert.NotContains(t, headers, "e/link")
+}
+
+// read returns the headers of the archive on the local disk by name.
+func read(t *testing.T, name string) map[string]*archive.Header {
+	t.Helper()
+	f, err := os.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+	r, err := decompress(f, detect(f))
+	require.NoError(t, err)
+	defer r.Close()
+
+	headers := map[string]*archive.Header{}
+	tr := archive.NewReader(r)
+	for {
+		hdr, err := tr.Next()
+		if err == io.EOF {
+			return headers
+		}
+		require.NoError(t, err)
+		headers[hdr.Name] = hdr
+	}
+}
+
+func TestTarStack(t *testing.T) {
+	// an archive in a filesystem of the program, written back to it
+	mem := vfstest.Open(t, "memory:///")
+	require.NoError(t, filesystem.WriteFile(mem, "/logs.tar.gz", build(t, Gzip)))
+	vfs, err := New(&Config{Archive: "/logs.tar.gz", FileSystem: mem, Write: true})
+	require.NoError(t, err)
+	require.NoError(t, filesystem.WriteFile(vfs, "/app.log", []byte("line")))
+	require.NoError(t, filesystem.Close(vfs))
+	assert.False(t, mem.Exists("/logs.tar.gz.tmp"))
+
+	vfs, err = New(&Config{Archive: "/logs.tar.gz", FileSystem: mem})
+	require.NoError(t, err)
+	data, err := filesystem.ReadFile(vfs, "/app.log")
+	require.NoError(t, err)
+	assert.Equal(t, "line", string(data))
+	assert.True(t, vfs.IsFile("/a/b/c.txt"))
+	require.NoError(t, filesystem.Close(vfs))
+
+	// an archive in a filesystem of a DSN, which the options are not passed to
+	archivePath := logs(t, "logs.tar", None)
+	dsn := "tar+os://" + filepath.ToSlash(archivePath) + "?write=true"
+	vfs = vfstest.Open(t, dsn)
+	conf := vfs.(*tarFs).config
+	assert.Equal(t, "os://"+filepath.ToSlash(filepath.Dir(archivePath)), conf.Stack)
+	assert.Equal(t, "true", conf.Encode().Get("write"))
+	assert.Equal(t, strings.TrimSuffix(dsn, "?write=true"), filesystem.BuildDsn(conf))
+	require.NoError(t, filesystem.WriteFile(vfs, "/app.log", []byte("line")))
+	require.NoError(t, filesystem.Close(vfs))
+
+	vfs = vfstest.Open(t, "tar://"+filepath.ToSlash(archivePath))
+	assert.True(t, vfs.IsFile("/app.log"))
+}
+
+func TestTarWalk(t *testing.T) {
+	vfs := vfstest.Open(t, "tar://"+filepath.ToSlash(filepath.Join(t.TempDir(), "new.tar"))+"?write=true")
+
+	require.NoError(t, vfs.MkdirAll("/a/b", 0755))
+	require.NoError(t, filesystem.Symlink(vfs, "/a", "/abs"))
+	require.NoError(t, filesystem.Symlink(vfs, "loop", "/loop"))
+	require.NoError(t, filesystem.Symlink(vfs, "missing/x", "/dangling"))
+
+	assert.True(t, vfs.IsDir("/abs/b"))
+	require.NoError(t, vfs.MkdirAll("/abs/b/c", 0755), "through a link")
+	assert.True(t, vfs.IsDir("/a/b/c"))
+	_, err := vfs.Stat("/loop")
+	assert.ErrorIs(t, err, syscall.ELOOP)
+	assert.ErrorIs(t, vfs.MkdirAll("/dangling/y", 0755), fs.ErrNotExist)
+
+	// an absolute link resolves from the root of the view
+	sub, err := vfs.Sub("/a")
+	require.NoError(t, err)
+	require.NoError(t, filesystem.Symlink(sub, "/b", "/top"))
+	assert.True(t, sub.IsDir("/top/c"))
+
+	assert.ErrorIs(t, vfs.Rename("/a", "/a/b/d"), syscall.EINVAL)
+	assert.ErrorIs(t, vfs.Remove("/"), syscall.EBUSY)
+	assert.ErrorIs(t, vfs.Remove("/a"), syscall.ENOTEMPTY)
+	require.NoError(t, vfs.RemoveAll("/"))
+	assert.True(t, vfs.IsDir("/"))
+	assert.False(t, vfs.Exists("/a"))
+}
+
+func TestTarOpen(t *testing.T) {
+	_, err := filesystem.Open("tar://")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+	_, err = filesystem.Open("tar://" + filepath.ToSlash(t.TempDir()))
+	assert.ErrorIs(t, err, syscall.EISDIR)
+	_, err = filesystem.Open("tar://" + filepath.ToSlash(logs(t, "logs.tar", None)) + "?compression=xz")
+	assert.Error(t, err)
+
+	name := filepath.Join(t.TempDir(), "text.tar.gz")
+	require.NoError(t, os.WriteFile(name, []byte("\x1f\x8bnot an archive"), 0644))
+	_, err = filesystem.Open("tar://" + filepath.ToSlash(name))
+	assert.Error(t, err)
+}
@@ -0,0 +1,76 @@
+package zip
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"net/url"
+	"path"
+)
+
+type Config struct {
+	filesystem.Config
+
+	// Archive is the path of the archive, in FileSystem or Stack when one
+	// is set, on the local disk otherwise.
+	Archive string
+
+	// FileSystem holds the archive, it stays open once the archive is
+	// closed.
+	FileSystem filesystem.FileSystem
+
+	// Stack is the DSN of the filesystem holding the archive when
+	// FileSystem is nil, opened and closed with the archive.
+	Stack string
+}
+
+// stack returns the DSN of Stack parsed, nil when there is none.
+func (conf *Config) stack() *url.URL {
+	if conf.Stack == "" {
+		return nil
+	}
+	uri, err := url.Parse(conf.Stack)
+	if err != nil {
+		return nil
+	}
+	return uri
+}
+
+func (conf *Config) Driver() string {
+	if uri := conf.stack(); uri != nil {
+		return Driver + "+" + uri.Scheme
+	}
+	return Driver
+}
+
+func (conf *Config) Host() string {
+	if uri := conf.stack(); uri != nil {
+		return uri.Host
+	}
+	return ""
+}
+
+func (conf *Config) Path() string {
+	if uri := conf.stack(); uri != nil {
+		return path.Join(uri.Path, conf.Archive)
+	}
+	return conf.Archive
+}
+
+func (conf *Config) UserInfo() *url.Userinfo {
+	if uri := conf.stack(); uri != nil {
+		return uri.User
+	}
+	return nil
+}
+
+// Encode the options to url.Values, the ones of the filesystem stacked on
+func (conf *Config) Encode() url.Values {
+	if uri := conf.stack(); uri != nil {
+		return uri.Query()
+	}
+	return url.Values{}
+}
+
+// Decode the url.Values to options, the archive has none
+func (conf *Config) Decode(query url.Values) error {
+	return nil
+}
@@ -0,0 +1,275 @@
+package zip
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"syscall"
+	"time"
+)
+
+type fileInfo struct {
+	name    string
+	size    int64
+	mode    fs.FileMode
+	modTime time.Time
+	dir     bool
+}
+
+func (fi *fileInfo) Name() string {
+	return fi.name
+}
+
+func (fi *fileInfo) Size() int64 {
+	return fi.size
+}
+
+func (fi *fileInfo) Mode() fs.FileMode {
+	if fi.dir {
+		return fs.ModeDir | fi.mode
+	}
+	return fi.mode
+}
+
+func (fi *fileInfo) ModTime() time.Time {
+	return fi.modTime
+}
+
+func (fi *fileInfo) IsDir() bool {
+	return fi.dir
+}
+
+func (fi *fileInfo) Sys() interface{} {
+	return nil
+}
+
+// zipFile decompresses a file of the archive from its first read. A seek
+// forward skips the content in between, a seek back decompresses the file
+// again from its start.
+type zipFile struct {
+	filesystem.Handle
+
+	vfs   *zipFs
+	name  string
+	entry *entry
+
+	// off is the offset of the next read, pos the one of rc.
+	off int64
+	rc  io.ReadCloser
+	pos int64
+}
+
+func (f *zipFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	if f.rc == nil || f.pos > f.off {
+		if f.rc != nil {
+			_ = f.rc.Close()
+		}
+		rc, err := f.entry.file.Open()
+		if err != nil {
+			f.rc = nil
+			return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: err}
+		}
+		f.rc, f.pos = rc, 0
+	}
+	if f.pos < f.off {
+		n, err := io.CopyN(io.Discard, f.rc, f.off-f.pos)
+		f.pos += n
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil {
+			return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: err}
+		}
+	}
+
+	n, err := f.rc.Read(p)
+	f.pos += int64(n)
+	f.off = f.pos
+	if err != nil && err != io.EOF {
+		return n, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: err}
+	}
+	return n, err
+}
+
+func (f *zipFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += f.off
+	case io.SeekEnd:
+		offset += int64(f.entry.file.UncompressedSize64)
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+
+	f.off = offset
+	return offset, nil
+}
+
+func (f *zipFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.abs(f.name), Err: syscall.EBADF}
+}
+
+func (f *zipFile) Stat() (fs.FileInfo, error) {
+	return f.entry.info(), nil
+}
+
+func (f *zipFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.abs(f.name), Err: err}
+	}
+	if f.rc != nil {
+		_ = f.rc.Close()
+		f.rc = nil
+	}
+	return nil
+}
+
+// zipStoredFile reads a file stored without compression at its offset in
+// the archive.
+type zipStoredFile struct {
+	filesystem.Handle
+
+	vfs     *zipFs
+	name    string
+	entry   *entry
+	section *io.SectionReader
+}
+
+func (f *zipStoredFile) Read(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	return f.section.Read(p)
+}
+
+func (f *zipStoredFile) ReadAt(p []byte, off int64) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+	return f.section.ReadAt(p, off)
+}
+
+func (f *zipStoredFile) Seek(offset int64, whence int) (int64, error) {
+	f.Lock()
+	defer f.Unlock()
+
+	if f.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: fs.ErrClosed}
+	}
+	off, err := f.section.Seek(offset, whence)
+	if err != nil {
+		return 0, &fs.PathError{Op: "seek", Path: f.vfs.abs(f.name), Err: syscall.EINVAL}
+	}
+	return off, nil
+}
+
+func (f *zipStoredFile) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: f.vfs.abs(f.name), Err: syscall.EBADF}
+}
+
+func (f *zipStoredFile) Stat() (fs.FileInfo, error) {
+	return f.entry.info(), nil
+}
+
+func (f *zipStoredFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+
+	if err := f.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: f.vfs.abs(f.name), Err: err}
+	}
+	return nil
+}
+
+// zipDir lists a directory of the archive.
+type zipDir struct {
+	filesystem.Handle
+
+	vfs   *zipFs
+	name  string
+	entry *entry
+
+	off int
+}
+
+func (d *zipDir) ReadDir(n int) ([]fs.DirEntry, error) {
+	d.Lock()
+	defer d.Unlock()
+
+	if d.Closed() {
+		return nil, &fs.PathError{Op: "readdir", Path: d.vfs.abs(d.name), Err: fs.ErrClosed}
+	}
+
+	rest := d.entry.list()[d.off:]
+	if n <= 0 {
+		d.off += len(rest)
+		return rest, nil
+	}
+	if len(rest) == 0 {
+		return nil, io.EOF
+	}
+	if n > len(rest) {
+		n = len(rest)
+	}
+	d.off += n
+	return rest[:n], nil
+}
+
+func (d *zipDir) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *zipDir) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: d.vfs.abs(d.name), Err: syscall.EISDIR}
+}
+
+func (d *zipDir) Stat() (fs.FileInfo, error) {
+	return d.entry.info(), nil
+}
+
+func (d *zipDir) Close() error {
+	d.Lock()
+	defer d.Unlock()
+
+	if err := d.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: d.vfs.abs(d.name), Err: err}
+	}
+	return nil
+}
+
+var (
+	_ filesystem.ReadDirFile = (*zipDir)(nil)
+	_ io.Seeker              = (*zipFile)(nil)
+	_ io.ReaderAt            = (*zipStoredFile)(nil)
+	_ io.Seeker              = (*zipStoredFile)(nil)
+)
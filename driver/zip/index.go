@@ -0,0 +1,103 @@
+package zip
+
+import (
+	archive "archive/zip"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"time"
+)
+
+// entry is a file or a directory of the archive.
+type entry struct {
+	name    string
+	dir     bool
+	mode    fs.FileMode
+	modTime time.Time
+
+	// file is the file of the archive, nil for a directory.
+	file *archive.File
+
+	// children are the entries of a directory, sorted by name.
+	children []*entry
+}
+
+func (e *entry) info() *fileInfo {
+	var size int64
+	if e.file != nil {
+		size = int64(e.file.UncompressedSize64)
+	}
+	return &fileInfo{
+		name:    e.name,
+		size:    size,
+		mode:    e.mode,
+		modTime: e.modTime,
+		dir:     e.dir,
+	}
+}
+
+// list returns the entries of the directory.
+func (e *entry) list() []fs.DirEntry {
+	list := make([]fs.DirEntry, 0, len(e.children))
+	for _, child := range e.children {
+		list = append(list, fs.FileInfoToDirEntry(child.info()))
+	}
+	return list
+}
+
+// newIndex returns the entries of the files of an archive by absolute path.
+// The parents the archive has no entry for are directories modified at
+// modTime, a directory wins over a file of the same name and a later file
+// over an earlier one.
+func newIndex(files []*archive.File, modTime time.Time) map[string]*entry {
+	index := map[string]*entry{
+		"/": {name: "/", dir: true, mode: 0755, modTime: modTime},
+	}
+
+	for _, f := range files {
+		// names escaping the root stay in it
+		p := path.Clean("/" + f.Name)
+		if p == "/" {
+			continue
+		}
+		dir := strings.HasSuffix(f.Name, "/") || f.Mode().IsDir()
+
+		e, ok := index[p]
+		switch {
+		case !ok:
+			e = &entry{name: path.Base(p)}
+			parent := mkdirAll(index, path.Dir(p), modTime)
+			parent.children = append(parent.children, e)
+			index[p] = e
+		case e.dir && !dir:
+			continue
+		}
+
+		e.dir, e.mode, e.modTime, e.file = dir, f.Mode().Perm(), f.Modified, nil
+		if !dir {
+			e.file = f
+		}
+	}
+
+	for _, e := range index {
+		sort.Slice(e.children, func(i, j int) bool { return e.children[i].name < e.children[j].name })
+	}
+	return index
+}
+
+// mkdirAll returns the directory at p, added with its parents when missing.
+func mkdirAll(index map[string]*entry, p string, modTime time.Time) *entry {
+	if e, ok := index[p]; ok {
+		if !e.dir {
+			e.dir, e.file, e.mode = true, nil, 0755
+		}
+		return e
+	}
+
+	parent := mkdirAll(index, path.Dir(p), modTime)
+	e := &entry{name: path.Base(p), dir: true, mode: 0755, modTime: modTime}
+	parent.children = append(parent.children, e)
+	index[p] = e
+	return e
+}
@@ -0,0 +1,260 @@
+package zip
+
+import (
+	archive "archive/zip"
+	"bytes"
+	"github.com/lazychanger/go-vfs"
+	_ "github.com/lazychanger/go-vfs/driver/memory"
+	_ "github.com/lazychanger/go-vfs/driver/os"
+	"github.com/lazychanger/go-vfs/vfstest"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+)
+
+var mtime = time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+// build returns an archive of the files, by name, deflated but the ones
+// ending in .bin, stored; a name ending in a slash is a directory.
+func build(t *testing.T, files map[string]string, order ...string) []byte {
+	t.Helper()
+	var buf bytes.Buffer
+	w := archive.NewWriter(&buf)
+	for _, name := range order {
+		method := archive.Deflate
+		if strings.HasSuffix(name, ".bin") || strings.HasSuffix(name, "/") {
+			method = archive.Store
+		}
+		f, err := w.CreateHeader(&archive.FileHeader{Name: name, Method: method, Modified: mtime})
+		require.NoError(t, err)
+		_, err = io.WriteString(f, files[name])
+		require.NoError(t, err)
+	}
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+// assets returns the path of an archive on the local disk.
+func assets(t *testing.T) string {
+	t.Helper()
+	files := map[string]string{
+		"a/b/c.txt":   strings.Repeat("deflated ", 1000),
+		"stored.bin":  "0123456789",
+		"e/":          "",
+		"../evil.txt": "evil",
+	}
+	name := filepath.Join(t.TempDir(), "assets.zip")
+	data := build(t, files, "a/b/c.txt", "stored.bin", "e/", "../evil.txt")
+	require.NoError(t, os.WriteFile(name, data, 0644))
+	return name
+}
+
+func TestZipIndex(t *testing.T) {
+	archivePath := assets(t)
+	vfs := vfstest.Open(t, "zip://"+filepath.ToSlash(archivePath))
+
+	list, err := filesystem.ReadDir(vfs, "/")
+	require.NoError(t, err)
+	var names []string
+	for _, e := range list {
+		names = append(names, e.Name())
+	}
+	assert.Equal(t, []string{"a", "e", "evil.txt", "stored.bin"}, names, "names escaping the root stay in it")
+
+	// the parents without an entry are directories of the archive's time
+	info, err := vfs.Stat("/a/b")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	archiveInfo, err := os.Stat(archivePath)
+	require.NoError(t, err)
+	assert.True(t, info.ModTime().Equal(archiveInfo.ModTime()))
+
+	info, err = vfs.Stat("/e")
+	require.NoError(t, err)
+	assert.True(t, info.IsDir())
+	assert.True(t, info.ModTime().Equal(mtime), "the time of the entry")
+
+	info, err = vfs.Stat("/a/b/c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, "c.txt", info.Name())
+	assert.Equal(t, int64(9000), info.Size())
+	assert.True(t, vfs.IsFile("/stored.bin"))
+	assert.True(t, vfs.IsDir("/a"))
+	assert.False(t, vfs.Exists("/missing"))
+
+	_, err = filesystem.ReadDir(vfs, "/stored.bin")
+	assert.ErrorIs(t, err, syscall.ENOTDIR)
+
+	// a directory wins over a file of its name, a later file over an earlier
+	data := build(t, map[string]string{"x": "file", "x/y": "y", "z": "1", "z/": ""}, "x", "x/y", "z", "z/")
+	r, err := archive.NewReader(bytes.NewReader(data), int64(len(data)))
+	require.NoError(t, err)
+	index := newIndex(r.File, time.Time{})
+	assert.True(t, index["/x"].dir)
+	assert.Nil(t, index["/x"].file)
+	assert.Len(t, index["/x"].children, 1)
+	assert.True(t, index["/z"].dir)
+}
+
+func TestZipRead(t *testing.T) {
+	vfs := vfstest.Open(t, "zip://"+filepath.ToSlash(assets(t)))
+
+	data, err := filesystem.ReadFile(vfs, "/a/b/c.txt")
+	require.NoError(t, err)
+	assert.Equal(t, strings.Repeat("deflated ", 1000), string(data))
+	_, err = filesystem.ReadFile(vfs, "/a")
+	assert.ErrorIs(t, err, syscall.EISDIR)
+
+	// a deflated file streams, seeking back starts it over
+	f, err := vfs.Open("/a/b/c.txt")
+	require.NoError(t, err)
+	defer f.Close()
+	_, ok := f.(io.ReaderAt)
+	assert.False(t, ok, "a deflated file reads in order")
+	_, err = f.(io.Seeker).Seek(9*999, io.SeekStart)
+	require.NoError(t, err)
+	rest, err := io.ReadAll(f)
+	require.NoError(t, err)
+	assert.Equal(t, "deflated ", string(rest))
+	_, err = f.(io.Seeker).Seek(0, io.SeekStart)
+	require.NoError(t, err)
+	buf := make([]byte, 8)
+	_, err = io.ReadFull(f, buf)
+	require.NoError(t, err)
+	assert.Equal(t, "deflated", string(buf))
+	_, err = f.(io.Seeker).Seek(1, io.SeekEnd)
+	require.NoError(t, err)
+	_, err = f.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	// a stored file reads at any offset
+	s, err := vfs.Open("/stored.bin")
+	require.NoError(t, err)
+	defer s.Close()
+	n, err := s.(io.ReaderAt).ReadAt(buf[:4], 3)
+	require.NoError(t, err)
+	assert.Equal(t, "3456", string(buf[:n]))
+	off, err := s.(io.Seeker).Seek(-2, io.SeekEnd)
+	require.NoError(t, err)
+	assert.Equal(t, int64(8), off)
+	rest, err = io.ReadAll(s)
+	require.NoError(t, err)
+	assert.Equal(t, "89", string(rest))
+
+	d, err := vfs.Open("/a")
+	require.NoError(t, err)
+	defer d.Close()
+	entries, err := d.(filesystem.ReadDirFile).ReadDir(1)
+	require.NoError(t, err)
+	assert.Equal(t, "b", entries[0].Name())
+	_, err = d.(filesystem.ReadDirFile).ReadDir(1)
+	assert.Equal(t, io.EOF, err)
+
+	sub, err := vfs.Sub("/a/b")
+	require.NoError(t, err)
+	data, err = filesystem.ReadFile(sub, "c.txt")
+	require.NoError(t, err)
+	assert.Len(t, data, 9000)
+	_, err = vfs.Sub("/stored.bin")
+	assert.ErrorIs(t, err, syscall.ENOTDIR)
+}
+
+func TestZipReadOnly(t *testing.T) {
+	vfs := vfstest.Open(t, "zip://"+filepath.ToSlash(assets(t)))
+
+	_, err := vfs.Create("/new")
+	assert.ErrorIs(t, err, fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Mkdir("/new", 0755), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.MkdirAll("/a/new", 0755), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Remove("/stored.bin"), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.RemoveAll("/a"), fs.ErrPermission)
+	assert.ErrorIs(t, vfs.Rename("/a", "/b"), fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.WriteFile(vfs, "/stored.bin", nil), fs.ErrPermission)
+	assert.ErrorIs(t, filesystem.Chmod(vfs, "/stored.bin", 0600), filesystem.ErrNotSupported)
+
+	f, err := vfs.Open("/stored.bin")
+	require.NoError(t, err)
+	defer f.Close()
+	_, err = f.Write([]byte("x"))
+	assert.ErrorIs(t, err, syscall.EBADF)
+}
+
+func TestZipStack(t *testing.T) {
+	archivePath := assets(t)
+	data, err := os.ReadFile(archivePath)
+	require.NoError(t, err)
+
+	// an archive in a filesystem of the program
+	mem := vfstest.Open(t, "memory:///")
+	require.NoError(t, mem.MkdirAll("/bundles", 0755))
+	require.NoError(t, filesystem.WriteFile(mem, "/bundles/assets.zip", data))
+	vfs, err := New(&Config{Archive: "/bundles/assets.zip", FileSystem: mem})
+	require.NoError(t, err)
+	content, err := filesystem.ReadFile(vfs, "/stored.bin")
+	require.NoError(t, err)
+	assert.Equal(t, "0123456789", string(content))
+	require.NoError(t, filesystem.Close(vfs))
+	assert.True(t, mem.Exists("/bundles/assets.zip"), "the filesystem of the program stays open")
+
+	// an archive in a filesystem of a DSN, closed with it
+	dsn := "zip+os://" + filepath.ToSlash(archivePath)
+	vfs = vfstest.Open(t, dsn)
+	content, err = filesystem.ReadFile(vfs, "/a/b/c.txt")
+	require.NoError(t, err)
+	assert.Len(t, content, 9000)
+	conf := vfs.(*zipFs).config
+	assert.Equal(t, "os://"+filepath.ToSlash(filepath.Dir(archivePath)), conf.Stack)
+	assert.Equal(t, "assets.zip", conf.Archive)
+	assert.Equal(t, dsn, filesystem.BuildDsn(conf))
+
+	stack := vfs.(*zipFs).conn.stack
+	require.NoError(t, filesystem.Close(vfs))
+	assert.False(t, stack.Exists("/assets.zip"), "the filesystem of the DSN is closed")
+}
+
+func TestZipClose(t *testing.T) {
+	vfs, err := filesystem.Open("zip://" + filepath.ToSlash(assets(t)))
+	require.NoError(t, err)
+
+	f, err := vfs.Open("/a/b/c.txt")
+	require.NoError(t, err)
+	_, err = f.Read(make([]byte, 1))
+	require.NoError(t, err)
+	files, err := filesystem.OpenFiles(vfs)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/a/b/c.txt"}, files)
+
+	require.NoError(t, filesystem.Close(vfs))
+	_, err = f.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, fs.ErrClosed, "the files are closed with the archive")
+	_, err = vfs.Open("/a/b/c.txt")
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	assert.ErrorIs(t, vfs.Remove("/a"), fs.ErrClosed)
+	assert.False(t, vfs.Exists("/a"))
+}
+
+func TestZipOpen(t *testing.T) {
+	_, err := filesystem.Open("zip://")
+	assert.ErrorIs(t, err, fs.ErrInvalid)
+
+	dir := t.TempDir()
+	_, err = filesystem.Open("zip://" + filepath.ToSlash(filepath.Join(dir, "missing.zip")))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = filesystem.Open("zip://" + filepath.ToSlash(dir))
+	assert.ErrorIs(t, err, syscall.EISDIR)
+
+	name := filepath.Join(dir, "text.zip")
+	require.NoError(t, os.WriteFile(name, []byte("not an archive"), 0644))
+	_, err = filesystem.Open("zip://" + filepath.ToSlash(name))
+	assert.ErrorIs(t, err, archive.ErrFormat)
+
+	_, err = filesystem.Open("zip+nodriver:///srv/assets.zip")
+	assert.Error(t, err)
+}
@@ -6,8 +6,13 @@ import (
 	"io/fs"
 	"os"
 	"sort"
+	"time"
 )
 
+// ErrNotSupported is returned by the helpers of optional interfaces when the
+// filesystem provides no implementation.
+var ErrNotSupported = errors.New("not supported")
+
 type FileSystem interface {
 
 	// Open opens the named file for reading.
@@ -185,3 +190,139 @@ func OpenFile(vfs FileSystem, name string) (File, error) {
 
 	return vfs.Open(name)
 }
+
+type ChtimesFS interface {
+	FileSystem
+	// Chtimes see os.Chtimes
+	Chtimes(name string, atime time.Time, mtime time.Time) error
+}
+
+// Chtimes see os.Chtimes
+// changes the access and modification times of the named file, the error is
+// ErrNotSupported when vfs cannot change them.
+func Chtimes(vfs FileSystem, name string, atime time.Time, mtime time.Time) error {
+	if vfs, ok := vfs.(ChtimesFS); ok {
+		return vfs.Chtimes(name, atime, mtime)
+	}
+
+	return &fs.PathError{Op: "chtimes", Path: name, Err: ErrNotSupported}
+}
+
+type TruncateFS interface {
+	FileSystem
+	// Truncate see os.Truncate
+	Truncate(name string, size int64) error
+}
+
+// Truncate see os.Truncate
+// changes the size of the named file, growing it with zeros, the error is
+// ErrNotSupported when vfs cannot resize files.
+func Truncate(vfs FileSystem, name string, size int64) error {
+	if vfs, ok := vfs.(TruncateFS); ok {
+		return vfs.Truncate(name, size)
+	}
+
+	return &fs.PathError{Op: "truncate", Path: name, Err: ErrNotSupported}
+}
+
+type ChmodFS interface {
+	FileSystem
+	// Chmod see os.Chmod
+	Chmod(name string, mode fs.FileMode) error
+}
+
+// Chmod see os.Chmod
+// changes the permission bits of the named file, the error is
+// ErrNotSupported when vfs keeps no permissions.
+func Chmod(vfs FileSystem, name string, mode fs.FileMode) error {
+	if vfs, ok := vfs.(ChmodFS); ok {
+		return vfs.Chmod(name, mode)
+	}
+
+	return &fs.PathError{Op: "chmod", Path: name, Err: ErrNotSupported}
+}
+
+type SymlinkFS interface {
+	FileSystem
+	// Symlink see os.Symlink
+	Symlink(oldname, newname string) error
+	// Readlink see os.Readlink
+	Readlink(name string) (string, error)
+	// Lstat see os.Lstat
+	Lstat(name string) (fs.FileInfo, error)
+}
+
+// Symlink see os.Symlink
+// creates newname as a symbolic link to oldname, the error is
+// ErrNotSupported when vfs has no symbolic links.
+func Symlink(vfs FileSystem, oldname, newname string) error {
+	if vfs, ok := vfs.(SymlinkFS); ok {
+		return vfs.Symlink(oldname, newname)
+	}
+
+	return &os.LinkError{Op: "symlink", Old: oldname, New: newname, Err: ErrNotSupported}
+}
+
+// Readlink see os.Readlink
+func Readlink(vfs FileSystem, name string) (string, error) {
+	if vfs, ok := vfs.(SymlinkFS); ok {
+		return vfs.Readlink(name)
+	}
+
+	return "", &fs.PathError{Op: "readlink", Path: name, Err: ErrNotSupported}
+}
+
+// Lstat see os.Lstat
+// describes a symbolic link rather than the file it refers to, on a
+// filesystem without symbolic links it is Stat.
+func Lstat(vfs FileSystem, name string) (fs.FileInfo, error) {
+	if vfs, ok := vfs.(SymlinkFS); ok {
+		return vfs.Lstat(name)
+	}
+
+	return vfs.Stat(name)
+}
+
+type SnapshotFS interface {
+	FileSystem
+	// Snapshot writes the content of the filesystem to w
+	Snapshot(w io.Writer) error
+	// Restore adds the content of a snapshot read from r to the filesystem
+	Restore(r io.Reader) error
+}
+
+// Snapshot writes the directories, files, modes, times and symbolic links of
+// vfs to w, the error is ErrNotSupported when vfs cannot.
+func Snapshot(vfs FileSystem, w io.Writer) error {
+	if vfs, ok := vfs.(SnapshotFS); ok {
+		return vfs.Snapshot(w)
+	}
+
+	return &fs.PathError{Op: "snapshot", Path: "/", Err: ErrNotSupported}
+}
+
+// Restore adds the content of the snapshot read from r to vfs, the error is
+// ErrNotSupported when vfs cannot.
+func Restore(vfs FileSystem, r io.Reader) error {
+	if vfs, ok := vfs.(SnapshotFS); ok {
+		return vfs.Restore(r)
+	}
+
+	return &fs.PathError{Op: "restore", Path: "/", Err: ErrNotSupported}
+}
+
+type CloneFS interface {
+	FileSystem
+	// Clone returns an independent copy of the filesystem
+	Clone() (FileSystem, error)
+}
+
+// Clone returns a copy of vfs that changes independently of it, the error is
+// ErrNotSupported when vfs cannot be cloned.
+func Clone(vfs FileSystem) (FileSystem, error) {
+	if vfs, ok := vfs.(CloneFS); ok {
+		return vfs.Clone()
+	}
+
+	return nil, &fs.PathError{Op: "clone", Path: "/", Err: ErrNotSupported}
+}
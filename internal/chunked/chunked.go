@@ -0,0 +1,270 @@
+// Package chunked reads and writes the files of the drivers storing their
+// content as fixed size chunks of an inode, one record per chunk. The driver
+// tells how to load a chunk and how to store one, the Reader and the Writer
+// do the rest: splitting the content in chunks, keeping the last chunk read
+// and buffering the writes until a chunk fills up.
+//
+// A chunk shorter than the chunk size, or missing, is a hole: the bytes past
+// its data read as zeros up to the size of the file.
+package chunked
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"io/fs"
+	"syscall"
+)
+
+// Chunks loads the chunks of the inode a Reader reads.
+type Chunks interface {
+	// Chunk returns the chunk at index i, empty when the inode has none
+	// there. The error matches fs.ErrNotExist once the inode is gone.
+	Chunk(i int64) ([]byte, error)
+}
+
+// Reader reads a file of Size bytes stored in chunks of ChunkSize bytes, and
+// keeps the last chunk it loaded for the next read. The driver tracks it
+// through its Handle.
+type Reader struct {
+	filesystem.Handle
+
+	Chunks    Chunks
+	Size      int64
+	ChunkSize int64
+
+	// Path names the file in errors.
+	Path string
+
+	off int64
+
+	// chunk is the content of the chunk at index, nil until a read.
+	chunk []byte
+	index int64
+}
+
+// readAt reads at off, the lock is held.
+func (r *Reader) readAt(p []byte, off int64) (int, error) {
+	n := 0
+	for n < len(p) && off < r.Size {
+		i := off / r.ChunkSize
+		chunk, err := r.load(i)
+		if err != nil {
+			return n, &fs.PathError{Op: "read", Path: r.Path, Err: err}
+		}
+
+		// the bytes of the file in the chunk, past its data they are zeros
+		start, end := off-i*r.ChunkSize, r.ChunkSize
+		if rest := r.Size - i*r.ChunkSize; rest < end {
+			end = rest
+		}
+		dst := p[n:]
+		if int64(len(dst)) > end-start {
+			dst = dst[:end-start]
+		}
+		c := 0
+		if start < int64(len(chunk)) {
+			c = copy(dst, chunk[start:])
+		}
+		for j := c; j < len(dst); j++ {
+			dst[j] = 0
+		}
+
+		n += len(dst)
+		off += int64(len(dst))
+	}
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+// load returns the chunk at index i.
+func (r *Reader) load(i int64) ([]byte, error) {
+	if r.chunk != nil && r.index == i {
+		return r.chunk, nil
+	}
+
+	chunk, err := r.Chunks.Chunk(i)
+	if err != nil {
+		return nil, err
+	}
+	if chunk == nil {
+		chunk = []byte{}
+	}
+
+	r.chunk, r.index = chunk, i
+	return chunk, nil
+}
+
+func (r *Reader) Read(p []byte) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: r.Path, Err: fs.ErrClosed}
+	}
+	if len(p) == 0 {
+		return 0, nil
+	}
+
+	n, err := r.readAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return n, err
+}
+
+func (r *Reader) ReadAt(p []byte, off int64) (int, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.Closed() {
+		return 0, &fs.PathError{Op: "read", Path: r.Path, Err: fs.ErrClosed}
+	}
+	if off < 0 {
+		return 0, &fs.PathError{Op: "read", Path: r.Path, Err: syscall.EINVAL}
+	}
+	return r.readAt(p, off)
+}
+
+func (r *Reader) Seek(offset int64, whence int) (int64, error) {
+	r.Lock()
+	defer r.Unlock()
+
+	if r.Closed() {
+		return 0, &fs.PathError{Op: "seek", Path: r.Path, Err: fs.ErrClosed}
+	}
+
+	switch whence {
+	case io.SeekCurrent:
+		offset += r.off
+	case io.SeekEnd:
+		offset += r.Size
+	}
+	if offset < 0 {
+		return 0, &fs.PathError{Op: "seek", Path: r.Path, Err: syscall.EINVAL}
+	}
+
+	r.off = offset
+	return offset, nil
+}
+
+func (r *Reader) Write(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "write", Path: r.Path, Err: syscall.EBADF}
+}
+
+func (r *Reader) Close() error {
+	r.Lock()
+	defer r.Unlock()
+
+	if err := r.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: r.Path, Err: err}
+	}
+	r.chunk = nil
+	return nil
+}
+
+// Sink stores the chunks of the inode a Writer writes.
+type Sink interface {
+	// Flush stores the chunk at index i, the first call allocates the
+	// inode.
+	Flush(i int64, chunk []byte) error
+
+	// Commit stores the last chunk, at index i and empty when the content
+	// ends on a chunk boundary, and names the inode of size bytes after
+	// the file, the inode replaced goes with it.
+	Commit(i int64, last []byte, size int64) error
+
+	// Abort frees the inode once a Flush or the Commit failed, when it was
+	// allocated.
+	Abort()
+}
+
+// Writer buffers the content written to it and hands it to Sink a chunk of
+// ChunkSize bytes at a time, the rest once it is closed. The driver tracks it
+// through its Handle.
+type Writer struct {
+	filesystem.Handle
+
+	Sink      Sink
+	ChunkSize int
+
+	// Path names the file in errors.
+	Path string
+
+	chunks int64
+
+	// buf holds what is written and not stored yet.
+	buf  []byte
+	size int64
+
+	// err is the first error of a chunk, the file fails once it has one.
+	err error
+}
+
+func (w *Writer) Write(p []byte) (int, error) {
+	w.Lock()
+	defer w.Unlock()
+
+	if w.Closed() {
+		return 0, &fs.PathError{Op: "write", Path: w.Path, Err: fs.ErrClosed}
+	}
+	if w.err != nil {
+		return 0, w.err
+	}
+
+	w.buf = append(w.buf, p...)
+	w.size += int64(len(p))
+
+	for len(w.buf) >= w.ChunkSize {
+		if err := w.Sink.Flush(w.chunks, w.buf[:w.ChunkSize]); err != nil {
+			w.err = &fs.PathError{Op: "write", Path: w.Path, Err: err}
+			return len(p), w.err
+		}
+		w.chunks++
+		w.buf = append(w.buf[:0], w.buf[w.ChunkSize:]...)
+	}
+	return len(p), nil
+}
+
+func (w *Writer) Read(p []byte) (int, error) {
+	return 0, &fs.PathError{Op: "read", Path: w.Path, Err: syscall.EBADF}
+}
+
+// Size returns the number of bytes written.
+func (w *Writer) Size() int64 {
+	w.Lock()
+	defer w.Unlock()
+
+	return w.size
+}
+
+// Close commits the content, or aborts it after an error.
+func (w *Writer) Close() error {
+	w.Lock()
+	defer w.Unlock()
+
+	if err := w.MarkClosed(); err != nil {
+		return &fs.PathError{Op: "close", Path: w.Path, Err: err}
+	}
+
+	err := w.err
+	if err == nil {
+		err = w.Sink.Commit(w.chunks, w.buf, w.size)
+	}
+	if err != nil {
+		w.Sink.Abort()
+	}
+	w.buf = nil
+
+	if err != nil {
+		return &fs.PathError{Op: "close", Path: w.Path, Err: err}
+	}
+	return nil
+}
+
+var (
+	_ io.ReaderAt = (*Reader)(nil)
+	_ io.Seeker   = (*Reader)(nil)
+)
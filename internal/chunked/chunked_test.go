@@ -0,0 +1,118 @@
+package chunked
+
+import (
+	"errors"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"testing"
+)
+
+// chunks stores the chunks of one inode by index.
+type chunks struct {
+	data map[int64][]byte
+	gone bool
+
+	// loads counts the chunks loaded.
+	loads int
+
+	// fail fails the Flush of the chunk at that index.
+	fail int64
+
+	committed []byte
+	aborted   bool
+}
+
+func (c *chunks) Chunk(i int64) ([]byte, error) {
+	if c.gone {
+		return nil, fs.ErrNotExist
+	}
+	c.loads++
+	return c.data[i], nil
+}
+
+func (c *chunks) Flush(i int64, chunk []byte) error {
+	if i == c.fail {
+		return errors.New("flush failed")
+	}
+	c.data[i] = append([]byte{}, chunk...)
+	return nil
+}
+
+func (c *chunks) Commit(i int64, last []byte, size int64) error {
+	if len(last) > 0 {
+		c.data[i] = append([]byte{}, last...)
+	}
+	for j := int64(0); j*4 < size; j++ {
+		c.committed = append(c.committed, c.data[j]...)
+	}
+	return nil
+}
+
+func (c *chunks) Abort() {
+	c.aborted = true
+}
+
+func TestReader(t *testing.T) {
+	// the second chunk is cut, the third missing
+	c := &chunks{data: map[int64][]byte{0: []byte("0123"), 1: []byte("45")}}
+	r := &Reader{Chunks: c, Size: 14, ChunkSize: 4, Path: "/f"}
+
+	buf := make([]byte, 5)
+	n, err := r.ReadAt(buf, 2)
+	require.NoError(t, err)
+	assert.Equal(t, "2345\x00", string(buf[:n]), "a read across chunks, past the data of one")
+
+	data, err := io.ReadAll(r)
+	require.NoError(t, err)
+	assert.Equal(t, "012345\x00\x00\x00\x00\x00\x00\x00\x00", string(data))
+
+	// the chunk read last is kept for the next read
+	loads := c.loads
+	_, err = r.Seek(13, io.SeekStart)
+	require.NoError(t, err)
+	_, err = r.Read(buf[:1])
+	require.NoError(t, err)
+	assert.Equal(t, loads, c.loads)
+	_, err = r.Read(buf)
+	assert.Equal(t, io.EOF, err)
+
+	c.gone = true
+	_, err = r.ReadAt(buf, 0)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, r.Close())
+	_, err = r.Read(buf)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	assert.ErrorIs(t, r.Close(), fs.ErrClosed)
+}
+
+func TestWriter(t *testing.T) {
+	c := &chunks{data: map[int64][]byte{}, fail: -1}
+	w := &Writer{Sink: c, ChunkSize: 4, Path: "/f"}
+
+	_, err := w.Write([]byte("01234"))
+	require.NoError(t, err)
+	_, err = w.Write([]byte("56789"))
+	require.NoError(t, err)
+	assert.Len(t, c.data, 2, "the chunks filled up")
+	assert.Equal(t, int64(10), w.Size())
+
+	require.NoError(t, w.Close())
+	assert.Equal(t, "0123456789", string(c.committed))
+	assert.False(t, c.aborted)
+	_, err = w.Write([]byte("x"))
+	assert.ErrorIs(t, err, fs.ErrClosed)
+
+	// a chunk that fails fails the writer, which aborts once closed
+	c = &chunks{data: map[int64][]byte{}, fail: 1}
+	w = &Writer{Sink: c, ChunkSize: 4, Path: "/f"}
+	_, err = w.Write([]byte("0123456789"))
+	assert.Error(t, err)
+	_, err = w.Write([]byte("x"))
+	assert.Error(t, err)
+	assert.Error(t, w.Close())
+	assert.True(t, c.aborted)
+	assert.Empty(t, c.committed)
+}
@@ -0,0 +1,452 @@
+package filesystem
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// SyncCompare selects how Sync decides that a file changed.
+type SyncCompare int
+
+const (
+	// CompareSizeModTime treats files of equal size and modification time as
+	// equal, the quick check of rsync.
+	CompareSizeModTime SyncCompare = iota
+
+	// CompareChecksum compares the SHA-256 of the contents of files of equal size.
+	CompareChecksum
+)
+
+// SyncOptions configures Sync, the zero value mirrors every file with the
+// quick check, one copy at a time, and keeps extraneous files.
+type SyncOptions struct {
+	Compare SyncCompare
+
+	// ModifyWindow is the largest difference of modification times that still
+	// counts as equal, for drivers storing coarse timestamps.
+	ModifyWindow time.Duration
+
+	// Delete removes the entries of dst that src does not have.
+	Delete bool
+
+	// Include and Exclude are path.Match patterns, a pattern containing a
+	// slash matches the path relative to the root, any other pattern the base
+	// name. When Include is set only matching files are synced, directories
+	// are always descended into. Exclude wins over Include and excludes whole
+	// directories. Excluded entries of dst are never deleted.
+	Include []string
+	Exclude []string
+
+	// DryRun reports the actions without performing them.
+	DryRun bool
+
+	// Parallelism is the number of files copied at once, at least one.
+	Parallelism int
+}
+
+// SyncAction is the action Sync takes on a path of dst.
+type SyncAction int
+
+const (
+	// SyncCreate copies a file missing from dst.
+	SyncCreate SyncAction = iota
+	// SyncUpdate copies a file that differs.
+	SyncUpdate
+	// SyncMkdir creates a directory missing from dst.
+	SyncMkdir
+	// SyncDelete removes an extraneous entry of dst, or one whose type
+	// differs from src.
+	SyncDelete
+	// SyncRename moves an entry, only two-way synchronization renames.
+	SyncRename
+)
+
+func (a SyncAction) String() string {
+	switch a {
+	case SyncCreate:
+		return "create"
+	case SyncUpdate:
+		return "update"
+	case SyncMkdir:
+		return "mkdir"
+	case SyncDelete:
+		return "delete"
+	case SyncRename:
+		return "rename"
+	}
+	return fmt.Sprintf("SyncAction(%d)", int(a))
+}
+
+// SyncItem is an action taken on a path, Err is set when the action failed.
+type SyncItem struct {
+	Action SyncAction
+	Path   string
+	Size   int64
+	Err    error
+}
+
+// SyncReport describes the actions of a Sync in the order they were planned.
+type SyncReport struct {
+	Items []SyncItem
+
+	// Unchanged counts the files that were already up to date.
+	Unchanged int
+
+	// Bytes is the number of bytes copied, or to be copied in a dry run.
+	Bytes int64
+
+	DryRun bool
+}
+
+// Count returns the number of items with the action.
+func (r *SyncReport) Count(action SyncAction) int {
+	n := 0
+	for _, item := range r.Items {
+		if item.Action == action {
+			n++
+		}
+	}
+	return n
+}
+
+// Sync makes dst match src, like rsync. Only the files that changed are
+// copied, modification times are carried over when dst implements ChtimesFS.
+// Sync does not stop at the first failing path: it returns the first error
+// after trying every path, the report tells which paths failed.
+func Sync(dst, src FileSystem, opts *SyncOptions) (*SyncReport, error) {
+	if opts == nil {
+		opts = &SyncOptions{}
+	}
+
+	for _, pattern := range append(opts.Include[:len(opts.Include):len(opts.Include)], opts.Exclude...) {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return nil, fmt.Errorf("sync pattern %q: %w", pattern, err)
+		}
+	}
+
+	_, chtimes := dst.(ChtimesFS)
+	s := &syncer{
+		dst:     dst,
+		src:     src,
+		opts:    opts,
+		chtimes: chtimes,
+		report:  &SyncReport{DryRun: opts.DryRun},
+		copies:  make(chan syncCopy),
+	}
+
+	parallelism := opts.Parallelism
+	if parallelism < 1 {
+		parallelism = 1
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < parallelism; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for c := range s.copies {
+				s.fail(c.item, s.copy(c.name, c.info))
+			}
+		}()
+	}
+
+	s.syncDir("", true)
+	close(s.copies)
+	wg.Wait()
+
+	return s.report, s.err
+}
+
+type syncer struct {
+	dst, src FileSystem
+
+	opts *SyncOptions
+
+	// chtimes is set when dst can take the modification times of src.
+	chtimes bool
+
+	copies chan syncCopy
+
+	mu     sync.Mutex
+	report *SyncReport
+	err    error
+}
+
+type syncCopy struct {
+	item int
+	name string
+	info fs.FileInfo
+}
+
+// syncDir syncs the directory rel of both trees, exists tells whether the
+// directory exists in dst, which in a dry run it may not.
+func (s *syncer) syncDir(rel string, exists bool) {
+	srcList, err := ReadDir(s.src, "/"+rel)
+	if err != nil {
+		s.fail(-1, err)
+		return
+	}
+
+	dstEntries := map[string]fs.DirEntry{}
+	if exists {
+		dstList, err := ReadDir(s.dst, "/"+rel)
+		if err != nil {
+			s.fail(-1, err)
+			return
+		}
+		for _, d := range dstList {
+			dstEntries[d.Name()] = d
+		}
+	}
+
+	for _, d := range srcList {
+		name := path.Join(rel, d.Name())
+		if !s.match(name, d.IsDir()) {
+			continue
+		}
+
+		existing, ok := dstEntries[d.Name()]
+		delete(dstEntries, d.Name())
+
+		if ok && existing.IsDir() != d.IsDir() {
+			s.remove(name, existing)
+			ok = false
+		}
+
+		if d.IsDir() {
+			if !ok {
+				ok = s.mkdir(name)
+			}
+			s.syncDir(name, ok)
+			continue
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			s.fail(-1, err)
+			continue
+		}
+		s.syncFile(name, info, existing, ok)
+	}
+
+	if !s.opts.Delete {
+		return
+	}
+
+	extraneous := make([]fs.DirEntry, 0, len(dstEntries))
+	for _, d := range dstEntries {
+		extraneous = append(extraneous, d)
+	}
+	sort.Slice(extraneous, func(i, j int) bool { return extraneous[i].Name() < extraneous[j].Name() })
+
+	for _, d := range extraneous {
+		s.prune(path.Join(rel, d.Name()), d)
+	}
+}
+
+// prune deletes the extraneous entry of dst. With Include set, only the
+// included files below an extraneous directory are deleted.
+func (s *syncer) prune(name string, d fs.DirEntry) {
+	if !s.match(name, d.IsDir()) {
+		return
+	}
+	if !d.IsDir() || len(s.opts.Include) == 0 {
+		s.remove(name, d)
+		return
+	}
+
+	list, err := ReadDir(s.dst, "/"+name)
+	if err != nil {
+		s.fail(-1, err)
+		return
+	}
+	for _, d := range list {
+		s.prune(path.Join(name, d.Name()), d)
+	}
+}
+
+func (s *syncer) syncFile(name string, info fs.FileInfo, existing fs.DirEntry, exists bool) {
+	action := SyncCreate
+	if exists {
+		changed, err := s.changed(name, info, existing)
+		if err != nil {
+			s.fail(-1, err)
+			return
+		}
+		if !changed {
+			s.mu.Lock()
+			s.report.Unchanged++
+			s.mu.Unlock()
+			return
+		}
+		action = SyncUpdate
+	}
+
+	item := s.plan(action, name, info.Size())
+	s.mu.Lock()
+	s.report.Bytes += info.Size()
+	s.mu.Unlock()
+
+	if !s.opts.DryRun {
+		s.copies <- syncCopy{item: item, name: name, info: info}
+	}
+}
+
+// changed tells whether the file of src differs from the one of dst.
+func (s *syncer) changed(name string, info fs.FileInfo, existing fs.DirEntry) (bool, error) {
+	dinfo, err := existing.Info()
+	if err != nil {
+		return false, err
+	}
+
+	if dinfo.Size() != info.Size() {
+		return true, nil
+	}
+
+	if s.opts.Compare == CompareChecksum {
+		a, err := checksum(s.src, "/"+name)
+		if err != nil {
+			return false, err
+		}
+		b, err := checksum(s.dst, "/"+name)
+		if err != nil {
+			return false, err
+		}
+		return !bytes.Equal(a, b), nil
+	}
+
+	diff := dinfo.ModTime().Sub(info.ModTime())
+	if !s.chtimes {
+		// dst stamps copies with the time of the copy, a copy is
+		// never older than its source.
+		return diff < -s.opts.ModifyWindow, nil
+	}
+	return diff < -s.opts.ModifyWindow || diff > s.opts.ModifyWindow, nil
+}
+
+func checksum(vfs FileSystem, name string) ([]byte, error) {
+	f, err := OpenFile(vfs, name)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	h := sha256.New()
+	if _, err := io.Copy(h, f); err != nil {
+		return nil, err
+	}
+	return h.Sum(nil), nil
+}
+
+func (s *syncer) copy(name string, info fs.FileInfo) error {
+	r, err := OpenFile(s.src, "/"+name)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+
+	w, err := s.dst.Create("/" + name)
+	if err != nil {
+		return err
+	}
+
+	_, err = io.Copy(w, r)
+	if cerr := w.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		return err
+	}
+
+	if s.chtimes {
+		return Chtimes(s.dst, "/"+name, info.ModTime(), info.ModTime())
+	}
+	return nil
+}
+
+// mkdir creates the directory in dst and tells whether it exists afterwards.
+func (s *syncer) mkdir(name string) bool {
+	item := s.plan(SyncMkdir, name, 0)
+	if s.opts.DryRun {
+		return false
+	}
+
+	err := s.dst.Mkdir("/"+name, 0755)
+	s.fail(item, err)
+	return err == nil
+}
+
+func (s *syncer) remove(name string, d fs.DirEntry) {
+	item := s.plan(SyncDelete, name, 0)
+	if s.opts.DryRun {
+		return
+	}
+
+	if d.IsDir() {
+		s.fail(item, s.dst.RemoveAll("/"+name))
+		return
+	}
+	s.fail(item, s.dst.Remove("/"+name))
+}
+
+// plan adds an item to the report and returns its index.
+func (s *syncer) plan(action SyncAction, name string, size int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.report.Items = append(s.report.Items, SyncItem{Action: action, Path: name, Size: size})
+	return len(s.report.Items) - 1
+}
+
+// fail records err on the item, a negative item records err for Sync only.
+func (s *syncer) fail(item int, err error) {
+	if err == nil {
+		return
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if item >= 0 {
+		s.report.Items[item].Err = err
+	}
+	if s.err == nil {
+		s.err = err
+	}
+}
+
+// match tells whether the path relative to the root takes part in the sync.
+func (s *syncer) match(name string, isDir bool) bool {
+	if s.excluded(name) {
+		return false
+	}
+	if isDir || len(s.opts.Include) == 0 {
+		return true
+	}
+	return matchAny(s.opts.Include, name)
+}
+
+func (s *syncer) excluded(name string) bool {
+	return matchAny(s.opts.Exclude, name)
+}
+
+func matchAny(patterns []string, name string) bool {
+	for _, pattern := range patterns {
+		subject := name
+		if !strings.Contains(pattern, "/") {
+			subject = path.Base(name)
+		}
+		if ok, _ := path.Match(strings.TrimPrefix(pattern, "/"), subject); ok {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,188 @@
+package filesystem_test
+
+import (
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	_ "github.com/lazychanger/go-vfs/driver/memory"
+	_ "github.com/lazychanger/go-vfs/driver/os"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+)
+
+func open(t *testing.T, dsn string) filesystem.FileSystem {
+	t.Helper()
+
+	vfs, err := filesystem.Open(dsn)
+	require.NoError(t, err)
+	return vfs
+}
+
+// populate writes the files, names ending with a slash are directories.
+func populate(t *testing.T, vfs filesystem.FileSystem, files map[string]string) {
+	t.Helper()
+
+	for name, content := range files {
+		if strings.HasSuffix(name, "/") {
+			require.NoError(t, vfs.MkdirAll(name, 0755))
+			continue
+		}
+		require.NoError(t, vfs.MkdirAll(name[:strings.LastIndex(name, "/")+1], 0755))
+		require.NoError(t, filesystem.WriteFile(vfs, name, []byte(content)))
+	}
+}
+
+// dump returns the tree of vfs in the form populate takes.
+func dump(t *testing.T, vfs filesystem.FileSystem) map[string]string {
+	t.Helper()
+
+	files := map[string]string{}
+	err := filesystem.WalkDir(vfs, "/", func(name string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		switch {
+		case name == "/":
+		case d.IsDir():
+			files[name+"/"] = ""
+		default:
+			data, err := filesystem.ReadFile(vfs, name)
+			require.NoError(t, err)
+			files[name] = string(data)
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	return files
+}
+
+func actions(report *filesystem.SyncReport) []string {
+	list := make([]string, 0, len(report.Items))
+	for _, item := range report.Items {
+		list = append(list, fmt.Sprintf("%s %s", item.Action, item.Path))
+	}
+	sort.Strings(list)
+	return list
+}
+
+var syncTree = map[string]string{
+	"/a.txt":         "a",
+	"/b.log":         "bb",
+	"/dir/":          "",
+	"/dir/c.txt":     "ccc",
+	"/dir/sub/":      "",
+	"/dir/sub/d.txt": "dddd",
+	"/empty/":        "",
+}
+
+func TestSync(t *testing.T) {
+	for name, dsns := range map[string][2]string{
+		"OsToMemory": {"memory:///", fmt.Sprintf("os://%s/", t.TempDir())},
+		"MemoryToOs": {fmt.Sprintf("os://%s/", t.TempDir()), "memory:///"},
+	} {
+		dsns := dsns
+		t.Run(name, func(t *testing.T) {
+			dst, src := open(t, dsns[0]), open(t, dsns[1])
+			populate(t, src, syncTree)
+
+			report, err := filesystem.Sync(dst, src, nil)
+			require.NoError(t, err)
+			assert.Equal(t, syncTree, dump(t, dst))
+			assert.Equal(t, []string{
+				"create a.txt", "create b.log", "create dir/c.txt", "create dir/sub/d.txt",
+				"mkdir dir", "mkdir dir/sub", "mkdir empty",
+			}, actions(report))
+			assert.Equal(t, int64(10), report.Bytes)
+
+			// nothing changed, nothing is copied
+			report, err = filesystem.Sync(dst, src, &filesystem.SyncOptions{Parallelism: 4})
+			require.NoError(t, err)
+			assert.Empty(t, report.Items)
+			assert.Equal(t, 4, report.Unchanged)
+
+			populate(t, src, map[string]string{"/a.txt": "A", "/dir/c.txt": "changed"})
+			populate(t, dst, map[string]string{"/extra/e.txt": "e"})
+			require.NoError(t, src.Remove("/b.log"))
+
+			report, err = filesystem.Sync(dst, src, &filesystem.SyncOptions{Delete: true, Parallelism: 4})
+			require.NoError(t, err)
+			assert.Equal(t, []string{"delete b.log", "delete extra", "update a.txt", "update dir/c.txt"}, actions(report))
+			assert.Equal(t, dump(t, src), dump(t, dst))
+		})
+	}
+}
+
+func TestSyncChecksum(t *testing.T) {
+	src, dst := open(t, "memory:///"), open(t, "memory:///")
+	populate(t, src, map[string]string{"/a": "same", "/b": "diff"})
+	populate(t, dst, map[string]string{"/a": "same", "/b": "DIFF"})
+
+	mtime := time.Date(2020, 1, 1, 0, 0, 0, 0, time.UTC)
+	for _, vfs := range []filesystem.FileSystem{src, dst} {
+		for _, name := range []string{"/a", "/b"} {
+			require.NoError(t, filesystem.Chtimes(vfs, name, mtime, mtime))
+		}
+	}
+
+	report, err := filesystem.Sync(dst, src, nil)
+	require.NoError(t, err)
+	assert.Empty(t, report.Items, "the quick check sees equal size and time")
+
+	report, err = filesystem.Sync(dst, src, &filesystem.SyncOptions{Compare: filesystem.CompareChecksum})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"update b"}, actions(report))
+	assert.Equal(t, 1, report.Unchanged)
+	assert.Equal(t, dump(t, src), dump(t, dst))
+}
+
+func TestSyncFilters(t *testing.T) {
+	src, dst := open(t, "memory:///"), open(t, "memory:///")
+	populate(t, src, syncTree)
+	populate(t, dst, map[string]string{"/keep.log": "k", "/drop.txt": "d", "/dir/sub/x.bin": "x", "/old/y.txt": "y"})
+
+	report, err := filesystem.Sync(dst, src, &filesystem.SyncOptions{
+		Include: []string{"*.txt"},
+		Exclude: []string{"dir/sub"},
+		Delete:  true,
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"create a.txt", "create dir/c.txt", "delete drop.txt", "delete old/y.txt", "mkdir empty"}, actions(report))
+	assert.Equal(t, map[string]string{
+		"/a.txt":         "a",
+		"/keep.log":      "k",
+		"/dir/":          "",
+		"/dir/c.txt":     "ccc",
+		"/dir/sub/":      "",
+		"/dir/sub/x.bin": "x",
+		"/empty/":        "",
+		"/old/":          "",
+	}, dump(t, dst))
+
+	_, err = filesystem.Sync(dst, src, &filesystem.SyncOptions{Exclude: []string{"["}})
+	assert.Error(t, err)
+}
+
+func TestSyncDryRun(t *testing.T) {
+	src, dst := open(t, "memory:///"), open(t, "memory:///")
+	populate(t, src, syncTree)
+	populate(t, dst, map[string]string{"/a.txt/": "", "/extra": "e"})
+	before := dump(t, dst)
+
+	report, err := filesystem.Sync(dst, src, &filesystem.SyncOptions{DryRun: true, Delete: true})
+	require.NoError(t, err)
+	assert.True(t, report.DryRun)
+	assert.Equal(t, []string{
+		"create a.txt", "create b.log", "create dir/c.txt", "create dir/sub/d.txt",
+		"delete a.txt", "delete extra",
+		"mkdir dir", "mkdir dir/sub", "mkdir empty",
+	}, actions(report))
+	assert.Equal(t, 2, report.Count(filesystem.SyncDelete))
+	assert.Equal(t, before, dump(t, dst))
+
+	// the type change is applied for real
+	_, err = filesystem.Sync(dst, src, &filesystem.SyncOptions{Delete: true})
+	require.NoError(t, err)
+	assert.Equal(t, syncTree, dump(t, dst))
+}
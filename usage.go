@@ -0,0 +1,82 @@
+package filesystem
+
+import (
+	"io/fs"
+)
+
+// Usage is the capacity of a filesystem in bytes and inodes, a filesystem
+// without a limit reports a zero Total or Inodes and a zero Free or
+// InodesFree.
+type Usage struct {
+	Total uint64 `json:"total"`
+	Used  uint64 `json:"used"`
+	Free  uint64 `json:"free"`
+
+	Inodes     uint64 `json:"inodes"`
+	InodesUsed uint64 `json:"inodesUsed"`
+	InodesFree uint64 `json:"inodesFree"`
+}
+
+type UsageFS interface {
+	FileSystem
+	// Usage see syscall.Statfs
+	Usage() (*Usage, error)
+}
+
+// Statfs returns the capacity of the filesystem, the error is ErrNotSupported
+// when vfs cannot tell.
+func Statfs(vfs FileSystem) (*Usage, error) {
+	if vfs, ok := vfs.(UsageFS); ok {
+		return vfs.Usage()
+	}
+
+	return nil, &fs.PathError{Op: "statfs", Path: "/", Err: ErrNotSupported}
+}
+
+// DirUsage is the du-style usage of a file or directory tree, Size counts
+// the bytes of the files, Dirs the directories below the root.
+type DirUsage struct {
+	Size  int64
+	Files int64
+	Dirs  int64
+}
+
+type DiskUsageFS interface {
+	FileSystem
+	// DiskUsage see DiskUsage
+	DiskUsage(name string) (*DirUsage, error)
+}
+
+// DiskUsage sums the sizes of the files below name, or returns the size of
+// the file name.
+func DiskUsage(vfs FileSystem, name string) (*DirUsage, error) {
+	if vfs, ok := vfs.(DiskUsageFS); ok {
+		return vfs.DiskUsage(name)
+	}
+
+	usage := &DirUsage{}
+	err := WalkDir(vfs, name, func(p string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+
+		if d.IsDir() {
+			if p != name {
+				usage.Dirs++
+			}
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		usage.Size += info.Size()
+		usage.Files++
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	return usage, nil
+}
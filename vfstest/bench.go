@@ -0,0 +1,390 @@
+package vfstest
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"path"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// benchScratch is the directory the benchmarks work in.
+const benchScratch = "/vfsbench"
+
+const (
+	benchSmallSize = 1 << 10
+	benchLargeSize = 8 << 20
+	benchChunkSize = 64 << 10
+	benchDepth     = 16
+	benchWidth     = 1000
+)
+
+// Benchmark opens dsn with filesystem.Open and runs the benchmarks against it.
+func Benchmark(b *testing.B, dsn string) {
+	vfs, err := filesystem.Open(dsn)
+	if err != nil {
+		b.Fatalf("open %s: %s", dsn, err)
+	}
+
+	BenchmarkFileSystem(b, vfs)
+}
+
+// BenchmarkFileSystem runs the benchmarks against vfs. Each benchmark reports
+// allocations and operations per second, running the same set against a
+// driver and against a wrapper of that driver shows the cost of the wrapper.
+//
+//	func BenchmarkMemory(b *testing.B) {
+//		vfstest.Benchmark(b, "memory:///")
+//	}
+func BenchmarkFileSystem(b *testing.B, vfs filesystem.FileSystem) {
+	bench := &benchmark{vfs: vfs}
+
+	b.Run("SmallFileChurn", bench.smallFileChurn)
+	b.Run("LargeWrite", bench.largeWrite)
+	b.Run("LargeRead", bench.largeRead)
+	b.Run("DeepMkdirAll", bench.deepMkdirAll)
+	b.Run("WideReadDir", bench.wideReadDir)
+	b.Run("DeepStat", bench.deepStat)
+	b.Run("ParallelStat", bench.parallelStat)
+	b.Run("ParallelChurn", bench.parallelChurn)
+	b.Run("ParallelMixed", bench.parallelMixed)
+	b.Run("RenameTree", bench.renameTree)
+}
+
+type benchmark struct {
+	vfs filesystem.FileSystem
+
+	seq int64
+}
+
+// dir creates a fresh scratch directory and returns its path.
+func (bench *benchmark) dir(b *testing.B) string {
+	b.Helper()
+
+	if err := bench.vfs.MkdirAll(benchScratch, 0755); err != nil {
+		b.Fatal(err)
+	}
+
+	dir := path.Join(benchScratch, fmt.Sprint(atomic.AddInt64(&bench.seq, 1)))
+	if err := bench.vfs.Mkdir(dir, 0755); err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = bench.vfs.RemoveAll(dir)
+	})
+
+	return dir
+}
+
+// measure resets the timer, runs fn and reports operations per second.
+func measure(b *testing.B, fn func()) {
+	b.ReportAllocs()
+	b.ResetTimer()
+
+	start := time.Now()
+	fn()
+	elapsed := time.Since(start)
+
+	b.StopTimer()
+	if elapsed > 0 {
+		b.ReportMetric(float64(b.N)/elapsed.Seconds(), "ops/s")
+	}
+}
+
+func (bench *benchmark) writeFile(b *testing.B, name string, data []byte) {
+	f, err := bench.vfs.Create(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	for p := data; len(p) > 0; {
+		n := len(p)
+		if n > benchChunkSize {
+			n = benchChunkSize
+		}
+		if _, err := f.Write(p[:n]); err != nil {
+			b.Fatal(err)
+		}
+		p = p[n:]
+	}
+	if err := f.Close(); err != nil {
+		b.Fatal(err)
+	}
+}
+
+func (bench *benchmark) readFile(b *testing.B, name string, buf []byte) int64 {
+	f, err := bench.vfs.Open(name)
+	if err != nil {
+		b.Fatal(err)
+	}
+	defer f.Close()
+
+	n, err := io.CopyBuffer(io.Discard, struct{ io.Reader }{f}, buf)
+	if err != nil {
+		b.Fatal(err)
+	}
+	return n
+}
+
+// deepPath returns a directory path benchDepth levels below dir.
+func deepPath(dir string) string {
+	elems := make([]string, benchDepth)
+	for i := range elems {
+		elems[i] = fmt.Sprintf("d%d", i)
+	}
+	return path.Join(dir, strings.Join(elems, "/"))
+}
+
+func (bench *benchmark) smallFileChurn(b *testing.B) {
+	dir := bench.dir(b)
+	data := bytes.Repeat([]byte{'s'}, benchSmallSize)
+	buf := make([]byte, benchChunkSize)
+
+	b.SetBytes(benchSmallSize)
+	measure(b, func() {
+		for i := 0; i < b.N; i++ {
+			name := path.Join(dir, fmt.Sprintf("f%d", i%64))
+			bench.writeFile(b, name, data)
+			bench.readFile(b, name, buf)
+			if err := bench.vfs.Remove(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func (bench *benchmark) largeWrite(b *testing.B) {
+	dir := bench.dir(b)
+	data := bytes.Repeat([]byte{'l'}, benchLargeSize)
+	name := path.Join(dir, "large")
+
+	b.SetBytes(benchLargeSize)
+	measure(b, func() {
+		for i := 0; i < b.N; i++ {
+			bench.writeFile(b, name, data)
+		}
+	})
+}
+
+func (bench *benchmark) largeRead(b *testing.B) {
+	dir := bench.dir(b)
+	name := path.Join(dir, "large")
+	bench.writeFile(b, name, bytes.Repeat([]byte{'l'}, benchLargeSize))
+	buf := make([]byte, benchChunkSize)
+
+	b.SetBytes(benchLargeSize)
+	measure(b, func() {
+		for i := 0; i < b.N; i++ {
+			if n := bench.readFile(b, name, buf); n != benchLargeSize {
+				b.Fatalf("read %d bytes, want %d", n, benchLargeSize)
+			}
+		}
+	})
+}
+
+func (bench *benchmark) deepMkdirAll(b *testing.B) {
+	dir := bench.dir(b)
+
+	measure(b, func() {
+		for i := 0; i < b.N; i++ {
+			top := path.Join(dir, fmt.Sprint(i))
+			if err := bench.vfs.MkdirAll(deepPath(top), 0755); err != nil {
+				b.Fatal(err)
+			}
+			if err := bench.vfs.RemoveAll(top); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func (bench *benchmark) wideReadDir(b *testing.B) {
+	dir := bench.dir(b)
+	for i := 0; i < benchWidth; i++ {
+		bench.writeFile(b, path.Join(dir, fmt.Sprintf("f%04d", i)), nil)
+	}
+
+	measure(b, func() {
+		for i := 0; i < b.N; i++ {
+			list, err := filesystem.ReadDir(bench.vfs, dir)
+			if err != nil {
+				b.Fatal(err)
+			}
+			if len(list) != benchWidth {
+				b.Fatalf("read %d entries, want %d", len(list), benchWidth)
+			}
+		}
+	})
+}
+
+func (bench *benchmark) deepStat(b *testing.B) {
+	dir := bench.dir(b)
+	deep := deepPath(dir)
+	if err := bench.vfs.MkdirAll(deep, 0755); err != nil {
+		b.Fatal(err)
+	}
+	name := path.Join(deep, "f")
+	bench.writeFile(b, name, []byte("f"))
+
+	measure(b, func() {
+		for i := 0; i < b.N; i++ {
+			if _, err := bench.vfs.Stat(name); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func (bench *benchmark) parallelStat(b *testing.B) {
+	dir := bench.dir(b)
+	deep := deepPath(dir)
+	if err := bench.vfs.MkdirAll(deep, 0755); err != nil {
+		b.Fatal(err)
+	}
+	names := make([]string, 16)
+	for i := range names {
+		names[i] = path.Join(deep, fmt.Sprintf("f%d", i))
+		bench.writeFile(b, names[i], []byte("f"))
+	}
+
+	measure(b, func() {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if _, err := bench.vfs.Stat(names[i%len(names)]); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+func (bench *benchmark) parallelChurn(b *testing.B) {
+	dir := bench.dir(b)
+	data := bytes.Repeat([]byte{'p'}, benchSmallSize)
+	var worker int64
+
+	b.SetBytes(benchSmallSize)
+	measure(b, func() {
+		b.RunParallel(func(pb *testing.PB) {
+			sub := path.Join(dir, fmt.Sprint(atomic.AddInt64(&worker, 1)))
+			if err := bench.vfs.Mkdir(sub, 0755); err != nil {
+				b.Error(err)
+				return
+			}
+			buf := make([]byte, benchChunkSize)
+
+			for i := 0; pb.Next(); i++ {
+				name := path.Join(sub, fmt.Sprintf("f%d", i%16))
+				if err := filesystem.WriteFile(bench.vfs, name, data); err != nil {
+					b.Error(err)
+					return
+				}
+				f, err := bench.vfs.Open(name)
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				_, err = io.CopyBuffer(io.Discard, struct{ io.Reader }{f}, buf)
+				_ = f.Close()
+				if err != nil {
+					b.Error(err)
+					return
+				}
+				if _, err := bench.vfs.Stat(name); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+}
+
+// parallelMixed stats deep files and lists a wide directory in parallel while
+// one writer keeps changing the same tree.
+func (bench *benchmark) parallelMixed(b *testing.B) {
+	dir := bench.dir(b)
+	deep := deepPath(dir)
+	if err := bench.vfs.MkdirAll(deep, 0755); err != nil {
+		b.Fatal(err)
+	}
+	names := make([]string, 16)
+	for i := range names {
+		names[i] = path.Join(deep, fmt.Sprintf("f%d", i))
+		bench.writeFile(b, names[i], []byte("f"))
+	}
+	wide := path.Join(dir, "wide")
+	if err := bench.vfs.Mkdir(wide, 0755); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < benchWidth; i++ {
+		bench.writeFile(b, path.Join(wide, fmt.Sprintf("f%04d", i)), nil)
+	}
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+		for i := 0; ; i++ {
+			select {
+			case <-done:
+				return
+			default:
+			}
+			name := path.Join(deep, fmt.Sprintf("w%d", i%16))
+			if err := filesystem.WriteFile(bench.vfs, name, []byte("w")); err != nil {
+				b.Error(err)
+				return
+			}
+			if err := bench.vfs.Remove(name); err != nil {
+				b.Error(err)
+				return
+			}
+		}
+	}()
+
+	measure(b, func() {
+		b.RunParallel(func(pb *testing.PB) {
+			for i := 0; pb.Next(); i++ {
+				if i%64 == 0 {
+					if _, err := filesystem.ReadDir(bench.vfs, wide); err != nil {
+						b.Error(err)
+						return
+					}
+					continue
+				}
+				if _, err := bench.vfs.Stat(names[i%len(names)]); err != nil {
+					b.Error(err)
+					return
+				}
+			}
+		})
+	})
+
+	close(done)
+	<-stopped
+}
+
+// renameTree moves a directory holding a deep and a wide tree back and forth.
+func (bench *benchmark) renameTree(b *testing.B) {
+	dir := bench.dir(b)
+	from, to := path.Join(dir, "a"), path.Join(dir, "b")
+	if err := bench.vfs.MkdirAll(deepPath(from), 0755); err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < benchWidth; i++ {
+		bench.writeFile(b, path.Join(from, fmt.Sprintf("f%04d", i)), nil)
+	}
+
+	measure(b, func() {
+		for i := 0; i < b.N; i++ {
+			if err := bench.vfs.Rename(from, to); err != nil {
+				b.Fatal(err)
+			}
+			from, to = to, from
+		}
+	})
+}
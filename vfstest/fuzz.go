@@ -0,0 +1,459 @@
+package vfstest
+
+import (
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"io"
+	"path"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// fuzzScratch is the directory the differential tests work in.
+const fuzzScratch = "/vfsfuzz"
+
+// maxOps bounds the length of a decoded operation sequence.
+const maxOps = 32
+
+type opKind byte
+
+const (
+	opCreate opKind = iota
+	opWrite
+	opWriteFile
+	opMkdir
+	opMkdirAll
+	opRemove
+	opRemoveAll
+	opRename
+	// operations after opRename leave the tree alone
+	opStat
+	opRead
+	opReadFile
+	opReadDir
+	opKinds
+)
+
+var opNames = [...]string{
+	opCreate:    "Create",
+	opWrite:     "Write",
+	opWriteFile: "WriteFile",
+	opMkdir:     "Mkdir",
+	opMkdirAll:  "MkdirAll",
+	opRemove:    "Remove",
+	opRemoveAll: "RemoveAll",
+	opRename:    "Rename",
+	opStat:      "Stat",
+	opRead:      "Read",
+	opReadFile:  "ReadFile",
+	opReadDir:   "ReadDir",
+}
+
+// op is a single step of a differential test. Names are relative to the
+// scratch directory.
+type op struct {
+	kind    opKind
+	name    string
+	newname string
+	data    string
+}
+
+func (o op) String() string {
+	switch o.kind {
+	case opRename:
+		return fmt.Sprintf("%s(%q, %q)", opNames[o.kind], o.name, o.newname)
+	case opWrite, opWriteFile:
+		return fmt.Sprintf("%s(%q, %q)", opNames[o.kind], o.name, o.data)
+	}
+	return fmt.Sprintf("%s(%q)", opNames[o.kind], o.name)
+}
+
+// result is what an operation observed, rendered so that results of
+// different implementations compare equal when they behave the same.
+type result struct {
+	class errClass
+	value string
+}
+
+func (r result) String() string {
+	if r.value == "" {
+		return string(r.class)
+	}
+	return fmt.Sprintf("%s %q", r.class, r.value)
+}
+
+// decoder turns fuzzer input into operations, reading past the end yields zeros.
+type decoder struct {
+	data []byte
+}
+
+func (d *decoder) byte() byte {
+	if len(d.data) == 0 {
+		return 0
+	}
+	b := d.data[0]
+	d.data = d.data[1:]
+	return b
+}
+
+// name decodes a path of up to three elements drawn from a tiny alphabet,
+// so that operations of a sequence keep running into each other. The low two
+// bits of the byte hold the number of elements, each pair of bits above them
+// an element.
+func (d *decoder) name() string {
+	b := d.byte()
+	elems := make([]string, int(b&3)%3+1)
+	for i := range elems {
+		elems[i] = string(rune('a' + (b>>(2+i*2)&3)%3))
+	}
+	return strings.Join(elems, "/")
+}
+
+func decodeOps(data []byte) []op {
+	d := &decoder{data: data}
+
+	var ops []op
+	for len(d.data) > 0 && len(ops) < maxOps {
+		o := op{kind: opKind(d.byte() % byte(opKinds)), name: d.name()}
+		switch o.kind {
+		case opRename:
+			o.newname = d.name()
+		case opWrite, opWriteFile:
+			o.data = strings.Repeat(string(rune('x'+d.byte()%3)), int(d.byte()%8))
+		}
+		ops = append(ops, o)
+	}
+	return ops
+}
+
+// target is one side of a differential test.
+type target interface {
+	reset() error
+	apply(o op) result
+	tree() string
+}
+
+type modelTarget struct {
+	m *model
+}
+
+func (t *modelTarget) reset() error {
+	t.m = newModel()
+	return nil
+}
+
+func (t *modelTarget) apply(o op) result {
+	m := t.m
+	switch o.kind {
+	case opCreate:
+		return result{class: m.create(o.name, "")}
+	case opWrite, opWriteFile:
+		return result{class: m.create(o.name, o.data)}
+	case opMkdir:
+		return result{class: m.mkdir(o.name)}
+	case opMkdirAll:
+		return result{class: m.mkdirAll(o.name)}
+	case opRemove:
+		return result{class: m.remove(o.name)}
+	case opRemoveAll:
+		return result{class: m.removeAll(o.name)}
+	case opRename:
+		return result{class: m.rename(o.name, o.newname)}
+	case opStat:
+		value, c := m.stat(o.name)
+		return result{class: c, value: value}
+	case opRead, opReadFile:
+		value, c := m.readFile(o.name)
+		return result{class: c, value: value}
+	case opReadDir:
+		value, c := m.readDir(o.name)
+		return result{class: c, value: value}
+	}
+	panic("unknown operation")
+}
+
+func (t *modelTarget) tree() string {
+	return t.m.tree()
+}
+
+type driverTarget struct {
+	vfs filesystem.FileSystem
+}
+
+func (t *driverTarget) reset() error {
+	if err := t.vfs.RemoveAll(fuzzScratch); err != nil {
+		return err
+	}
+	return t.vfs.Mkdir(fuzzScratch, 0755)
+}
+
+func (t *driverTarget) apply(o op) result {
+	vfs := t.vfs
+	name := path.Join(fuzzScratch, o.name)
+
+	switch o.kind {
+	case opCreate:
+		f, err := vfs.Create(name)
+		if err == nil {
+			err = f.Close()
+		}
+		return result{class: classify(err)}
+	case opWrite:
+		f, err := vfs.Create(name)
+		if err != nil {
+			return result{class: classify(err)}
+		}
+		_, err = io.WriteString(f, o.data)
+		if cerr := f.Close(); err == nil {
+			err = cerr
+		}
+		return result{class: classify(err)}
+	case opWriteFile:
+		return result{class: classify(filesystem.WriteFile(vfs, name, []byte(o.data)))}
+	case opMkdir:
+		return result{class: classify(vfs.Mkdir(name, 0755))}
+	case opMkdirAll:
+		return result{class: classify(vfs.MkdirAll(name, 0755))}
+	case opRemove:
+		return result{class: classify(vfs.Remove(name))}
+	case opRemoveAll:
+		return result{class: classify(vfs.RemoveAll(name))}
+	case opRename:
+		return result{class: classify(vfs.Rename(name, path.Join(fuzzScratch, o.newname)))}
+	case opStat:
+		fi, err := vfs.Stat(name)
+		if err != nil {
+			return result{class: classify(err)}
+		}
+		return result{class: classOK, value: statString(fi.Name(), fi.IsDir(), fi.Size())}
+	case opRead:
+		f, err := vfs.Open(name)
+		if err != nil {
+			return result{class: classify(err)}
+		}
+		defer f.Close()
+		b, err := io.ReadAll(f)
+		if err != nil {
+			return result{class: classify(err)}
+		}
+		return result{class: classOK, value: string(b)}
+	case opReadFile:
+		b, err := filesystem.ReadFile(vfs, name)
+		if err != nil {
+			return result{class: classify(err)}
+		}
+		return result{class: classOK, value: string(b)}
+	case opReadDir:
+		list, err := filesystem.ReadDir(vfs, name)
+		if err != nil {
+			return result{class: classify(err)}
+		}
+		entries := make([]string, 0, len(list))
+		for _, entry := range list {
+			entries = append(entries, entryString(entry.Name(), entry.IsDir()))
+		}
+		return result{class: classOK, value: strings.Join(entries, " ")}
+	}
+	panic("unknown operation")
+}
+
+func (t *driverTarget) tree() string {
+	var lines []string
+
+	var walk func(dir string)
+	walk = func(dir string) {
+		list, err := filesystem.ReadDir(t.vfs, path.Join(fuzzScratch, dir))
+		if err != nil {
+			lines = append(lines, fmt.Sprintf("%s/ %s", dir, err))
+			return
+		}
+		for _, entry := range list {
+			name := strings.TrimPrefix(dir+"/"+entry.Name(), "/")
+			if entry.IsDir() {
+				lines = append(lines, name+"/")
+				walk(name)
+				continue
+			}
+			b, err := filesystem.ReadFile(t.vfs, path.Join(fuzzScratch, name))
+			if err != nil {
+				lines = append(lines, fmt.Sprintf("%s %s", name, err))
+				continue
+			}
+			lines = append(lines, fmt.Sprintf("%s %q", name, b))
+		}
+	}
+	walk("")
+
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+// divergence describes the first step at which two targets disagree.
+type divergence struct {
+	step      int
+	what      string
+	got, want string
+}
+
+// diverge applies ops to both targets and compares every result and the
+// resulting trees, it returns nil when they agree on the whole sequence.
+func diverge(got, want target, ops []op) (*divergence, error) {
+	if err := got.reset(); err != nil {
+		return nil, err
+	}
+	if err := want.reset(); err != nil {
+		return nil, err
+	}
+
+	for i, o := range ops {
+		g, w := got.apply(o), want.apply(o)
+		if g != w {
+			return &divergence{step: i, what: "result", got: g.String(), want: w.String()}, nil
+		}
+
+		if o.kind > opRename {
+			continue
+		}
+
+		if g, w := got.tree(), want.tree(); g != w {
+			return &divergence{step: i, what: "tree", got: g, want: w}, nil
+		}
+	}
+	return nil, nil
+}
+
+// minimize drops operations from a diverging sequence for as long as the
+// remaining sequence still diverges.
+func minimize(got, want target, ops []op) ([]op, *divergence, error) {
+	d, err := diverge(got, want, ops)
+	if err != nil || d == nil {
+		return ops, d, err
+	}
+	ops = ops[:d.step+1]
+
+	for shrunk := true; shrunk; {
+		shrunk = false
+		for i := len(ops) - 1; i >= 0; i-- {
+			candidate := append(append([]op{}, ops[:i]...), ops[i+1:]...)
+
+			cd, err := diverge(got, want, candidate)
+			if err != nil {
+				return nil, nil, err
+			}
+			if cd != nil {
+				ops, d, shrunk = candidate[:cd.step+1], cd, true
+				break
+			}
+		}
+	}
+	return ops, d, nil
+}
+
+func report(t *testing.T, ops []op, d *divergence) {
+	var b strings.Builder
+	for i, o := range ops {
+		fmt.Fprintf(&b, "\n\t%d: %s", i, o)
+	}
+	t.Fatalf("diverged at step %d of%s\n%s got:\n%s\n%s want:\n%s", d.step, b.String(), d.what, d.got, d.what, d.want)
+}
+
+// encodeOps is the inverse of decodeOps for operations it can decode.
+func encodeOps(ops []op) []byte {
+	var data []byte
+	for _, o := range ops {
+		data = append(data, byte(o.kind), encodeName(o.name))
+		switch o.kind {
+		case opRename:
+			data = append(data, encodeName(o.newname))
+		case opWrite, opWriteFile:
+			var c byte
+			if o.data != "" {
+				c = o.data[0] - 'x'
+			}
+			data = append(data, c, byte(len(o.data)))
+		}
+	}
+	return data
+}
+
+func encodeName(name string) byte {
+	elems := strings.Split(name, "/")
+	b := byte(len(elems) - 1)
+	for i, elem := range elems {
+		b |= (elem[0] - 'a') << (2 + i*2)
+	}
+	return b
+}
+
+// seeds exercise behaviour the drivers are known to have disagreed on.
+var seeds = [][]op{
+	// directories holding only files, empty directories
+	{{kind: opMkdir, name: "b"}, {kind: opWrite, name: "b/a", data: "yyy"}, {kind: opReadDir, name: "b"}, {kind: opMkdir, name: "c"}, {kind: opReadDir, name: "c"}},
+	// Create truncates
+	{{kind: opWrite, name: "a", data: "xxxxx"}, {kind: opCreate, name: "a"}, {kind: opRead, name: "a"}, {kind: opStat, name: "a"}},
+	// directories replaced by renames, renames into themselves
+	{{kind: opMkdirAll, name: "a/b"}, {kind: opMkdir, name: "b"}, {kind: opRename, name: "b", newname: "a"}, {kind: opRename, name: "a", newname: "a/b/c"}, {kind: opRename, name: "a/b", newname: "a"}, {kind: opRename, name: "a", newname: "c"}},
+	// files in the way of directories
+	{{kind: opCreate, name: "a"}, {kind: opMkdirAll, name: "a/b"}, {kind: opStat, name: "a/b"}, {kind: opRemoveAll, name: "a/b"}, {kind: opMkdir, name: "a"}, {kind: opRemove, name: "a"}},
+	// removing directories that are not empty
+	{{kind: opMkdirAll, name: "a/b"}, {kind: opRemove, name: "a"}, {kind: opRemoveAll, name: "a"}, {kind: opReadDir, name: "a"}},
+}
+
+func fuzz(f *testing.F, got, want target) {
+	for _, seed := range seeds {
+		f.Add(encodeOps(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, data []byte) {
+		ops := decodeOps(data)
+
+		d, err := diverge(got, want, ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if d == nil {
+			return
+		}
+
+		ops, d, err = minimize(got, want, ops)
+		if err != nil {
+			t.Fatal(err)
+		}
+		report(t, ops, d)
+	})
+}
+
+// Fuzz is a differential fuzz target comparing the FileSystem behind dsn with
+// a reference model of the os package semantics. Every input is decoded into
+// a sequence of operations on a scratch directory, when the FileSystem and the
+// model disagree the test fails with the shortest sequence that still makes
+// them disagree.
+//
+//	func FuzzMemory(f *testing.F) {
+//		vfstest.Fuzz(f, "memory:///")
+//	}
+func Fuzz(f *testing.F, dsn string) {
+	vfs, err := filesystem.Open(dsn)
+	if err != nil {
+		f.Fatalf("open %s: %s", dsn, err)
+	}
+
+	fuzz(f, &driverTarget{vfs: vfs}, &modelTarget{})
+}
+
+// FuzzAgainst is like Fuzz but takes the FileSystem behind reference as the
+// reference, for example the os driver in a temporary directory.
+func FuzzAgainst(f *testing.F, dsn, reference string) {
+	vfs, err := filesystem.Open(dsn)
+	if err != nil {
+		f.Fatalf("open %s: %s", dsn, err)
+	}
+
+	ref, err := filesystem.Open(reference)
+	if err != nil {
+		f.Fatalf("open %s: %s", reference, err)
+	}
+
+	fuzz(f, &driverTarget{vfs: vfs}, &driverTarget{vfs: ref})
+}
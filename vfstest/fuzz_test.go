@@ -0,0 +1,12 @@
+package vfstest
+
+import (
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestEncodeOps(t *testing.T) {
+	for _, seed := range seeds {
+		assert.Equal(t, seed, decodeOps(encodeOps(seed)))
+	}
+}
@@ -0,0 +1,270 @@
+package vfstest
+
+import (
+	"errors"
+	"fmt"
+	"io/fs"
+	"sort"
+	"strings"
+)
+
+// errClass is the part of an error the differential tests compare, drivers
+// are free to word their errors however they like.
+type errClass string
+
+const (
+	classOK       errClass = "ok"
+	classNotExist errClass = "not exist"
+	classExist    errClass = "exist"
+	classOther    errClass = "error"
+)
+
+func classify(err error) errClass {
+	switch {
+	case err == nil:
+		return classOK
+	case errors.Is(err, fs.ErrNotExist):
+		return classNotExist
+	case errors.Is(err, fs.ErrExist):
+		return classExist
+	}
+	return classOther
+}
+
+// model is the reference implementation the drivers are compared with.
+// It follows the behaviour of the os package on Linux, names are cleaned
+// paths relative to the root without a leading slash.
+type model struct {
+	nodes map[string]*modelNode
+}
+
+type modelNode struct {
+	dir  bool
+	data string
+}
+
+func newModel() *model {
+	return &model{nodes: map[string]*modelNode{"": {dir: true}}}
+}
+
+func parentOf(name string) string {
+	if i := strings.LastIndex(name, "/"); i >= 0 {
+		return name[:i]
+	}
+	return ""
+}
+
+// resolve walks the directories leading to name.
+func (m *model) resolve(name string) errClass {
+	parent := parentOf(name)
+	if parent == "" {
+		return classOK
+	}
+
+	dir := ""
+	for _, elem := range strings.Split(parent, "/") {
+		dir = strings.TrimPrefix(dir+"/"+elem, "/")
+		node, ok := m.nodes[dir]
+		if !ok {
+			return classNotExist
+		}
+		if !node.dir {
+			return classOther
+		}
+	}
+	return classOK
+}
+
+func (m *model) lookup(name string) (*modelNode, errClass) {
+	if c := m.resolve(name); c != classOK {
+		return nil, c
+	}
+	if node, ok := m.nodes[name]; ok {
+		return node, classOK
+	}
+	return nil, classNotExist
+}
+
+// children returns the names below dir, deepest first.
+func (m *model) children(dir string) []string {
+	var names []string
+	for name := range m.nodes {
+		if strings.HasPrefix(name, dir+"/") {
+			names = append(names, name)
+		}
+	}
+	sort.Sort(sort.Reverse(sort.StringSlice(names)))
+	return names
+}
+
+func (m *model) create(name, data string) errClass {
+	if c := m.resolve(name); c != classOK {
+		return c
+	}
+	if node, ok := m.nodes[name]; ok && node.dir {
+		return classOther
+	}
+	m.nodes[name] = &modelNode{data: data}
+	return classOK
+}
+
+func (m *model) mkdir(name string) errClass {
+	if c := m.resolve(name); c != classOK {
+		return c
+	}
+	if _, ok := m.nodes[name]; ok {
+		return classExist
+	}
+	m.nodes[name] = &modelNode{dir: true}
+	return classOK
+}
+
+func (m *model) mkdirAll(name string) errClass {
+	dir := ""
+	for _, elem := range strings.Split(name, "/") {
+		dir = strings.TrimPrefix(dir+"/"+elem, "/")
+		node, ok := m.nodes[dir]
+		if !ok {
+			m.nodes[dir] = &modelNode{dir: true}
+			continue
+		}
+		if !node.dir {
+			return classOther
+		}
+	}
+	return classOK
+}
+
+func (m *model) remove(name string) errClass {
+	node, c := m.lookup(name)
+	if c != classOK {
+		return c
+	}
+	if node.dir && len(m.children(name)) > 0 {
+		return classExist
+	}
+	delete(m.nodes, name)
+	return classOK
+}
+
+func (m *model) removeAll(name string) errClass {
+	switch _, c := m.lookup(name); c {
+	case classNotExist:
+		return classOK
+	case classOther:
+		return c
+	}
+	for _, child := range m.children(name) {
+		delete(m.nodes, child)
+	}
+	delete(m.nodes, name)
+	return classOK
+}
+
+func (m *model) rename(oldname, newname string) errClass {
+	src, srcClass := m.lookup(oldname)
+
+	// os.Rename refuses to replace a directory before asking the kernel.
+	if dst, c := m.lookup(newname); c == classOK && dst.dir {
+		if srcClass != classOK {
+			return srcClass
+		}
+		return classExist
+	}
+
+	if c := m.resolve(oldname); c != classOK {
+		return c
+	}
+	if c := m.resolve(newname); c != classOK {
+		return c
+	}
+	if srcClass != classOK {
+		return srcClass
+	}
+	if oldname == newname {
+		return classOK
+	}
+	if src.dir && strings.HasPrefix(newname, oldname+"/") {
+		return classOther
+	}
+	if _, ok := m.nodes[newname]; ok && src.dir {
+		return classOther
+	}
+
+	for _, child := range m.children(oldname) {
+		m.nodes[newname+strings.TrimPrefix(child, oldname)] = m.nodes[child]
+		delete(m.nodes, child)
+	}
+	delete(m.nodes, oldname)
+	m.nodes[newname] = src
+	return classOK
+}
+
+func (m *model) stat(name string) (string, errClass) {
+	node, c := m.lookup(name)
+	if c != classOK {
+		return "", c
+	}
+	return statString(name[strings.LastIndex(name, "/")+1:], node.dir, int64(len(node.data))), classOK
+}
+
+func (m *model) readFile(name string) (string, errClass) {
+	node, c := m.lookup(name)
+	if c != classOK {
+		return "", c
+	}
+	if node.dir {
+		return "", classOther
+	}
+	return node.data, classOK
+}
+
+func (m *model) readDir(name string) (string, errClass) {
+	node, c := m.lookup(name)
+	if c != classOK {
+		return "", c
+	}
+	if !node.dir {
+		return "", classOther
+	}
+
+	var list []string
+	for child, node := range m.nodes {
+		if child != name && parentOf(child) == name {
+			list = append(list, entryString(child[strings.LastIndex(child, "/")+1:], node.dir))
+		}
+	}
+	sort.Strings(list)
+	return strings.Join(list, " "), classOK
+}
+
+// tree renders the whole model the way snapshot renders a FileSystem.
+func (m *model) tree() string {
+	var lines []string
+	for name, node := range m.nodes {
+		if name == "" {
+			continue
+		}
+		if node.dir {
+			lines = append(lines, name+"/")
+		} else {
+			lines = append(lines, fmt.Sprintf("%s %q", name, node.data))
+		}
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func statString(name string, dir bool, size int64) string {
+	if dir {
+		return name + "/"
+	}
+	return fmt.Sprintf("%s %d", name, size)
+}
+
+func entryString(name string, dir bool) string {
+	if dir {
+		return name + "/"
+	}
+	return name
+}
@@ -0,0 +1,941 @@
+package vfstest
+
+import (
+	"context"
+	"fmt"
+	"github.com/lazychanger/go-vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io"
+	"io/fs"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+type suite struct {
+	vfs filesystem.FileSystem
+
+	// open opens another filesystem like vfs, nil when the suite cannot.
+	open func() (filesystem.FileSystem, error)
+
+	caps Capability
+
+	seq int32
+}
+
+func (s *suite) require(t *testing.T, caps Capability) {
+	if s.caps&caps != caps {
+		t.Skip("capability switched off")
+	}
+}
+
+// dir creates a fresh scratch directory and returns its path.
+func (s *suite) dir(t *testing.T) string {
+	dir := path.Join(scratch, strconv.Itoa(int(atomic.AddInt32(&s.seq, 1))))
+	require.NoError(t, s.vfs.Mkdir(dir, 0755))
+	return dir
+}
+
+// write creates name with content through a File.
+func (s *suite) write(t *testing.T, name, content string) {
+	f, err := s.vfs.Create(name)
+	require.NoError(t, err)
+
+	_, err = io.WriteString(f, content)
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+}
+
+// read returns the content of name read through a File.
+func (s *suite) read(t *testing.T, name string) string {
+	f, err := s.vfs.Open(name)
+	require.NoError(t, err)
+	defer f.Close()
+
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	return string(b)
+}
+
+func (s *suite) testCreate(t *testing.T) {
+	dir := s.dir(t)
+	name := path.Join(dir, "a.txt")
+
+	f, err := s.vfs.Create(name)
+	require.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	fi, err := s.vfs.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(0), fi.Size())
+	assert.False(t, fi.IsDir())
+
+	s.write(t, name, "content")
+
+	f, err = s.vfs.Create(name)
+	require.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "", s.read(t, name), "Create must truncate an existing file")
+
+	_, err = s.vfs.Create(path.Join(dir, "noexist", "a.txt"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, s.vfs.Mkdir(path.Join(dir, "sub"), 0755))
+	_, err = s.vfs.Create(path.Join(dir, "sub"))
+	assert.Error(t, err, "Create must refuse a directory")
+	assert.True(t, s.vfs.IsDir(path.Join(dir, "sub")))
+}
+
+func (s *suite) testContent(t *testing.T) {
+	dir := s.dir(t)
+	name := path.Join(dir, "a.txt")
+
+	f, err := s.vfs.Create(name)
+	require.NoError(t, err)
+	_, err = io.WriteString(f, "hello ")
+	assert.NoError(t, err)
+	_, err = io.WriteString(f, "world")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	fi, err := s.vfs.Stat(name)
+	require.NoError(t, err)
+	assert.Equal(t, int64(len("hello world")), fi.Size())
+
+	r1, err := s.vfs.Open(name)
+	require.NoError(t, err)
+	defer r1.Close()
+	r2, err := s.vfs.Open(name)
+	require.NoError(t, err)
+	defer r2.Close()
+
+	buf := make([]byte, 5)
+	n, err := io.ReadFull(r1, buf)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello", string(buf[:n]))
+
+	b, err := io.ReadAll(r2)
+	assert.NoError(t, err)
+	assert.Equal(t, "hello world", string(b), "handles must not share offsets")
+
+	b, err = io.ReadAll(r1)
+	assert.NoError(t, err)
+	assert.Equal(t, " world", string(b))
+
+	n, err = r1.Read(buf)
+	assert.Equal(t, 0, n)
+	assert.ErrorIs(t, err, io.EOF)
+
+	fi, err = r1.Stat()
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", fi.Name())
+	assert.Equal(t, int64(len("hello world")), fi.Size())
+}
+
+func (s *suite) testOpen(t *testing.T) {
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "a.txt"), "a")
+
+	f, err := s.vfs.Open(path.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	assert.NoError(t, f.Close())
+
+	_, err = s.vfs.Open(path.Join(dir, "noexist.txt"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = s.vfs.Open(path.Join(dir, "noexist", "a.txt"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testOpenDir(t *testing.T) {
+	s.require(t, CapOpenDir)
+
+	dir := s.dir(t)
+	want := []string{"a", "b.txt", "c.txt", "d", "e.txt"}
+	for _, name := range want {
+		if path.Ext(name) == "" {
+			require.NoError(t, s.vfs.Mkdir(path.Join(dir, name), 0755))
+		} else {
+			s.write(t, path.Join(dir, name), name)
+		}
+	}
+
+	readDir := func(t *testing.T) filesystem.ReadDirFile {
+		f, err := s.vfs.Open(dir)
+		require.NoError(t, err)
+		t.Cleanup(func() { _ = f.Close() })
+
+		fi, err := f.Stat()
+		require.NoError(t, err)
+		assert.True(t, fi.IsDir())
+
+		rd, ok := f.(filesystem.ReadDirFile)
+		require.True(t, ok, "Open on a directory must return a ReadDirFile")
+		return rd
+	}
+
+	t.Run("paged", func(t *testing.T) {
+		rd := readDir(t)
+
+		var got []string
+		for {
+			list, err := rd.ReadDir(2)
+			assert.LessOrEqual(t, len(list), 2)
+			got = append(got, names(list)...)
+			if err == io.EOF {
+				assert.Empty(t, list, "ReadDir(n) must return io.EOF with an empty list")
+				break
+			}
+			require.NoError(t, err)
+			require.NotEmpty(t, list, "ReadDir(n) must return entries or an error")
+		}
+		sort.Strings(got)
+		assert.Equal(t, want, got)
+
+		list, err := rd.ReadDir(2)
+		assert.Empty(t, list)
+		assert.ErrorIs(t, err, io.EOF)
+	})
+
+	t.Run("all", func(t *testing.T) {
+		rd := readDir(t)
+
+		list, err := rd.ReadDir(-1)
+		require.NoError(t, err)
+		got := names(list)
+		sort.Strings(got)
+		assert.Equal(t, want, got)
+
+		list, err = rd.ReadDir(0)
+		assert.NoError(t, err, "ReadDir(n <= 0) must not return io.EOF")
+		assert.Empty(t, list)
+	})
+}
+
+func (s *suite) testMkdir(t *testing.T) {
+	dir := s.dir(t)
+	name := path.Join(dir, "sub")
+
+	require.NoError(t, s.vfs.Mkdir(name, 0755))
+	assert.True(t, s.vfs.IsDir(name))
+
+	assert.ErrorIs(t, s.vfs.Mkdir(name, 0755), fs.ErrExist)
+
+	s.write(t, path.Join(dir, "a.txt"), "a")
+	assert.ErrorIs(t, s.vfs.Mkdir(path.Join(dir, "a.txt"), 0755), fs.ErrExist)
+	assert.True(t, s.vfs.IsFile(path.Join(dir, "a.txt")))
+
+	assert.ErrorIs(t, s.vfs.Mkdir(path.Join(dir, "noexist", "sub"), 0755), fs.ErrNotExist)
+}
+
+func (s *suite) testMkdirAll(t *testing.T) {
+	dir := s.dir(t)
+
+	require.NoError(t, s.vfs.MkdirAll(path.Join(dir, "a", "b", "c"), 0755))
+	assert.True(t, s.vfs.IsDir(path.Join(dir, "a")))
+	assert.True(t, s.vfs.IsDir(path.Join(dir, "a", "b")))
+	assert.True(t, s.vfs.IsDir(path.Join(dir, "a", "b", "c")))
+
+	s.write(t, path.Join(dir, "a", "b", "c", "f.txt"), "f")
+	assert.NoError(t, s.vfs.MkdirAll(path.Join(dir, "a", "b", "c"), 0755))
+	assert.Equal(t, "f", s.read(t, path.Join(dir, "a", "b", "c", "f.txt")), "MkdirAll must keep existing content")
+
+	s.write(t, path.Join(dir, "file"), "file")
+	assert.Error(t, s.vfs.MkdirAll(path.Join(dir, "file"), 0755))
+	assert.Error(t, s.vfs.MkdirAll(path.Join(dir, "file", "sub"), 0755))
+	assert.True(t, s.vfs.IsFile(path.Join(dir, "file")))
+}
+
+func (s *suite) testRemove(t *testing.T) {
+	dir := s.dir(t)
+
+	s.write(t, path.Join(dir, "a.txt"), "a")
+	require.NoError(t, s.vfs.Remove(path.Join(dir, "a.txt")))
+	_, err := s.vfs.Stat(path.Join(dir, "a.txt"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	require.NoError(t, s.vfs.Mkdir(path.Join(dir, "empty"), 0755))
+	require.NoError(t, s.vfs.Remove(path.Join(dir, "empty")))
+	assert.False(t, s.vfs.Exists(path.Join(dir, "empty")))
+
+	require.NoError(t, s.vfs.Mkdir(path.Join(dir, "full"), 0755))
+	s.write(t, path.Join(dir, "full", "b.txt"), "b")
+	assert.Error(t, s.vfs.Remove(path.Join(dir, "full")), "Remove must refuse a directory that is not empty")
+	assert.Equal(t, "b", s.read(t, path.Join(dir, "full", "b.txt")))
+
+	assert.ErrorIs(t, s.vfs.Remove(path.Join(dir, "noexist")), fs.ErrNotExist)
+	assert.ErrorIs(t, s.vfs.Remove(path.Join(dir, "noexist", "a.txt")), fs.ErrNotExist)
+}
+
+func (s *suite) testRemoveAll(t *testing.T) {
+	dir := s.dir(t)
+
+	require.NoError(t, s.vfs.MkdirAll(path.Join(dir, "a", "b"), 0755))
+	s.write(t, path.Join(dir, "a", "a.txt"), "a")
+	s.write(t, path.Join(dir, "a", "b", "b.txt"), "b")
+
+	require.NoError(t, s.vfs.RemoveAll(path.Join(dir, "a")))
+	assert.False(t, s.vfs.Exists(path.Join(dir, "a")))
+
+	s.write(t, path.Join(dir, "c.txt"), "c")
+	require.NoError(t, s.vfs.RemoveAll(path.Join(dir, "c.txt")))
+	assert.False(t, s.vfs.Exists(path.Join(dir, "c.txt")))
+
+	assert.NoError(t, s.vfs.RemoveAll(path.Join(dir, "noexist")))
+	assert.NoError(t, s.vfs.RemoveAll(path.Join(dir, "noexist", "noexist")))
+	assert.True(t, s.vfs.IsDir(dir))
+}
+
+func (s *suite) testRename(t *testing.T) {
+	t.Run("file", func(t *testing.T) {
+		dir := s.dir(t)
+
+		s.write(t, path.Join(dir, "a.txt"), "a")
+		require.NoError(t, s.vfs.Rename(path.Join(dir, "a.txt"), path.Join(dir, "b.txt")))
+		assert.Equal(t, "a", s.read(t, path.Join(dir, "b.txt")))
+		_, err := s.vfs.Stat(path.Join(dir, "a.txt"))
+		assert.ErrorIs(t, err, fs.ErrNotExist)
+
+		fi, err := s.vfs.Stat(path.Join(dir, "b.txt"))
+		require.NoError(t, err)
+		assert.Equal(t, "b.txt", fi.Name())
+	})
+
+	t.Run("replace file", func(t *testing.T) {
+		dir := s.dir(t)
+
+		s.write(t, path.Join(dir, "a.txt"), "new")
+		s.write(t, path.Join(dir, "b.txt"), "old content")
+		require.NoError(t, s.vfs.Rename(path.Join(dir, "a.txt"), path.Join(dir, "b.txt")))
+		assert.Equal(t, "new", s.read(t, path.Join(dir, "b.txt")))
+		assert.False(t, s.vfs.Exists(path.Join(dir, "a.txt")))
+	})
+
+	t.Run("across directories", func(t *testing.T) {
+		dir := s.dir(t)
+
+		require.NoError(t, s.vfs.Mkdir(path.Join(dir, "sub"), 0755))
+		s.write(t, path.Join(dir, "a.txt"), "a")
+		require.NoError(t, s.vfs.Rename(path.Join(dir, "a.txt"), path.Join(dir, "sub", "a.txt")))
+		assert.Equal(t, "a", s.read(t, path.Join(dir, "sub", "a.txt")))
+		assert.False(t, s.vfs.Exists(path.Join(dir, "a.txt")))
+	})
+
+	t.Run("directory", func(t *testing.T) {
+		dir := s.dir(t)
+
+		require.NoError(t, s.vfs.MkdirAll(path.Join(dir, "a", "b"), 0755))
+		s.write(t, path.Join(dir, "a", "a.txt"), "a")
+		s.write(t, path.Join(dir, "a", "b", "b.txt"), "b")
+
+		require.NoError(t, s.vfs.Rename(path.Join(dir, "a"), path.Join(dir, "c")))
+		assert.False(t, s.vfs.Exists(path.Join(dir, "a")))
+		assert.Equal(t, "a", s.read(t, path.Join(dir, "c", "a.txt")))
+		assert.Equal(t, "b", s.read(t, path.Join(dir, "c", "b", "b.txt")))
+
+		fi, err := s.vfs.Stat(path.Join(dir, "c"))
+		require.NoError(t, err)
+		assert.Equal(t, "c", fi.Name())
+		assert.True(t, fi.IsDir())
+
+		require.NoError(t, s.vfs.MkdirAll(path.Join(dir, "full", "x"), 0755))
+		assert.Error(t, s.vfs.Rename(path.Join(dir, "c"), path.Join(dir, "full")))
+		assert.True(t, s.vfs.IsDir(path.Join(dir, "c", "b")))
+	})
+
+	t.Run("errors", func(t *testing.T) {
+		dir := s.dir(t)
+
+		assert.ErrorIs(t, s.vfs.Rename(path.Join(dir, "noexist"), path.Join(dir, "a")), fs.ErrNotExist)
+
+		s.write(t, path.Join(dir, "a.txt"), "a")
+		assert.Error(t, s.vfs.Rename(path.Join(dir, "a.txt"), path.Join(dir, "noexist", "a.txt")))
+		assert.Equal(t, "a", s.read(t, path.Join(dir, "a.txt")))
+	})
+}
+
+func (s *suite) testStat(t *testing.T) {
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "a.txt"), "abc")
+
+	fi, err := s.vfs.Stat(path.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", fi.Name())
+	assert.Equal(t, int64(3), fi.Size())
+	assert.False(t, fi.IsDir())
+	assert.True(t, fi.Mode().IsRegular())
+	assert.False(t, fi.ModTime().IsZero())
+
+	fi, err = s.vfs.Stat(dir)
+	require.NoError(t, err)
+	assert.Equal(t, path.Base(dir), fi.Name())
+	assert.True(t, fi.IsDir())
+	assert.True(t, fi.Mode().IsDir())
+
+	_, err = s.vfs.Stat(path.Join(dir, "noexist"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = s.vfs.Stat(path.Join(dir, "noexist", "a.txt"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testExists(t *testing.T) {
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "a.txt"), "a")
+	require.NoError(t, s.vfs.Mkdir(path.Join(dir, "sub"), 0755))
+
+	cases := []struct {
+		name   string
+		exists bool
+		file   bool
+		dir    bool
+	}{
+		{name: "a.txt", exists: true, file: true},
+		{name: "sub", exists: true, dir: true},
+		{name: "noexist"},
+		{name: "noexist/a.txt"},
+		{name: "a.txt/noexist"},
+	}
+
+	for _, c := range cases {
+		name := path.Join(dir, c.name)
+		assert.Equal(t, c.exists, s.vfs.Exists(name), "Exists(%s)", c.name)
+		assert.Equal(t, c.file, s.vfs.IsFile(name), "IsFile(%s)", c.name)
+		assert.Equal(t, c.dir, s.vfs.IsDir(name), "IsDir(%s)", c.name)
+	}
+}
+
+func (s *suite) testSub(t *testing.T) {
+	dir := s.dir(t)
+	require.NoError(t, s.vfs.MkdirAll(path.Join(dir, "sub", "child"), 0755))
+	s.write(t, path.Join(dir, "a.txt"), "a")
+	s.write(t, path.Join(dir, "sub", "b.txt"), "b")
+
+	sub, err := s.vfs.Sub(path.Join(dir, "sub"))
+	require.NoError(t, err)
+
+	assert.True(t, sub.IsFile("b.txt"))
+	assert.True(t, sub.IsFile("/b.txt"), "a leading slash must refer to the sub root")
+	assert.True(t, sub.IsDir("child"))
+	assert.False(t, sub.Exists("a.txt"))
+
+	f, err := sub.Create("c.txt")
+	require.NoError(t, err)
+	_, err = io.WriteString(f, "c")
+	assert.NoError(t, err)
+	assert.NoError(t, f.Close())
+	assert.Equal(t, "c", s.read(t, path.Join(dir, "sub", "c.txt")))
+
+	_, err = s.vfs.Sub(path.Join(dir, "noexist"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = s.vfs.Sub(path.Join(dir, "a.txt"))
+	assert.Error(t, err)
+
+	_, err = s.vfs.Sub(".")
+	assert.Error(t, err)
+
+	_, err = s.vfs.Sub("..")
+	assert.Error(t, err)
+}
+
+// readDirTree creates the tree checked by the ReadDir tests.
+func (s *suite) readDirTree(t *testing.T) string {
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "b.txt"), "bb")
+	s.write(t, path.Join(dir, "a.txt"), "a")
+	require.NoError(t, s.vfs.MkdirAll(path.Join(dir, "c", "d"), 0755))
+	require.NoError(t, s.vfs.Mkdir(path.Join(dir, "empty"), 0755))
+	return dir
+}
+
+func (s *suite) checkReadDir(t *testing.T, readDir func(name string) ([]fs.DirEntry, error)) {
+	dir := s.readDirTree(t)
+
+	list, err := readDir(dir)
+	require.NoError(t, err)
+	assert.Equal(t, []string{"a.txt", "b.txt", "c", "empty"}, names(list))
+
+	for _, entry := range list {
+		fi, err := entry.Info()
+		require.NoError(t, err)
+		assert.Equal(t, entry.Name(), fi.Name())
+		assert.Equal(t, entry.IsDir(), fi.IsDir())
+		assert.Equal(t, entry.IsDir(), entry.Type().IsDir())
+
+		switch entry.Name() {
+		case "b.txt":
+			assert.Equal(t, int64(2), fi.Size())
+		case "c":
+			assert.True(t, entry.IsDir())
+		}
+	}
+
+	list, err = readDir(path.Join(dir, "c"))
+	require.NoError(t, err, "a directory holding only directories must be readable")
+	assert.Equal(t, []string{"d"}, names(list))
+
+	list, err = readDir(path.Join(dir, "empty"))
+	assert.NoError(t, err, "an empty directory must not be an error")
+	assert.Empty(t, list)
+
+	_, err = readDir(path.Join(dir, "noexist"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	_, err = readDir(path.Join(dir, "a.txt"))
+	assert.Error(t, err)
+}
+
+func (s *suite) testReadDir(t *testing.T) {
+	s.checkReadDir(t, func(name string) ([]fs.DirEntry, error) {
+		return filesystem.ReadDir(s.vfs, name)
+	})
+}
+
+func (s *suite) testReadDirFS(t *testing.T) {
+	vfs, ok := s.vfs.(filesystem.ReadDirFS)
+	if !ok {
+		t.Skip("ReadDirFS not implemented")
+	}
+
+	s.checkReadDir(t, vfs.ReadDir)
+}
+
+func (s *suite) checkReadFile(t *testing.T, readFile func(name string) ([]byte, error), writeFile func(name string, data []byte) error) {
+	dir := s.dir(t)
+	name := path.Join(dir, "a.txt")
+
+	require.NoError(t, writeFile(name, []byte("hello world")))
+	b, err := readFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hello world", string(b))
+	assert.Equal(t, "hello world", s.read(t, name))
+
+	require.NoError(t, writeFile(name, []byte("hi")))
+	b, err = readFile(name)
+	require.NoError(t, err)
+	assert.Equal(t, "hi", string(b), "WriteFile must replace the whole content")
+
+	require.NoError(t, writeFile(path.Join(dir, "empty.txt"), nil))
+	b, err = readFile(path.Join(dir, "empty.txt"))
+	require.NoError(t, err)
+	assert.Empty(t, b)
+
+	_, err = readFile(path.Join(dir, "noexist"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+
+	assert.ErrorIs(t, writeFile(path.Join(dir, "noexist", "a.txt"), nil), fs.ErrNotExist)
+}
+
+func (s *suite) testReadFile(t *testing.T) {
+	s.checkReadFile(t, func(name string) ([]byte, error) {
+		return filesystem.ReadFile(s.vfs, name)
+	}, func(name string, data []byte) error {
+		return filesystem.WriteFile(s.vfs, name, data)
+	})
+}
+
+func (s *suite) testReadFileFS(t *testing.T) {
+	vfs, ok := s.vfs.(filesystem.ReadFileFS)
+	if !ok {
+		t.Skip("ReadFileFS not implemented")
+	}
+
+	s.checkReadFile(t, vfs.ReadFile, func(name string, data []byte) error {
+		return filesystem.WriteFile(s.vfs, name, data)
+	})
+}
+
+func (s *suite) testWriteFileFS(t *testing.T) {
+	vfs, ok := s.vfs.(filesystem.WriteFileFS)
+	if !ok {
+		t.Skip("WriteFileFS not implemented")
+	}
+
+	s.checkReadFile(t, func(name string) ([]byte, error) {
+		return filesystem.ReadFile(s.vfs, name)
+	}, vfs.WriteFile)
+}
+
+func (s *suite) testOpenFile(t *testing.T) {
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "a.txt"), "a")
+
+	f, err := filesystem.OpenFile(s.vfs, path.Join(dir, "a.txt"))
+	require.NoError(t, err)
+	b, err := io.ReadAll(f)
+	assert.NoError(t, err)
+	assert.Equal(t, "a", string(b))
+	assert.NoError(t, f.Close())
+
+	_, err = filesystem.OpenFile(s.vfs, path.Join(dir, "noexist"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testWalkDir(t *testing.T) {
+	dir := s.readDirTree(t)
+
+	var visited []string
+	err := filesystem.WalkDir(s.vfs, dir, func(name string, d fs.DirEntry, err error) error {
+		require.NoError(t, err)
+		rel := strings.TrimPrefix(strings.TrimPrefix(name, dir), "/")
+		if d.IsDir() {
+			rel += "/"
+		}
+		visited = append(visited, rel)
+		if d.Name() == "c" {
+			return fs.SkipDir
+		}
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/", "a.txt", "b.txt", "c/", "empty/"}, visited)
+
+	err = filesystem.WalkDir(s.vfs, path.Join(dir, "noexist"), func(name string, d fs.DirEntry, err error) error {
+		return err
+	})
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testChtimes(t *testing.T) {
+	if _, ok := s.vfs.(filesystem.ChtimesFS); !ok {
+		err := filesystem.Chtimes(s.vfs, "/", time.Now(), time.Now())
+		assert.ErrorIs(t, err, filesystem.ErrNotSupported)
+		t.Skip("ChtimesFS not implemented")
+	}
+
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "a.txt"), "a")
+	mtime := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+
+	for _, name := range []string{path.Join(dir, "a.txt"), dir} {
+		require.NoError(t, filesystem.Chtimes(s.vfs, name, mtime, mtime))
+		fi, err := s.vfs.Stat(name)
+		require.NoError(t, err)
+		assert.True(t, fi.ModTime().Equal(mtime), "%s: modtime %s, want %s", name, fi.ModTime(), mtime)
+	}
+
+	err := filesystem.Chtimes(s.vfs, path.Join(dir, "noexist"), mtime, mtime)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testTruncate(t *testing.T) {
+	if _, ok := s.vfs.(filesystem.TruncateFS); !ok {
+		err := filesystem.Truncate(s.vfs, "/", 0)
+		assert.ErrorIs(t, err, filesystem.ErrNotSupported)
+		t.Skip("TruncateFS not implemented")
+	}
+
+	dir := s.dir(t)
+	name := path.Join(dir, "a.txt")
+	s.write(t, name, "abcdef")
+
+	require.NoError(t, filesystem.Truncate(s.vfs, name, 3))
+	assert.Equal(t, "abc", s.read(t, name))
+
+	// growing a file fills it with zeros
+	require.NoError(t, filesystem.Truncate(s.vfs, name, 5))
+	assert.Equal(t, "abc\x00\x00", s.read(t, name))
+
+	assert.Error(t, filesystem.Truncate(s.vfs, dir, 0))
+	err := filesystem.Truncate(s.vfs, path.Join(dir, "noexist"), 0)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testChmod(t *testing.T) {
+	if _, ok := s.vfs.(filesystem.ChmodFS); !ok {
+		err := filesystem.Chmod(s.vfs, "/", 0755)
+		assert.ErrorIs(t, err, filesystem.ErrNotSupported)
+		t.Skip("ChmodFS not implemented")
+	}
+
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "a.txt"), "a")
+
+	for name, mode := range map[string]fs.FileMode{path.Join(dir, "a.txt"): 0600, dir: 0700} {
+		require.NoError(t, filesystem.Chmod(s.vfs, name, mode))
+		fi, err := s.vfs.Stat(name)
+		require.NoError(t, err)
+		assert.Equal(t, mode, fi.Mode().Perm(), name)
+	}
+
+	err := filesystem.Chmod(s.vfs, path.Join(dir, "noexist"), 0600)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testSymlink(t *testing.T) {
+	if _, ok := s.vfs.(filesystem.SymlinkFS); !ok {
+		err := filesystem.Symlink(s.vfs, "a", "/b")
+		assert.ErrorIs(t, err, filesystem.ErrNotSupported)
+		t.Skip("SymlinkFS not implemented")
+	}
+
+	dir := s.dir(t)
+	s.write(t, path.Join(dir, "a.txt"), "abc")
+	require.NoError(t, s.vfs.Mkdir(path.Join(dir, "sub"), 0755))
+	s.write(t, path.Join(dir, "sub", "b.txt"), "b")
+
+	link := path.Join(dir, "link")
+	require.NoError(t, filesystem.Symlink(s.vfs, "a.txt", link))
+	assert.ErrorIs(t, filesystem.Symlink(s.vfs, "a.txt", link), fs.ErrExist)
+
+	target, err := filesystem.Readlink(s.vfs, link)
+	require.NoError(t, err)
+	assert.Equal(t, "a.txt", target)
+	_, err = filesystem.Readlink(s.vfs, path.Join(dir, "a.txt"))
+	assert.Error(t, err)
+
+	// Stat and Open follow the link, Lstat does not
+	fi, err := s.vfs.Stat(link)
+	require.NoError(t, err)
+	assert.True(t, fi.Mode().IsRegular())
+	assert.Equal(t, int64(3), fi.Size())
+	assert.Equal(t, "abc", s.read(t, link))
+
+	fi, err = filesystem.Lstat(s.vfs, link)
+	require.NoError(t, err)
+	assert.Equal(t, "link", fi.Name())
+	assert.Equal(t, fs.ModeSymlink, fi.Mode().Type())
+
+	// links to directories are walked through, .. goes back up
+	require.NoError(t, filesystem.Symlink(s.vfs, "sub", path.Join(dir, "dirlink")))
+	require.NoError(t, filesystem.Symlink(s.vfs, "../a.txt", path.Join(dir, "sub", "up")))
+	assert.Equal(t, "b", s.read(t, path.Join(dir, "dirlink", "b.txt")))
+	assert.Equal(t, "abc", s.read(t, path.Join(dir, "dirlink", "up")))
+	assert.True(t, s.vfs.IsDir(path.Join(dir, "dirlink")))
+
+	list, err := filesystem.ReadDir(s.vfs, dir)
+	require.NoError(t, err)
+	for _, entry := range list {
+		if entry.Name() == "link" || entry.Name() == "dirlink" {
+			assert.Equal(t, fs.ModeSymlink, entry.Type(), entry.Name())
+		}
+	}
+
+	// a dangling link exists for Lstat only
+	dangling := path.Join(dir, "dangling")
+	require.NoError(t, filesystem.Symlink(s.vfs, "noexist", dangling))
+	assert.False(t, s.vfs.Exists(dangling))
+	_, err = s.vfs.Stat(dangling)
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+	_, err = filesystem.Lstat(s.vfs, dangling)
+	assert.NoError(t, err)
+
+	// Rename and Remove work on the link itself
+	require.NoError(t, s.vfs.Rename(link, path.Join(dir, "moved")))
+	assert.Equal(t, "abc", s.read(t, path.Join(dir, "moved")))
+	require.NoError(t, s.vfs.Remove(path.Join(dir, "moved")))
+	require.NoError(t, s.vfs.Remove(path.Join(dir, "dirlink")))
+	assert.Equal(t, "abc", s.read(t, path.Join(dir, "a.txt")))
+	assert.True(t, s.vfs.IsDir(path.Join(dir, "sub")))
+}
+
+func (s *suite) testDiskUsage(t *testing.T) {
+	dir := s.readDirTree(t)
+
+	usage, err := filesystem.DiskUsage(s.vfs, dir)
+	require.NoError(t, err)
+	assert.Equal(t, &filesystem.DirUsage{Size: 3, Files: 2, Dirs: 3}, usage)
+
+	usage, err = filesystem.DiskUsage(s.vfs, path.Join(dir, "b.txt"))
+	require.NoError(t, err)
+	assert.Equal(t, &filesystem.DirUsage{Size: 2, Files: 1}, usage)
+
+	_, err = filesystem.DiskUsage(s.vfs, path.Join(dir, "noexist"))
+	assert.ErrorIs(t, err, fs.ErrNotExist)
+}
+
+func (s *suite) testUsage(t *testing.T) {
+	if _, ok := s.vfs.(filesystem.UsageFS); !ok {
+		_, err := filesystem.Statfs(s.vfs)
+		assert.ErrorIs(t, err, filesystem.ErrNotSupported)
+		t.Skip("UsageFS not implemented")
+	}
+
+	s.write(t, path.Join(s.dir(t), "a.txt"), "a")
+
+	usage, err := filesystem.Statfs(s.vfs)
+	require.NoError(t, err)
+	assert.NotZero(t, usage.Used)
+	assert.NotZero(t, usage.InodesUsed)
+	if usage.Total > 0 {
+		assert.LessOrEqual(t, usage.Used, usage.Total)
+		assert.LessOrEqual(t, usage.Free, usage.Total-usage.Used)
+	}
+	if usage.Inodes > 0 {
+		assert.LessOrEqual(t, usage.InodesUsed, usage.Inodes)
+	}
+}
+
+func (s *suite) testWatch(t *testing.T) {
+	if _, ok := s.vfs.(filesystem.WatchFS); !ok {
+		_, err := filesystem.Watch(context.Background(), s.vfs, "/")
+		assert.ErrorIs(t, err, filesystem.ErrNotSupported)
+		t.Skip("WatchFS not implemented")
+	}
+
+	dir := s.dir(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	events, err := filesystem.Watch(ctx, s.vfs, dir)
+	require.NoError(t, err)
+
+	// wait skips the events before the one expected
+	wait := func(name string, op filesystem.EventOp) {
+		t.Helper()
+		timeout := time.After(5 * time.Second)
+		for {
+			select {
+			case e, ok := <-events:
+				require.True(t, ok, "events closed waiting for %s %s", op, name)
+				if e.Name == name && e.Op == op {
+					return
+				}
+			case <-timeout:
+				t.Fatalf("no %s event for %s", op, name)
+			}
+		}
+	}
+
+	name := path.Join(dir, "a.txt")
+	require.NoError(t, filesystem.WriteFile(s.vfs, name, []byte("a")))
+	wait(name, filesystem.EventCreate)
+	require.NoError(t, filesystem.WriteFile(s.vfs, name, []byte("b")))
+	wait(name, filesystem.EventWrite)
+	require.NoError(t, s.vfs.Mkdir(path.Join(dir, "sub"), 0755))
+	wait(path.Join(dir, "sub"), filesystem.EventCreate)
+	require.NoError(t, s.vfs.Rename(name, path.Join(dir, "sub", "b.txt")))
+	wait(name, filesystem.EventRemove)
+	wait(path.Join(dir, "sub", "b.txt"), filesystem.EventCreate)
+
+	// the changes outside the directory are not reported
+	other := s.dir(t)
+	require.NoError(t, filesystem.WriteFile(s.vfs, path.Join(other, "c.txt"), []byte("c")))
+	require.NoError(t, s.vfs.Remove(path.Join(dir, "sub", "b.txt")))
+	wait(path.Join(dir, "sub", "b.txt"), filesystem.EventRemove)
+
+	cancel()
+	timeout := time.After(5 * time.Second)
+	for {
+		select {
+		case e, ok := <-events:
+			if !ok {
+				return
+			}
+			assert.NotContains(t, e.Name, other)
+		case <-timeout:
+			t.Fatal("events not closed once the context is done")
+		}
+	}
+}
+
+func (s *suite) testConcurrent(t *testing.T) {
+	s.require(t, CapConcurrent)
+
+	const (
+		workers = 8
+		files   = 16
+	)
+
+	dir := s.dir(t)
+	shared := path.Join(dir, "shared.txt")
+	s.write(t, shared, "shared content")
+
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+
+			assert.NoError(t, s.vfs.MkdirAll(path.Join(dir, "deep", "er"), 0755))
+
+			for i := 0; i < files; i++ {
+				name := path.Join(dir, fmt.Sprintf("w%d-%d.txt", w, i))
+				content := fmt.Sprintf("worker %d file %d", w, i)
+
+				assert.NoError(t, filesystem.WriteFile(s.vfs, name, []byte(content)))
+
+				b, err := filesystem.ReadFile(s.vfs, name)
+				assert.NoError(t, err)
+				assert.Equal(t, content, string(b))
+
+				b, err = filesystem.ReadFile(s.vfs, shared)
+				assert.NoError(t, err)
+				assert.Equal(t, "shared content", string(b))
+
+				_, err = s.vfs.Stat(name)
+				assert.NoError(t, err)
+			}
+		}(w)
+	}
+	wg.Wait()
+
+	list, err := filesystem.ReadDir(s.vfs, dir)
+	require.NoError(t, err)
+	assert.Len(t, list, workers*files+2)
+	assert.True(t, s.vfs.IsDir(path.Join(dir, "deep", "er")))
+}
+
+func names(list []fs.DirEntry) []string {
+	names := make([]string, 0, len(list))
+	for _, entry := range list {
+		names = append(names, entry.Name())
+	}
+	return names
+}
+
+func (s *suite) testClose(t *testing.T) {
+	if _, ok := s.vfs.(io.Closer); !ok {
+		t.Skip("io.Closer not implemented")
+	}
+	if s.open == nil {
+		t.Skip("no filesystem to close")
+	}
+
+	vfs, err := s.open()
+	require.NoError(t, err)
+	require.NoError(t, vfs.MkdirAll(scratch, 0755))
+	name := path.Join(scratch, "close.txt")
+	require.NoError(t, filesystem.WriteFile(vfs, name, []byte("close")))
+	sub, err := vfs.Sub(scratch)
+	require.NoError(t, err)
+
+	f, err := vfs.Open(name)
+	require.NoError(t, err)
+	if open, err := filesystem.OpenFiles(vfs); err == nil {
+		assert.Len(t, open, 1)
+	}
+
+	require.NoError(t, sub.(io.Closer).Close(), "closing a Sub view does nothing")
+	assert.True(t, vfs.Exists(name))
+
+	require.NoError(t, filesystem.Close(vfs))
+	assert.ErrorIs(t, filesystem.Close(vfs), fs.ErrClosed)
+
+	// the files left open are closed with the filesystem
+	_, err = f.Read(make([]byte, 1))
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	if open, err := filesystem.OpenFiles(vfs); err == nil {
+		assert.Empty(t, open)
+	}
+
+	_, err = vfs.Open(name)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	_, err = vfs.Create(name)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	_, err = vfs.Stat(name)
+	assert.ErrorIs(t, err, fs.ErrClosed)
+	assert.ErrorIs(t, vfs.Mkdir(path.Join(scratch, "d"), 0755), fs.ErrClosed)
+	assert.ErrorIs(t, vfs.Remove(name), fs.ErrClosed)
+	assert.ErrorIs(t, vfs.Rename(name, name+".old"), fs.ErrClosed)
+	_, err = sub.Stat("/close.txt")
+	assert.ErrorIs(t, err, fs.ErrClosed, "Sub views close with their filesystem")
+	assert.False(t, vfs.Exists(name))
+}
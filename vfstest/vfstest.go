@@ -0,0 +1,192 @@
+// Package vfstest implements support for testing implementations of
+// filesystem.FileSystem, in the spirit of testing/fstest.
+//
+// TestDriver and TestFileSystem run a conformance suite made of named
+// sub-tests, so a failure points at the semantics it covers. Every sub-test
+// works in a scratch directory of its own below /vfstest, the whole scratch
+// tree is removed once the suite finishes.
+//
+// The suite expects the following semantics:
+//
+//   - Open, Stat, Remove, Rename, ReadDir and ReadFile report a missing name
+//     with an error matching fs.ErrNotExist.
+//   - Create makes an empty file or truncates an existing one. It fails when
+//     the parent directory is missing or the name is a directory.
+//   - Content written through a File is seen by every File opened once the
+//     writer is closed, and each opened File reads from an offset of its own.
+//   - Mkdir fails with fs.ErrExist when the name is taken. MkdirAll is
+//     idempotent and fails when a file is in the way.
+//   - Remove refuses directories that are not empty, RemoveAll removes whole
+//     trees and ignores missing names.
+//   - Rename moves files and directories with their content, a renamed file
+//     replaces an existing file and a directory is never moved onto a
+//     directory that is not empty.
+//   - ReadDir returns the entries sorted by name, an empty directory gives an
+//     empty list and no error.
+//   - WriteFile replaces the whole content of an existing file.
+//   - Sub returns a view rooted at a directory, where a leading slash refers
+//     to that directory, and rejects "." and "..".
+//   - Symbolic links are followed by Open, Stat and paths going through them,
+//     relative targets from the directory of the link; Lstat, Readlink,
+//     Rename and Remove work on the link itself.
+//   - A filesystem implementing filesystem.WatchFS reports the files created,
+//     written and removed below a watched directory, a rename as a removal
+//     and a creation, and closes the events once the context is done.
+//   - Every sub-test closes the files it opens, filesystems implementing
+//     filesystem.OpenFilesFS must report none open once it is done.
+//   - A filesystem implementing io.Closer closes the files left open on
+//     Close, then fails every operation with fs.ErrClosed.
+//
+// Fuzz and FuzzAgainst complement the suite with differential fuzz targets,
+// comparing random operation sequences on a driver with a reference model of
+// the os package or with another driver.
+//
+// Optional behaviour is grouped into capabilities. The extension interfaces
+// such as filesystem.ReadDirFS are detected on the FileSystem, the remaining
+// capabilities are assumed and can be switched off with Without.
+package vfstest
+
+import (
+	"github.com/lazychanger/go-vfs"
+	"strings"
+	"testing"
+)
+
+// Capability is a piece of optional behaviour checked by the suite.
+type Capability uint
+
+const (
+	// CapOpenDir means Open accepts a directory and returns a
+	// filesystem.ReadDirFile.
+	CapOpenDir Capability = 1 << iota
+
+	// CapConcurrent means the FileSystem is safe for concurrent use.
+	CapConcurrent
+)
+
+const capAll = CapOpenDir | CapConcurrent
+
+// scratch is the directory the suite works in.
+const scratch = "/vfstest"
+
+type options struct {
+	caps Capability
+}
+
+// Option configures the suite.
+type Option func(o *options)
+
+// Without switches off capabilities the FileSystem does not provide,
+// the sub-tests covering them are skipped.
+func Without(caps ...Capability) Option {
+	return func(o *options) {
+		for _, c := range caps {
+			o.caps &^= c
+		}
+	}
+}
+
+// TestDriver opens dsn with filesystem.Open and runs the suite against it,
+// Close is checked on a filesystem opened for that purpose.
+func TestDriver(t *testing.T, dsn string, opts ...Option) {
+	s := newSuite(t, Open(t, dsn), opts...)
+	s.open = func() (filesystem.FileSystem, error) {
+		return filesystem.Open(dsn)
+	}
+	s.run(t)
+}
+
+// Open opens dsn with filesystem.Open for the test, which fails when it
+// cannot, and closes the filesystem once the test is over.
+func Open(t testing.TB, dsn string) filesystem.FileSystem {
+	t.Helper()
+
+	vfs, err := filesystem.Open(dsn)
+	if err != nil {
+		t.Fatalf("open %s: %s", dsn, err)
+	}
+	t.Cleanup(func() {
+		_ = filesystem.Close(vfs)
+	})
+	return vfs
+}
+
+// TestFileSystem runs the suite against vfs.
+func TestFileSystem(t *testing.T, vfs filesystem.FileSystem, opts ...Option) {
+	newSuite(t, vfs, opts...).run(t)
+}
+
+// CheckLeaks fails the test when files are still open on vfs once the test
+// and its cleanups are done, for filesystems implementing
+// filesystem.OpenFilesFS.
+func CheckLeaks(t testing.TB, vfs filesystem.FileSystem) {
+	t.Helper()
+
+	t.Cleanup(func() {
+		if open, err := filesystem.OpenFiles(vfs); err == nil && len(open) > 0 {
+			t.Errorf("files left open: %s", strings.Join(open, ", "))
+		}
+	})
+}
+
+func newSuite(t *testing.T, vfs filesystem.FileSystem, opts ...Option) *suite {
+	o := &options{caps: capAll}
+	for _, opt := range opts {
+		opt(o)
+	}
+
+	if err := vfs.RemoveAll(scratch); err != nil {
+		t.Fatalf("clear %s: %s", scratch, err)
+	}
+	if err := vfs.MkdirAll(scratch, 0755); err != nil {
+		t.Fatalf("mkdir %s: %s", scratch, err)
+	}
+	t.Cleanup(func() {
+		_ = vfs.RemoveAll(scratch)
+	})
+
+	return &suite{vfs: vfs, caps: o.caps}
+}
+
+// run runs every sub-test, each of them must close the files it opens.
+func (s *suite) run(t *testing.T) {
+	for _, test := range []struct {
+		name string
+		fn   func(t *testing.T)
+	}{
+		{"Create", s.testCreate},
+		{"Content", s.testContent},
+		{"Open", s.testOpen},
+		{"OpenDir", s.testOpenDir},
+		{"Mkdir", s.testMkdir},
+		{"MkdirAll", s.testMkdirAll},
+		{"Remove", s.testRemove},
+		{"RemoveAll", s.testRemoveAll},
+		{"Rename", s.testRename},
+		{"Stat", s.testStat},
+		{"Exists", s.testExists},
+		{"Sub", s.testSub},
+		{"ReadDir", s.testReadDir},
+		{"ReadDirFS", s.testReadDirFS},
+		{"ReadFile", s.testReadFile},
+		{"ReadFileFS", s.testReadFileFS},
+		{"WriteFileFS", s.testWriteFileFS},
+		{"OpenFile", s.testOpenFile},
+		{"WalkDir", s.testWalkDir},
+		{"Chtimes", s.testChtimes},
+		{"Truncate", s.testTruncate},
+		{"Chmod", s.testChmod},
+		{"Symlink", s.testSymlink},
+		{"DiskUsage", s.testDiskUsage},
+		{"Usage", s.testUsage},
+		{"Watch", s.testWatch},
+		{"Concurrent", s.testConcurrent},
+		{"Close", s.testClose},
+	} {
+		fn := test.fn
+		t.Run(test.name, func(t *testing.T) {
+			CheckLeaks(t, s.vfs)
+			fn(t)
+		})
+	}
+}
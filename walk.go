@@ -0,0 +1,53 @@
+package filesystem
+
+import (
+	"io/fs"
+	"path"
+)
+
+// WalkDir see fs.WalkDir
+// walks the file tree rooted at root, calling fn for each file or directory
+// in the tree, including root. Entries of a directory are visited in lexical
+// order.
+func WalkDir(vfs FileSystem, root string, fn fs.WalkDirFunc) error {
+	info, err := vfs.Stat(root)
+	if err != nil {
+		err = fn(root, nil, err)
+	} else {
+		err = walkDir(vfs, root, fs.FileInfoToDirEntry(info), fn)
+	}
+	if err == fs.SkipDir {
+		return nil
+	}
+	return err
+}
+
+func walkDir(vfs FileSystem, name string, d fs.DirEntry, fn fs.WalkDirFunc) error {
+	if err := fn(name, d, nil); err != nil || !d.IsDir() {
+		if err == fs.SkipDir && d.IsDir() {
+			err = nil
+		}
+		return err
+	}
+
+	dirs, err := ReadDir(vfs, name)
+	if err != nil {
+		err = fn(name, d, err)
+		if err != nil {
+			if err == fs.SkipDir && d.IsDir() {
+				err = nil
+			}
+			return err
+		}
+	}
+
+	for _, d1 := range dirs {
+		if err := walkDir(vfs, path.Join(name, d1.Name()), d1, fn); err != nil {
+			if err == fs.SkipDir {
+				break
+			}
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,48 @@
+package filesystem_test
+
+import (
+	"errors"
+	"github.com/lazychanger/go-vfs"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"io/fs"
+	"testing"
+)
+
+// unreadable fails to list the directory dir.
+type unreadable struct {
+	filesystem.FileSystem
+
+	dir string
+}
+
+func (vfs *unreadable) ReadDir(name string) ([]fs.DirEntry, error) {
+	if name == vfs.dir {
+		return nil, &fs.PathError{Op: "readdir", Path: name, Err: fs.ErrPermission}
+	}
+	return filesystem.ReadDir(vfs.FileSystem, name)
+}
+
+func TestWalkDirSkipUnreadable(t *testing.T) {
+	mem := open(t, "memory:///")
+	defer filesystem.Close(mem)
+	populate(t, mem, map[string]string{
+		"/a/1.txt": "1",
+		"/b/2.txt": "2",
+		"/c/3.txt": "3",
+		"/d.txt":   "d",
+	})
+	vfs := &unreadable{FileSystem: mem, dir: "/b"}
+
+	var visited []string
+	err := filesystem.WalkDir(vfs, "/", func(name string, d fs.DirEntry, err error) error {
+		if err != nil {
+			require.True(t, errors.Is(err, fs.ErrPermission))
+			return fs.SkipDir
+		}
+		visited = append(visited, name)
+		return nil
+	})
+	require.NoError(t, err)
+	assert.Equal(t, []string{"/", "/a", "/a/1.txt", "/b", "/c", "/c/3.txt", "/d.txt"}, visited, "the siblings after the directory are walked")
+}
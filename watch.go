@@ -0,0 +1,57 @@
+package filesystem
+
+import (
+	"context"
+	"io/fs"
+)
+
+// EventOp is the kind of change an Event reports.
+type EventOp uint8
+
+const (
+	// EventCreate reports a file or directory created.
+	EventCreate EventOp = iota + 1
+
+	// EventWrite reports a file whose content changed.
+	EventWrite
+
+	// EventRemove reports a file or directory removed. A rename reports
+	// the old name removed and the new one created.
+	EventRemove
+)
+
+func (op EventOp) String() string {
+	switch op {
+	case EventCreate:
+		return "create"
+	case EventWrite:
+		return "write"
+	case EventRemove:
+		return "remove"
+	}
+	return "unknown"
+}
+
+// Event is a change of the file Name, a path of the filesystem watched.
+type Event struct {
+	Name string
+	Op   EventOp
+}
+
+type WatchFS interface {
+	FileSystem
+	// Watch reports the changes of name and of the files below it
+	Watch(ctx context.Context, name string) (<-chan Event, error)
+}
+
+// Watch reports the changes of name, and of every file below it when it is a
+// directory, on the returned channel until ctx is done or vfs is closed,
+// which closes the channel. The error is ErrNotSupported when vfs cannot
+// watch.
+func Watch(ctx context.Context, vfs FileSystem, name string) (<-chan Event, error) {
+	if vfs, ok := vfs.(WatchFS); ok {
+		return vfs.Watch(ctx, name)
+	}
+
+	return nil, &fs.PathError{Op: "watch", Path: name, Err: ErrNotSupported}
+}